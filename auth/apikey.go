@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// APIKey represents an entry of the API keys file
+type APIKey struct {
+	Key            string `json:"key"`
+	UserID         string `json:"user_id"`
+	Role           string `json:"role"`
+	OrganizationID string `json:"organization_id,omitempty"` // defaults to the user ID
+}
+
+// APIKeyAuthenticator authenticates requests by a static API key sent as a bearer token
+// or in the X-API-Key header. Keys are held by their SHA-256 digest only.
+type APIKeyAuthenticator struct {
+	principals map[string]*Principal
+}
+
+// NewAPIKeyAuthenticator loads the API keys from a JSON file holding a list of APIKey entries
+func NewAPIKeyAuthenticator(path string) (*APIKeyAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %v", err)
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file: %v", err)
+	}
+
+	authenticator := &APIKeyAuthenticator{principals: make(map[string]*Principal, len(keys))}
+	for i, key := range keys {
+		if key.Key == "" || key.UserID == "" {
+			return nil, fmt.Errorf("API key %d is missing a key or user_id", i)
+		}
+		if !validRole(key.Role) {
+			return nil, fmt.Errorf("API key %d has an invalid role: %s", i, key.Role)
+		}
+
+		organizationID := key.OrganizationID
+		if organizationID == "" {
+			organizationID = key.UserID
+		}
+		authenticator.principals[digest(key.Key)] = &Principal{
+			UserID:         key.UserID,
+			Role:           key.Role,
+			OrganizationID: organizationID,
+		}
+	}
+
+	return authenticator, nil
+}
+
+// Authenticate resolves the principal of the request's API key
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("%w: no API key", ErrUnauthenticated)
+	}
+
+	principal, ok := a.principals[digest(key)]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown API key", ErrUnauthenticated)
+	}
+	return principal, nil
+}
+
+// digest returns the hex SHA-256 digest of a key, so lookups never compare raw secrets
+func digest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// validRole reports whether a role is one of the models.User roles
+func validRole(role string) bool {
+	switch role {
+	case models.RoleManufacturer, models.RoleDistributor, models.RolePharmacy, models.RoleDoctor, models.RolePatient, models.RoleAdmin:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// ErrUnauthenticated is returned when a request carries no valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal represents the authenticated caller of a request
+type Principal struct {
+	UserID         string `json:"user_id"`
+	Role           string `json:"role"`            // one of the models.User roles
+	OrganizationID string `json:"organization_id"` // manufacturer, distributor, pharmacy or practice the user acts for
+}
+
+// Authenticator resolves the principal of a request from its credentials
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Bind replaces the acting user ID taken from a request payload with the principal's, and
+// the organization ID too when the principal acts in the organization's role. Admins act
+// on behalf of the organization named in the payload.
+func (p *Principal) Bind(role string, userID, organizationID *string) {
+	if p == nil {
+		return
+	}
+	if userID != nil {
+		*userID = p.UserID
+	}
+	if organizationID != nil && p.Role == role {
+		*organizationID = p.OrganizationID
+	}
+}
+
+// BindRole replaces a role taken from a request payload with the principal's. Admins act
+// on behalf of the organization named in the payload, in the role given there.
+func (p *Principal) BindRole(role *string) {
+	if p == nil || p.Role == models.RoleAdmin {
+		return
+	}
+	*role = p.Role
+}
+
+// chain tries authenticators in turn
+type chain []Authenticator
+
+// Authenticate returns the principal of the first authenticator that accepts the request
+func (c chain) Authenticate(r *http.Request) (*Principal, error) {
+	if len(c) == 0 {
+		return nil, fmt.Errorf("%w: no authenticator configured", ErrUnauthenticated)
+	}
+
+	errs := make([]error, 0, len(c))
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(r)
+		if err == nil {
+			return principal, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Chain combines authenticators so a request is accepted by any of them
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+// NewAuthenticatorFromEnv creates the authenticators configured by the environment:
+// bearer JWTs when SUPABASE_JWT_SECRET or JWT_JWKS_FILE is set (with optional
+// JWT_AUDIENCE and JWT_ISSUER), and API keys from API_KEYS_FILE, or api_keys.json when
+// it exists. At least one must be configured.
+func NewAuthenticatorFromEnv() (Authenticator, error) {
+	var authenticators []Authenticator
+
+	secret := os.Getenv("SUPABASE_JWT_SECRET")
+	jwksFile := os.Getenv("JWT_JWKS_FILE")
+	if secret != "" || jwksFile != "" {
+		jwtAuthenticator, err := NewJWTAuthenticator(JWTConfig{
+			Secret:   []byte(secret),
+			JWKSFile: jwksFile,
+			Audience: os.Getenv("JWT_AUDIENCE"),
+			Issuer:   os.Getenv("JWT_ISSUER"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+
+	apiKeysFile := os.Getenv("API_KEYS_FILE")
+	if apiKeysFile == "" {
+		if _, err := os.Stat("api_keys.json"); err == nil {
+			apiKeysFile = "api_keys.json"
+		}
+	}
+	if apiKeysFile != "" {
+		apiKeyAuthenticator, err := NewAPIKeyAuthenticator(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, apiKeyAuthenticator)
+	}
+
+	if len(authenticators) == 0 {
+		return nil, errors.New("no authentication configured: set SUPABASE_JWT_SECRET, JWT_JWKS_FILE or API_KEYS_FILE")
+	}
+	return Chain(authenticators...), nil
+}
+
+// principalKey is the context key of the request principal
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the context carrying the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal of a request context, or nil if the request is unauthenticated
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// Middleware authenticates every request before passing it to the next handler. Requests
+// to exactly one of the public paths skip authentication; they must carry their own
+// verification, such as webhook signatures.
+func Middleware(authenticator Authenticator, next http.Handler, publicPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range publicPaths {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			log.Printf("Authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// bearerToken extracts the token of a "Bearer" authorization header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
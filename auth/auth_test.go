@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// headerAuthenticator accepts requests carrying an X-User header
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if user := r.Header.Get("X-User"); user != "" {
+		return &Principal{UserID: user}, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+func TestMiddlewarePublicPaths(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := Middleware(headerAuthenticator{}, next, "/api/webhooks/supabase", "/api/webhook")
+
+	tests := []struct {
+		path          string
+		authenticated bool
+		status        int
+	}{
+		{"/api/webhooks/supabase", false, http.StatusOK},
+		{"/api/webhook", false, http.StatusOK},
+		{"/api/webhook/", false, http.StatusUnauthorized},
+		{"/api/webhooks", false, http.StatusUnauthorized},
+		{"/api/webhooks/supabase/replay", false, http.StatusUnauthorized},
+		{"/api/webhook-queue", false, http.StatusUnauthorized},
+		{"/api/drugs", false, http.StatusUnauthorized},
+		{"/api/drugs", true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.authenticated {
+				r.Header.Set("X-User", "user-1")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
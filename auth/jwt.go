@@ -0,0 +1,397 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// jwtLeeway is the clock skew tolerated when checking token lifetimes
+const jwtLeeway = time.Minute
+
+// jwksRefreshInterval is the shortest time between reloads of the JWKS file for tokens
+// signed by an unknown key
+const jwksRefreshInterval = time.Minute
+
+// supabaseServiceRole is the role claim of Supabase service role tokens, which are
+// trusted like an admin
+const supabaseServiceRole = "service_role"
+
+// JWTConfig holds the keys and expected claims of bearer JWTs
+type JWTConfig struct {
+	Secret   []byte // HS256 secret, the Supabase project JWT secret
+	JWKSFile string // local JSON Web Key Set holding RS256 public keys
+	Audience string // expected aud claim, not checked if empty
+	Issuer   string // expected iss claim, not checked if empty
+}
+
+// JWTAuthenticator authenticates requests by a bearer JWT signed with HS256 or RS256.
+// It accepts Supabase Auth access tokens: the subject is the user ID, and the user role
+// and organization are read from app_metadata when present.
+type JWTAuthenticator struct {
+	config      JWTConfig
+	mu          sync.RWMutex
+	rsaKeys     map[string]*rsa.PublicKey
+	refreshedAt time.Time // when the JWKS file was last loaded
+}
+
+// jwtHeader represents the header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// jwk represents an RSA key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// NewJWTAuthenticator creates a JWT authenticator, loading the RS256 keys of the JWKS file
+// if configured. The file is loaded again when a token names a key it does not know yet,
+// so keys added by a rotation are picked up without a restart.
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if len(config.Secret) == 0 && config.JWKSFile == "" {
+		return nil, fmt.Errorf("a JWT secret or JWKS file is required")
+	}
+
+	a := &JWTAuthenticator{config: config, rsaKeys: make(map[string]*rsa.PublicKey)}
+	if config.JWKSFile == "" {
+		return a, nil
+	}
+
+	rsaKeys, err := loadJWKS(config.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	a.rsaKeys = rsaKeys
+	a.refreshedAt = time.Now()
+
+	return a, nil
+}
+
+// loadJWKS reads the RS256 keys of a JWKS file
+func loadJWKS(file string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file: %v", err)
+	}
+
+	rsaKeys := make(map[string]*rsa.PublicKey)
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Alg != "" && key.Alg != AlgRS256) {
+			continue
+		}
+		publicKey, err := key.rsaPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %v", key.Kid, err)
+		}
+		rsaKeys[key.Kid] = publicKey
+	}
+	if len(rsaKeys) == 0 {
+		return nil, fmt.Errorf("JWKS file %s holds no RS256 keys", file)
+	}
+
+	return rsaKeys, nil
+}
+
+// Authenticate verifies the request's bearer JWT and resolves its principal
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, fmt.Errorf("%w: no bearer token", ErrUnauthenticated)
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return claimsPrincipal(claims)
+}
+
+// Verify checks the signature and lifetime of a token and returns its claims
+func (a *JWTAuthenticator) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrUnauthenticated)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed token header", ErrUnauthenticated)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed token signature", ErrUnauthenticated)
+	}
+
+	// Verify the signature with the key configured for the token's algorithm
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case AlgHS256:
+		if len(a.config.Secret) == 0 {
+			return nil, fmt.Errorf("%w: HS256 tokens are not accepted", ErrUnauthenticated)
+		}
+		mac := hmac.New(sha256.New, a.config.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, fmt.Errorf("%w: invalid token signature", ErrUnauthenticated)
+		}
+	case AlgRS256:
+		publicKey, err := a.rsaKey(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: invalid token signature", ErrUnauthenticated)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported token algorithm %q", ErrUnauthenticated, header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed token claims", ErrUnauthenticated)
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// rsaKey returns the RS256 key with the given ID, or the only key when the token names
+// none. An unknown key ID reloads the JWKS file, at most once per jwksRefreshInterval.
+func (a *JWTAuthenticator) rsaKey(kid string) (*rsa.PublicKey, error) {
+	if a.config.JWKSFile == "" {
+		return nil, fmt.Errorf("%w: RS256 tokens are not accepted", ErrUnauthenticated)
+	}
+
+	if publicKey, ok := a.lookupRSAKey(kid); ok {
+		return publicKey, nil
+	}
+	if kid != "" && a.refreshJWKS() {
+		if publicKey, ok := a.lookupRSAKey(kid); ok {
+			return publicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown token key %q", ErrUnauthenticated, kid)
+}
+
+// lookupRSAKey returns a loaded RS256 key by ID, or the only key for an empty ID
+func (a *JWTAuthenticator) lookupRSAKey(kid string) (*rsa.PublicKey, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if publicKey, ok := a.rsaKeys[kid]; ok {
+		return publicKey, true
+	}
+	if kid == "" && len(a.rsaKeys) == 1 {
+		for _, publicKey := range a.rsaKeys {
+			return publicKey, true
+		}
+	}
+	return nil, false
+}
+
+// refreshJWKS reloads the JWKS file unless it was loaded within jwksRefreshInterval, and
+// reports whether it was reloaded. A file that cannot be loaded keeps the current keys.
+func (a *JWTAuthenticator) refreshJWKS() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if time.Since(a.refreshedAt) < jwksRefreshInterval {
+		return false
+	}
+	a.refreshedAt = time.Now()
+
+	rsaKeys, err := loadJWKS(a.config.JWKSFile)
+	if err != nil {
+		log.Printf("Warning: Failed to reload JWKS file, keeping the loaded keys: %v", err)
+		return false
+	}
+	a.rsaKeys = rsaKeys
+	return true
+}
+
+// checkClaims checks the lifetime, audience and issuer of a token
+func (a *JWTAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: token has no expiry", ErrUnauthenticated)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("%w: token has expired", ErrUnauthenticated)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token is not valid yet", ErrUnauthenticated)
+	}
+
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return fmt.Errorf("%w: unexpected token issuer", ErrUnauthenticated)
+	}
+	if a.config.Audience != "" && !hasAudience(claims["aud"], a.config.Audience) {
+		return fmt.Errorf("%w: unexpected token audience", ErrUnauthenticated)
+	}
+
+	return nil
+}
+
+// claimsPrincipal builds the principal of verified token claims. The user role is read
+// from app_metadata.role, then from a user_role claim, then from the role claim itself.
+func claimsPrincipal(claims map[string]interface{}) (*Principal, error) {
+	subject, _ := claims["sub"].(string)
+
+	appMetadata, _ := claims["app_metadata"].(map[string]interface{})
+	role := firstClaim(appMetadata["role"], claims["user_role"], claims["role"])
+	if role == supabaseServiceRole {
+		role = models.RoleAdmin
+		if subject == "" {
+			subject = supabaseServiceRole
+		}
+	}
+
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrUnauthenticated)
+	}
+	if !validRole(role) {
+		return nil, fmt.Errorf("%w: token has no valid role", ErrUnauthenticated)
+	}
+
+	organizationID := firstClaim(appMetadata["organization_id"], claims["organization_id"])
+	if organizationID == "" {
+		organizationID = subject
+	}
+
+	return &Principal{UserID: subject, Role: role, OrganizationID: organizationID}, nil
+}
+
+// MintHS256Token signs claims into an HS256 token. It lets tools and test fixtures create
+// tokens offline with the same secret the service verifies against.
+func MintHS256Token(claims map[string]interface{}, secret []byte) (string, error) {
+	signingInput, err := signingInput(jwtHeader{Alg: AlgHS256, Typ: "JWT"}, claims)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// MintRS256Token signs claims into an RS256 token with the key of the given JWKS key ID
+func MintRS256Token(claims map[string]interface{}, key *rsa.PrivateKey, kid string) (string, error) {
+	signingInput, err := signingInput(jwtHeader{Alg: AlgRS256, Kid: kid, Typ: "JWT"}, claims)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signingInput encodes the header and claims of a token
+func signingInput(header jwtHeader, claims map[string]interface{}) (string, error) {
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token header: %v", err)
+	}
+	claimsData, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token claims: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(headerData) + "." + base64.RawURLEncoding.EncodeToString(claimsData), nil
+}
+
+// rsaPublicKey decodes the modulus and exponent of an RSA JWK
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	if len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("invalid exponent length: %d", len(e))
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether an aud claim, a string or a list of strings, contains the audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstClaim returns the first non-empty string among claim values
+func firstClaim(values ...interface{}) string {
+	for _, value := range values {
+		if s, ok := value.(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
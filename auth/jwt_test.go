@@ -0,0 +1,293 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+const (
+	testAudience = "authenticated"
+	testIssuer   = "https://example.supabase.co/auth/v1"
+)
+
+var testSecret = []byte("test-jwt-secret")
+
+// newRSAKey generates an RSA key for signing test tokens
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeJWKS writes the public keys to a JWKS file
+func writeJWKS(t *testing.T, file string, keys map[string]*rsa.PrivateKey) {
+	t.Helper()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Alg: AlgRS256,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClaims returns the claims of a valid token, with the given claims changed
+func testClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "user-1",
+		"aud": testAudience,
+		"iss": testIssuer,
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+		"app_metadata": map[string]interface{}{
+			"role":            models.RoleManufacturer,
+			"organization_id": "manufacturer-1",
+		},
+	}
+	for claim, value := range changes {
+		if value == nil {
+			delete(claims, claim)
+			continue
+		}
+		claims[claim] = value
+	}
+	return claims
+}
+
+func TestVerifyJWT(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, otherKey := newRSAKey(t), newRSAKey(t)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwksFile, map[string]*rsa.PrivateKey{"key-1": rsaKey})
+
+	a, err := NewJWTAuthenticator(JWTConfig{Secret: testSecret, JWKSFile: jwksFile, Audience: testAudience, Issuer: testIssuer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := func(changes map[string]interface{}) func() (string, error) {
+		return func() (string, error) { return MintHS256Token(testClaims(changes), testSecret) }
+	}
+	expired := float64(time.Now().Add(-time.Hour).Unix())
+
+	tests := []struct {
+		name  string
+		token func() (string, error)
+		valid bool
+	}{
+		{"valid HS256", hs256(nil), true},
+		{"valid RS256", func() (string, error) { return MintRS256Token(testClaims(nil), rsaKey, "key-1") }, true},
+		{"expired", hs256(map[string]interface{}{"exp": expired}), false},
+		{"expired within the leeway", hs256(map[string]interface{}{"exp": float64(time.Now().Add(-30 * time.Second).Unix())}), true},
+		{"no expiry", hs256(map[string]interface{}{"exp": nil}), false},
+		{"not valid yet", hs256(map[string]interface{}{"nbf": float64(time.Now().Add(time.Hour).Unix())}), false},
+		{"wrong audience", hs256(map[string]interface{}{"aud": "anon"}), false},
+		{"audience in a list", hs256(map[string]interface{}{"aud": []interface{}{"anon", testAudience}}), true},
+		{"no audience", hs256(map[string]interface{}{"aud": nil}), false},
+		{"wrong issuer", hs256(map[string]interface{}{"iss": "https://other.supabase.co/auth/v1"}), false},
+		{"wrong secret", func() (string, error) { return MintHS256Token(testClaims(nil), []byte("other-secret")) }, false},
+		{"unknown RS256 key", func() (string, error) { return MintRS256Token(testClaims(nil), otherKey, "key-1") }, false},
+		{"alg none", func() (string, error) {
+			input, err := signingInput(jwtHeader{Alg: "none", Typ: "JWT"}, testClaims(nil))
+			return input + ".", err
+		}, false},
+		{"RS256 header with an HS256 signature", func() (string, error) {
+			token, err := MintHS256Token(testClaims(nil), testSecret)
+			return withSegment(t, token, 0, jwtHeader{Alg: AlgRS256, Kid: "key-1", Typ: "JWT"}), err
+		}, false},
+		{"edited claims", func() (string, error) {
+			token, err := MintHS256Token(testClaims(nil), testSecret)
+			return withSegment(t, token, 1, testClaims(map[string]interface{}{"sub": "user-2"})), err
+		}, false},
+		{"malformed", func() (string, error) { return "not-a-token", nil }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = a.Verify(token)
+			if tt.valid && err != nil {
+				t.Fatalf("expected the token to verify: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrUnauthenticated) {
+				t.Fatalf("err = %v, want ErrUnauthenticated", err)
+			}
+		})
+	}
+}
+
+// withSegment replaces the header (0) or claims (1) segment of a token, keeping its signature
+func withSegment(t *testing.T, token string, segment int, value interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parts[segment] = base64.RawURLEncoding.EncodeToString(data)
+	return strings.Join(parts, ".")
+}
+
+func TestJWKSRefreshOnUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	firstKey, secondKey := newRSAKey(t), newRSAKey(t)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwksFile, map[string]*rsa.PrivateKey{"key-1": firstKey})
+
+	a, err := NewJWTAuthenticator(JWTConfig{JWKSFile: jwksFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(key *rsa.PrivateKey, kid string) error {
+		t.Helper()
+		token, err := MintRS256Token(testClaims(nil), key, kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = a.Verify(token)
+		return err
+	}
+	expireRefresh := func() {
+		a.mu.Lock()
+		a.refreshedAt = time.Now().Add(-jwksRefreshInterval)
+		a.mu.Unlock()
+	}
+
+	// A rotated key is not picked up while the file was loaded recently
+	writeJWKS(t, jwksFile, map[string]*rsa.PrivateKey{"key-1": firstKey, "key-2": secondKey})
+	if err := verify(secondKey, "key-2"); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("err = %v, want ErrUnauthenticated before the refresh interval passed", err)
+	}
+
+	// Once the interval passed, the unknown key ID reloads the file
+	expireRefresh()
+	if err := verify(secondKey, "key-2"); err != nil {
+		t.Fatalf("expected the rotated key to verify after a reload: %v", err)
+	}
+	if err := verify(firstKey, "key-1"); err != nil {
+		t.Fatalf("expected the first key to still verify: %v", err)
+	}
+
+	// Another unknown key ID does not reload the file again right away
+	a.mu.RLock()
+	refreshedAt := a.refreshedAt
+	a.mu.RUnlock()
+	if err := verify(secondKey, "key-3"); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("err = %v, want ErrUnauthenticated for an unknown key", err)
+	}
+	a.mu.RLock()
+	reloaded := !a.refreshedAt.Equal(refreshedAt)
+	a.mu.RUnlock()
+	if reloaded {
+		t.Fatal("the JWKS file was reloaded within the refresh interval")
+	}
+
+	// A file that cannot be loaded keeps the loaded keys
+	if err := os.WriteFile(jwksFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expireRefresh()
+	if err := verify(secondKey, "key-3"); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("err = %v, want ErrUnauthenticated for an unknown key", err)
+	}
+	if err := verify(secondKey, "key-2"); err != nil {
+		t.Fatalf("expected the loaded keys to survive a broken JWKS file: %v", err)
+	}
+}
+
+func TestClaimsPrincipal(t *testing.T) {
+	tests := []struct {
+		name           string
+		claims         map[string]interface{}
+		role           string
+		userID         string
+		organizationID string
+	}{
+		{
+			name:           "role and organization from app_metadata",
+			claims:         map[string]interface{}{"sub": "user-1", "role": "authenticated", "app_metadata": map[string]interface{}{"role": models.RoleDistributor, "organization_id": "distributor-1"}},
+			role:           models.RoleDistributor,
+			userID:         "user-1",
+			organizationID: "distributor-1",
+		},
+		{
+			name:           "user_role claim",
+			claims:         map[string]interface{}{"sub": "user-1", "role": "authenticated", "user_role": models.RolePharmacy, "organization_id": "pharmacy-1"},
+			role:           models.RolePharmacy,
+			userID:         "user-1",
+			organizationID: "pharmacy-1",
+		},
+		{
+			name:           "role claim with the subject as organization",
+			claims:         map[string]interface{}{"sub": "user-1", "role": models.RoleDoctor},
+			role:           models.RoleDoctor,
+			userID:         "user-1",
+			organizationID: "user-1",
+		},
+		{
+			name:           "service role",
+			claims:         map[string]interface{}{"role": supabaseServiceRole},
+			role:           models.RoleAdmin,
+			userID:         supabaseServiceRole,
+			organizationID: supabaseServiceRole,
+		},
+		{
+			name:   "authenticated role only",
+			claims: map[string]interface{}{"sub": "user-1", "role": "authenticated"},
+		},
+		{
+			name:   "unknown role",
+			claims: map[string]interface{}{"sub": "user-1", "app_metadata": map[string]interface{}{"role": "owner"}},
+		},
+		{
+			name:   "no subject",
+			claims: map[string]interface{}{"role": models.RoleManufacturer},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := claimsPrincipal(tt.claims)
+			if tt.role == "" {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Fatalf("err = %v, want ErrUnauthenticated", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal.Role != tt.role || principal.UserID != tt.userID || principal.OrganizationID != tt.organizationID {
+				t.Fatalf("principal = %+v, want %s %s of %s", principal, tt.role, tt.userID, tt.organizationID)
+			}
+		})
+	}
+}
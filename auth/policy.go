@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// ErrForbidden is returned when a principal may not perform an action
+var ErrForbidden = errors.New("forbidden")
+
+// Actions guarded by the access policy
+const (
+	ActionCreateDrug        = "drug:create"
+	ActionRevertDrug        = "drug:revert"
+	ActionUpdateUnit        = "unit:update"
+	ActionCreateRecall      = "recall:create"
+	ActionCreateShipment    = "shipment:create"
+	ActionUpdateShipment    = "shipment:update"
+	ActionIssuePrescription = "prescription:issue"
+	ActionFillPrescription  = "prescription:fill"
+	ActionClosePrescription = "prescription:close"
+	ActionReadPrescription  = "prescription:read"
+	ActionRegisterKey       = "organization_key:register"
+	ActionRotateKey         = "organization_key:rotate"
+	ActionAdminister        = "service:administer"
+)
+
+// policy maps each action to the roles allowed to perform it. A role mapped to true may
+// only act on resources owned by its organization. Admins may perform every action.
+var policy = map[string]map[string]bool{
+	ActionCreateDrug:        {models.RoleManufacturer: true},
+	ActionRevertDrug:        {models.RoleManufacturer: true},
+	ActionUpdateUnit:        {models.RoleManufacturer: true},
+	ActionCreateRecall:      {models.RoleManufacturer: true},
+	ActionCreateShipment:    {models.RoleManufacturer: true},
+	ActionUpdateShipment:    {models.RoleDistributor: true},
+	ActionIssuePrescription: {models.RoleDoctor: true},
+	ActionFillPrescription:  {models.RolePharmacy: true},
+	ActionClosePrescription: {models.RoleDoctor: true},
+	ActionReadPrescription:  {models.RoleDoctor: true, models.RolePatient: true, models.RolePharmacy: false},
+	ActionRegisterKey: {
+		models.RoleManufacturer: true,
+		models.RoleDistributor:  true,
+		models.RolePharmacy:     true,
+		models.RoleDoctor:       true,
+	},
+	ActionRotateKey: {
+		models.RoleManufacturer: true,
+		models.RoleDistributor:  true,
+		models.RolePharmacy:     true,
+		models.RoleDoctor:       true,
+	},
+	ActionAdminister: {},
+}
+
+// Authorize checks that a principal may perform an action on a resource owned by any of
+// the given organizations. Denials are logged and returned wrapping ErrForbidden.
+func Authorize(principal *Principal, action string, owners ...string) error {
+	if err := authorize(principal, action, owners); err != nil {
+		userID, role := "anonymous", "none"
+		if principal != nil {
+			userID, role = principal.UserID, principal.Role
+		}
+		log.Printf("Access denied: user %s (%s) attempted %s on resource owned by %v: %v", userID, role, action, owners, err)
+		return err
+	}
+	return nil
+}
+
+// authorize applies the policy without logging
+func authorize(principal *Principal, action string, owners []string) error {
+	if principal == nil {
+		return fmt.Errorf("%w: request is not authenticated", ErrForbidden)
+	}
+	if principal.Role == models.RoleAdmin {
+		return nil
+	}
+
+	roles, ok := policy[action]
+	if !ok {
+		return fmt.Errorf("%w: unknown action %s", ErrForbidden, action)
+	}
+	mustOwn, ok := roles[principal.Role]
+	if !ok {
+		return fmt.Errorf("%w: role %s may not perform %s", ErrForbidden, principal.Role, action)
+	}
+	if !mustOwn {
+		return nil
+	}
+
+	for _, owner := range owners {
+		if owner != "" && owner == principal.OrganizationID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s does not own the resource", ErrForbidden, principal.OrganizationID)
+}
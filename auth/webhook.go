@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook signature headers. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<raw body>" keyed with the webhook secret, optionally prefixed with "sha256=".
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// DefaultWebhookTolerance is how far a webhook timestamp may be from the current time
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// DefaultWebhookReplayDir is the directory recording the accepted webhook signatures
+const DefaultWebhookReplayDir = "webhook_replay"
+
+// ErrInvalidWebhook is returned when a webhook request fails verification
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// WebhookVerifier verifies the HMAC signatures of webhook requests and rejects replays.
+// A signature is accepted once: it is remembered until its timestamp leaves the
+// tolerance window, after which the timestamp check rejects it instead. Accepted
+// signatures are recorded as files in a directory, so a restart does not reopen the
+// window; verifiers sharing the directory reject each other's replays too.
+type WebhookVerifier struct {
+	secret    []byte
+	tolerance time.Duration
+	dir       string // directory recording accepted signatures, or empty to keep them in memory only
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // signature to the time it can be forgotten
+	lastPrune time.Time
+}
+
+// NewWebhookVerifier creates a verifier for the given secret, recording accepted
+// signatures in dir. Without a directory they are kept in memory only, and a request
+// accepted before a restart is accepted again after it while its timestamp is within the
+// tolerance window. Without a secret every webhook is rejected.
+func NewWebhookVerifier(secret string, tolerance time.Duration, dir string) (*WebhookVerifier, error) {
+	if tolerance <= 0 {
+		tolerance = DefaultWebhookTolerance
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create webhook replay directory: %v", err)
+		}
+	}
+
+	return &WebhookVerifier{
+		secret:    []byte(secret),
+		tolerance: tolerance,
+		dir:       dir,
+		seen:      make(map[string]time.Time),
+	}, nil
+}
+
+// NewWebhookVerifierFromEnv creates a verifier for WEBHOOK_SECRET with the tolerance
+// window given by WEBHOOK_TOLERANCE (a duration such as "5m"), recording accepted
+// signatures in DefaultWebhookReplayDir
+func NewWebhookVerifierFromEnv() (*WebhookVerifier, error) {
+	tolerance := DefaultWebhookTolerance
+	if value := os.Getenv("WEBHOOK_TOLERANCE"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBHOOK_TOLERANCE: %v", err)
+		}
+		tolerance = parsed
+	}
+
+	return NewWebhookVerifier(os.Getenv("WEBHOOK_SECRET"), tolerance, DefaultWebhookReplayDir)
+}
+
+// Configured reports whether the verifier has a secret to verify against
+func (v *WebhookVerifier) Configured() bool {
+	return len(v.secret) > 0
+}
+
+// Verify checks a webhook's signature over its timestamp and raw body, that the
+// timestamp is within the tolerance window, and that the signature was not seen before.
+// It fails with ErrInvalidWebhook for a request that must be refused, and with another
+// error when the signature could not be recorded.
+func (v *WebhookVerifier) Verify(signature, timestamp string, body []byte) error {
+	if !v.Configured() {
+		return fmt.Errorf("%w: no webhook secret configured", ErrInvalidWebhook)
+	}
+	if signature == "" || timestamp == "" {
+		return fmt.Errorf("%w: missing signature or timestamp", ErrInvalidWebhook)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalidWebhook)
+	}
+	sentAt := time.Unix(seconds, 0)
+	now := time.Now()
+	if sentAt.Before(now.Add(-v.tolerance)) || sentAt.After(now.Add(v.tolerance)) {
+		return fmt.Errorf("%w: timestamp outside the tolerance window", ErrInvalidWebhook)
+	}
+
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidWebhook)
+	}
+	if !hmac.Equal(received, v.mac(timestamp, body)) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidWebhook)
+	}
+
+	// Reject a replay of a signature accepted before
+	key := hex.EncodeToString(received)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastPrune) > v.tolerance {
+		for seenKey, forgetAt := range v.seen {
+			if now.After(forgetAt) {
+				delete(v.seen, seenKey)
+			}
+		}
+		v.pruneFiles(now)
+		v.lastPrune = now
+	}
+
+	if _, ok := v.seen[key]; ok {
+		return fmt.Errorf("%w: replayed request", ErrInvalidWebhook)
+	}
+	if err := v.record(key); err != nil {
+		return err
+	}
+	v.seen[key] = sentAt.Add(v.tolerance)
+
+	return nil
+}
+
+// record creates the file of an accepted signature. The file is created exclusively, so
+// a signature already recorded, before a restart or by another verifier sharing the
+// directory, is rejected as a replay.
+func (v *WebhookVerifier) record(key string) error {
+	if v.dir == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(v.path(key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: replayed request", ErrInvalidWebhook)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record webhook signature: %v", err)
+	}
+	return file.Close()
+}
+
+// pruneFiles removes the recorded signatures whose timestamp has left the tolerance
+// window. A signature is accepted at most one tolerance after its timestamp, so its file
+// is kept for twice the tolerance.
+func (v *WebhookVerifier) pruneFiles(now time.Time) {
+	if v.dir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(v.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && now.Sub(info.ModTime()) > 2*v.tolerance {
+			os.Remove(filepath.Join(v.dir, entry.Name()))
+		}
+	}
+}
+
+// path returns the file path recording a signature, named by its hex encoding
+func (v *WebhookVerifier) path(key string) string {
+	return filepath.Join(v.dir, key)
+}
+
+// Release forgets an accepted signature, so a request the service could not take, such
+// as one refused while the work queue is full, is accepted when the sender retries it
+func (v *WebhookVerifier) Release(signature string) {
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(received) == 0 {
+		return
+	}
+
+	key := hex.EncodeToString(received)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.seen, key)
+	if v.dir != "" {
+		os.Remove(v.path(key))
+	}
+}
+
+// Sign returns the signature header value of a webhook body sent at the given timestamp
+func (v *WebhookVerifier) Sign(timestamp string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(v.mac(timestamp, body))
+}
+
+// mac computes the HMAC-SHA256 of a timestamp and body
+func (v *WebhookVerifier) mac(timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
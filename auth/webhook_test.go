@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// webhookTimestamp returns the timestamp header value of a webhook sent at an offset from now
+func webhookTimestamp(offset time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+}
+
+// newWebhookVerifier creates a verifier with a tolerance of a minute
+func newWebhookVerifier(t *testing.T, secret, dir string) *WebhookVerifier {
+	t.Helper()
+	v, err := NewWebhookVerifier(secret, time.Minute, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	v := newWebhookVerifier(t, "webhook-secret", "")
+	other := newWebhookVerifier(t, "other-secret", "")
+	body := []byte(`{"type":"INSERT","table":"drugs"}`)
+
+	now := webhookTimestamp(0)
+	signature := v.Sign(now, body)
+	expired := webhookTimestamp(-2 * time.Minute)
+	future := webhookTimestamp(2 * time.Minute)
+
+	// Each request is verified after the ones before it, so a replay follows its original
+	tests := []struct {
+		name      string
+		signature string
+		timestamp string
+		body      []byte
+		valid     bool
+	}{
+		{"valid", signature, now, body, true},
+		{"replayed", signature, now, body, false},
+		{"replayed without the prefix", signature[len("sha256="):], now, body, false},
+		{"another body", v.Sign(now, []byte(`{}`)), now, []byte(`{}`), true},
+		{"expired", v.Sign(expired, body), expired, body, false},
+		{"from the future", v.Sign(future, body), future, body, false},
+		{"signed with another secret", other.Sign(webhookTimestamp(0), body), webhookTimestamp(0), body, false},
+		{"edited body", v.Sign(webhookTimestamp(-time.Second), body), webhookTimestamp(-time.Second), []byte(`{"type":"DELETE"}`), false},
+		{"signature of another timestamp", v.Sign(expired, body), now, body, false},
+		{"malformed signature", "sha256=zz", now, body, false},
+		{"malformed timestamp", signature, "yesterday", body, false},
+		{"no signature", "", now, body, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Verify(tt.signature, tt.timestamp, tt.body)
+			if tt.valid && err != nil {
+				t.Fatalf("expected the webhook to verify: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidWebhook) {
+				t.Fatalf("err = %v, want ErrInvalidWebhook", err)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookWithoutSecret(t *testing.T) {
+	v := newWebhookVerifier(t, "", "")
+	timestamp := webhookTimestamp(0)
+	if err := v.Verify(v.Sign(timestamp, nil), timestamp, nil); !errors.Is(err, ErrInvalidWebhook) {
+		t.Fatalf("err = %v, want ErrInvalidWebhook", err)
+	}
+}
+
+func TestReleaseWebhook(t *testing.T) {
+	v := newWebhookVerifier(t, "webhook-secret", t.TempDir())
+	body := []byte(`{}`)
+	timestamp := webhookTimestamp(0)
+	signature := v.Sign(timestamp, body)
+
+	if err := v.Verify(signature, timestamp, body); err != nil {
+		t.Fatal(err)
+	}
+	v.Release(signature)
+
+	// A released request is accepted once more when the sender retries it
+	if err := v.Verify(signature, timestamp, body); err != nil {
+		t.Fatalf("expected the retried webhook to verify: %v", err)
+	}
+	if err := v.Verify(signature, timestamp, body); !errors.Is(err, ErrInvalidWebhook) {
+		t.Fatalf("err = %v, want ErrInvalidWebhook for a replay", err)
+	}
+}
+
+func TestWebhookReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	body := []byte(`{}`)
+	timestamp := webhookTimestamp(0)
+	signature := newWebhookVerifier(t, "webhook-secret", dir).Sign(timestamp, body)
+
+	if err := newWebhookVerifier(t, "webhook-secret", dir).Verify(signature, timestamp, body); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted verifier, or another one sharing the directory, rejects the replay
+	restarted := newWebhookVerifier(t, "webhook-secret", dir)
+	if err := restarted.Verify(signature, timestamp, body); !errors.Is(err, ErrInvalidWebhook) {
+		t.Fatalf("err = %v, want ErrInvalidWebhook for a replay after a restart", err)
+	}
+
+	// A released signature is forgotten on disk too
+	restarted.Release(signature)
+	if err := newWebhookVerifier(t, "webhook-secret", dir).Verify(signature, timestamp, body); err != nil {
+		t.Fatalf("expected the released webhook to verify: %v", err)
+	}
+}
+
+func TestWebhookReplayFilesArePruned(t *testing.T) {
+	dir := t.TempDir()
+	v := newWebhookVerifier(t, "webhook-secret", dir)
+
+	// Signatures recorded more than twice the tolerance ago are removed, later ones kept
+	stale, recent := filepath.Join(dir, "aa"), filepath.Join(dir, "bb")
+	for file, age := range map[string]time.Duration{stale: 3 * time.Minute, recent: time.Minute} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timestamp := webhookTimestamp(0)
+	if err := v.Verify(v.Sign(timestamp, nil), timestamp, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale signature to be pruned: %v", err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Fatalf("expected the recent signature to be kept: %v", err)
+	}
+}
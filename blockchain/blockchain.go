@@ -3,11 +3,10 @@ package blockchain
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/ankit/blockchain_ledger/canonical"
 )
 
 // Transaction represents a blockchain transaction
@@ -33,8 +32,8 @@ func NewTransaction(data map[string]interface{}) *Transaction {
 func (tx *Transaction) CalculateHash() {
 	h := sha256.New()
 
-	// Create a string representation of the transaction data
-	dataJSON, _ := json.Marshal(tx.Data)
+	// Create a canonical string representation of the transaction data
+	dataJSON, _ := canonical.Marshal(tx.Data)
 	data := fmt.Sprintf("%s%s%s", tx.Timestamp, string(dataJSON), tx.PreviousHash)
 
 	h.Write([]byte(data))
@@ -106,32 +105,38 @@ func NewShipmentTransaction(shipmentData map[string]interface{}) (*ShipmentTrans
 	return tx, nil
 }
 
-// GenerateTransactionHash generates a unique transaction hash
-func GenerateTransactionHash(data map[string]interface{}) string {
-	// Create a unique identifier
-	uuid := uuid.New().String()
-
-	// Combine with timestamp for uniqueness
-	timestamp := time.Now().Format(time.RFC3339Nano)
+// hashExcludedFields lists transaction fields that are derived from the hash and are
+// therefore left out when the hash is computed
+var hashExcludedFields = []string{"tx_hash", "signature"}
+
+// GenerateTransactionHash generates the transaction hash as the SHA-256 digest of the
+// canonical JSON encoding of the transaction data. Uniqueness comes from the timestamp
+// carried in the data, so the same data always produces the same hash.
+func GenerateTransactionHash(data map[string]interface{}) (string, error) {
+	hashData := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		hashData[k] = v
+	}
+	for _, field := range hashExcludedFields {
+		delete(hashData, field)
+	}
 
-	// Create a hash of the combined data
-	h := sha256.New()
-	dataJSON, _ := json.Marshal(data)
-	h.Write([]byte(fmt.Sprintf("%s%s%s", uuid, timestamp, string(dataJSON))))
+	txHash, err := canonical.Hash(hashData)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash transaction data: %v", err)
+	}
 
-	return hex.EncodeToString(h.Sum(nil))
+	return txHash, nil
 }
 
 // ValidateTransaction validates a transaction hash against its data
 func ValidateTransaction(txHash string, txData map[string]interface{}) bool {
-	// Create a new transaction with the same data
-	tx := NewTransaction(txData)
-
-	// If the previous hash is included in the data, set it
-	if prevHash, ok := txData["previous_hash"].(string); ok {
-		tx.SetPreviousHash(prevHash)
+	// Recompute the hash from the stored data
+	calculatedHash, err := GenerateTransactionHash(txData)
+	if err != nil {
+		return false
 	}
 
 	// Compare the calculated hash with the provided hash
-	return tx.Hash == txHash
+	return calculatedHash == txHash
 }
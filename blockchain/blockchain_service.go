@@ -1,9 +1,11 @@
 package blockchain
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/ankit/blockchain_ledger/merkle"
 	"github.com/ankit/blockchain_ledger/models"
 	"github.com/ankit/blockchain_ledger/storage"
 )
@@ -11,88 +13,296 @@ import (
 // BlockchainService implements the models.BlockchainService interface
 type BlockchainService struct {
 	dataStorage *storage.DataStorage
+	keys        *KeyStore
 }
 
 // NewBlockchainService creates a new blockchain service
-func NewBlockchainService(dataStorage *storage.DataStorage) *BlockchainService {
+func NewBlockchainService(dataStorage *storage.DataStorage, keys *KeyStore) *BlockchainService {
 	return &BlockchainService{
 		dataStorage: dataStorage,
+		keys:        keys,
 	}
 }
 
+// Keys returns the key store holding the organizations' signing keys
+func (bs *BlockchainService) Keys() *KeyStore {
+	return bs.keys
+}
+
 // CreateTransaction creates a new blockchain transaction
 func (bs *BlockchainService) CreateTransaction(txType string, data map[string]interface{}) (string, error) {
-	// Add transaction type to data
-	data["tx_type"] = txType
-	data["timestamp"] = time.Now().Format(time.RFC3339)
+	txHashes, err := bs.CreateTransactions(txType, []map[string]interface{}{data})
+	if err != nil {
+		return "", err
+	}
+
+	return txHashes[0], nil
+}
+
+// CreateTransactions creates a batch of blockchain transactions of the same type and
+// commits them together in a single block
+func (bs *BlockchainService) CreateTransactions(txType string, batch []map[string]interface{}) ([]string, error) {
+	txs, err := bs.PrepareTransactions(txType, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bs.AppendTransactions(txs); err != nil {
+		return nil, err
+	}
+
+	txHashes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHashes[i] = tx.TxHash
+	}
+
+	return txHashes, nil
+}
+
+// PrepareTransactions hashes and signs a batch of blockchain transactions of the same type
+// without adding them to the blockchain, so they can be journaled before they are appended
+func (bs *BlockchainService) PrepareTransactions(txType string, batch []map[string]interface{}) ([]storage.BlockTransaction, error) {
+	txs := make([]storage.BlockTransaction, len(batch))
+
+	for i, data := range batch {
+		// Add transaction type to data
+		data["tx_type"] = txType
+		data["timestamp"] = time.Now().Format(time.RFC3339Nano)
+
+		// Name the signer's key in the hashed data, so the signature still verifies after a rotation
+		if err := bs.nameSigningKey(txType, data); err != nil {
+			return nil, err
+		}
+
+		// Generate transaction hash
+		txHash, err := GenerateTransactionHash(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate transaction hash: %v", err)
+		}
+		data["tx_hash"] = txHash
 
-	// Generate transaction hash
-	txHash := GenerateTransactionHash(data)
-	data["tx_hash"] = txHash
+		// Sign the transaction on behalf of the acting organization
+		if err := bs.signTransaction(txType, data); err != nil {
+			return nil, err
+		}
 
-	// Add transaction to blockchain
-	if err := bs.dataStorage.AddTransactionToBlockchain(data, txHash); err != nil {
-		return "", fmt.Errorf("failed to add transaction to blockchain: %v", err)
+		txs[i] = storage.BlockTransaction{TxHash: txHash, TxData: data}
 	}
 
-	return txHash, nil
+	return txs, nil
+}
+
+// AppendTransactions adds prepared transactions to the blockchain in a single block. A
+// batch whose first transaction is already on the chain was appended before and is not
+// appended again, so a journaled batch can be replayed safely.
+func (bs *BlockchainService) AppendTransactions(txs []storage.BlockTransaction) error {
+	if len(txs) == 0 {
+		return fmt.Errorf("cannot add an empty block to the blockchain")
+	}
+
+	appended, err := bs.dataStorage.HasTransaction(txs[0].TxHash)
+	if err != nil {
+		return fmt.Errorf("failed to look up transaction %s: %v", txs[0].TxHash, err)
+	}
+	if appended {
+		return nil
+	}
+
+	// Add transactions to blockchain
+	if err := bs.dataStorage.AddTransactionsToBlockchain(txs); err != nil {
+		return fmt.Errorf("failed to add transaction to blockchain: %v", err)
+	}
+
+	return nil
 }
 
 // GetTransaction retrieves a transaction from the blockchain
 func (bs *BlockchainService) GetTransaction(txID string) (*models.BlockchainTransaction, error) {
-	// Get blockchain ledger
-	ledger, err := bs.dataStorage.GetBlockchainLedger()
+	block, index, err := bs.findTransaction(txID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get blockchain ledger: %v", err)
+		return nil, err
 	}
 
-	// Find transaction with matching hash
-	for _, block := range ledger.Blocks {
-		if block.TxHash == txID {
-			// Convert block data to BlockchainTransaction
-			txData, ok := block.TxData.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("invalid transaction data format")
-			}
-
-			txType, _ := txData["tx_type"].(string)
-			timestamp, _ := time.Parse(time.RFC3339, block.Timestamp)
-
-			return &models.BlockchainTransaction{
-				TransactionID: block.TxHash,
-				Type:          txType,
-				Data:          txData,
-				Timestamp:     timestamp,
-			}, nil
-		}
+	// Convert block data to BlockchainTransaction
+	txData, ok := block.Transactions[index].TxData.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid transaction data format")
 	}
 
-	return nil, fmt.Errorf("transaction not found: %s", txID)
+	txType, _ := txData["tx_type"].(string)
+	timestamp, _ := time.Parse(time.RFC3339Nano, block.Timestamp)
+
+	return &models.BlockchainTransaction{
+		TransactionID: txID,
+		Type:          txType,
+		Data:          txData,
+		Timestamp:     timestamp,
+	}, nil
 }
 
 // VerifyTransaction verifies a transaction in the blockchain
 func (bs *BlockchainService) VerifyTransaction(txID string) (bool, error) {
-	// Get blockchain ledger
-	ledger, err := bs.dataStorage.GetBlockchainLedger()
+	block, index, err := bs.findTransaction(txID)
 	if err != nil {
-		return false, fmt.Errorf("failed to get blockchain ledger: %v", err)
+		return false, err
+	}
+
+	// Convert block data to map
+	txData, ok := block.Transactions[index].TxData.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("invalid transaction data format")
 	}
 
-	// Find transaction with matching hash
-	for _, block := range ledger.Blocks {
-		if block.TxHash == txID {
-			// Convert block data to map
-			txData, ok := block.TxData.(map[string]interface{})
-			if !ok {
-				return false, fmt.Errorf("invalid transaction data format")
-			}
+	// Validate transaction
+	if !ValidateTransaction(txID, txData) {
+		return false, nil
+	}
+
+	// Validate the signature of the acting organization
+	return bs.verifySignature(txData)
+}
 
-			// Validate transaction
-			return ValidateTransaction(txID, txData), nil
+// nameSigningKey records the signer's active key ID in the transaction data. Transaction
+// types listed in signedTxTypes are rejected without a signer.
+func (bs *BlockchainService) nameSigningKey(txType string, data map[string]interface{}) error {
+	signerID, _ := data["signer_id"].(string)
+	if signerID == "" {
+		if signedTxTypes[txType] {
+			return fmt.Errorf("%s transaction requires a signer_id", txType)
 		}
+		return nil
 	}
 
-	return false, fmt.Errorf("transaction not found: %s", txID)
+	keyID, err := bs.keys.ActiveKeyID(signerID)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s transaction: %v", txType, err)
+	}
+	data["key_id"] = keyID
+
+	return nil
+}
+
+// signTransaction adds the signer's signature over the transaction hash to the data
+func (bs *BlockchainService) signTransaction(txType string, data map[string]interface{}) error {
+	signerID, _ := data["signer_id"].(string)
+	if signerID == "" {
+		return nil
+	}
+
+	txHash, ok := data["tx_hash"].(string)
+	if !ok {
+		return fmt.Errorf("failed to sign %s transaction: missing transaction hash", txType)
+	}
+	keyID, _ := data["key_id"].(string)
+
+	signature, err := bs.keys.SignTransaction(signerID, keyID, txHash)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s transaction: %v", txType, err)
+	}
+	data["signature"] = signature
+
+	return nil
+}
+
+// verifySignature checks a transaction's signature against the signer's registered public key
+func (bs *BlockchainService) verifySignature(txData map[string]interface{}) (bool, error) {
+	txType, _ := txData["tx_type"].(string)
+	signerID, _ := txData["signer_id"].(string)
+	signature, _ := txData["signature"].(string)
+
+	if signerID == "" && signature == "" {
+		// Unsigned transactions are only valid for types that do not require a signature
+		return !signedTxTypes[txType], nil
+	}
+	if signerID == "" || signature == "" {
+		return false, nil
+	}
+	txHash, ok := txData["tx_hash"].(string)
+	if !ok {
+		return false, nil
+	}
+
+	// Transactions signed before key IDs were recorded name no key
+	keyID, _ := txData["key_id"].(string)
+	valid, err := bs.keys.VerifyTransactionSignature(signerID, keyID, txHash, signature)
+	if errors.Is(err, ErrSignerNotRegistered) {
+		return false, nil
+	}
+	return valid, err
+}
+
+// TransactionProof is a merkle inclusion proof for a transaction that can be verified
+// offline against the published block header
+type TransactionProof struct {
+	TxHash      string              `json:"tx_hash"`
+	TxData      interface{}         `json:"tx_data"`
+	LeafHash    string              `json:"leaf_hash"`
+	LeafIndex   int                 `json:"leaf_index"`
+	Proof       []merkle.ProofStep  `json:"proof"`
+	BlockHeader storage.BlockHeader `json:"block_header"`
+}
+
+// GetTransactionProof builds the merkle inclusion proof for a transaction
+func (bs *BlockchainService) GetTransactionProof(txID string) (*TransactionProof, error) {
+	block, index, err := bs.findTransaction(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	leaves, err := storage.TransactionLeafHashes(block.Transactions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute leaf hashes: %v", err)
+	}
+
+	proof, err := merkle.Proof(leaves, index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build merkle proof: %v", err)
+	}
+
+	return &TransactionProof{
+		TxHash:      txID,
+		TxData:      block.Transactions[index].TxData,
+		LeafHash:    leaves[index],
+		LeafIndex:   index,
+		Proof:       proof,
+		BlockHeader: block.Header(),
+	}, nil
+}
+
+// GetBlockHeaders retrieves the headers of all blocks in the blockchain
+func (bs *BlockchainService) GetBlockHeaders() ([]storage.BlockHeader, error) {
+	ledger, err := bs.dataStorage.GetBlockchainLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blockchain ledger: %v", err)
+	}
+
+	headers := make([]storage.BlockHeader, len(ledger.Blocks))
+	for i := range ledger.Blocks {
+		headers[i] = ledger.Blocks[i].Header()
+	}
+
+	return headers, nil
+}
+
+// GetTransactionsByIndex retrieves every transaction that mentions an ID under the given
+// index kind (storage.IndexDrug, storage.IndexShipment or storage.IndexActor)
+func (bs *BlockchainService) GetTransactionsByIndex(kind, value string) ([]storage.ChainTransaction, error) {
+	txs, err := bs.dataStorage.FindTransactions(kind, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find transactions: %v", err)
+	}
+
+	return txs, nil
+}
+
+// RebuildIndex rebuilds the transaction index from the chain
+func (bs *BlockchainService) RebuildIndex() error {
+	return bs.dataStorage.RebuildIndex()
+}
+
+// findTransaction locates the block containing a transaction and its index in the block
+func (bs *BlockchainService) findTransaction(txID string) (*storage.Block, int, error) {
+	return bs.dataStorage.FindTransaction(txID)
 }
 
 // RecordDrugCreation records a drug creation in the blockchain
@@ -100,6 +310,7 @@ func (bs *BlockchainService) RecordDrugCreation(drugID, manufacturerID string, t
 	data := map[string]interface{}{
 		"drug_id":         drugID,
 		"manufacturer_id": manufacturerID,
+		"signer_id":       manufacturerID,
 		"status":          "created",
 		"created_at":      timestamp.Format(time.RFC3339),
 	}
@@ -139,6 +350,7 @@ func (bs *BlockchainService) RecordShipmentStatusUpdate(shipmentID, status, upda
 		"shipment_id": shipmentID,
 		"status":      status,
 		"updated_by":  updatedBy,
+		"signer_id":   updatedBy,
 		"updated_at":  timestamp.Format(time.RFC3339),
 	}
 
@@ -0,0 +1,214 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// Provenance events derived from transaction types
+const (
+	EventCreated         = "created"
+	EventStatusUpdate    = "status_update"
+	EventReverted        = "reverted"
+	EventLotCreated      = "lot_created"
+	EventUnitUpdate      = "unit_status_update"
+	EventRecall          = "recall"
+	EventExpired         = "expired"
+	EventShipmentCreate  = "shipment_created"
+	EventShipmentUpdate  = "shipment_status_update"
+	EventPrescribed      = "prescribed"
+	EventDispensed       = "dispensed"
+	EventPrescriptionEnd = "prescription_closed"
+)
+
+// ErrNoProvenance is returned when the chain holds no transactions for a drug
+var ErrNoProvenance = errors.New("no transactions found for drug")
+
+// provenanceEvents maps the transaction types of the chain to provenance events
+var provenanceEvents = map[string]string{
+	"drug":                   EventCreated,
+	"drug_create":            EventCreated,
+	"drug_update":            EventStatusUpdate,
+	"drug_status_update":     EventStatusUpdate,
+	"drug_revert":            EventReverted,
+	"lot_create":             EventLotCreated,
+	"unit_status_update":     EventUnitUpdate,
+	"recall":                 EventRecall,
+	"drug_expired":           EventExpired,
+	"shipment":               EventShipmentCreate,
+	"shipment_create":        EventShipmentCreate,
+	"shipment_update":        EventShipmentUpdate,
+	"shipment_status_update": EventShipmentUpdate,
+	"prescription_issue":     EventPrescribed,
+	"prescription_fill":      EventDispensed,
+	"prescription_cancel":    EventPrescriptionEnd,
+	"prescription_expire":    EventPrescriptionEnd,
+}
+
+// ProvenanceStep is a single event in the custody chain of a drug, anchored to the block
+// that records it
+type ProvenanceStep struct {
+	Event       string `json:"event"`
+	TxType      string `json:"tx_type"`
+	Status      string `json:"status,omitempty"`
+	ShipmentID  string `json:"shipment_id,omitempty"`
+	Actor       string `json:"actor,omitempty"`
+	SignerID    string `json:"signer_id,omitempty"`
+	Details     string `json:"details,omitempty"`
+	Timestamp   string `json:"timestamp"`
+	TxHash      string `json:"tx_hash"`
+	BlockHeight int    `json:"block_height"`
+	BlockHash   string `json:"block_hash"`
+	Verified    bool   `json:"verified"`
+}
+
+// Provenance is the custody chain of a drug reconstructed from the blockchain alone
+type Provenance struct {
+	DrugID         string           `json:"drug_id"`
+	ManufacturerID string           `json:"manufacturer_id,omitempty"`
+	CurrentStatus  string           `json:"current_status,omitempty"`
+	ShipmentIDs    []string         `json:"shipment_ids"`
+	Steps          []ProvenanceStep `json:"steps"`
+}
+
+// GetDrugProvenance reconstructs the custody chain of a drug from the blocks of the local
+// chain. Transactions that mention the drug are combined with every transaction of the
+// shipments that carried it, in chain order. Database rows are never consulted.
+func (bs *BlockchainService) GetDrugProvenance(drugID string) (*Provenance, error) {
+	drugTxs, err := bs.dataStorage.FindTransactions(storage.IndexDrug, drugID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find drug transactions: %v", err)
+	}
+	if len(drugTxs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoProvenance, drugID)
+	}
+
+	// Cross-reference the shipments that carried the drug
+	txs := make(map[string]storage.ChainTransaction, len(drugTxs))
+	var shipmentIDs []string
+	seenShipments := make(map[string]bool)
+	for _, tx := range drugTxs {
+		txs[tx.TxHash] = tx
+		if shipmentID := txField(tx.TxData, "shipment_id"); shipmentID != "" && !seenShipments[shipmentID] {
+			seenShipments[shipmentID] = true
+			shipmentIDs = append(shipmentIDs, shipmentID)
+		}
+	}
+
+	for _, shipmentID := range shipmentIDs {
+		shipmentTxs, err := bs.dataStorage.FindTransactions(storage.IndexShipment, shipmentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find transactions for shipment %s: %v", shipmentID, err)
+		}
+		for _, tx := range shipmentTxs {
+			txs[tx.TxHash] = tx
+		}
+	}
+
+	// Order the transactions as they appear in the chain
+	ordered := make([]storage.ChainTransaction, 0, len(txs))
+	for _, tx := range txs {
+		ordered = append(ordered, tx)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].BlockHeight != ordered[j].BlockHeight {
+			return ordered[i].BlockHeight < ordered[j].BlockHeight
+		}
+		return ordered[i].TxIndex < ordered[j].TxIndex
+	})
+
+	provenance := &Provenance{
+		DrugID:      drugID,
+		ShipmentIDs: shipmentIDs,
+		Steps:       make([]ProvenanceStep, 0, len(ordered)),
+	}
+	if provenance.ShipmentIDs == nil {
+		provenance.ShipmentIDs = []string{}
+	}
+
+	for _, tx := range ordered {
+		step := bs.provenanceStep(tx)
+		provenance.Steps = append(provenance.Steps, step)
+
+		// Track the drug's own state
+		switch step.Event {
+		case EventCreated:
+			if manufacturerID := txField(tx.TxData, "manufacturer_id"); manufacturerID != "" {
+				provenance.ManufacturerID = manufacturerID
+			}
+			provenance.CurrentStatus = "created"
+		case EventStatusUpdate:
+			if txField(tx.TxData, "drug_id") == drugID && step.Status != "" {
+				provenance.CurrentStatus = step.Status
+			}
+		case EventReverted:
+			provenance.CurrentStatus = "reverted"
+		case EventExpired:
+			// The expiry of a lot's units leaves the drug's own state alone
+			if txField(tx.TxData, "lot_id") == "" {
+				provenance.CurrentStatus = step.Status
+			}
+		}
+	}
+
+	return provenance, nil
+}
+
+// provenanceStep describes a transaction as a provenance step and verifies its hash and signature
+func (bs *BlockchainService) provenanceStep(tx storage.ChainTransaction) ProvenanceStep {
+	txType := txField(tx.TxData, "tx_type")
+
+	event, ok := provenanceEvents[txType]
+	if !ok {
+		event = txType
+	}
+
+	step := ProvenanceStep{
+		Event:       event,
+		TxType:      txType,
+		Status:      txField(tx.TxData, "status"),
+		ShipmentID:  txField(tx.TxData, "shipment_id"),
+		Actor:       firstTxField(tx.TxData, "updated_by", "signer_id", "manufacturer_id"),
+		SignerID:    txField(tx.TxData, "signer_id"),
+		Details:     txField(tx.TxData, "reason"),
+		Timestamp:   firstTxField(tx.TxData, "timestamp", "updated_at", "created_at"),
+		TxHash:      tx.TxHash,
+		BlockHeight: tx.BlockHeight,
+		BlockHash:   tx.BlockHash,
+	}
+	if step.Timestamp == "" {
+		step.Timestamp = tx.BlockTimestamp
+	}
+	if step.Status == "" && (event == EventCreated || event == EventShipmentCreate) {
+		step.Status = "created"
+	}
+
+	if txData, ok := tx.TxData.(map[string]interface{}); ok && ValidateTransaction(tx.TxHash, txData) {
+		step.Verified, _ = bs.verifySignature(txData)
+	}
+
+	return step
+}
+
+// txField returns a string field of transaction data
+func txField(txData interface{}, field string) string {
+	data, ok := txData.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	value, _ := data[field].(string)
+	return value
+}
+
+// firstTxField returns the first non-empty string field of transaction data
+func firstTxField(txData interface{}, fields ...string) string {
+	for _, field := range fields {
+		if value := txField(txData, field); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,437 @@
+package blockchain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Organization roles that can hold signing keys
+const (
+	RoleManufacturer = "manufacturer"
+	RoleDistributor  = "distributor"
+	RolePharmacy     = "pharmacy"
+	RoleDoctor       = "doctor"
+)
+
+// signedTxTypes lists the transaction types that must carry a signature from the acting organization
+var signedTxTypes = map[string]bool{
+	"drug_create":        true,
+	"shipment_update":    true,
+	"prescription_issue": true,
+	"prescription_fill":  true,
+	"recall":             true,
+}
+
+// Key store errors
+var (
+	ErrSignerNotRegistered = errors.New("signer is not registered")
+	ErrKeyExists           = errors.New("organization key is already registered")
+	ErrKeyNotFound         = errors.New("organization key not found")
+)
+
+// retiredKeyDir is the subdirectory of the key store holding the rotated-out keys of each
+// organization, kept to verify the transactions they signed
+const retiredKeyDir = "retired"
+
+// OrganizationKey represents a signing key pair registered for an organization
+type OrganizationKey struct {
+	OrganizationID string `json:"organization_id"`
+	Role           string `json:"role"`
+	KeyID          string `json:"key_id"`                // identifies this key among the organization's keys
+	PublicKey      string `json:"public_key"`            // base64-encoded Ed25519 public key
+	PrivateKey     string `json:"private_key,omitempty"` // base64-encoded Ed25519 private key, absent once the key is retired
+	RegisteredAt   string `json:"registered_at"`
+	RetiredAt      string `json:"retired_at,omitempty"`
+}
+
+// KeyStore manages Ed25519 key pairs for the organizations that submit transactions. Each
+// organization signs with its active key; keys replaced by a rotation are retired but kept,
+// so the transactions they signed still verify.
+type KeyStore struct {
+	mu      sync.RWMutex
+	Dir     string
+	keys    map[string]*OrganizationKey            // active key of each organization
+	retired map[string]map[string]*OrganizationKey // retired keys of each organization by key ID
+}
+
+// NewKeyStore creates a key store backed by the given directory and loads existing keys
+func NewKeyStore(dir string) (*KeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %v", err)
+	}
+
+	ks := &KeyStore{
+		Dir:     dir,
+		keys:    make(map[string]*OrganizationKey),
+		retired: make(map[string]map[string]*OrganizationKey),
+	}
+
+	// Load the active keys, then the retired keys of each organization
+	keys, err := loadKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.PrivateKey == "" {
+			log.Printf("Warning: organization %s has no private key held by the service and cannot sign until its key is rotated", key.OrganizationID)
+		}
+		ks.keys[key.OrganizationID] = key
+	}
+
+	organizations, err := os.ReadDir(filepath.Join(dir, retiredKeyDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read retired key directory: %v", err)
+	}
+	for _, organization := range organizations {
+		if !organization.IsDir() {
+			continue
+		}
+		keys, err := loadKeys(filepath.Join(dir, retiredKeyDir, organization.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			ks.retire(key)
+		}
+	}
+
+	return ks, nil
+}
+
+// loadKeys reads the key files of a directory. Keys saved before key IDs were introduced
+// are given the ID derived from their public key.
+func loadKeys(dir string) ([]*OrganizationKey, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %v", err)
+	}
+
+	var keys []*OrganizationKey
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file %s: %v", file.Name(), err)
+		}
+
+		var key OrganizationKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal key file %s: %v", file.Name(), err)
+		}
+		if key.KeyID == "" {
+			if key.KeyID, err = keyID(key.PublicKey); err != nil {
+				return nil, fmt.Errorf("invalid key file %s: %v", file.Name(), err)
+			}
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, nil
+}
+
+// GenerateKey generates and registers a new key pair held by the service for an
+// organization that has no key yet
+func (ks *KeyStore) GenerateKey(organizationID, role string) (*OrganizationKey, error) {
+	key, err := generateKey(organizationID, role)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ks.register(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// RotateKey replaces an organization's active key with a new key pair generated and held
+// by the service. The replaced key is retired: it no longer signs, but still verifies the
+// transactions it signed.
+func (ks *KeyStore) RotateKey(organizationID string) (*OrganizationKey, error) {
+	ks.mu.RLock()
+	current, ok := ks.keys[organizationID]
+	ks.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSignerNotRegistered, organizationID)
+	}
+
+	key, err := generateKey(organizationID, current.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ks.rotate(current, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetPublicKey returns the active key of an organization without its private key
+func (ks *KeyStore) GetPublicKey(organizationID string) (*OrganizationKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[organizationID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSignerNotRegistered, organizationID)
+	}
+
+	public := *key
+	public.PrivateKey = ""
+	return &public, nil
+}
+
+// GetKeyVersion returns a key of an organization by key ID, active or retired, without
+// its private key
+func (ks *KeyStore) GetKeyVersion(organizationID, keyID string) (*OrganizationKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[organizationID]
+	if !ok || key.KeyID != keyID {
+		if key, ok = ks.retired[organizationID][keyID]; !ok {
+			return nil, fmt.Errorf("%w: %s/%s", ErrKeyNotFound, organizationID, keyID)
+		}
+	}
+
+	public := *key
+	public.PrivateKey = ""
+	return &public, nil
+}
+
+// ActiveKeyID returns the ID of the key an organization currently signs with
+func (ks *KeyStore) ActiveKeyID(organizationID string) (string, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	key, ok := ks.keys[organizationID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSignerNotRegistered, organizationID)
+	}
+	return key.KeyID, nil
+}
+
+// SignTransaction signs a transaction hash with the organization's private key. The key
+// must be the organization's active key, so a key rotated out meanwhile is never used.
+func (ks *KeyStore) SignTransaction(organizationID, keyID, txHash string) (string, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[organizationID]
+	ks.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSignerNotRegistered, organizationID)
+	}
+	if key.KeyID != keyID {
+		return "", fmt.Errorf("key %s of %s is not the active key", keyID, organizationID)
+	}
+	if key.PrivateKey == "" {
+		return "", fmt.Errorf("organization %s has no private key held by the service; rotate its key", organizationID)
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(key.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key for %s: %v", organizationID, err)
+	}
+
+	message, err := hex.DecodeString(txHash)
+	if err != nil {
+		return "", fmt.Errorf("invalid transaction hash: %v", err)
+	}
+
+	signature := ed25519.Sign(ed25519.PrivateKey(privateKey), message)
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// VerifyTransactionSignature checks a transaction signature against the organization's key
+// with the given ID, active or retired. Transactions signed before key IDs were recorded
+// name no key and are checked against every key of the organization.
+func (ks *KeyStore) VerifyTransactionSignature(organizationID, keyID, txHash, signature string) (bool, error) {
+	var keys []*OrganizationKey
+	ks.mu.RLock()
+	active, registered := ks.keys[organizationID]
+	if registered && (keyID == "" || active.KeyID == keyID) {
+		keys = append(keys, active)
+	}
+	for id, key := range ks.retired[organizationID] {
+		if keyID == "" || id == keyID {
+			keys = append(keys, key)
+		}
+	}
+	ks.mu.RUnlock()
+
+	if len(keys) == 0 {
+		if !registered {
+			return false, fmt.Errorf("%w: %s", ErrSignerNotRegistered, organizationID)
+		}
+		return false, nil
+	}
+
+	message, err := hex.DecodeString(txHash)
+	if err != nil {
+		return false, nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false, nil
+	}
+
+	for _, key := range keys {
+		publicKey, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil {
+			return false, fmt.Errorf("invalid public key %s for %s: %v", key.KeyID, organizationID, err)
+		}
+		if ed25519.Verify(ed25519.PublicKey(publicKey), message, sig) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// register stores the first key of an organization in memory and on disk
+func (ks *KeyStore) register(key *OrganizationKey) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.keys[key.OrganizationID]; ok {
+		return fmt.Errorf("%w: %s", ErrKeyExists, key.OrganizationID)
+	}
+
+	if err := writeKey(filepath.Join(ks.Dir, fmt.Sprintf("%s.json", key.OrganizationID)), key); err != nil {
+		return err
+	}
+
+	ks.keys[key.OrganizationID] = key
+	return nil
+}
+
+// rotate retires an organization's active key and makes another key active. The retired
+// key is saved before the active key file is replaced, so no key is ever lost.
+func (ks *KeyStore) rotate(current, key *OrganizationKey) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.keys[key.OrganizationID] != current {
+		return fmt.Errorf("key of %s was rotated concurrently", key.OrganizationID)
+	}
+	if key.KeyID == current.KeyID {
+		return fmt.Errorf("%w: %s already uses key %s", ErrKeyExists, key.OrganizationID, key.KeyID)
+	}
+	if _, ok := ks.retired[key.OrganizationID][key.KeyID]; ok {
+		return fmt.Errorf("%w: key %s of %s was retired and cannot be reused", ErrKeyExists, key.KeyID, key.OrganizationID)
+	}
+
+	// Retired keys only verify, so their private key is dropped
+	retired := *current
+	retired.PrivateKey = ""
+	retired.RetiredAt = time.Now().Format(time.RFC3339)
+
+	retiredDir := filepath.Join(ks.Dir, retiredKeyDir, key.OrganizationID)
+	if err := os.MkdirAll(retiredDir, 0700); err != nil {
+		return fmt.Errorf("failed to create retired key directory: %v", err)
+	}
+	if err := writeKey(filepath.Join(retiredDir, fmt.Sprintf("%s.json", retired.KeyID)), &retired); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(ks.Dir, fmt.Sprintf("%s.json", key.OrganizationID)), key); err != nil {
+		return err
+	}
+
+	ks.retire(&retired)
+	ks.keys[key.OrganizationID] = key
+	return nil
+}
+
+// retire adds a key to the retired keys of its organization
+func (ks *KeyStore) retire(key *OrganizationKey) {
+	if ks.retired[key.OrganizationID] == nil {
+		ks.retired[key.OrganizationID] = make(map[string]*OrganizationKey)
+	}
+	ks.retired[key.OrganizationID][key.KeyID] = key
+}
+
+// generateKey generates a key pair held by the service for an organization
+func generateKey(organizationID, role string) (*OrganizationKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	id, err := keyID(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrganizationKey{
+		OrganizationID: organizationID,
+		Role:           role,
+		KeyID:          id,
+		PublicKey:      encoded,
+		PrivateKey:     base64.StdEncoding.EncodeToString(privateKey),
+		RegisteredAt:   time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// keyID derives a key's ID from its base64-encoded public key: the first 16 hex digits of
+// the key's SHA-256 digest
+func keyID(publicKey string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid public key size: %d", len(decoded))
+	}
+
+	digest := sha256.Sum256(decoded)
+	return hex.EncodeToString(digest[:8]), nil
+}
+
+// validateKey checks the organization and role of a key before it is stored
+func validateKey(key *OrganizationKey) error {
+	if key.OrganizationID == "" || filepath.Base(key.OrganizationID) != key.OrganizationID {
+		return fmt.Errorf("invalid organization ID: %q", key.OrganizationID)
+	}
+	switch key.Role {
+	case RoleManufacturer, RoleDistributor, RolePharmacy, RoleDoctor:
+	default:
+		return fmt.Errorf("invalid organization role: %s", key.Role)
+	}
+	return nil
+}
+
+// writeKey saves a key file
+func writeKey(path string, key *OrganizationKey) error {
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal organization key: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save organization key: %v", err)
+	}
+	return nil
+}
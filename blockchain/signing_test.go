@@ -0,0 +1,154 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+// prepare hashes and signs a transaction signed by the given organization
+func prepare(t *testing.T, bs *BlockchainService, txType, signerID string) map[string]interface{} {
+	t.Helper()
+	data := map[string]interface{}{"drug_id": "D1", "signer_id": signerID}
+	txs, err := bs.PrepareTransactions(txType, []map[string]interface{}{data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txs[0].TxData.(map[string]interface{})
+}
+
+// verify checks the hash and signature of prepared transaction data
+func verify(t *testing.T, bs *BlockchainService, data map[string]interface{}) bool {
+	t.Helper()
+	if !ValidateTransaction(data["tx_hash"].(string), data) {
+		return false
+	}
+	valid, err := bs.verifySignature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return valid
+}
+
+func TestSignAndVerifyTransaction(t *testing.T) {
+	keys, err := NewKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("m1", RoleManufacturer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("m2", RoleManufacturer); err != nil {
+		t.Fatal(err)
+	}
+	bs := NewBlockchainService(nil, keys)
+
+	tests := []struct {
+		name   string
+		tamper func(data map[string]interface{})
+		want   bool
+	}{
+		{"signed by the signer", func(data map[string]interface{}) {}, true},
+		{"edited data", func(data map[string]interface{}) { data["drug_id"] = "D2" }, false},
+		{"other signer", func(data map[string]interface{}) { data["signer_id"] = "m2" }, false},
+		{"unknown signer", func(data map[string]interface{}) { data["signer_id"] = "m3" }, false},
+		{"missing signature", func(data map[string]interface{}) { delete(data, "signature") }, false},
+		{"signature of another transaction", func(data map[string]interface{}) {
+			data["signature"] = prepare(t, bs, "drug_create", "m1")["signature"]
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := prepare(t, bs, "drug_create", "m1")
+			tt.tamper(data)
+			if got := verify(t, bs, data); got != tt.want {
+				t.Fatalf("verified = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedTransactionRequiresSigner(t *testing.T) {
+	keys, err := NewKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := NewBlockchainService(nil, keys)
+
+	if _, err := bs.PrepareTransactions("drug_create", []map[string]interface{}{{"drug_id": "D1"}}); err == nil {
+		t.Fatal("expected a drug_create transaction without a signer to be rejected")
+	}
+	if _, err := bs.PrepareTransactions("drug_create", []map[string]interface{}{{"drug_id": "D1", "signer_id": "m1"}}); err == nil {
+		t.Fatal("expected a drug_create transaction of an unregistered signer to be rejected")
+	}
+
+	// Unsigned transaction types verify without a signature
+	data := prepare(t, bs, "drug_update", "")
+	if !verify(t, bs, data) {
+		t.Fatal("unsigned drug_update transaction does not verify")
+	}
+	data["tx_type"] = "drug_create"
+	if verify(t, bs, data) {
+		t.Fatal("unsigned drug_create transaction verifies")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := keys.GenerateKey("d1", RoleDistributor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("d1", RoleDistributor); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("second registration: err = %v, want ErrKeyExists", err)
+	}
+	bs := NewBlockchainService(nil, keys)
+	before := prepare(t, bs, "shipment_update", "d1")
+
+	second, err := keys.RotateKey("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.KeyID == first.KeyID || second.Role != RoleDistributor {
+		t.Fatalf("rotated key = %s (%s), previous %s", second.KeyID, second.Role, first.KeyID)
+	}
+	if _, err := keys.RotateKey("d2"); !errors.Is(err, ErrSignerNotRegistered) {
+		t.Fatalf("rotation of an unknown organization: err = %v", err)
+	}
+
+	// The retired key no longer signs
+	if _, err := keys.SignTransaction("d1", first.KeyID, before["tx_hash"].(string)); err == nil {
+		t.Fatal("expected the retired key to be refused for signing")
+	}
+
+	// Transactions name the key that signed them, so both verify after the rotation and
+	// after the key store is reloaded
+	after := prepare(t, bs, "shipment_update", "d1")
+	if before["key_id"] != first.KeyID || after["key_id"] != second.KeyID {
+		t.Fatalf("key IDs = %v and %v, want %s and %s", before["key_id"], after["key_id"], first.KeyID, second.KeyID)
+	}
+	reloaded, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ks := range []*KeyStore{keys, reloaded} {
+		bs := NewBlockchainService(nil, ks)
+		if !verify(t, bs, before) || !verify(t, bs, after) {
+			t.Fatal("a transaction signed before or after the rotation does not verify")
+		}
+	}
+	if key, err := reloaded.GetKeyVersion("d1", first.KeyID); err != nil || key.RetiredAt == "" || key.PrivateKey != "" {
+		t.Fatalf("retired key = %+v, %v", key, err)
+	}
+
+	// A signature made by the retired key does not verify under the new key
+	forged := prepare(t, bs, "shipment_update", "d1")
+	forged["signature"] = before["signature"]
+	if verify(t, bs, forged) {
+		t.Fatal("a signature of another transaction verifies")
+	}
+}
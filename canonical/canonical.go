@@ -0,0 +1,192 @@
+package canonical
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Marshal encodes a value as canonical JSON following RFC 8785 (JSON Canonicalization Scheme):
+// object keys are sorted by their UTF-16 code units, numbers use the ECMAScript number
+// format, strings only escape what JSON requires and no insignificant whitespace is emitted.
+// The value is first encoded with encoding/json, so structs and time values are supported.
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal value: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, fmt.Errorf("failed to decode value: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, generic); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Hash returns the hex-encoded SHA-256 digest of the canonical JSON encoding of a value
+func Hash(v interface{}) (string, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// encodeValue writes the canonical form of a decoded JSON value
+func encodeValue(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if value {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		number, err := formatNumber(value)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(number)
+	case string:
+		return encodeString(buf, value)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range value {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return lessUTF16(keys[i], keys[j])
+		})
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeString(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encodeValue(buf, value[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported canonical JSON value of type %T", v)
+	}
+
+	return nil
+}
+
+// formatNumber formats a JSON number the way ECMAScript's Number.prototype.toString does
+func formatNumber(number json.Number) (string, error) {
+	f, err := strconv.ParseFloat(string(number), 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid number %s: %v", number, err)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("number %s cannot be represented in canonical JSON", number)
+	}
+	if f == 0 {
+		// Covers negative zero as well
+		return "0", nil
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		format = 'e'
+	}
+
+	s := strconv.FormatFloat(f, format, -1, 64)
+	if format == 'e' {
+		// ECMAScript writes 1e-7 rather than 1e-07
+		n := len(s)
+		if n >= 4 && s[n-4] == 'e' && s[n-3] == '-' && s[n-2] == '0' {
+			s = s[:n-2] + s[n-1:]
+		}
+	}
+
+	return s, nil
+}
+
+// encodeString writes a JSON string escaping only quotes, backslashes and control characters
+func encodeString(buf *bytes.Buffer, s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("string is not valid UTF-8: %q", s)
+	}
+
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+
+	return nil
+}
+
+// lessUTF16 orders two strings by their UTF-16 code units as required for object keys
+func lessUTF16(a, b string) bool {
+	ua := utf16.Encode([]rune(a))
+	ub := utf16.Encode([]rune(b))
+
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+
+	return len(ua) < len(ub)
+}
@@ -0,0 +1,135 @@
+package canonical
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+// TestMarshalRFC8785 checks the examples of RFC 8785 sections 3.2.2 and 3.2.3
+func TestMarshalRFC8785(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name: "json data",
+			input: `{
+				"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+				"string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+				"literals": [null, true, false]
+			}`,
+			want: `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			name: "sorting of properties",
+			input: `{
+				"\u20ac": "Euro Sign",
+				"\r": "Carriage Return",
+				"\ufb33": "Hebrew Letter Dalet With Dagesh",
+				"1": "One",
+				"\ud83d\ude00": "Emoji: Grinning Face",
+				"\u0080": "Control",
+				"\u00f6": "Latin Small Letter O With Diaeresis"
+			}`,
+			want: "{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001f600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			name:  "nested values and whitespace",
+			input: ` { "b" : [ { "d" : 1 , "c" : { } } , [ ] ] , "a" : "" } `,
+			want:  `{"a":"","b":[{"c":{},"d":1},[]]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.input), &value); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Marshal =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMarshalNumbers checks the IEEE 754 number samples of RFC 8785 appendix B
+func TestMarshalNumbers(t *testing.T) {
+	tests := []struct {
+		bits uint64
+		want string
+	}{
+		{0x0000000000000000, "0"},
+		{0x8000000000000000, "0"},
+		{0x0000000000000001, "5e-324"},
+		{0x8000000000000001, "-5e-324"},
+		{0x7fefffffffffffff, "1.7976931348623157e+308"},
+		{0xffefffffffffffff, "-1.7976931348623157e+308"},
+		{0x4340000000000000, "9007199254740992"},
+		{0xc340000000000000, "-9007199254740992"},
+		{0x4430000000000000, "295147905179352830000"},
+		{0x44b52d02c7e14af5, "9.999999999999997e+22"},
+		{0x44b52d02c7e14af6, "1e+23"},
+		{0x44b52d02c7e14af7, "1.0000000000000001e+23"},
+		{0x444b1ae4d6e2ef4e, "999999999999999700000"},
+		{0x444b1ae4d6e2ef4f, "999999999999999900000"},
+		{0x444b1ae4d6e2ef50, "1e+21"},
+		{0x3eb0c6f7a0b5ed8c, "9.999999999999997e-7"},
+		{0x3eb0c6f7a0b5ed8d, "0.000001"},
+		{0x41b3de4355555553, "333333333.3333332"},
+		{0x41b3de4355555554, "333333333.33333325"},
+		{0x41b3de4355555555, "333333333.3333333"},
+		{0x41b3de4355555556, "333333333.3333334"},
+		{0x41b3de4355555557, "333333333.33333343"},
+		{0xbecbf647612f3696, "-0.0000033333333333333333"},
+		{0x43143ff3c1cb0959, "1424953923781206.2"},
+	}
+
+	for _, tt := range tests {
+		got, err := Marshal(math.Float64frombits(tt.bits))
+		if err != nil {
+			t.Fatalf("%016x: %v", tt.bits, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%016x: Marshal = %s, want %s", tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"nan", math.NaN()},
+		{"infinity", math.Inf(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Marshal(tt.value); err == nil {
+				t.Fatalf("expected an error, got %s", got)
+			}
+		})
+	}
+}
+
+func TestHashIgnoresKeyOrder(t *testing.T) {
+	a, err := Hash(map[string]interface{}{"tx_type": "drug_create", "drug_id": "D1", "quantity": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Hash(map[string]interface{}{"quantity": 2.0, "drug_id": "D1", "tx_type": "drug_create"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatalf("hashes differ: %s and %s", a, b)
+	}
+}
@@ -1,95 +1,144 @@
 package handlers
 
 import (
-	"github.com/gofiber/fiber/v2"
-	"github.com/ankit/blockchain_ledger/storage"
-	"github.com/ankit/blockchain_ledger/blockchain"
+	"encoding/json"
+	"log"
+	"net/http"
 	"time"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/blockchain"
+	"github.com/ankit/blockchain_ledger/storage"
 )
 
 // BlockchainHandler handles blockchain-related API endpoints
 type BlockchainHandler struct {
-	Storage *storage.DataStorage
+	Storage    *storage.DataStorage
+	Blockchain *blockchain.BlockchainService
 }
 
 // NewBlockchainHandler creates a new blockchain handler
-func NewBlockchainHandler(storage *storage.DataStorage) *BlockchainHandler {
-	return &BlockchainHandler{Storage: storage}
+func NewBlockchainHandler(storage *storage.DataStorage, blockchainService *blockchain.BlockchainService) *BlockchainHandler {
+	return &BlockchainHandler{Storage: storage, Blockchain: blockchainService}
 }
 
 // GetStatus returns the current status of the blockchain
-func (h *BlockchainHandler) GetStatus(c *fiber.Ctx) error {
+func (h *BlockchainHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
 	// Get blockchain ledger
 	ledger, err := h.Storage.GetBlockchainLedger()
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to retrieve blockchain ledger",
-		})
+		log.Printf("Error retrieving blockchain ledger: %v", err)
+		http.Error(w, "Failed to retrieve blockchain ledger", http.StatusInternalServerError)
+		return
+	}
+
+	// Count transactions across all blocks
+	txCount := 0
+	for _, block := range ledger.Blocks {
+		txCount += len(block.Transactions)
 	}
 
 	// Return blockchain status
-	return c.JSON(fiber.Map{
-		"status": "active",
-		"block_height": ledger.BlockHeight,
-		"last_updated": ledger.LastUpdated,
-		"block_count": len(ledger.Blocks),
-		"timestamp": time.Now().Format(time.RFC3339),
-	})
+	response := map[string]interface{}{
+		"status":            "active",
+		"block_height":      ledger.BlockHeight,
+		"last_updated":      ledger.LastUpdated,
+		"block_count":       len(ledger.Blocks),
+		"transaction_count": txCount,
+		"timestamp":         time.Now().Format(time.RFC3339),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // VerifyTransaction verifies a blockchain transaction
-func (h *BlockchainHandler) VerifyTransaction(c *fiber.Ctx) error {
-	txHash := c.Params("tx_hash")
+func (h *BlockchainHandler) VerifyTransaction(w http.ResponseWriter, r *http.Request) {
+	txHash := r.URL.Path[len("/api/blockchain/verify/"):]
 	if txHash == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing transaction hash",
-		})
+		http.Error(w, "Missing transaction hash", http.StatusBadRequest)
+		return
 	}
 
-	// Get blockchain ledger
-	ledger, err := h.Storage.GetBlockchainLedger()
+	// Find transaction in blockchain through the transaction index
+	block, index, err := h.Storage.FindTransaction(txHash)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to retrieve blockchain ledger",
-		})
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
 	}
 
-	// Find transaction in blockchain
-	var txData map[string]interface{}
-	var blockHeight int
-	var timestamp string
+	txData, _ := block.Transactions[index].TxData.(map[string]interface{})
+	if txData == nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
 
-	for _, block := range ledger.Blocks {
-		if block.TxHash == txHash {
-			txData, _ = block.TxData.(map[string]interface{})
-			blockHeight = block.BlockHeight
-			timestamp = block.Timestamp
-			break
-		}
+	// Verify transaction hash and signature
+	isValid, err := h.Blockchain.VerifyTransaction(txHash)
+	if err != nil {
+		log.Printf("Error verifying transaction %s: %v", txHash, err)
+		http.Error(w, "Failed to verify transaction", http.StatusInternalServerError)
+		return
 	}
 
-	if txData == nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Transaction not found",
-		})
+	response := map[string]interface{}{
+		"tx_hash":      txHash,
+		"is_valid":     isValid,
+		"block_height": block.BlockHeight,
+		"timestamp":    block.Timestamp,
+		"signer_id":    txData["signer_id"],
+		"tx_data":      txData,
 	}
 
-	// Verify transaction
-	isValid := blockchain.ValidateTransaction(txHash, txData)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	return c.JSON(fiber.Map{
-		"tx_hash": txHash,
-		"is_valid": isValid,
-		"block_height": blockHeight,
-		"timestamp": timestamp,
-		"tx_data": txData,
-	})
+// GetProof returns the merkle inclusion proof for a blockchain transaction
+func (h *BlockchainHandler) GetProof(w http.ResponseWriter, r *http.Request) {
+	txHash := r.URL.Path[len("/api/blockchain/proof/"):]
+	if txHash == "" {
+		http.Error(w, "Missing transaction hash", http.StatusBadRequest)
+		return
+	}
+
+	proof, err := h.Blockchain.GetTransactionProof(txHash)
+	if err != nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// GetBlockHeaders returns the headers of all blocks for publication to partners
+func (h *BlockchainHandler) GetBlockHeaders(w http.ResponseWriter, r *http.Request) {
+	headers, err := h.Blockchain.GetBlockHeaders()
+	if err != nil {
+		log.Printf("Error retrieving block headers: %v", err)
+		http.Error(w, "Failed to retrieve block headers", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"headers": headers,
+		"count":   len(headers),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // RunConsistencyCheck runs a consistency check on the blockchain
-func (h *BlockchainHandler) RunConsistencyCheck(c *fiber.Ctx) error {
+func (h *BlockchainHandler) RunConsistencyCheck(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
 	// Run consistency check
 	result := h.Storage.RunConsistencyCheck()
 
-	return c.JSON(result)
-}
\ No newline at end of file
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/sync"
+)
+
+// DeadLetterPath is the prefix of the admin routes over failed webhook events
+const DeadLetterPath = "/api/admin/dead-letters"
+
+// DeadLetterHandler handles the admin API over the webhook work and dead-letter queues
+type DeadLetterHandler struct {
+	Webhooks *sync.WebhookHandler
+}
+
+// NewDeadLetterHandler creates a new dead-letter handler
+func NewDeadLetterHandler(webhookHandler *sync.WebhookHandler) *DeadLetterHandler {
+	return &DeadLetterHandler{Webhooks: webhookHandler}
+}
+
+// ListDeadLetters returns the dead-lettered events, optionally filtered by table, with
+// the queue metrics
+func (h *DeadLetterHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	letters, err := h.Webhooks.DeadLetters.List(r.URL.Query().Get("table"))
+	if err != nil {
+		log.Printf("Error listing dead letters: %v", err)
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := h.Webhooks.DeadLetters.Stats()
+	if err != nil {
+		log.Printf("Error retrieving dead-letter metrics: %v", err)
+		http.Error(w, "Failed to retrieve dead-letter metrics", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"dead_letters": letters,
+		"count":        len(letters),
+		"metrics":      stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetDeadLetterMetrics returns the depth of the dead-letter queue
+func (h *DeadLetterHandler) GetDeadLetterMetrics(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	stats, err := h.Webhooks.DeadLetters.Stats()
+	if err != nil {
+		log.Printf("Error retrieving dead-letter metrics: %v", err)
+		http.Error(w, "Failed to retrieve dead-letter metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetWebhookQueue returns the depth and settings of the webhook work queue
+func (h *DeadLetterHandler) GetWebhookQueue(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Webhooks.Queue.Stats())
+}
+
+// GetDeadLetter returns a dead-lettered event with its error history
+func (h *DeadLetterHandler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	id := deadLetterID(r)
+	letter, err := h.Webhooks.DeadLetters.Get(id)
+	if writeDeadLetterError(w, id, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letter)
+}
+
+// ReplayDeadLetter processes a dead-lettered event again and removes it once processed
+func (h *DeadLetterHandler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	id := deadLetterID(r)
+	letter, err := h.Webhooks.ReplayDeadLetter(id)
+	if errors.Is(err, sync.ErrDeadLetterNotFound) {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// The event stays queued with the failure added to its history
+		log.Printf("Error replaying dead letter %s: %v", id, err)
+		response := map[string]interface{}{
+			"error":       err.Error(),
+			"dead_letter": letter,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := map[string]interface{}{
+		"id":      id,
+		"message": "Dead letter replayed successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DiscardDeadLetter removes a dead-lettered event without processing it
+func (h *DeadLetterHandler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	id := deadLetterID(r)
+	if writeDeadLetterError(w, id, h.Webhooks.DeadLetters.Discard(id)) {
+		return
+	}
+	log.Printf("Discarded dead letter %s", id)
+
+	response := map[string]interface{}{
+		"id":      id,
+		"message": "Dead letter discarded successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deadLetterID extracts the dead letter ID from /api/admin/dead-letters/{id}[/replay]
+func deadLetterID(r *http.Request) string {
+	id := r.URL.Path[len(DeadLetterPath+"/"):]
+	return strings.TrimSuffix(id, "/replay")
+}
+
+// writeDeadLetterError writes the response for a failed dead-letter lookup or removal,
+// and reports whether it did
+func writeDeadLetterError(w http.ResponseWriter, id string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sync.ErrDeadLetterNotFound) {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return true
+	}
+	log.Printf("Error accessing dead letter %s: %v", id, err)
+	http.Error(w, "Failed to access dead letter", http.StatusInternalServerError)
+	return true
+}
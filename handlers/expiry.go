@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// GetUpcomingExpiry handles the report of stock expiring within a number of days, filtered
+// by manufacturer_id and distributor_id. Manufacturers and distributors only see their own
+// stock.
+func (h *Handler) GetUpcomingExpiry(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := models.ExpiryQuery{
+		ManufacturerID: params.Get("manufacturer_id"),
+		DistributorID:  params.Get("distributor_id"),
+	}
+	if value := params.Get("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			http.Error(w, "days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		query.Days = days
+	}
+
+	// Scope the report to the authenticated principal's organization
+	principal := auth.FromContext(r.Context())
+	principal.Bind(models.RoleManufacturer, nil, &query.ManufacturerID)
+	principal.Bind(models.RoleDistributor, nil, &query.DistributorID)
+
+	report, err := h.ledgerManager.GetExpiryReport(&query)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error reporting upcoming expiry: %v", err)
+		http.Error(w, "Failed to retrieve expiry report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// VerifyUnit handles the verification of a serialized unit by its GTIN and serial
+func (h *Handler) VerifyUnit(w http.ResponseWriter, r *http.Request) {
+	// Extract GTIN and serial from URL
+	gtin, serial, _ := strings.Cut(r.URL.Path[len("/api/verify/units/"):], "/")
+	if gtin == "" || serial == "" {
+		http.Error(w, "GTIN and serial are required", http.StatusBadRequest)
+		return
+	}
+
+	// Expired units fail verification rather than the request
+	isVerified, err := h.ledgerManager.VerifyUnit(gtin, serial)
+	expired := errors.Is(err, models.ErrDrugExpired)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return
+	}
+	if err != nil && !expired {
+		log.Printf("Error verifying unit %s: %v", models.UnitID(gtin, serial), err)
+		http.Error(w, "Failed to verify unit", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Unit verification completed"
+	if expired {
+		message = err.Error()
+	}
+	response := map[string]interface{}{
+		"gtin":        gtin,
+		"serial":      serial,
+		"is_verified": isVerified,
+		"expired":     expired,
+		"message":     message,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -2,11 +2,18 @@ package handlers
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/blockchain"
 	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
 	"github.com/ankit/blockchain_ledger/sync"
 	"github.com/google/uuid"
 )
@@ -15,19 +22,25 @@ import (
 type Handler struct {
 	ledgerManager models.LedgerManager
 	syncService   *sync.SyncService
+	blockchain    *blockchain.BlockchainService
+	keyStore      *blockchain.KeyStore
 }
 
 // NewHandler creates a new handler
-func NewHandler(ledgerManager models.LedgerManager, syncService *sync.SyncService) *Handler {
+func NewHandler(ledgerManager models.LedgerManager, syncService *sync.SyncService, blockchainService *blockchain.BlockchainService) *Handler {
 	return &Handler{
 		ledgerManager: ledgerManager,
 		syncService:   syncService,
+		blockchain:    blockchainService,
+		keyStore:      blockchainService.Keys(),
 	}
 }
 
-// SetupRoutes sets up the HTTP routes for the API
-func SetupRoutes(ledgerManager models.LedgerManager, syncService *sync.SyncService) {
-	handler := NewHandler(ledgerManager, syncService)
+// SetupRoutes sets up the HTTP routes for the API, including the blockchain and webhook routes
+func SetupRoutes(ledgerManager models.LedgerManager, syncService *sync.SyncService, blockchainService *blockchain.BlockchainService, dataStorage *storage.DataStorage, webhookHandler *sync.WebhookHandler) {
+	handler := NewHandler(ledgerManager, syncService, blockchainService)
+	blockchainHandler := NewBlockchainHandler(dataStorage, blockchainService)
+	deadLetterHandler := NewDeadLetterHandler(webhookHandler)
 
 	// Drug routes
 	http.HandleFunc("/api/drugs", func(w http.ResponseWriter, r *http.Request) {
@@ -42,16 +55,71 @@ func SetupRoutes(ledgerManager models.LedgerManager, syncService *sync.SyncServi
 	})
 
 	http.HandleFunc("/api/drugs/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/transactions"):
+			handler.GetDrugTransactions(w, r)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/provenance"):
+			handler.GetDrugProvenance(w, r)
+		case r.Method == http.MethodGet:
 			handler.GetDrug(w, r)
-		case http.MethodPut:
+		case r.Method == http.MethodPut:
 			handler.RevertDrug(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	// Lot and unit routes
+	http.HandleFunc("/api/lots", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handler.CreateLot(w, r)
+		case http.MethodGet:
+			handler.GetLots(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/lots/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/units"):
+			handler.UpdateUnitStatus(w, r)
+		case r.Method == http.MethodGet:
+			handler.GetLot(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/units/", getOnly(handler.GetUnit))
+
+	// Recall routes
+	http.HandleFunc("/api/recalls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handler.CreateRecall(w, r)
+		case http.MethodGet:
+			handler.GetRecalls(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/recalls/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/report"):
+			handler.GetRecallReport(w, r)
+		case r.Method == http.MethodGet:
+			handler.GetRecall(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Expiry routes
+	http.HandleFunc("/api/expiry/upcoming", getOnly(handler.GetUpcomingExpiry))
+
 	// Shipment routes
 	http.HandleFunc("/api/shipments", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -65,25 +133,151 @@ func SetupRoutes(ledgerManager models.LedgerManager, syncService *sync.SyncServi
 	})
 
 	http.HandleFunc("/api/shipments/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/transactions"):
+			handler.GetShipmentTransactions(w, r)
+		case r.Method == http.MethodGet:
 			handler.GetShipment(w, r)
-		case http.MethodPut:
+		case r.Method == http.MethodPut:
 			handler.UpdateShipmentStatus(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	// Prescription routes
+	http.HandleFunc("/api/prescriptions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handler.IssuePrescription(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/prescriptions/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/fill"):
+			handler.FillPrescription(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+			handler.CancelPrescription(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/expire"):
+			handler.ExpirePrescription(w, r)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/transactions"):
+			handler.GetPrescriptionTransactions(w, r)
+		case r.Method == http.MethodGet:
+			handler.GetPrescription(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	// Verification routes
 	http.HandleFunc("/api/verify/", handler.VerifyDrug)
+	http.HandleFunc("/api/verify/units/", getOnly(handler.VerifyUnit))
+
+	// Transaction index routes
+	http.HandleFunc("/api/transactions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			handler.GetTransactions(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/transactions/index/rebuild", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handler.RebuildTransactionIndex(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Organization signing key routes
+	http.HandleFunc("/api/organizations/keys", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handler.RegisterOrganizationKey(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/organizations/keys/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/rotate"):
+			handler.RotateOrganizationKey(w, r)
+		case r.Method == http.MethodGet:
+			handler.GetOrganizationKey(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
 	// Sync routes
 	http.HandleFunc("/api/sync/status", handler.GetSyncStatus)
 	http.HandleFunc("/api/sync/force", handler.ForceSync)
 
-	// Webhook route for real-time sync
-	http.HandleFunc("/api/webhook", handler.HandleWebhook)
+	// Blockchain routes
+	http.HandleFunc("/api/blockchain/status", getOnly(blockchainHandler.GetStatus))
+	http.HandleFunc("/api/blockchain/headers", getOnly(blockchainHandler.GetBlockHeaders))
+	http.HandleFunc("/api/blockchain/verify/", getOnly(blockchainHandler.VerifyTransaction))
+	http.HandleFunc("/api/blockchain/proof/", getOnly(blockchainHandler.GetProof))
+	http.HandleFunc("/api/blockchain/consistency-check", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			blockchainHandler.RunConsistencyCheck(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Dead-letter routes for webhook events that failed processing
+	http.HandleFunc(DeadLetterPath, getOnly(deadLetterHandler.ListDeadLetters))
+	http.HandleFunc(DeadLetterPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == DeadLetterPath+"/metrics":
+			deadLetterHandler.GetDeadLetterMetrics(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/replay"):
+			deadLetterHandler.ReplayDeadLetter(w, r)
+		case r.Method == http.MethodGet:
+			deadLetterHandler.GetDeadLetter(w, r)
+		case r.Method == http.MethodDelete:
+			deadLetterHandler.DiscardDeadLetter(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/admin/webhook-queue", getOnly(deadLetterHandler.GetWebhookQueue))
+
+	// Webhook route for real-time sync. /api/webhook is kept as an alias of the documented
+	// path so both share one handler, and one replay cache.
+	http.HandleFunc(WebhookPath, webhookHandler.HandleWebhook)
+	http.HandleFunc(legacyWebhookPath, webhookHandler.HandleWebhook)
+}
+
+// Webhook paths, which are authenticated by their signature rather than by the caller
+const (
+	WebhookPath       = "/api/webhooks/supabase"
+	legacyWebhookPath = "/api/webhook"
+)
+
+// PublicPaths lists the paths that skip request authentication. They are matched exactly,
+// so no other route under them is left unauthenticated.
+var PublicPaths = []string{WebhookPath, legacyWebhookPath}
+
+// getOnly restricts a handler to GET requests
+func getOnly(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handle(w, r)
+	}
 }
 
 // CreateDrug handles the creation of a new drug
@@ -94,6 +288,12 @@ func (h *Handler) CreateDrug(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, &params.ManufacturerID)
+	if !authorize(w, r, auth.ActionCreateDrug, params.ManufacturerID) {
+		return
+	}
+
 	// Generate drug ID if not provided
 	if params.DrugID == "" {
 		params.DrugID = uuid.New().String()
@@ -101,6 +301,9 @@ func (h *Handler) CreateDrug(w http.ResponseWriter, r *http.Request) {
 
 	verificationHash, err := h.ledgerManager.CreateDrug(&params)
 	if err != nil {
+		if writeLotError(w, err) {
+			return
+		}
 		log.Printf("Error creating drug: %v", err)
 		http.Error(w, "Failed to create drug", http.StatusInternalServerError)
 		return
@@ -117,16 +320,28 @@ func (h *Handler) CreateDrug(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetDrugs handles the retrieval of all drugs
+// GetDrugs handles the retrieval of a page of drugs, filtered by manufacturer_id,
+// distributor_id, status and a created_from/created_to range and sorted by sort and order
 func (h *Handler) GetDrugs(w http.ResponseWriter, r *http.Request) {
-	// This would typically query the database for all drugs
-	// For now, we'll return a placeholder response
-	response := map[string]interface{}{
-		"message": "Get drugs endpoint",
+	query, err := parseListQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.ledgerManager.ListDrugs(query)
+	if errors.Is(err, models.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing drugs: %v", err)
+		http.Error(w, "Failed to retrieve drugs", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(page)
 }
 
 // GetDrug handles the retrieval of a specific drug
@@ -138,15 +353,19 @@ func (h *Handler) GetDrug(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// This would typically query the database for the specific drug
-	// For now, we'll return a placeholder response
-	response := map[string]interface{}{
-		"drug_id": drugID,
-		"message": "Get drug endpoint",
+	drug, err := h.ledgerManager.GetDrug(drugID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Drug not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving drug %s: %v", drugID, err)
+		http.Error(w, "Failed to retrieve drug", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(drug)
 }
 
 // RevertDrug handles the reversion of a drug
@@ -166,7 +385,27 @@ func (h *Handler) RevertDrug(w http.ResponseWriter, r *http.Request) {
 
 	params.DrugID = drugID
 
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, &params.ManufacturerID)
+
+	// Only the manufacturer owning the drug may revert it
+	drug, err := h.ledgerManager.GetDrug(drugID)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error retrieving drug %s: %v", drugID, err)
+		http.Error(w, "Failed to revert drug", http.StatusInternalServerError)
+		return
+	}
+	if !authorize(w, r, auth.ActionRevertDrug, drug.ManufacturerID) {
+		return
+	}
+
 	if err := h.ledgerManager.RevertDrug(&params); err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
 		log.Printf("Error reverting drug: %v", err)
 		http.Error(w, "Failed to revert drug", http.StatusInternalServerError)
 		return
@@ -189,6 +428,27 @@ func (h *Handler) CreateShipment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, &params.ManufacturerID)
+
+	// Only the manufacturer owning the drug, or the lot, may ship it
+	ownerID, err := h.shipmentOwner(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error retrieving shipped drug or lot: %v", err)
+		http.Error(w, "Failed to create shipment", http.StatusInternalServerError)
+		return
+	}
+	if !authorize(w, r, auth.ActionCreateShipment, ownerID) {
+		return
+	}
+	if params.ManufacturerID != ownerID {
+		http.Error(w, "manufacturer_id does not match the manufacturer of the shipped drug", http.StatusBadRequest)
+		return
+	}
+
 	// Generate shipment ID if not provided
 	if params.ShipmentID == "" {
 		params.ShipmentID = uuid.New().String()
@@ -196,6 +456,9 @@ func (h *Handler) CreateShipment(w http.ResponseWriter, r *http.Request) {
 
 	txHash, err := h.ledgerManager.CreateShipment(&params)
 	if err != nil {
+		if writeLifecycleError(w, err) || writeLotError(w, err) {
+			return
+		}
 		log.Printf("Error creating shipment: %v", err)
 		http.Error(w, "Failed to create shipment", http.StatusInternalServerError)
 		return
@@ -212,16 +475,46 @@ func (h *Handler) CreateShipment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetShipments handles the retrieval of all shipments
+// shipmentOwner returns the manufacturer of the lot a shipment carries units of, or else
+// of the drug it carries
+func (h *Handler) shipmentOwner(params *models.CreateShipmentParams) (string, error) {
+	if params.LotID != "" {
+		lot, err := h.ledgerManager.GetLot(params.LotID)
+		if err != nil {
+			return "", err
+		}
+		return lot.ManufacturerID, nil
+	}
+
+	drug, err := h.ledgerManager.GetDrug(params.DrugID)
+	if err != nil {
+		return "", err
+	}
+	return drug.ManufacturerID, nil
+}
+
+// GetShipments handles the retrieval of a page of shipments, filtered by manufacturer_id,
+// distributor_id, status and a created_from/created_to range and sorted by sort and order
 func (h *Handler) GetShipments(w http.ResponseWriter, r *http.Request) {
-	// This would typically query the database for all shipments
-	// For now, we'll return a placeholder response
-	response := map[string]interface{}{
-		"message": "Get shipments endpoint",
+	query, err := parseListQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := h.ledgerManager.ListShipments(query)
+	if errors.Is(err, models.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing shipments: %v", err)
+		http.Error(w, "Failed to retrieve shipments", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(page)
 }
 
 // GetShipment handles the retrieval of a specific shipment
@@ -233,15 +526,56 @@ func (h *Handler) GetShipment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// This would typically query the database for the specific shipment
-	// For now, we'll return a placeholder response
-	response := map[string]interface{}{
-		"shipment_id": shipmentID,
-		"message":     "Get shipment endpoint",
+	shipment, err := h.ledgerManager.GetShipment(shipmentID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving shipment %s: %v", shipmentID, err)
+		http.Error(w, "Failed to retrieve shipment", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(shipment)
+}
+
+// parseListQuery reads the filter, sorting and pagination parameters of a list request
+func parseListQuery(r *http.Request) (*models.ListQuery, error) {
+	values := r.URL.Query()
+	query := &models.ListQuery{
+		ManufacturerID: values.Get("manufacturer_id"),
+		DistributorID:  values.Get("distributor_id"),
+		Status:         values.Get("status"),
+		SortBy:         values.Get("sort"),
+		Order:          values.Get("order"),
+		Cursor:         values.Get("cursor"),
+	}
+
+	if from := values.Get("created_from"); from != "" {
+		createdFrom, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_from: expected an RFC 3339 timestamp")
+		}
+		query.CreatedFrom = createdFrom
+	}
+	if to := values.Get("created_to"); to != "" {
+		createdTo, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid created_to: expected an RFC 3339 timestamp")
+		}
+		query.CreatedTo = createdTo
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit: expected a positive integer")
+		}
+		query.Limit = n
+	}
+
+	return query, nil
 }
 
 // UpdateShipmentStatus handles the update of a shipment's status
@@ -261,7 +595,27 @@ func (h *Handler) UpdateShipmentStatus(w http.ResponseWriter, r *http.Request) {
 
 	params.ShipmentID = shipmentID
 
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleDistributor, &params.UserID, nil)
+
+	// Only the distributor assigned to the shipment may advance it
+	shipment, err := h.ledgerManager.GetShipment(shipmentID)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error retrieving shipment %s: %v", shipmentID, err)
+		http.Error(w, "Failed to update shipment status", http.StatusInternalServerError)
+		return
+	}
+	if !authorize(w, r, auth.ActionUpdateShipment, shipment.DistributorID) {
+		return
+	}
+
 	if err := h.ledgerManager.UpdateShipmentStatus(&params); err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
 		log.Printf("Error updating shipment status: %v", err)
 		http.Error(w, "Failed to update shipment status", http.StatusInternalServerError)
 		return
@@ -277,6 +631,248 @@ func (h *Handler) UpdateShipmentStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// IssuePrescription handles the issuing of a new prescription
+func (h *Handler) IssuePrescription(w http.ResponseWriter, r *http.Request) {
+	var params models.IssuePrescriptionParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleDoctor, &params.UserID, &params.DoctorID)
+	if !authorize(w, r, auth.ActionIssuePrescription, params.DoctorID) {
+		return
+	}
+
+	// Generate prescription ID if not provided
+	if params.PrescriptionID == "" {
+		params.PrescriptionID = uuid.New().String()
+	}
+
+	txHash, err := h.ledgerManager.IssuePrescription(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error issuing prescription: %v", err)
+		http.Error(w, "Failed to issue prescription", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"prescription_id":  params.PrescriptionID,
+		"blockchain_tx_id": txHash,
+		"message":          "Prescription issued successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetPrescription handles the retrieval of a specific prescription
+func (h *Handler) GetPrescription(w http.ResponseWriter, r *http.Request) {
+	// Extract prescription ID from URL
+	prescriptionID := r.URL.Path[len("/api/prescriptions/"):]
+	if prescriptionID == "" {
+		http.Error(w, "Prescription ID is required", http.StatusBadRequest)
+		return
+	}
+
+	prescription, ok := h.authorizePrescription(w, r, auth.ActionReadPrescription, prescriptionID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prescription)
+}
+
+// FillPrescription handles dispensing some or all of the remaining units of a prescription
+func (h *Handler) FillPrescription(w http.ResponseWriter, r *http.Request) {
+	// Extract prescription ID from URL
+	prescriptionID := strings.TrimSuffix(r.URL.Path[len("/api/prescriptions/"):], "/fill")
+	if prescriptionID == "" {
+		http.Error(w, "Prescription ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var params models.FillPrescriptionParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params.PrescriptionID = prescriptionID
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RolePharmacy, &params.UserID, &params.PharmacyID)
+	if !authorize(w, r, auth.ActionFillPrescription, params.PharmacyID) {
+		return
+	}
+
+	prescription, err := h.ledgerManager.FillPrescription(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		if errors.Is(err, models.ErrInvalidFillQuantity) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error filling prescription: %v", err)
+		http.Error(w, "Failed to fill prescription", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"prescription_id":  prescription.ID,
+		"status":           prescription.Status,
+		"quantity_filled":  prescription.QuantityFilled,
+		"quantity":         prescription.Quantity,
+		"blockchain_tx_id": prescription.BlockchainTxID,
+		"message":          "Prescription filled successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CancelPrescription handles the cancellation of a prescription
+func (h *Handler) CancelPrescription(w http.ResponseWriter, r *http.Request) {
+	h.closePrescription(w, r, "/cancel", h.ledgerManager.CancelPrescription, "cancelled")
+}
+
+// ExpirePrescription handles marking a prescription as expired
+func (h *Handler) ExpirePrescription(w http.ResponseWriter, r *http.Request) {
+	h.closePrescription(w, r, "/expire", h.ledgerManager.ExpirePrescription, "expired")
+}
+
+// closePrescription handles moving a prescription to a final status
+func (h *Handler) closePrescription(w http.ResponseWriter, r *http.Request, suffix string, update func(*models.PrescriptionStatusParams) error, status string) {
+	// Extract prescription ID from URL
+	prescriptionID := strings.TrimSuffix(r.URL.Path[len("/api/prescriptions/"):], suffix)
+	if prescriptionID == "" {
+		http.Error(w, "Prescription ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var params models.PrescriptionStatusParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params.PrescriptionID = prescriptionID
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleDoctor, &params.UserID, nil)
+
+	// Only the prescribing doctor may cancel or expire a prescription
+	if _, ok := h.authorizePrescription(w, r, auth.ActionClosePrescription, prescriptionID); !ok {
+		return
+	}
+
+	if err := update(&params); err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error updating prescription %s: %v", prescriptionID, err)
+		http.Error(w, "Failed to update prescription", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"prescription_id": prescriptionID,
+		"status":          status,
+		"message":         fmt.Sprintf("Prescription %s successfully", status),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetPrescriptionTransactions handles the retrieval of all blockchain transactions for a prescription
+func (h *Handler) GetPrescriptionTransactions(w http.ResponseWriter, r *http.Request) {
+	// Extract prescription ID from URL
+	prescriptionID := strings.TrimSuffix(r.URL.Path[len("/api/prescriptions/"):], "/transactions")
+	if prescriptionID == "" {
+		http.Error(w, "Prescription ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := h.authorizePrescription(w, r, auth.ActionReadPrescription, prescriptionID); !ok {
+		return
+	}
+
+	h.writeIndexedTransactions(w, storage.IndexPrescription, prescriptionID)
+}
+
+// authorizePrescription loads a prescription and checks that the request principal may
+// perform an action on it as its prescribing doctor or patient. It writes the error
+// response and returns false if the prescription cannot be loaded or the action is denied.
+func (h *Handler) authorizePrescription(w http.ResponseWriter, r *http.Request, action, prescriptionID string) (*models.Prescription, bool) {
+	prescription, err := h.ledgerManager.GetPrescription(prescriptionID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Prescription not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error retrieving prescription %s: %v", prescriptionID, err)
+		http.Error(w, "Failed to retrieve prescription", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !authorize(w, r, action, prescription.DoctorID, prescription.PatientID) {
+		return nil, false
+	}
+	return prescription, true
+}
+
+// authorize checks the request principal against the access policy for an action on a
+// resource owned by any of the given organizations, writing a 403 response if it is denied
+func authorize(w http.ResponseWriter, r *http.Request, action string, owners ...string) bool {
+	if err := auth.Authorize(auth.FromContext(r.Context()), action, owners...); err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeLifecycleError writes the response for a ledger operation rejected because the
+// record does not exist or may not move to the requested state, and reports whether it did
+func writeLifecycleError(w http.ResponseWriter, err error) bool {
+	var transitionErr *models.TransitionError
+	if errors.As(err, &transitionErr) {
+		response := map[string]interface{}{
+			"error":               transitionErr.Error(),
+			"entity":              transitionErr.Entity,
+			"id":                  transitionErr.ID,
+			"current_status":      transitionErr.From,
+			"requested_status":    transitionErr.To,
+			"allowed_next_states": transitionErr.Allowed,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return true
+	}
+
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return true
+	}
+
+	if errors.Is(err, models.ErrPrescriptionExpired) || errors.Is(err, models.ErrDrugExpired) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return true
+	}
+
+	return false
+}
+
 // VerifyDrug handles the verification of a drug
 func (h *Handler) VerifyDrug(w http.ResponseWriter, r *http.Request) {
 	// Extract drug ID from URL
@@ -286,126 +882,277 @@ func (h *Handler) VerifyDrug(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Expired drugs fail verification rather than the request
 	isVerified, err := h.ledgerManager.VerifyDrug(drugID)
-	if err != nil {
+	expired := errors.Is(err, models.ErrDrugExpired)
+	if err != nil && !expired {
 		log.Printf("Error verifying drug: %v", err)
 		http.Error(w, "Failed to verify drug", http.StatusInternalServerError)
 		return
 	}
 
+	message := "Drug verification completed"
+	if expired {
+		message = err.Error()
+	}
 	response := map[string]interface{}{
 		"drug_id":     drugID,
 		"is_verified": isVerified,
-		"message":     "Drug verification completed",
+		"expired":     expired,
+		"message":     message,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// GetSyncStatus handles the retrieval of sync status
-func (h *Handler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
-	status := h.syncService.GetSyncStatus()
+// GetDrugTransactions handles the retrieval of all blockchain transactions for a drug
+func (h *Handler) GetDrugTransactions(w http.ResponseWriter, r *http.Request) {
+	// Extract drug ID from URL
+	drugID := strings.TrimSuffix(r.URL.Path[len("/api/drugs/"):], "/transactions")
+	if drugID == "" {
+		http.Error(w, "Drug ID is required", http.StatusBadRequest)
+		return
+	}
+
+	h.writeIndexedTransactions(w, storage.IndexDrug, drugID)
+}
+
+// GetDrugProvenance handles the retrieval of a drug's custody chain reconstructed from the blockchain
+func (h *Handler) GetDrugProvenance(w http.ResponseWriter, r *http.Request) {
+	// Extract drug ID from URL
+	drugID := strings.TrimSuffix(r.URL.Path[len("/api/drugs/"):], "/provenance")
+	if drugID == "" {
+		http.Error(w, "Drug ID is required", http.StatusBadRequest)
+		return
+	}
+
+	provenance, err := h.blockchain.GetDrugProvenance(drugID)
+	if errors.Is(err, blockchain.ErrNoProvenance) {
+		http.Error(w, "Drug provenance not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reconstructing provenance for drug %s: %v", drugID, err)
+		http.Error(w, "Failed to reconstruct drug provenance", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	json.NewEncoder(w).Encode(provenance)
 }
 
-// ForceSync handles the forcing of a sync operation
-func (h *Handler) ForceSync(w http.ResponseWriter, r *http.Request) {
-	if err := h.syncService.ForceSync(); err != nil {
-		log.Printf("Error forcing sync: %v", err)
-		http.Error(w, "Failed to force sync", http.StatusInternalServerError)
+// GetShipmentTransactions handles the retrieval of all blockchain transactions for a shipment
+func (h *Handler) GetShipmentTransactions(w http.ResponseWriter, r *http.Request) {
+	// Extract shipment ID from URL
+	shipmentID := strings.TrimSuffix(r.URL.Path[len("/api/shipments/"):], "/transactions")
+	if shipmentID == "" {
+		http.Error(w, "Shipment ID is required", http.StatusBadRequest)
+		return
+	}
+
+	h.writeIndexedTransactions(w, storage.IndexShipment, shipmentID)
+}
+
+// GetTransactions handles the retrieval of blockchain transactions by drug_id, lot_id, recall_id, shipment_id, prescription_id or actor
+func (h *Handler) GetTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("drug_id") != "":
+		h.writeIndexedTransactions(w, storage.IndexDrug, query.Get("drug_id"))
+	case query.Get("lot_id") != "":
+		h.writeIndexedTransactions(w, storage.IndexLot, query.Get("lot_id"))
+	case query.Get("recall_id") != "":
+		h.writeIndexedTransactions(w, storage.IndexRecall, query.Get("recall_id"))
+	case query.Get("shipment_id") != "":
+		h.writeIndexedTransactions(w, storage.IndexShipment, query.Get("shipment_id"))
+	case query.Get("prescription_id") != "":
+		if _, ok := h.authorizePrescription(w, r, auth.ActionReadPrescription, query.Get("prescription_id")); !ok {
+			return
+		}
+		h.writeIndexedTransactions(w, storage.IndexPrescription, query.Get("prescription_id"))
+	case query.Get("actor") != "":
+		h.writeIndexedTransactions(w, storage.IndexActor, query.Get("actor"))
+	default:
+		http.Error(w, "One of drug_id, lot_id, recall_id, shipment_id, prescription_id or actor is required", http.StatusBadRequest)
+	}
+}
+
+// RebuildTransactionIndex handles rebuilding the transaction index from the chain
+func (h *Handler) RebuildTransactionIndex(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
+	}
+
+	if err := h.blockchain.RebuildIndex(); err != nil {
+		log.Printf("Error rebuilding transaction index: %v", err)
+		http.Error(w, "Failed to rebuild transaction index", http.StatusInternalServerError)
 		return
 	}
 
 	response := map[string]interface{}{
-		"message": "Sync operation started",
+		"message": "Transaction index rebuilt successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeIndexedTransactions writes the transactions found under an index as the response
+func (h *Handler) writeIndexedTransactions(w http.ResponseWriter, kind, value string) {
+	txs, err := h.blockchain.GetTransactionsByIndex(kind, value)
+	if err != nil {
+		log.Printf("Error retrieving %s transactions for %s: %v", kind, value, err)
+		http.Error(w, "Failed to retrieve transactions", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"index":        kind,
+		"id":           value,
+		"transactions": txs,
+		"count":        len(txs),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// SupabaseWebhookPayload represents the structure of a Supabase webhook payload
-type SupabaseWebhookPayload struct {
-	Type      string                 `json:"type"`
-	Table     string                 `json:"table"`
-	Schema    string                 `json:"schema"`
-	Record    map[string]interface{} `json:"record"`
-	OldRecord map[string]interface{} `json:"old_record,omitempty"`
+// RegisterOrganizationKeyParams represents the parameters for registering an organization's signing key
+type RegisterOrganizationKeyParams struct {
+	OrganizationID string `json:"organization_id"`
+	Role           string `json:"role"` // manufacturer, distributor, pharmacy, doctor
+}
+
+// RegisterOrganizationKey handles the registration of an organization's first signing key,
+// a key pair generated and held by the service. The key takes the role of the caller,
+// unless an admin registers it on behalf of the organization.
+func (h *Handler) RegisterOrganizationKey(w http.ResponseWriter, r *http.Request) {
+	var params RegisterOrganizationKeyParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	principal := auth.FromContext(r.Context())
+	principal.BindRole(&params.Role)
+	if !authorize(w, r, auth.ActionRegisterKey, params.OrganizationID) {
+		return
+	}
+
+	key, err := h.keyStore.GenerateKey(params.OrganizationID, params.Role)
+	if errors.Is(err, blockchain.ErrKeyExists) {
+		http.Error(w, "Organization key is already registered; rotate it instead", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error registering organization key: %v", err)
+		http.Error(w, "Failed to register organization key", http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"organization_id": key.OrganizationID,
+		"role":            key.Role,
+		"key_id":          key.KeyID,
+		"public_key":      key.PublicKey,
+		"message":         "Organization key registered successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
 }
 
-// HandleWebhook handles webhook requests for real-time sync
-func (h *Handler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	// Log the incoming request details
-	log.Printf("Received webhook request:")
-	log.Printf("  Method: %s", r.Method)
-	log.Printf("  URL: %s", r.URL.String())
-	log.Printf("  RemoteAddr: %s", r.RemoteAddr)
-	log.Printf("  Headers: %v", r.Header)
+// RotateOrganizationKey handles the replacement of an organization's signing key with a new
+// key pair held by the service. The replaced key is retired and kept to verify the
+// transactions it signed.
+func (h *Handler) RotateOrganizationKey(w http.ResponseWriter, r *http.Request) {
+	// Extract organization ID from URL
+	organizationID := strings.TrimSuffix(r.URL.Path[len("/api/organizations/keys/"):], "/rotate")
+	if organizationID == "" {
+		http.Error(w, "Organization ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if !authorize(w, r, auth.ActionRotateKey, organizationID) {
+		return
+	}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
+	key, err := h.keyStore.RotateKey(organizationID)
+	if errors.Is(err, blockchain.ErrSignerNotRegistered) {
+		http.Error(w, "Organization key not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, blockchain.ErrKeyExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("Error reading webhook body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		log.Printf("Error rotating organization key: %v", err)
+		http.Error(w, "Failed to rotate organization key", http.StatusBadRequest)
 		return
 	}
-	defer r.Body.Close()
 
-	// Log the raw payload for debugging
-	log.Printf("Webhook payload: %s", string(body))
+	response := map[string]interface{}{
+		"organization_id": key.OrganizationID,
+		"role":            key.Role,
+		"key_id":          key.KeyID,
+		"public_key":      key.PublicKey,
+		"message":         "Organization key rotated successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetOrganizationKey handles the retrieval of an organization's active public signing key,
+// or of the key given by key_id, active or retired
+func (h *Handler) GetOrganizationKey(w http.ResponseWriter, r *http.Request) {
+	// Extract organization ID from URL
+	organizationID := r.URL.Path[len("/api/organizations/keys/"):]
+	if organizationID == "" {
+		http.Error(w, "Organization ID is required", http.StatusBadRequest)
+		return
+	}
 
-	// Parse the webhook payload
-	var payload SupabaseWebhookPayload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		log.Printf("Error parsing webhook payload: %v", err)
-		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+	var key *blockchain.OrganizationKey
+	var err error
+	if keyID := r.URL.Query().Get("key_id"); keyID != "" {
+		key, err = h.keyStore.GetKeyVersion(organizationID, keyID)
+	} else {
+		key, err = h.keyStore.GetPublicKey(organizationID)
+	}
+	if err != nil {
+		http.Error(w, "Organization key not found", http.StatusNotFound)
 		return
 	}
 
-	// Log the parsed payload
-	log.Printf("Webhook type: %s, Table: %s, Schema: %s", payload.Type, payload.Table, payload.Schema)
-	log.Printf("Record: %v", payload.Record)
-	if payload.OldRecord != nil {
-		log.Printf("Old Record: %v", payload.OldRecord)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
+
+// GetSyncStatus handles the retrieval of sync status
+func (h *Handler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	status := h.syncService.GetSyncStatus()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// ForceSync handles the forcing of a sync operation
+func (h *Handler) ForceSync(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, auth.ActionAdminister) {
+		return
 	}
 
-	// Handle different types of events
-	switch payload.Type {
-	case "INSERT":
-		log.Printf("New record inserted in table %s", payload.Table)
-		// Trigger sync for the affected table
-		if err := h.syncService.ForceSync(); err != nil {
-			log.Printf("Error syncing after webhook: %v", err)
-			http.Error(w, "Failed to sync after webhook", http.StatusInternalServerError)
-			return
-		}
-	case "UPDATE":
-		log.Printf("Record updated in table %s", payload.Table)
-		// Trigger sync for the affected table
-		if err := h.syncService.ForceSync(); err != nil {
-			log.Printf("Error syncing after webhook: %v", err)
-			http.Error(w, "Failed to sync after webhook", http.StatusInternalServerError)
-			return
-		}
-	case "DELETE":
-		log.Printf("Record deleted from table %s", payload.Table)
-		// Trigger sync for the affected table
-		if err := h.syncService.ForceSync(); err != nil {
-			log.Printf("Error syncing after webhook: %v", err)
-			http.Error(w, "Failed to sync after webhook", http.StatusInternalServerError)
-			return
-		}
-	default:
-		log.Printf("Unknown webhook type: %s", payload.Type)
+	if err := h.syncService.ForceSync(); err != nil {
+		log.Printf("Error forcing sync: %v", err)
+		http.Error(w, "Failed to force sync", http.StatusInternalServerError)
+		return
 	}
 
-	// Return success response
 	response := map[string]interface{}{
-		"message": "Webhook processed successfully",
-		"type":    payload.Type,
-		"table":   payload.Table,
+		"message": "Sync operation started",
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// fakeLedgerManager serves drugs and shipments from memory and moves them through the
+// lifecycle state machines
+type fakeLedgerManager struct {
+	models.LedgerManager
+	drugs     map[string]*models.DrugView
+	shipments map[string]*models.ShipmentView
+}
+
+func newFakeLedgerManager() *fakeLedgerManager {
+	return &fakeLedgerManager{
+		drugs: map[string]*models.DrugView{
+			"D1": {CommonDrugRecord: models.CommonDrugRecord{DrugID: "D1", ManufacturerID: "m1", CurrentStatus: models.DrugCreated}},
+			"D2": {CommonDrugRecord: models.CommonDrugRecord{DrugID: "D2", ManufacturerID: "m1", CurrentStatus: models.DrugDelivered}},
+		},
+		shipments: map[string]*models.ShipmentView{
+			"S1": {CommonShipmentRecord: models.CommonShipmentRecord{ShipmentID: "S1", DrugID: "D1", DistributorID: "d1", CurrentStatus: models.ShipmentCreated}},
+			"S2": {CommonShipmentRecord: models.CommonShipmentRecord{ShipmentID: "S2", DrugID: "D2", DistributorID: "d1", CurrentStatus: models.ShipmentDelivered}},
+		},
+	}
+}
+
+func (f *fakeLedgerManager) GetDrug(drugID string) (*models.DrugView, error) {
+	if drug, ok := f.drugs[drugID]; ok {
+		return drug, nil
+	}
+	return nil, fmt.Errorf("%w: drug %s", models.ErrRecordNotFound, drugID)
+}
+
+func (f *fakeLedgerManager) RevertDrug(params *models.RevertDrugParams) error {
+	drug, err := f.GetDrug(params.DrugID)
+	if err != nil {
+		return err
+	}
+	if err := models.CheckDrugTransition(params.DrugID, drug.CurrentStatus, models.DrugReverted); err != nil {
+		return err
+	}
+	drug.CurrentStatus = models.DrugReverted
+	return nil
+}
+
+func (f *fakeLedgerManager) GetShipment(shipmentID string) (*models.ShipmentView, error) {
+	if shipment, ok := f.shipments[shipmentID]; ok {
+		return shipment, nil
+	}
+	return nil, fmt.Errorf("%w: shipment %s", models.ErrRecordNotFound, shipmentID)
+}
+
+func (f *fakeLedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatusParams) error {
+	shipment, err := f.GetShipment(params.ShipmentID)
+	if err != nil {
+		return err
+	}
+	if err := models.CheckShipmentTransition(params.ShipmentID, shipment.CurrentStatus, params.Status); err != nil {
+		return err
+	}
+	shipment.CurrentStatus = params.Status
+	return nil
+}
+
+// serve calls a handler with a JSON body as the given principal
+func serve(handle http.HandlerFunc, method, path, body string, principal *auth.Principal) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = r.WithContext(auth.WithPrincipal(r.Context(), principal))
+	w := httptest.NewRecorder()
+	handle(w, r)
+	return w
+}
+
+func TestIllegalTransitionsReturnConflict(t *testing.T) {
+	manufacturer := &auth.Principal{UserID: "user-m1", Role: models.RoleManufacturer, OrganizationID: "m1"}
+	distributor := &auth.Principal{UserID: "user-d1", Role: models.RoleDistributor, OrganizationID: "d1"}
+
+	tests := []struct {
+		name      string
+		call      func(h *Handler) *httptest.ResponseRecorder
+		status    int
+		current   string
+		requested string
+		allowed   []string
+	}{
+		{
+			name: "shipment picked up",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.UpdateShipmentStatus, http.MethodPut, "/api/shipments/S1", `{"status":"picked_up"}`, distributor)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "shipment delivered before it was picked up",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.UpdateShipmentStatus, http.MethodPut, "/api/shipments/S1", `{"status":"delivered"}`, distributor)
+			},
+			status:    http.StatusConflict,
+			current:   models.ShipmentCreated,
+			requested: models.ShipmentDelivered,
+			allowed:   []string{models.ShipmentPickedUp, models.ShipmentFailed},
+		},
+		{
+			name: "delivered shipment moved again",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.UpdateShipmentStatus, http.MethodPut, "/api/shipments/S2", `{"status":"in_transit"}`, distributor)
+			},
+			status:    http.StatusConflict,
+			current:   models.ShipmentDelivered,
+			requested: models.ShipmentInTransit,
+			allowed:   []string{},
+		},
+		{
+			name: "unknown shipment",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.UpdateShipmentStatus, http.MethodPut, "/api/shipments/S3", `{"status":"picked_up"}`, distributor)
+			},
+			status: http.StatusNotFound,
+		},
+		{
+			name: "created drug reverted",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.RevertDrug, http.MethodPut, "/api/drugs/D1", `{"reason":"mislabelled"}`, manufacturer)
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "delivered drug reverted",
+			call: func(h *Handler) *httptest.ResponseRecorder {
+				return serve(h.RevertDrug, http.MethodPut, "/api/drugs/D2", `{"reason":"mislabelled"}`, manufacturer)
+			},
+			status:    http.StatusConflict,
+			current:   models.DrugDelivered,
+			requested: models.DrugReverted,
+			allowed:   models.DrugTransitions[models.DrugDelivered],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{ledgerManager: newFakeLedgerManager()}
+			w := tt.call(h)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusConflict {
+				return
+			}
+
+			var response struct {
+				Current   string   `json:"current_status"`
+				Requested string   `json:"requested_status"`
+				Allowed   []string `json:"allowed_next_states"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Current != tt.current || response.Requested != tt.requested || fmt.Sprint(response.Allowed) != fmt.Sprint(tt.allowed) {
+				t.Fatalf("response = %+v, want %s to %s with allowed %v", response, tt.current, tt.requested, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// Idempotency headers. A mutating request sent with an Idempotency-Key is applied once;
+// repeating it with the same key returns the stored response, marked with Idempotent-Replayed.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	maxIdempotentBodySize    = 1 << 20 // largest request body fingerprinted, in bytes
+)
+
+// Idempotent makes every mutating request carrying an Idempotency-Key header safe to
+// retry. Keys are scoped to the authenticated principal, so it must run after
+// authentication. Responses with a server error are not stored, so those requests can
+// be retried with the same key.
+func Idempotent(store *storage.IdempotencyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		// Read the body to fingerprint the request, then restore it for the handler
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scopedKey := idempotencyScope(r) + "\n" + key
+		fingerprint := requestFingerprint(r, body)
+		stored, err := store.Begin(scopedKey, fingerprint)
+		switch {
+		case errors.Is(err, storage.ErrIdempotencyKeyReused):
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, storage.ErrIdempotencyKeyInFlight):
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("Error checking idempotency key: %v", err)
+			http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+			return
+		case stored != nil:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		// Run the request, keeping a copy of its response
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				store.Release(scopedKey)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= http.StatusInternalServerError {
+			return
+		}
+		response := &storage.IdempotentResponse{
+			Fingerprint: fingerprint,
+			StatusCode:  recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}
+		if err := store.Complete(scopedKey, response); err != nil {
+			log.Printf("Warning: Failed to store response for idempotency key: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// isMutating reports whether a request method changes state
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// idempotencyScope returns the caller an idempotency key belongs to
+func idempotencyScope(r *http.Request) string {
+	principal := auth.FromContext(r.Context())
+	if principal == nil {
+		return "anonymous"
+	}
+	return principal.Role + ":" + principal.UserID
+}
+
+// requestFingerprint hashes the method, URL and body of a request
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder writes a response through while keeping its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+// WriteHeader records the status code
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
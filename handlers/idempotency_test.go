@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+func TestIdempotent(t *testing.T) {
+	store, err := storage.NewIdempotencyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler counts its calls, and fails on paths containing "fail"
+	calls := 0
+	handler := Idempotent(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if strings.Contains(r.URL.Path, "fail") {
+			http.Error(w, "Failed to create drug", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"call":%d}`, calls)
+	}))
+
+	manufacturer := &auth.Principal{UserID: "user-m1", Role: models.RoleManufacturer, OrganizationID: "m1"}
+	otherManufacturer := &auth.Principal{UserID: "user-m2", Role: models.RoleManufacturer, OrganizationID: "m2"}
+
+	// Each request is sent after the ones before it
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		path      string
+		key       string
+		body      string
+		status    int
+		response  string
+		replayed  bool
+		calls     int
+	}{
+		{"first request", manufacturer, "/api/drugs", "key-1", `{"drug_id":"D1"}`, http.StatusCreated, `{"call":1}`, false, 1},
+		{"retried request", manufacturer, "/api/drugs", "key-1", `{"drug_id":"D1"}`, http.StatusCreated, `{"call":1}`, true, 1},
+		{"reused key with another body", manufacturer, "/api/drugs", "key-1", `{"drug_id":"D2"}`, http.StatusUnprocessableEntity, "", false, 1},
+		{"reused key on another path", manufacturer, "/api/lots", "key-1", `{"drug_id":"D1"}`, http.StatusUnprocessableEntity, "", false, 1},
+		{"same key of another caller", otherManufacturer, "/api/drugs", "key-1", `{"drug_id":"D2"}`, http.StatusCreated, `{"call":2}`, false, 2},
+		{"no key", manufacturer, "/api/drugs", "", `{"drug_id":"D1"}`, http.StatusCreated, `{"call":3}`, false, 3},
+		{"server error", manufacturer, "/api/fail", "key-2", `{}`, http.StatusInternalServerError, "", false, 4},
+		{"server error retried", manufacturer, "/api/fail", "key-2", `{}`, http.StatusInternalServerError, "", false, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			r = r.WithContext(auth.WithPrincipal(r.Context(), tt.principal))
+			if tt.key != "" {
+				r.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.response != "" && w.Body.String() != tt.response {
+				t.Fatalf("body = %s, want %s", w.Body.String(), tt.response)
+			}
+			if replayed := w.Header().Get(IdempotentReplayedHeader) == "true"; replayed != tt.replayed {
+				t.Fatalf("replayed = %v, want %v", replayed, tt.replayed)
+			}
+			if calls != tt.calls {
+				t.Fatalf("handler called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
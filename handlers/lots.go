@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/google/uuid"
+)
+
+// CreateLot handles the creation of a lot of serialized units of a drug
+func (h *Handler) CreateLot(w http.ResponseWriter, r *http.Request) {
+	var params models.CreateLotParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, &params.ManufacturerID)
+	if !authorize(w, r, auth.ActionCreateDrug, params.ManufacturerID) {
+		return
+	}
+
+	// Generate lot ID if not provided
+	if params.LotID == "" {
+		params.LotID = uuid.New().String()
+	}
+
+	txHash, err := h.ledgerManager.CreateLot(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) || writeLotError(w, err) {
+			return
+		}
+		log.Printf("Error creating lot: %v", err)
+		http.Error(w, "Failed to create lot", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"lot_id":           params.LotID,
+		"blockchain_tx_id": txHash,
+		"message":          "Lot created successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetLots handles the retrieval of lots, filtered by drug_id and manufacturer_id
+func (h *Handler) GetLots(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lots, err := h.ledgerManager.ListLots(query.Get("drug_id"), query.Get("manufacturer_id"))
+	if err != nil {
+		log.Printf("Error listing lots: %v", err)
+		http.Error(w, "Failed to retrieve lots", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"lots":  lots,
+		"count": len(lots),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetLot handles the retrieval of a specific lot and its units
+func (h *Handler) GetLot(w http.ResponseWriter, r *http.Request) {
+	// Extract lot ID from URL
+	lotID := r.URL.Path[len("/api/lots/"):]
+	if lotID == "" {
+		http.Error(w, "Lot ID is required", http.StatusBadRequest)
+		return
+	}
+
+	lot, err := h.ledgerManager.GetLot(lotID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Lot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving lot %s: %v", lotID, err)
+		http.Error(w, "Failed to retrieve lot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lot)
+}
+
+// UpdateUnitStatus handles the status update of units of a lot, selected by serials or
+// by a serial_from/serial_to range
+func (h *Handler) UpdateUnitStatus(w http.ResponseWriter, r *http.Request) {
+	// Extract lot ID from URL
+	lotID := strings.TrimSuffix(r.URL.Path[len("/api/lots/"):], "/units")
+	if lotID == "" {
+		http.Error(w, "Lot ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var params models.UpdateUnitStatusParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params.LotID = lotID
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, nil)
+
+	// Only the manufacturer owning the lot may update its units
+	lot, err := h.ledgerManager.GetLot(lotID)
+	if err != nil {
+		if writeLifecycleError(w, err) {
+			return
+		}
+		log.Printf("Error retrieving lot %s: %v", lotID, err)
+		http.Error(w, "Failed to update unit status", http.StatusInternalServerError)
+		return
+	}
+	if !authorize(w, r, auth.ActionUpdateUnit, lot.ManufacturerID) {
+		return
+	}
+
+	txHash, err := h.ledgerManager.UpdateUnitStatus(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) || writeLotError(w, err) {
+			return
+		}
+		log.Printf("Error updating unit status: %v", err)
+		http.Error(w, "Failed to update unit status", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"lot_id":           lotID,
+		"status":           params.Status,
+		"blockchain_tx_id": txHash,
+		"message":          "Unit status updated successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetUnit handles the retrieval of a serialized unit by its GTIN and serial
+func (h *Handler) GetUnit(w http.ResponseWriter, r *http.Request) {
+	// Extract GTIN and serial from URL
+	gtin, serial, _ := strings.Cut(r.URL.Path[len("/api/units/"):], "/")
+	if gtin == "" || serial == "" {
+		http.Error(w, "GTIN and serial are required", http.StatusBadRequest)
+		return
+	}
+
+	unit, err := h.ledgerManager.GetUnit(gtin, serial)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving unit %s: %v", models.UnitID(gtin, serial), err)
+		http.Error(w, "Failed to retrieve unit", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(unit)
+}
+
+// writeLotError writes the response for a ledger operation rejected because of an invalid
+// lot, unit selection or date, and reports whether it did
+func writeLotError(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, models.ErrInvalidLot) || errors.Is(err, models.ErrInvalidDate) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	return false
+}
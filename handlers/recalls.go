@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/auth"
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/google/uuid"
+)
+
+// CreateRecall handles a recall of a manufacturer's drugs and units, optionally narrowed
+// to a lot and to an expiry_from/expiry_to window
+func (h *Handler) CreateRecall(w http.ResponseWriter, r *http.Request) {
+	var params models.CreateRecallParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Act as the authenticated principal rather than the IDs in the payload
+	auth.FromContext(r.Context()).Bind(models.RoleManufacturer, &params.UserID, &params.ManufacturerID)
+
+	// A lot recall belongs to the lot's manufacturer
+	if params.LotID != "" {
+		lot, err := h.ledgerManager.GetLot(params.LotID)
+		if err != nil {
+			if writeLifecycleError(w, err) {
+				return
+			}
+			log.Printf("Error retrieving lot %s: %v", params.LotID, err)
+			http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+			return
+		}
+		if params.ManufacturerID == "" {
+			params.ManufacturerID = lot.ManufacturerID
+		}
+	}
+	if !authorize(w, r, auth.ActionCreateRecall, params.ManufacturerID) {
+		return
+	}
+
+	// Generate recall ID if not provided
+	if params.RecallID == "" {
+		params.RecallID = uuid.New().String()
+	}
+
+	recall, err := h.ledgerManager.CreateRecall(&params)
+	if err != nil {
+		if writeLifecycleError(w, err) || writeLotError(w, err) {
+			return
+		}
+		if errors.Is(err, models.ErrInvalidRecall) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error creating recall: %v", err)
+		http.Error(w, "Failed to create recall", http.StatusInternalServerError)
+		return
+	}
+
+	unitCount := 0
+	for _, lot := range recall.Lots {
+		unitCount += len(lot.Serials)
+	}
+	response := map[string]interface{}{
+		"recall_id":      recall.RecallID,
+		"drug_count":     len(recall.DrugIDs),
+		"lot_count":      len(recall.Lots),
+		"unit_count":     unitCount,
+		"shipment_count": len(recall.ShipmentIDs),
+		"message":        "Recall created successfully",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetRecalls handles the retrieval of recalls, filtered by manufacturer_id
+func (h *Handler) GetRecalls(w http.ResponseWriter, r *http.Request) {
+	recalls, err := h.ledgerManager.ListRecalls(r.URL.Query().Get("manufacturer_id"))
+	if err != nil {
+		log.Printf("Error listing recalls: %v", err)
+		http.Error(w, "Failed to retrieve recalls", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"recalls": recalls,
+		"count":   len(recalls),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetRecall handles the retrieval of a specific recall
+func (h *Handler) GetRecall(w http.ResponseWriter, r *http.Request) {
+	// Extract recall ID from URL
+	recallID := r.URL.Path[len("/api/recalls/"):]
+	if recallID == "" {
+		http.Error(w, "Recall ID is required", http.StatusBadRequest)
+		return
+	}
+
+	recall, err := h.ledgerManager.GetRecall(recallID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Recall not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving recall %s: %v", recallID, err)
+		http.Error(w, "Failed to retrieve recall", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recall)
+}
+
+// GetRecallReport handles the retrieval of the status report of a recall
+func (h *Handler) GetRecallReport(w http.ResponseWriter, r *http.Request) {
+	// Extract recall ID from URL
+	recallID := strings.TrimSuffix(r.URL.Path[len("/api/recalls/"):], "/report")
+	if recallID == "" {
+		http.Error(w, "Recall ID is required", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.ledgerManager.GetRecallReport(recallID)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		http.Error(w, "Recall not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reporting on recall %s: %v", recallID, err)
+		http.Error(w, "Failed to retrieve recall report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
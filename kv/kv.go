@@ -0,0 +1,540 @@
+// Package kv implements a small embedded key-value store. Keys are grouped into
+// buckets and every batch of writes is appended to a single checksummed log file.
+// An in-memory index of value positions is rebuilt when the file is opened, and
+// Compact rewrites the file with only the live values.
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned when a key does not exist in a bucket
+var ErrNotFound = errors.New("key not found")
+
+// recordHeaderSize is the size of the length and checksum prefix of every record
+const recordHeaderSize = 8
+
+// MaxRecordSize is the largest batch record, so a corrupt length read at startup cannot
+// force a huge allocation
+const MaxRecordSize = 256 << 20
+
+// Operation types of a batch
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord marks a record that was only partially written or fails its checksum
+var errTornRecord = errors.New("torn or corrupt record")
+
+// valuePosition locates a value inside the log file
+type valuePosition struct {
+	offset int64
+	length int
+}
+
+// operation is a single put or delete of a batch
+type operation struct {
+	kind   byte
+	bucket string
+	key    string
+	value  []byte
+}
+
+// DB is an open key-value store. It is safe for concurrent use by multiple goroutines
+// of one process; the file must not be opened by more than one process at a time.
+type DB struct {
+	mu         sync.RWMutex
+	Path       string
+	file       *os.File
+	size       int64
+	staleBytes int64
+	index      map[string]map[string]valuePosition
+}
+
+// Open opens the store at the given path, creating it if needed. A torn record at the
+// end of the file, left by a crash during a write, is truncated; a bad record anywhere
+// else is corruption, and the store refuses to open rather than drop the batches after it.
+func Open(path string) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	db := &DB{
+		Path:  path,
+		file:  file,
+		index: make(map[string]map[string]valuePosition),
+	}
+
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// load scans the log file and rebuilds the index
+func (db *DB) load() error {
+	if _, err := db.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", db.Path, err)
+	}
+
+	var offset int64
+	for {
+		payload, err := readRecord(db.file, MaxRecordSize)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			torn, tailErr := db.tornTail(offset)
+			if tailErr != nil {
+				return tailErr
+			}
+			if !torn {
+				return fmt.Errorf("%s is corrupt at offset %d: %v", db.Path, offset, err)
+			}
+
+			log.Printf("Warning: truncating torn record at offset %d of %s", offset, db.Path)
+			if err := db.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate %s: %v", db.Path, err)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", db.Path, err)
+		}
+
+		ops, positions, err := decodeBatch(payload, offset+recordHeaderSize)
+		if err != nil {
+			return fmt.Errorf("corrupt record at offset %d of %s: %v", offset, db.Path, err)
+		}
+		db.apply(ops, positions)
+
+		offset += recordHeaderSize + int64(len(payload))
+	}
+
+	if _, err := db.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", db.Path, err)
+	}
+	db.size = offset
+	return nil
+}
+
+// tornTail reports whether the bad record at an offset is the tail torn by an interrupted
+// write: a record that extends to, or past, the end of the file with a length a write
+// could have produced, or a run of zeros left by a size extended before its data reached
+// the disk
+func (db *DB) tornTail(offset int64) (bool, error) {
+	info, err := db.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %v", db.Path, err)
+	}
+	rest := info.Size() - offset
+
+	zeros, err := allZeros(io.NewSectionReader(db.file, offset, rest))
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", db.Path, err)
+	}
+	if zeros || rest < recordHeaderSize {
+		return true, nil
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := db.file.ReadAt(header, offset); err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", db.Path, err)
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length == 0 || length > MaxRecordSize {
+		return false, nil
+	}
+	return recordHeaderSize+length >= rest, nil
+}
+
+// allZeros reports whether every byte read from r is zero
+func allZeros(r io.Reader) (bool, error) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// apply updates the index with the operations of a batch written at the given positions
+func (db *DB) apply(ops []operation, positions []valuePosition) {
+	for i, op := range ops {
+		// Approximate the space held by the superseded value and by tombstones
+		overhead := int64(recordHeaderSize + len(op.bucket) + len(op.key))
+		bucket := db.index[op.bucket]
+		if old, ok := bucket[op.key]; ok {
+			db.staleBytes += overhead + int64(old.length)
+		}
+		if op.kind == opDelete {
+			db.staleBytes += overhead
+		}
+
+		switch op.kind {
+		case opPut:
+			if bucket == nil {
+				bucket = make(map[string]valuePosition)
+				db.index[op.bucket] = bucket
+			}
+			bucket[op.key] = positions[i]
+		case opDelete:
+			delete(bucket, op.key)
+		}
+	}
+}
+
+// Get returns the value of a key in a bucket
+func (db *DB) Get(bucket, key string) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.file == nil {
+		return nil, fmt.Errorf("store %s is closed", db.Path)
+	}
+
+	pos, ok := db.index[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value := make([]byte, pos.length)
+	if _, err := db.file.ReadAt(value, pos.offset); err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s: %v", bucket, key, err)
+	}
+
+	return value, nil
+}
+
+// Keys returns the keys of a bucket in ascending order
+func (db *DB) Keys(bucket string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	keys := make([]string, 0, len(db.index[bucket]))
+	for key := range db.index[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Count returns the number of keys in a bucket
+func (db *DB) Count(bucket string) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.index[bucket])
+}
+
+// Put stores a value under a key in a bucket
+func (db *DB) Put(bucket, key string, value []byte) error {
+	return db.Update(func(b *Batch) error {
+		b.Put(bucket, key, value)
+		return nil
+	})
+}
+
+// Delete removes a key from a bucket
+func (db *DB) Delete(bucket, key string) error {
+	return db.Update(func(b *Batch) error {
+		b.Delete(bucket, key)
+		return nil
+	})
+}
+
+// Batch collects writes that are committed atomically by Update
+type Batch struct {
+	ops []operation
+}
+
+// Put adds a put of a value to the batch
+func (b *Batch) Put(bucket, key string, value []byte) {
+	b.ops = append(b.ops, operation{kind: opPut, bucket: bucket, key: key, value: append([]byte(nil), value...)})
+}
+
+// Delete adds a delete of a key to the batch
+func (b *Batch) Delete(bucket, key string) {
+	b.ops = append(b.ops, operation{kind: opDelete, bucket: bucket, key: key})
+}
+
+// Update runs fn to fill a batch and writes the batch as a single record. Either all
+// writes of the batch survive a crash or none do. Nothing is written if fn fails.
+func (db *DB) Update(fn func(b *Batch) error) error {
+	var batch Batch
+	if err := fn(&batch); err != nil {
+		return err
+	}
+	if len(batch.ops) == 0 {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file == nil {
+		return fmt.Errorf("store %s is closed", db.Path)
+	}
+
+	payload, positions := encodeBatch(batch.ops, db.size+recordHeaderSize)
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("batch of %d bytes exceeds the record size limit of %d bytes", len(payload), MaxRecordSize)
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+
+	// Undo a partial write, so the next record does not land in front of its remains
+	if _, err := db.file.WriteAt(record, db.size); err != nil {
+		db.file.Truncate(db.size)
+		return fmt.Errorf("failed to write to %s: %v", db.Path, err)
+	}
+	if err := db.file.Sync(); err != nil {
+		db.file.Truncate(db.size)
+		return fmt.Errorf("failed to sync %s: %v", db.Path, err)
+	}
+
+	db.size += int64(len(record))
+	db.apply(batch.ops, positions)
+	return nil
+}
+
+// Size returns the size of the log file and the approximate number of bytes held by
+// overwritten or deleted values
+func (db *DB) Size() (int64, int64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.size, db.staleBytes
+}
+
+// Compact rewrites the log file with only the live value of every key
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file == nil {
+		return fmt.Errorf("store %s is closed", db.Path)
+	}
+
+	tmpPath := db.Path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+
+	// Write every live value as its own put record
+	index := make(map[string]map[string]valuePosition, len(db.index))
+	var size int64
+	buckets := make([]string, 0, len(db.index))
+	for bucket := range db.index {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+
+	for _, bucket := range buckets {
+		index[bucket] = make(map[string]valuePosition, len(db.index[bucket]))
+		for key, pos := range db.index[bucket] {
+			value := make([]byte, pos.length)
+			if _, err := db.file.ReadAt(value, pos.offset); err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return fmt.Errorf("failed to read %s/%s: %v", bucket, key, err)
+			}
+
+			payload, positions := encodeBatch([]operation{{kind: opPut, bucket: bucket, key: key, value: value}}, size+recordHeaderSize)
+			record := make([]byte, recordHeaderSize+len(payload))
+			binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+			binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+			copy(record[recordHeaderSize:], payload)
+
+			if _, err := tmp.WriteAt(record, size); err != nil {
+				tmp.Close()
+				os.Remove(tmpPath)
+				return fmt.Errorf("failed to write %s: %v", tmpPath, err)
+			}
+			index[bucket][key] = positions[0]
+			size += int64(len(record))
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, db.Path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %s: %v", db.Path, err)
+	}
+
+	db.file.Close()
+	db.file = tmp
+	db.size = size
+	db.staleBytes = 0
+	db.index = index
+	return nil
+}
+
+// Close closes the log file
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file == nil {
+		return nil
+	}
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
+
+// readRecord reads and checksums the next record of the log file. Records longer than
+// maxLength are rejected before their payload is allocated.
+func readRecord(r io.Reader, maxLength int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: short header (%d bytes)", errTornRecord, n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length == 0 {
+		return nil, fmt.Errorf("%w: empty record", errTornRecord)
+	}
+	if int64(length) > maxLength {
+		return nil, fmt.Errorf("%w: record length %d exceeds %d", errTornRecord, length, maxLength)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: short payload", errTornRecord)
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+
+	return payload, nil
+}
+
+// encodeBatch encodes the operations of a batch as a record payload. It also returns
+// the position every value will have once the payload is written at base.
+func encodeBatch(ops []operation, base int64) ([]byte, []valuePosition) {
+	var buf bytes.Buffer
+	positions := make([]valuePosition, len(ops))
+
+	writeUvarint(&buf, uint64(len(ops)))
+	for i, op := range ops {
+		buf.WriteByte(op.kind)
+		writeUvarint(&buf, uint64(len(op.bucket)))
+		buf.WriteString(op.bucket)
+		writeUvarint(&buf, uint64(len(op.key)))
+		buf.WriteString(op.key)
+		writeUvarint(&buf, uint64(len(op.value)))
+		positions[i] = valuePosition{offset: base + int64(buf.Len()), length: len(op.value)}
+		buf.Write(op.value)
+	}
+
+	return buf.Bytes(), positions
+}
+
+// decodeBatch decodes a record payload written at base into its operations and the
+// positions of their values. Values are not retained; only their positions are.
+func decodeBatch(payload []byte, base int64) ([]operation, []valuePosition, error) {
+	r := bytes.NewReader(payload)
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid operation count: %v", err)
+	}
+	if count > uint64(len(payload)) {
+		return nil, nil, fmt.Errorf("invalid operation count %d", count)
+	}
+
+	ops := make([]operation, 0, count)
+	positions := make([]valuePosition, 0, count)
+	for i := uint64(0); i < count; i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid operation: %v", err)
+		}
+		if kind != opPut && kind != opDelete {
+			return nil, nil, fmt.Errorf("unknown operation type %d", kind)
+		}
+
+		bucket, err := readString(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bucket: %v", err)
+		}
+		key, err := readString(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key: %v", err)
+		}
+
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > uint64(r.Len()) {
+			return nil, nil, fmt.Errorf("invalid value length")
+		}
+		offset := base + int64(len(payload)-r.Len())
+		if _, err := r.Seek(int64(length), io.SeekCurrent); err != nil {
+			return nil, nil, fmt.Errorf("invalid value: %v", err)
+		}
+
+		ops = append(ops, operation{kind: kind, bucket: bucket, key: key})
+		positions = append(positions, valuePosition{offset: offset, length: int(length)})
+	}
+
+	return ops, positions, nil
+}
+
+// writeUvarint appends an unsigned varint to a buffer
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+// readString reads a length-prefixed string
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", fmt.Errorf("length %d exceeds record", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
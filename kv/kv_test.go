@@ -0,0 +1,263 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// step is a write applied to a store in a test
+type step struct {
+	del        bool
+	bucket     string
+	key, value string
+}
+
+func put(bucket, key, value string) step { return step{bucket: bucket, key: key, value: value} }
+func del(bucket, key string) step        { return step{del: true, bucket: bucket, key: key} }
+
+func applySteps(t *testing.T, db *DB, steps []step) {
+	t.Helper()
+	for _, s := range steps {
+		var err error
+		if s.del {
+			err = db.Delete(s.bucket, s.key)
+		} else {
+			err = db.Put(s.bucket, s.key, []byte(s.value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// contents reads every key of the given buckets
+func contents(t *testing.T, db *DB, buckets ...string) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	for _, bucket := range buckets {
+		for _, key := range db.Keys(bucket) {
+			value, err := db.Get(bucket, key)
+			if err != nil {
+				t.Fatalf("Get(%s, %s): %v", bucket, key, err)
+			}
+			got[bucket+"/"+key] = string(value)
+		}
+	}
+	return got
+}
+
+func TestReopenAfterCompaction(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []step // written before the compaction
+		after  []step // written after it, before reopening
+		want   map[string]string
+	}{
+		{
+			name:   "overwritten values",
+			before: []step{put("a", "k1", "v1"), put("a", "k1", "v2"), put("a", "k2", "v1"), put("a", "k1", "v3")},
+			want:   map[string]string{"a/k1": "v3", "a/k2": "v1"},
+		},
+		{
+			name:   "deleted keys",
+			before: []step{put("a", "k1", "v1"), put("b", "k1", "v1"), del("a", "k1"), put("a", "k2", "v2")},
+			want:   map[string]string{"a/k2": "v2", "b/k1": "v1"},
+		},
+		{
+			name:   "writes after compaction",
+			before: []step{put("a", "k1", "v1"), put("a", "k1", "v2")},
+			after:  []step{put("a", "k2", "v3"), put("a", "k1", "v4"), del("a", "k2"), put("b", "k1", "")},
+			want:   map[string]string{"a/k1": "v4", "b/k1": ""},
+		},
+		{
+			name:   "everything deleted",
+			before: []step{put("a", "k1", "v1"), del("a", "k1")},
+			want:   map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store.kv")
+			db, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applySteps(t, db, tt.before)
+
+			sizeBefore, _ := db.Size()
+			if err := db.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			size, stale := db.Size()
+			if stale != 0 || size > sizeBefore {
+				t.Fatalf("after compaction size = %d (was %d), stale = %d", size, sizeBefore, stale)
+			}
+			applySteps(t, db, tt.after)
+			if got := contents(t, db, "a", "b"); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("before reopening: %v, want %v", got, tt.want)
+			}
+			db.Close()
+
+			reopened, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if got := contents(t, reopened, "a", "b"); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("after reopening: %v, want %v", got, tt.want)
+			}
+			if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+				t.Fatalf("compaction left its temporary file behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestBatchIsAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.kv")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applySteps(t, db, []step{put("a", "k1", "v1")})
+	size, _ := db.Size()
+
+	err = db.Update(func(b *Batch) error {
+		b.Put("a", "k2", []byte("v2"))
+		b.Put("a", "k3", []byte("v3"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Tear the batch record, as a crash in the middle of the write would
+	if err := os.Truncate(path, size+5); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	want := map[string]string{"a/k1": "v1"}
+	if got := contents(t, reopened, "a"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after a torn batch: %v, want %v", got, want)
+	}
+	if _, err := reopened.Get("a", "k2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a torn write = %v, want ErrNotFound", err)
+	}
+
+	// The torn record is truncated, so new writes survive another reopen
+	applySteps(t, reopened, []step{put("a", "k4", "v4")})
+	reopened.Close()
+	again, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	want["a/k4"] = "v4"
+	if got := contents(t, again, "a"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after appending: %v, want %v", got, want)
+	}
+}
+
+func TestCorruptRecordRefusesToOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage modifies the file, whose second of three records starts at offset
+		damage func(t *testing.T, path string, offset int64)
+	}{
+		{
+			name: "flipped byte in the middle",
+			damage: func(t *testing.T, path string, offset int64) {
+				flipByte(t, path, offset+recordHeaderSize+2)
+			},
+		},
+		{
+			name: "oversized length in the middle",
+			damage: func(t *testing.T, path string, offset int64) {
+				header := make([]byte, 4)
+				binary.BigEndian.PutUint32(header, 0xffffffff)
+				writeAt(t, path, header, offset)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "store.kv")
+			db, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applySteps(t, db, []step{put("a", "k1", "v1")})
+			offset, _ := db.Size()
+			applySteps(t, db, []step{put("a", "k2", "v2"), put("a", "k3", "v3")})
+			size, _ := db.Size()
+			db.Close()
+
+			tt.damage(t, path, offset)
+			if _, err := Open(path); err == nil {
+				t.Fatal("expected a corrupt record in the middle of the file to be refused")
+			}
+			if info, err := os.Stat(path); err != nil || info.Size() != size {
+				t.Fatalf("corrupt file was truncated: %v", err)
+			}
+		})
+	}
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.kv")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applySteps(t, db, []step{put("a", "k1", "v1"), put("a", "k2", "v2")})
+	size, _ := db.Size()
+	db.Close()
+
+	// A checksum mismatch in the last record is a write that did not reach the disk whole
+	flipByte(t, path, size-1)
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	want := map[string]string{"a/k1": "v1"}
+	if got := contents(t, reopened, "a"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after a torn tail: %v, want %v", got, want)
+	}
+}
+
+// flipByte inverts the byte at an offset of a file
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, path, []byte{^data[offset]}, offset)
+}
+
+// writeAt overwrites bytes of a file at an offset
+func writeAt(t *testing.T, path string, data []byte, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
+	"github.com/ankit/blockchain_ledger/auth"
 	"github.com/ankit/blockchain_ledger/blockchain"
 	"github.com/ankit/blockchain_ledger/handlers"
 	"github.com/ankit/blockchain_ledger/manager"
@@ -15,28 +20,61 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout bounds how long a shutdown waits for requests and queued webhook events
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Println("Warning: No .env file found")
 	}
 
+	// Initialize storage backend selected by STORAGE_BACKEND
+	backend, err := storage.NewBackend()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage backend: %v", err)
+	}
+	defer backend.Close()
+
 	// Initialize storage
-	dataStorage, err := storage.NewDataStorage()
+	dataStorage, err := storage.NewDataStorage(backend)
 	if err != nil {
 		log.Fatalf("Failed to initialize data storage: %v", err)
 	}
 
-	ledgerStorage, err := storage.NewLedgerStorage()
+	ledgerStorage, err := storage.NewLedgerStorage(backend)
 	if err != nil {
 		log.Fatalf("Failed to initialize ledger storage: %v", err)
 	}
 
+	// Initialize organization signing keys
+	keyStore, err := blockchain.NewKeyStore(filepath.Join(dataStorage.BlockchainDir, "keys"))
+	if err != nil {
+		log.Fatalf("Failed to initialize key store: %v", err)
+	}
+
 	// Initialize blockchain service
-	blockchainService := blockchain.NewBlockchainService(dataStorage)
+	blockchainService := blockchain.NewBlockchainService(dataStorage, keyStore)
+
+	// Initialize write-ahead log for ledger operations
+	wal, err := storage.NewWAL(dataStorage.WalDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize write-ahead log: %v", err)
+	}
 
 	// Initialize ledger manager
-	ledgerManager := manager.NewLedgerManager(ledgerStorage, blockchainService)
+	ledgerManager := manager.NewLedgerManager(ledgerStorage, blockchainService, wal, dataStorage.Outbox)
+
+	// Replay ledger operations interrupted by a previous crash
+	if err := ledgerManager.RecoverFromWAL(); err != nil {
+		log.Printf("Warning: Failed to recover from write-ahead log: %v", err)
+	}
+
+	// Initialize the scheduler recording the expiry of stock past its expiry date
+	expiryScheduler, err := manager.NewExpiryScheduler(ledgerManager)
+	if err != nil {
+		log.Fatalf("Failed to initialize expiry scheduler: %v", err)
+	}
 
 	// Initialize sync service
 	syncInterval := 1 * time.Minute // Default sync interval
@@ -45,12 +83,46 @@ func main() {
 		log.Fatalf("Failed to initialize sync service: %v", err)
 	}
 
+	// Initialize request authentication by JWT and API key
+	authenticator, err := auth.NewAuthenticatorFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize authentication: %v", err)
+	}
+
+	// Initialize webhook signature verification
+	webhookVerifier, err := auth.NewWebhookVerifierFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize webhook verification: %v", err)
+	}
+	if !webhookVerifier.Configured() {
+		log.Println("Warning: WEBHOOK_SECRET is not set, webhook requests will be rejected")
+	}
+
+	webhookHandler, err := sync.NewWebhookHandler(syncService, webhookVerifier)
+	if err != nil {
+		log.Fatalf("Failed to initialize webhook handler: %v", err)
+	}
+
+	// Initialize the responses kept for idempotency keys
+	idempotencyStore, err := storage.NewIdempotencyStore("idempotency_keys")
+	if err != nil {
+		log.Fatalf("Failed to initialize idempotency store: %v", err)
+	}
+
 	// Initialize handlers
-	handlers.SetupRoutes(ledgerManager, syncService)
+	handlers.SetupRoutes(ledgerManager, syncService, blockchainService, dataStorage, webhookHandler)
 
 	// Start sync service
 	go syncService.Start()
 
+	// Start the workers processing queued webhook events
+	webhookHandler.Start()
+
+	// Start recording the expiry of drugs and units
+	if err := expiryScheduler.Start(); err != nil {
+		log.Fatalf("Failed to start expiry scheduler: %v", err)
+	}
+
 	// Get port from environment variable or use default
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -58,8 +130,39 @@ func main() {
 	}
 
 	// Start HTTP server
-	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	// Every route requires an authenticated principal except the webhooks, which are called by Supabase.
+	// Mutating requests with an Idempotency-Key are applied once per authenticated caller.
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: auth.Middleware(authenticator, handlers.Idempotent(idempotencyStore, http.DefaultServeMux), handlers.PublicPaths...),
+	}
+
+	go func() {
+		fmt.Printf("Server starting on port %s...\n", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then stop taking requests and drain the webhook queue
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: Failed to shut down server gracefully: %v", err)
+	}
+	if err := webhookHandler.Shutdown(ctx); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := expiryScheduler.Stop(); err != nil {
+		log.Printf("Warning: Failed to stop expiry scheduler: %v", err)
+	}
+	if err := syncService.Stop(); err != nil {
+		log.Printf("Warning: Failed to stop sync service: %v", err)
 	}
 }
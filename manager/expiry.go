@@ -0,0 +1,559 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// DefaultExpiryInterval is how often the expiry scheduler looks for stock past its expiry date
+const DefaultExpiryInterval = time.Hour
+
+// expiryActor is recorded as the author of the expiry transactions of the scheduler
+const expiryActor = "system:expiry"
+
+// ExpiryScheduler periodically records the expiry of drugs and lot units whose expiry date
+// has passed
+type ExpiryScheduler struct {
+	LedgerManager *LedgerManager
+	Interval      time.Duration
+	StopChan      chan struct{}
+	WaitGroup     sync.WaitGroup
+	IsRunning     bool
+	Lock          sync.Mutex
+}
+
+// NewExpiryScheduler creates an expiry scheduler, running every EXPIRY_CHECK_INTERVAL
+func NewExpiryScheduler(lm *LedgerManager) (*ExpiryScheduler, error) {
+	// Get check interval from environment variable or use default
+	interval := DefaultExpiryInterval
+	if value := os.Getenv("EXPIRY_CHECK_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid EXPIRY_CHECK_INTERVAL: %s", value)
+		}
+		interval = parsed
+	}
+
+	return &ExpiryScheduler{
+		LedgerManager: lm,
+		Interval:      interval,
+		StopChan:      make(chan struct{}),
+	}, nil
+}
+
+// Start begins the expiry scheduler
+func (s *ExpiryScheduler) Start() error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	if s.IsRunning {
+		return fmt.Errorf("expiry scheduler is already running")
+	}
+
+	s.IsRunning = true
+	s.WaitGroup.Add(1)
+
+	go func() {
+		defer s.WaitGroup.Done()
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		// Catch up on stock that expired while the service was down
+		s.run()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.StopChan:
+				log.Println("Stopping expiry scheduler")
+				return
+			}
+		}
+	}()
+
+	log.Printf("Expiry scheduler started with interval: %v", s.Interval)
+	return nil
+}
+
+// Stop stops the expiry scheduler
+func (s *ExpiryScheduler) Stop() error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	if !s.IsRunning {
+		return fmt.Errorf("expiry scheduler is not running")
+	}
+
+	close(s.StopChan)
+	s.WaitGroup.Wait()
+	s.IsRunning = false
+
+	log.Println("Expiry scheduler stopped")
+	return nil
+}
+
+// run records the expiry of the stock due now
+func (s *ExpiryScheduler) run() {
+	expired, err := s.LedgerManager.ExpireDue(time.Now())
+	if err != nil {
+		log.Printf("Warning: Expiry run incomplete: %v", err)
+	}
+	if expired > 0 {
+		log.Printf("Recorded expiry of %d drugs and units", expired)
+	}
+}
+
+// expiringStock holds the drugs and lot units of a manufacturer that are past their
+// expiry date and may still move to expired
+type expiringStock struct {
+	drugs   []*models.CommonDrugRecord
+	lots    []*models.CommonLotRecord
+	serials [][]string // units of each lot that expire
+}
+
+// ExpireDue records the expiry of every drug and lot unit whose expiry date has passed at
+// a time, along with their lots. Each manufacturer's expiries are recorded as drug_expired
+// transactions in one block and journaled as one operation, so a failure for one
+// manufacturer does not hold back the others, and a drug or unit is expired on the chain
+// only once. It returns the number of drugs and units that expired.
+func (lm *LedgerManager) ExpireDue(now time.Time) (int, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// The stock due is read from ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return 0, err
+	}
+
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	// Group the stock past its expiry date by manufacturer
+	due := make(map[string]*expiringStock)
+	var manufacturerIDs []string
+	stockOf := func(manufacturerID string) *expiringStock {
+		if due[manufacturerID] == nil {
+			due[manufacturerID] = &expiringStock{}
+			manufacturerIDs = append(manufacturerIDs, manufacturerID)
+		}
+		return due[manufacturerID]
+	}
+
+	for i, drug := range commonLedger.Drugs {
+		if !models.IsExpired(drug.ExpiryDate, now) {
+			continue
+		}
+		if models.CheckDrugTransition(drug.DrugID, drug.CurrentStatus, models.DrugExpired) != nil {
+			continue
+		}
+		stock := stockOf(drug.ManufacturerID)
+		stock.drugs = append(stock.drugs, &commonLedger.Drugs[i])
+	}
+
+	for i, lot := range commonLedger.Lots {
+		if !models.IsExpired(lot.ExpiryDate, now) {
+			continue
+		}
+		serials := []string{}
+		for _, unit := range lot.Units {
+			if models.CheckUnitTransition(lot.GTIN, unit.Serial, unit.Status, models.DrugExpired) == nil {
+				serials = append(serials, unit.Serial)
+			}
+		}
+		if len(serials) == 0 && models.CheckLotTransition(lot.LotID, lot.CurrentStatus, models.LotExpired) != nil {
+			continue
+		}
+		stock := stockOf(lot.ManufacturerID)
+		stock.lots = append(stock.lots, &commonLedger.Lots[i])
+		stock.serials = append(stock.serials, serials)
+	}
+
+	sort.Strings(manufacturerIDs)
+	expired := 0
+	var errs []error
+	for _, manufacturerID := range manufacturerIDs {
+		count, err := lm.expireStock(manufacturerID, due[manufacturerID], now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to expire stock of manufacturer %s: %v", manufacturerID, err))
+			continue
+		}
+		expired += count
+	}
+
+	return expired, errors.Join(errs...)
+}
+
+// expireStock records the expiry of a manufacturer's stock in the blockchain, both ledgers
+// and the database. A drug or lot that cannot be read from the database is left for the
+// next run. An expiry already on the chain, from a run that failed before it reached the
+// ledgers, is not recorded again: its transaction is reused.
+func (lm *LedgerManager) expireStock(manufacturerID string, stock *expiringStock, now time.Time) (int, error) {
+	timestamp := now.Format(time.RFC3339)
+
+	// Get the affected records from database, with the expiries already on the chain
+	var records []*models.CommonDrugRecord
+	var drugs []*models.Drug
+	var drugTxHashes []string
+	for _, record := range stock.drugs {
+		drug, err := lm.storage.GetDrug(record.DrugID)
+		if err != nil {
+			log.Printf("Warning: Skipping expiry of drug %s: failed to get drug from database: %v", record.DrugID, err)
+			continue
+		}
+		recorded, err := lm.recordedExpiries(storage.IndexDrug, record.DrugID, "")
+		if err != nil {
+			log.Printf("Warning: Skipping expiry of drug %s: %v", record.DrugID, err)
+			continue
+		}
+		txHash := ""
+		if len(recorded) > 0 {
+			txHash = recorded[len(recorded)-1].TxHash
+		}
+		records = append(records, record)
+		drugs = append(drugs, drug)
+		drugTxHashes = append(drugTxHashes, txHash)
+	}
+
+	var lots []*models.CommonLotRecord
+	var expiringSerials [][]string
+	var dbLots []*models.Lot
+	var lotTxHashes []string
+	var pendingSerials [][]string // units of each lot whose expiry is not on the chain yet
+	for i, lot := range stock.lots {
+		var dbLot *models.Lot
+		if models.CheckLotTransition(lot.LotID, lot.CurrentStatus, models.LotExpired) == nil {
+			var err error
+			dbLot, err = lm.storage.GetLot(lot.LotID)
+			if err != nil {
+				log.Printf("Warning: Skipping expiry of lot %s: failed to get lot from database: %v", lot.LotID, err)
+				continue
+			}
+		}
+		recorded, err := lm.recordedExpiries(storage.IndexLot, lot.LotID, lot.LotID)
+		if err != nil {
+			log.Printf("Warning: Skipping expiry of lot %s: %v", lot.LotID, err)
+			continue
+		}
+		txHash := ""
+		pending := stock.serials[i]
+		if len(recorded) > 0 {
+			txHash = recorded[len(recorded)-1].TxHash
+			pending = []string{}
+			for _, serial := range stock.serials[i] {
+				if !namedByAny(recorded, serial) {
+					pending = append(pending, serial)
+				}
+			}
+		}
+		lots = append(lots, lot)
+		expiringSerials = append(expiringSerials, stock.serials[i])
+		dbLots = append(dbLots, dbLot)
+		lotTxHashes = append(lotTxHashes, txHash)
+		pendingSerials = append(pendingSerials, pending)
+	}
+
+	if len(records) == 0 && len(lots) == 0 {
+		return 0, nil
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("expire_stock", manufacturerID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Record the expiry of each drug, and of the units of each lot, not yet on the chain in one block
+	var batch []map[string]interface{}
+	var batchTxHashes []*string
+	for i, drug := range records {
+		if drugTxHashes[i] != "" {
+			continue
+		}
+		batch = append(batch, map[string]interface{}{
+			"drug_id":         drug.DrugID,
+			"manufacturer_id": manufacturerID,
+			"status":          models.DrugExpired,
+			"expiry_date":     drug.ExpiryDate,
+			"reason":          expiryReason(drug.ExpiryDate),
+			"updated_by":      expiryActor,
+			"updated_at":      timestamp,
+		})
+		batchTxHashes = append(batchTxHashes, &drugTxHashes[i])
+	}
+	for i, lot := range lots {
+		if lotTxHashes[i] != "" && len(pendingSerials[i]) == 0 {
+			continue
+		}
+		batch = append(batch, map[string]interface{}{
+			"lot_id":          lot.LotID,
+			"drug_id":         lot.DrugID,
+			"gtin":            lot.GTIN,
+			"serials":         pendingSerials[i],
+			"manufacturer_id": manufacturerID,
+			"status":          models.DrugExpired,
+			"expiry_date":     lot.ExpiryDate,
+			"reason":          expiryReason(lot.ExpiryDate),
+			"updated_by":      expiryActor,
+			"updated_at":      timestamp,
+		})
+		batchTxHashes = append(batchTxHashes, &lotTxHashes[i])
+	}
+	if len(batch) > 0 {
+		txHashes, err := lm.addTransactions(entry, "drug_expired", batch)
+		if err != nil {
+			return 0, err
+		}
+		for i, txHash := range txHashes {
+			*batchTxHashes[i] = txHash
+		}
+	}
+
+	// Expire the drugs, lots and units in both ledgers
+	expired := len(records)
+	for _, drug := range records {
+		setDrugStatus(manufacturerLedger, commonLedger, drug.DrugID, models.DrugExpired, timestamp, expiryReason(drug.ExpiryDate))
+	}
+	for i, lot := range lots {
+		if dbLots[i] != nil {
+			setLotStatus(manufacturerLedger, commonLedger, lot.LotID, models.LotExpired, timestamp, expiryReason(lot.ExpiryDate))
+		}
+		setUnitStatus(manufacturerLedger, commonLedger, lot.LotID, expiringSerials[i], models.DrugExpired, "", timestamp)
+		expired += len(expiringSerials[i])
+	}
+
+	// Update drugs in database and insert their status updates
+	for i, drug := range drugs {
+		drug.Status = models.DrugExpired
+		drug.BlockchainTxID = drugTxHashes[i]
+		drug.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
+
+		drugStatusUpdate := &models.DrugStatusUpdate{
+			DrugID:         drug.ID,
+			Status:         models.DrugExpired,
+			UpdatedBy:      expiryActor,
+			BlockchainTxID: drugTxHashes[i],
+			Timestamp:      now,
+		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
+	}
+
+	// Update lots in database
+	for i, lot := range dbLots {
+		if lot == nil {
+			continue
+		}
+		lot.Status = models.LotExpired
+		lot.BlockchainTxID = lotTxHashes[i]
+		lot.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateLot, Lot: lot})
+	}
+
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// recordedExpiries returns the drug_expired transactions on the chain under an index entry
+// that expire a drug, when lotID is empty, or units of the lot lotID
+func (lm *LedgerManager) recordedExpiries(kind, value, lotID string) ([]storage.ChainTransaction, error) {
+	txs, err := lm.blockchain.GetTransactionsByIndex(kind, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []storage.ChainTransaction
+	for _, tx := range txs {
+		data, ok := tx.TxData.(map[string]interface{})
+		if !ok || data["tx_type"] != "drug_expired" {
+			continue
+		}
+		if txLotID, _ := data["lot_id"].(string); txLotID == lotID {
+			recorded = append(recorded, tx)
+		}
+	}
+	return recorded, nil
+}
+
+// namedByAny reports whether any of the transactions lists a serial in its serials field
+func namedByAny(txs []storage.ChainTransaction, serial string) bool {
+	for _, tx := range txs {
+		if txNamesSerial(tx.TxData, serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyUnit verifies a serialized unit's authenticity against the blockchain transaction
+// that created its lot. Units past their expiry date are never verified.
+func (lm *LedgerManager) VerifyUnit(gtin, serial string) (bool, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return false, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, lot := range commonLedger.Lots {
+		if lot.GTIN != gtin {
+			continue
+		}
+		for _, unit := range lot.Units {
+			if unit.Serial != serial {
+				continue
+			}
+
+			// Refuse expired units, whether or not their expiry has been recorded yet
+			if unit.Status == models.DrugExpired || models.IsExpired(lot.ExpiryDate, time.Now()) {
+				return false, errExpired("unit "+models.UnitID(gtin, serial), lot.ExpiryDate)
+			}
+
+			// Verify the lot's creation transaction
+			txs, err := lm.blockchain.GetTransactionsByIndex(storage.IndexLot, lot.LotID)
+			if err != nil {
+				return false, err
+			}
+			for _, tx := range txs {
+				if data, ok := tx.TxData.(map[string]interface{}); ok && data["tx_type"] == "lot_create" {
+					return lm.blockchain.VerifyTransaction(tx.TxHash)
+				}
+			}
+			return false, nil
+		}
+	}
+
+	return false, fmt.Errorf("%w: unit %s", models.ErrRecordNotFound, models.UnitID(gtin, serial))
+}
+
+// GetExpiryReport reports the drugs and lot units still in circulation that expire within
+// the query's window, with who holds them. Lot units are counted per lot and holder.
+func (lm *LedgerManager) GetExpiryReport(query *models.ExpiryQuery) (*models.ExpiryReport, error) {
+	days := query.Days
+	if days == 0 {
+		days = models.DefaultExpiryWindowDays
+	}
+	if days < 0 || days > models.MaxExpiryWindowDays {
+		return nil, fmt.Errorf("%w: days must be between 1 and %d", models.ErrInvalidQuery, models.MaxExpiryWindowDays)
+	}
+
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	now := time.Now()
+	today, _ := time.Parse(models.DateLayout, now.Format(models.DateLayout))
+	report := &models.ExpiryReport{
+		ManufacturerID: query.ManufacturerID,
+		DistributorID:  query.DistributorID,
+		From:           today.Format(models.DateLayout),
+		To:             today.AddDate(0, 0, days).Format(models.DateLayout),
+		Items:          []models.ExpiryItem{},
+		GeneratedAt:    now.Format(time.RFC3339),
+	}
+
+	// Keep stock of the manufacturer, held by the distributor, that expires within the window
+	inScope := func(manufacturerID, expiryDate, status string, shipment *models.CommonShipmentRecord) (models.ExpiryItem, bool) {
+		item := models.ExpiryItem{ManufacturerID: manufacturerID, ExpiryDate: expiryDate}
+		if query.ManufacturerID != "" && manufacturerID != query.ManufacturerID {
+			return item, false
+		}
+		if !inCirculation(status) || !inExpiryWindow(expiryDate, report.From, report.To) {
+			return item, false
+		}
+		item.Custody, item.HolderID = custody(status, shipment, manufacturerID)
+		if query.DistributorID != "" && item.HolderID != query.DistributorID {
+			return item, false
+		}
+		expiry, _ := time.Parse(models.DateLayout, expiryDate)
+		item.DaysLeft = int(expiry.Sub(today).Hours() / 24)
+		return item, true
+	}
+
+	shipments, lastDrugShipment := indexShipments(commonLedger)
+	for _, drug := range commonLedger.Drugs {
+		item, ok := inScope(drug.ManufacturerID, drug.ExpiryDate, drug.CurrentStatus, lastDrugShipment[drug.DrugID])
+		if !ok {
+			continue
+		}
+		item.DrugID = drug.DrugID
+		item.BatchNumber = drug.BatchNumber
+		item.Units = 1
+		report.Items = append(report.Items, item)
+	}
+
+	for _, lot := range commonLedger.Lots {
+		holders := make(map[[2]string]int)
+		var lotItems []models.ExpiryItem
+		for _, unit := range lot.Units {
+			item, ok := inScope(lot.ManufacturerID, lot.ExpiryDate, unit.Status, shipments[unit.ShipmentID])
+			if !ok {
+				continue
+			}
+			key := [2]string{item.HolderID, item.Custody}
+			if _, seen := holders[key]; !seen {
+				item.DrugID = lot.DrugID
+				item.LotID = lot.LotID
+				item.GTIN = lot.GTIN
+				item.BatchNumber = lot.BatchNumber
+				lotItems = append(lotItems, item)
+			}
+			holders[key]++
+		}
+		for _, item := range lotItems {
+			item.Units = holders[[2]string{item.HolderID, item.Custody}]
+			report.Items = append(report.Items, item)
+		}
+	}
+
+	// Soonest expiry first
+	sort.Slice(report.Items, func(i, j int) bool {
+		a, b := report.Items[i], report.Items[j]
+		if a.ExpiryDate != b.ExpiryDate {
+			return a.ExpiryDate < b.ExpiryDate
+		}
+		if a.DrugID != b.DrugID {
+			return a.DrugID < b.DrugID
+		}
+		if a.LotID != b.LotID {
+			return a.LotID < b.LotID
+		}
+		return a.HolderID < b.HolderID
+	})
+	for _, item := range report.Items {
+		report.Units += item.Units
+	}
+
+	return report, nil
+}
+
+// inCirculation reports whether a drug or unit in a status is still stocked or shipped
+func inCirculation(status string) bool {
+	return status == models.DrugCreated || status == models.DrugInTransit || status == models.DrugDelivered
+}
+
+// expiryReason describes the expiry of stock with an expiry date
+func expiryReason(expiryDate string) string {
+	return fmt.Sprintf("Expiry date %s passed", expiryDate)
+}
+
+// errExpired returns the error for an operation refused because stock has expired
+func errExpired(subject, expiryDate string) error {
+	if expiryDate == "" {
+		return fmt.Errorf("%w: %s", models.ErrDrugExpired, subject)
+	}
+	return fmt.Errorf("%w: %s passed its expiry date %s", models.ErrDrugExpired, subject, expiryDate)
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+func TestExpiredStockIsNotShippedOrVerified(t *testing.T) {
+	lm, fs := newTestManager(t)
+	date := func(days int) string { return time.Now().AddDate(0, 0, days).Format(models.DateLayout) }
+
+	// Drug D1 and lot L1 expired yesterday, drug D2 expires next year
+	if _, err := lm.CreateDrug(&models.CreateDrugParams{DrugID: "D1", ManufacturerID: "m1", Name: "Expired drug", ExpiryDate: date(-1), UserID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.CreateDrug(&models.CreateDrugParams{DrugID: "D2", ManufacturerID: "m1", Name: "Current drug", ExpiryDate: date(365), UserID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lm.CreateLot(&models.CreateLotParams{LotID: "L1", DrugID: "D1", ManufacturerID: "m1", GTIN: "96385074", BatchNumber: "B1", ManufactureDate: date(-365), ExpiryDate: date(-1), Serials: []string{"U1", "U2"}, UserID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	shipDrug := func(drugID string) func() error {
+		return func() error {
+			_, err := lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S-" + drugID, DrugID: drugID, ManufacturerID: "m1", DistributorID: "d1", UserID: "m1"})
+			return err
+		}
+	}
+	shipLot := func() error {
+		_, err := lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S-L1", LotID: "L1", ManufacturerID: "m1", DistributorID: "d1", UserID: "m1"})
+		return err
+	}
+	verifyDrug := func(drugID string) func() error {
+		return func() error {
+			verified, err := lm.VerifyDrug(drugID)
+			if err == nil && !verified {
+				return errors.New("drug not verified")
+			}
+			return err
+		}
+	}
+	verifyUnit := func() error {
+		_, err := lm.VerifyUnit("96385074", "U1")
+		return err
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"ship expired drug", shipDrug("D1")},
+		{"ship expired lot", shipLot},
+		{"verify expired drug", verifyDrug("D1")},
+		{"verify expired unit", verifyUnit},
+	}
+
+	// Expired stock is refused both before and after the scheduler records its expiry
+	check := func(t *testing.T) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				height, _, _ := fs.Tip()
+				if err := tt.call(); !errors.Is(err, models.ErrDrugExpired) {
+					t.Fatalf("err = %v, want ErrDrugExpired", err)
+				}
+				if after, _, _ := fs.Tip(); after != height {
+					t.Fatalf("refused call appended %d blocks", after-height)
+				}
+			})
+		}
+	}
+
+	t.Run("expiry not recorded", check)
+
+	expired, err := lm.ExpireDue(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 3 {
+		t.Fatalf("%d drugs and units expired, want 3", expired)
+	}
+	drug, err := lm.GetDrug("D1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drug.CurrentStatus != models.DrugExpired {
+		t.Fatalf("drug status = %s, want %s", drug.CurrentStatus, models.DrugExpired)
+	}
+
+	t.Run("expiry recorded", check)
+
+	// Stock within its expiry date is still verified and shipped
+	if err := verifyDrug("D2")(); err != nil {
+		t.Fatal(err)
+	}
+	if err := shipDrug("D2")(); err != nil {
+		t.Fatal(err)
+	}
+}
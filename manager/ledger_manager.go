@@ -4,6 +4,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ankit/blockchain_ledger/blockchain"
@@ -11,55 +14,88 @@ import (
 	"github.com/ankit/blockchain_ledger/storage"
 )
 
+// shipmentDrugStatus maps the shipment states that also move the carried drug to the
+// drug's new state
+var shipmentDrugStatus = map[string]string{
+	models.ShipmentDelivered: models.DrugDelivered,
+	models.ShipmentReturned:  models.DrugCreated,
+}
+
 // LedgerManager implements the models.LedgerManager interface
 type LedgerManager struct {
-	storage    *storage.LedgerStorage
+	storage    models.LedgerStorage
 	blockchain *blockchain.BlockchainService
+	wal        *storage.WAL
+	outbox     *storage.Outbox   // receives database writes that fail, for the sync service to push
+	stalled    *storage.WALEntry // operation on the chain whose ledgers could not be saved yet
+	mu         sync.Mutex        // serializes ledger mutations so ledger deltas apply to the version they were made to
 }
 
-// NewLedgerManager creates a new ledger manager
-func NewLedgerManager(storage *storage.LedgerStorage, blockchain *blockchain.BlockchainService) *LedgerManager {
+// NewLedgerManager creates a new ledger manager. Without an outbox, an operation whose
+// database writes fail stays pending in the WAL until the next recovery.
+func NewLedgerManager(storage models.LedgerStorage, blockchain *blockchain.BlockchainService, wal *storage.WAL, outbox *storage.Outbox) *LedgerManager {
 	return &LedgerManager{
 		storage:    storage,
 		blockchain: blockchain,
+		wal:        wal,
+		outbox:     outbox,
 	}
 }
 
 // CreateDrug creates a new drug in the manufacturer and common ledgers
 func (lm *LedgerManager) CreateDrug(params *models.CreateDrugParams) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return "", err
+	}
+
 	// Get current timestamp
 	now := time.Now()
 	timestamp := now.Format(time.RFC3339)
 
+	if err := models.ValidateDates(params.ManufactureDate, params.ExpiryDate, false); err != nil {
+		return "", err
+	}
+
 	// Generate verification hash
 	verificationHash := lm.generateVerificationHash(params.DrugID, params.ManufacturerID, timestamp)
 
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("create_drug", params.ManufacturerID)
+	if err != nil {
+		return "", err
+	}
+
 	// Create blockchain transaction
 	txData := map[string]interface{}{
 		"drug_id":           params.DrugID,
 		"manufacturer_id":   params.ManufacturerID,
 		"name":              params.Name,
 		"description":       params.Description,
+		"batch_number":      params.BatchNumber,
+		"manufacture_date":  params.ManufactureDate,
+		"expiry_date":       params.ExpiryDate,
 		"verification_hash": verificationHash,
+		"signer_id":         params.ManufacturerID,
 		"created_at":        timestamp,
 	}
-	txHash, err := lm.blockchain.CreateTransaction("drug_create", txData)
+	txHash, err := lm.addTransaction(entry, "drug_create", txData)
 	if err != nil {
-		return "", fmt.Errorf("failed to create blockchain transaction: %v", err)
-	}
-
-	// Get manufacturer ledger
-	manufacturerLedger, err := lm.storage.GetManufacturerLedger(params.ManufacturerID)
-	if err != nil {
-		return "", fmt.Errorf("failed to get manufacturer ledger: %v", err)
+		return "", err
 	}
 
 	// Create drug record in manufacturer ledger
 	drugRecord := models.DrugRecord{
-		DrugID:        params.DrugID,
-		Status:        "created",
-		CreatedAt:     timestamp,
-		CurrentStatus: "created",
+		DrugID:          params.DrugID,
+		BatchNumber:     params.BatchNumber,
+		ManufactureDate: params.ManufactureDate,
+		ExpiryDate:      params.ExpiryDate,
+		Status:          "created",
+		CreatedAt:       timestamp,
+		CurrentStatus:   "created",
 		History: []models.Status{
 			{
 				Status:    "created",
@@ -73,21 +109,13 @@ func (lm *LedgerManager) CreateDrug(params *models.CreateDrugParams) (string, er
 	manufacturerLedger.Drugs = append(manufacturerLedger.Drugs, drugRecord)
 	manufacturerLedger.LastUpdated = timestamp
 
-	// Save manufacturer ledger
-	if err := lm.storage.SaveManufacturerLedger(manufacturerLedger); err != nil {
-		return "", fmt.Errorf("failed to save manufacturer ledger: %v", err)
-	}
-
-	// Get common ledger
-	commonLedger, err := lm.storage.GetCommonLedger()
-	if err != nil {
-		return "", fmt.Errorf("failed to get common ledger: %v", err)
-	}
-
 	// Create drug record in common ledger
 	commonDrugRecord := models.CommonDrugRecord{
 		DrugID:           params.DrugID,
 		ManufacturerID:   params.ManufacturerID,
+		BatchNumber:      params.BatchNumber,
+		ManufactureDate:  params.ManufactureDate,
+		ExpiryDate:       params.ExpiryDate,
 		Status:           "created",
 		CreatedAt:        timestamp,
 		CurrentStatus:    "created",
@@ -105,26 +133,22 @@ func (lm *LedgerManager) CreateDrug(params *models.CreateDrugParams) (string, er
 	commonLedger.Drugs = append(commonLedger.Drugs, commonDrugRecord)
 	commonLedger.LastUpdated = timestamp
 
-	// Save common ledger
-	if err := lm.storage.SaveCommonLedger(commonLedger); err != nil {
-		return "", fmt.Errorf("failed to save common ledger: %v", err)
-	}
-
 	// Insert drug into database
 	drug := &models.Drug{
 		ID:               params.DrugID,
 		ManufacturerID:   params.ManufacturerID,
 		Name:             params.Name,
 		Description:      params.Description,
+		BatchNumber:      params.BatchNumber,
+		ManufactureDate:  params.ManufactureDate,
+		ExpiryDate:       params.ExpiryDate,
 		Status:           "created",
 		VerificationHash: verificationHash,
 		BlockchainTxID:   txHash,
 		CreatedAt:        now,
 		UpdatedAt:        now,
 	}
-	if err := lm.storage.InsertDrug(drug); err != nil {
-		return "", fmt.Errorf("failed to insert drug into database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrug, Drug: drug})
 
 	// Insert drug status update into database
 	drugStatusUpdate := &models.DrugStatusUpdate{
@@ -135,19 +159,69 @@ func (lm *LedgerManager) CreateDrug(params *models.CreateDrugParams) (string, er
 		BlockchainTxID: txHash,
 		Timestamp:      now,
 	}
-	if err := lm.storage.InsertDrugStatusUpdate(drugStatusUpdate); err != nil {
-		return "", fmt.Errorf("failed to insert drug status update into database: %v", err)
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
+
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return "", err
 	}
 
 	return verificationHash, nil
 }
 
-// CreateShipment creates a new shipment in the manufacturer and common ledgers
+// CreateShipment creates a new shipment in the manufacturer and common ledgers. A shipment
+// of a lot moves its units to in_transit; any other shipment moves its drug.
 func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return "", err
+	}
+
 	// Get current timestamp
 	now := time.Now()
 	timestamp := now.Format(time.RFC3339)
 
+	// Check that the drug, or the selected units of the lot, can be shipped
+	var lot *models.CommonLotRecord
+	var serials []string
+	if params.LotID != "" {
+		var err error
+		lot, serials, err = lm.shippableUnits(params)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		drug, err := lm.drug(params.DrugID)
+		if err != nil {
+			return "", err
+		}
+		if models.IsExpired(drug.ExpiryDate, now) {
+			return "", errExpired("drug "+drug.DrugID, drug.ExpiryDate)
+		}
+		if err := models.CheckDrugTransition(params.DrugID, drug.CurrentStatus, models.DrugInTransit); err != nil {
+			return "", err
+		}
+	}
+
+	// Get drug from database
+	var drug *models.Drug
+	if lot == nil {
+		var err error
+		drug, err = lm.storage.GetDrug(params.DrugID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get drug from database: %v", err)
+		}
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("create_shipment", params.ManufacturerID)
+	if err != nil {
+		return "", err
+	}
+
 	// Create blockchain transaction
 	txData := map[string]interface{}{
 		"shipment_id":     params.ShipmentID,
@@ -156,21 +230,32 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 		"distributor_id":  params.DistributorID,
 		"created_at":      timestamp,
 	}
-	txHash, err := lm.blockchain.CreateTransaction("shipment_create", txData)
+	if lot != nil {
+		txData["lot_id"] = lot.LotID
+		txData["serials"] = serials
+	}
+	txHash, err := lm.addTransaction(entry, "shipment_create", txData)
 	if err != nil {
-		return "", fmt.Errorf("failed to create blockchain transaction: %v", err)
+		return "", err
 	}
 
-	// Get manufacturer ledger
-	manufacturerLedger, err := lm.storage.GetManufacturerLedger(params.ManufacturerID)
+	// Record the drug, or unit, status update in the blockchain
+	var statusTxHash string
+	if lot != nil {
+		statusTxHash, err = lm.addTransaction(entry, "unit_status_update", unitStatusTx(lot, serials, models.DrugInTransit, fmt.Sprintf("Shipped in %s", params.ShipmentID), params.UserID, timestamp))
+	} else {
+		statusTxHash, err = lm.addTransaction(entry, "drug_update", drugStatusTx(params.DrugID, models.DrugInTransit, params.UserID, now))
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to get manufacturer ledger: %v", err)
+		return "", err
 	}
 
 	// Create shipment record in manufacturer ledger
 	shipmentRecord := models.ShipmentRecord{
 		ShipmentID:    params.ShipmentID,
 		DrugID:        params.DrugID,
+		LotID:         params.LotID,
+		Serials:       serials,
 		Status:        "created",
 		CreatedAt:     timestamp,
 		CurrentStatus: "created",
@@ -187,35 +272,12 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 	manufacturerLedger.Shipments = append(manufacturerLedger.Shipments, shipmentRecord)
 	manufacturerLedger.LastUpdated = timestamp
 
-	// Update drug status in manufacturer ledger
-	for i, drug := range manufacturerLedger.Drugs {
-		if drug.DrugID == params.DrugID {
-			manufacturerLedger.Drugs[i].Status = "in_transit"
-			manufacturerLedger.Drugs[i].CurrentStatus = "in_transit"
-			manufacturerLedger.Drugs[i].History = append(manufacturerLedger.Drugs[i].History, models.Status{
-				Status:    "in_transit",
-				Timestamp: timestamp,
-				Details:   fmt.Sprintf("Drug added to shipment %s", params.ShipmentID),
-			})
-			break
-		}
-	}
-
-	// Save manufacturer ledger
-	if err := lm.storage.SaveManufacturerLedger(manufacturerLedger); err != nil {
-		return "", fmt.Errorf("failed to save manufacturer ledger: %v", err)
-	}
-
-	// Get common ledger
-	commonLedger, err := lm.storage.GetCommonLedger()
-	if err != nil {
-		return "", fmt.Errorf("failed to get common ledger: %v", err)
-	}
-
 	// Create shipment record in common ledger
 	commonShipmentRecord := models.CommonShipmentRecord{
 		ShipmentID:     params.ShipmentID,
 		DrugID:         params.DrugID,
+		LotID:          params.LotID,
+		Serials:        serials,
 		ManufacturerID: params.ManufacturerID,
 		DistributorID:  params.DistributorID,
 		Status:         "created",
@@ -234,29 +296,19 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 	commonLedger.Shipments = append(commonLedger.Shipments, commonShipmentRecord)
 	commonLedger.LastUpdated = timestamp
 
-	// Update drug status in common ledger
-	for i, drug := range commonLedger.Drugs {
-		if drug.DrugID == params.DrugID {
-			commonLedger.Drugs[i].Status = "in_transit"
-			commonLedger.Drugs[i].CurrentStatus = "in_transit"
-			commonLedger.Drugs[i].History = append(commonLedger.Drugs[i].History, models.Status{
-				Status:    "in_transit",
-				Timestamp: timestamp,
-				Details:   fmt.Sprintf("Drug added to shipment %s", params.ShipmentID),
-			})
-			break
-		}
-	}
-
-	// Save common ledger
-	if err := lm.storage.SaveCommonLedger(commonLedger); err != nil {
-		return "", fmt.Errorf("failed to save common ledger: %v", err)
+	// Update drug, or unit, status in both ledgers
+	if lot != nil {
+		setUnitStatus(manufacturerLedger, commonLedger, lot.LotID, serials, models.DrugInTransit, params.ShipmentID, timestamp)
+	} else {
+		setDrugStatus(manufacturerLedger, commonLedger, params.DrugID, models.DrugInTransit, timestamp, fmt.Sprintf("Drug added to shipment %s", params.ShipmentID))
 	}
 
 	// Insert shipment into database
 	shipment := &models.Shipment{
 		ID:             params.ShipmentID,
 		DrugID:         params.DrugID,
+		LotID:          params.LotID,
+		Serials:        serials,
 		ManufacturerID: params.ManufacturerID,
 		DistributorID:  params.DistributorID,
 		Status:         "created",
@@ -264,9 +316,7 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 		CreatedAt:      now,
 		UpdatedAt:      now,
 	}
-	if err := lm.storage.InsertShipment(shipment); err != nil {
-		return "", fmt.Errorf("failed to insert shipment into database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertShipment, Shipment: shipment})
 
 	// Insert shipment status update into database
 	shipmentStatusUpdate := &models.ShipmentStatusUpdate{
@@ -277,43 +327,30 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 		BlockchainTxID: txHash,
 		Timestamp:      now,
 	}
-	if err := lm.storage.InsertShipmentStatusUpdate(shipmentStatusUpdate); err != nil {
-		return "", fmt.Errorf("failed to insert shipment status update into database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertShipmentStatusUpdate, ShipmentStatusUpdate: shipmentStatusUpdate})
 
-	// Update drug status in database
-	drugStatusTxHash, err := lm.blockchain.RecordDrugStatusUpdate(params.DrugID, "in_transit", params.UserID, now)
-	if err != nil {
-		return "", fmt.Errorf("failed to record drug status update in blockchain: %v", err)
-	}
+	if drug != nil {
+		// Update drug status in database
+		drug.Status = "in_transit"
+		drug.BlockchainTxID = statusTxHash
+		drug.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
 
-	// Get drug from database
-	drug, err := lm.storage.GetDrug(params.DrugID)
-	if err != nil {
-		return "", fmt.Errorf("failed to get drug from database: %v", err)
+		// Insert drug status update into database
+		drugInTransitUpdate := &models.DrugStatusUpdate{
+			DrugID:         params.DrugID,
+			Status:         "in_transit",
+			Location:       params.Location,
+			UpdatedBy:      params.UserID,
+			BlockchainTxID: statusTxHash,
+			Timestamp:      now,
+		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugInTransitUpdate})
 	}
 
-	// Update drug status
-	drug.Status = "in_transit"
-	drug.BlockchainTxID = drugStatusTxHash
-	drug.UpdatedAt = now
-
-	// Update drug in database
-	if err := lm.storage.UpdateDrug(drug); err != nil {
-		return "", fmt.Errorf("failed to update drug in database: %v", err)
-	}
-
-	// Insert drug status update into database
-	drugInTransitUpdate := &models.DrugStatusUpdate{
-		DrugID:         params.DrugID,
-		Status:         "in_transit",
-		Location:       params.Location,
-		UpdatedBy:      params.UserID,
-		BlockchainTxID: drugStatusTxHash,
-		Timestamp:      now,
-	}
-	if err := lm.storage.InsertDrugStatusUpdate(drugInTransitUpdate); err != nil {
-		return "", fmt.Errorf("failed to insert drug status update into database: %v", err)
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return "", err
 	}
 
 	return txHash, nil
@@ -321,20 +358,25 @@ func (lm *LedgerManager) CreateShipment(params *models.CreateShipmentParams) (st
 
 // UpdateShipmentStatus updates a shipment's status in the manufacturer and common ledgers
 func (lm *LedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatusParams) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return err
+	}
+
 	// Get current timestamp
 	now := time.Now()
 	timestamp := now.Format(time.RFC3339)
 
-	// Create blockchain transaction
-	txData := map[string]interface{}{
-		"shipment_id": params.ShipmentID,
-		"status":      params.Status,
-		"updated_by":  params.UserID,
-		"updated_at":  timestamp,
-	}
-	txHash, err := lm.blockchain.CreateTransaction("shipment_update", txData)
+	// Check that the shipment, and the drug it carries, may move to the new status
+	shipmentStatus, err := lm.shipmentStatus(params.ShipmentID)
 	if err != nil {
-		return fmt.Errorf("failed to create blockchain transaction: %v", err)
+		return err
+	}
+	if err := models.CheckShipmentTransition(params.ShipmentID, shipmentStatus, params.Status); err != nil {
+		return err
 	}
 
 	// Get shipment from database
@@ -343,10 +385,76 @@ func (lm *LedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatu
 		return fmt.Errorf("failed to get shipment from database: %v", err)
 	}
 
-	// Get manufacturer ledger
-	manufacturerLedger, err := lm.storage.GetManufacturerLedger(shipment.ManufacturerID)
+	// A delivered or returned shipment moves the drug it carries, or its units of a lot
+	drugStatus, movesDrug := shipmentDrugStatus[params.Status]
+	var lot *models.CommonLotRecord
+	var serials []string
+	if movesDrug && shipment.LotID != "" {
+		movesDrug = false
+		lot, err = lm.lot(shipment.LotID)
+		if err != nil {
+			return err
+		}
+		serials = shippedUnits(lot, params.ShipmentID)
+		if err := checkUnitTransitions(lot, serials, drugStatus); err != nil {
+			return err
+		}
+	}
+	if movesDrug {
+		currentDrugStatus, err := lm.drugStatus(shipment.DrugID)
+		if err != nil {
+			return err
+		}
+
+		// A drug recalled or expired in transit keeps its status wherever its shipment ends
+		if currentDrugStatus == models.DrugRecalled || currentDrugStatus == models.DrugExpired {
+			movesDrug = false
+		} else if err := models.CheckDrugTransition(shipment.DrugID, currentDrugStatus, drugStatus); err != nil {
+			return err
+		}
+	}
+
+	// Get drug from database
+	var drug *models.Drug
+	if movesDrug {
+		drug, err = lm.storage.GetDrug(shipment.DrugID)
+		if err != nil {
+			return fmt.Errorf("failed to get drug from database: %v", err)
+		}
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("update_shipment_status", shipment.ManufacturerID)
 	if err != nil {
-		return fmt.Errorf("failed to get manufacturer ledger: %v", err)
+		return err
+	}
+
+	// Create blockchain transaction signed by the distributor handling the shipment
+	txData := map[string]interface{}{
+		"shipment_id": params.ShipmentID,
+		"status":      params.Status,
+		"updated_by":  params.UserID,
+		"signer_id":   shipment.DistributorID,
+		"updated_at":  timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, "shipment_update", txData)
+	if err != nil {
+		return err
+	}
+
+	// If shipment is delivered or returned, record the drug status update as well
+	var drugStatusTxHash string
+	if movesDrug {
+		// Create blockchain transaction for drug status update
+		drugStatusTxHash, err = lm.addTransaction(entry, "drug_update", drugStatusTx(shipment.DrugID, drugStatus, params.UserID, now))
+		if err != nil {
+			return err
+		}
+	}
+	if len(serials) > 0 {
+		if _, err := lm.addTransaction(entry, "unit_status_update", unitStatusTx(lot, serials, drugStatus, fmt.Sprintf("Shipment %s %s", params.ShipmentID, params.Status), params.UserID, timestamp)); err != nil {
+			return err
+		}
 	}
 
 	// Update shipment status in manufacturer ledger
@@ -363,34 +471,23 @@ func (lm *LedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatu
 		}
 	}
 
-	// If shipment is delivered, update drug status
-	if params.Status == "delivered" {
+	// If shipment is delivered or returned, update drug status
+	if movesDrug {
 		// Update drug status in manufacturer ledger
 		for i, drug := range manufacturerLedger.Drugs {
 			if drug.DrugID == shipment.DrugID {
-				manufacturerLedger.Drugs[i].Status = "delivered"
-				manufacturerLedger.Drugs[i].CurrentStatus = "delivered"
+				manufacturerLedger.Drugs[i].Status = drugStatus
+				manufacturerLedger.Drugs[i].CurrentStatus = drugStatus
 				manufacturerLedger.Drugs[i].History = append(manufacturerLedger.Drugs[i].History, models.Status{
-					Status:    "delivered",
+					Status:    drugStatus,
 					Timestamp: timestamp,
-					Details:   fmt.Sprintf("Drug delivered via shipment %s", params.ShipmentID),
+					Details:   fmt.Sprintf("Drug %s via shipment %s", params.Status, params.ShipmentID),
 				})
 				break
 			}
 		}
 	}
-
-	// Save manufacturer ledger
 	manufacturerLedger.LastUpdated = timestamp
-	if err := lm.storage.SaveManufacturerLedger(manufacturerLedger); err != nil {
-		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
-	}
-
-	// Get common ledger
-	commonLedger, err := lm.storage.GetCommonLedger()
-	if err != nil {
-		return fmt.Errorf("failed to get common ledger: %v", err)
-	}
 
 	// Update shipment status in common ledger
 	for i, s := range commonLedger.Shipments {
@@ -406,37 +503,34 @@ func (lm *LedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatu
 		}
 	}
 
-	// If shipment is delivered, update drug status
-	if params.Status == "delivered" {
+	// If shipment is delivered or returned, update drug status
+	if movesDrug {
 		// Update drug status in common ledger
 		for i, drug := range commonLedger.Drugs {
 			if drug.DrugID == shipment.DrugID {
-				commonLedger.Drugs[i].Status = "delivered"
-				commonLedger.Drugs[i].CurrentStatus = "delivered"
+				commonLedger.Drugs[i].Status = drugStatus
+				commonLedger.Drugs[i].CurrentStatus = drugStatus
 				commonLedger.Drugs[i].History = append(commonLedger.Drugs[i].History, models.Status{
-					Status:    "delivered",
+					Status:    drugStatus,
 					Timestamp: timestamp,
-					Details:   fmt.Sprintf("Drug delivered via shipment %s", params.ShipmentID),
+					Details:   fmt.Sprintf("Drug %s via shipment %s", params.Status, params.ShipmentID),
 				})
 				break
 			}
 		}
 	}
-
-	// Save common ledger
 	commonLedger.LastUpdated = timestamp
-	if err := lm.storage.SaveCommonLedger(commonLedger); err != nil {
-		return fmt.Errorf("failed to save common ledger: %v", err)
+
+	// If shipment carries units of a lot, update their status
+	if len(serials) > 0 {
+		setUnitStatus(manufacturerLedger, commonLedger, lot.LotID, serials, drugStatus, "", timestamp)
 	}
 
 	// Update shipment in database
 	shipment.Status = params.Status
 	shipment.BlockchainTxID = txHash
 	shipment.UpdatedAt = now
-
-	if err := lm.storage.UpdateShipment(shipment); err != nil {
-		return fmt.Errorf("failed to update shipment in database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateShipment, Shipment: shipment})
 
 	// Insert shipment status update into database
 	shipmentStatusUpdate := &models.ShipmentStatusUpdate{
@@ -447,67 +541,53 @@ func (lm *LedgerManager) UpdateShipmentStatus(params *models.UpdateShipmentStatu
 		BlockchainTxID: txHash,
 		Timestamp:      now,
 	}
-	if err := lm.storage.InsertShipmentStatusUpdate(shipmentStatusUpdate); err != nil {
-		return fmt.Errorf("failed to insert shipment status update into database: %v", err)
-	}
-
-	// If shipment is delivered, update drug status
-	if params.Status == "delivered" {
-		// Create blockchain transaction for drug status update
-		drugStatusTxHash, err := lm.blockchain.RecordDrugStatusUpdate(shipment.DrugID, "delivered", params.UserID, now)
-		if err != nil {
-			return fmt.Errorf("failed to record drug status update in blockchain: %v", err)
-		}
-
-		// Get drug from database
-		drug, err := lm.storage.GetDrug(shipment.DrugID)
-		if err != nil {
-			return fmt.Errorf("failed to get drug from database: %v", err)
-		}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertShipmentStatusUpdate, ShipmentStatusUpdate: shipmentStatusUpdate})
 
-		// Update drug status
-		drug.Status = "delivered"
+	// If shipment is delivered or returned, update drug status
+	if movesDrug {
+		// Update drug in database
+		drug.Status = drugStatus
 		drug.BlockchainTxID = drugStatusTxHash
 		drug.UpdatedAt = now
-
-		// Update drug in database
-		if err := lm.storage.UpdateDrug(drug); err != nil {
-			return fmt.Errorf("failed to update drug in database: %v", err)
-		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
 
 		// Insert drug status update into database
 		drugStatusUpdate := &models.DrugStatusUpdate{
 			DrugID:         shipment.DrugID,
-			Status:         "delivered",
+			Status:         drugStatus,
 			Location:       params.Location,
 			UpdatedBy:      params.UserID,
 			BlockchainTxID: drugStatusTxHash,
 			Timestamp:      now,
 		}
-		if err := lm.storage.InsertDrugStatusUpdate(drugStatusUpdate); err != nil {
-			return fmt.Errorf("failed to insert drug status update into database: %v", err)
-		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
 	}
 
-	return nil
+	// Journal and apply the ledger and database changes
+	return lm.commitEntry(entry, manufacturerLedger, commonLedger)
 }
 
 // RevertDrug reverts a drug in the manufacturer and common ledgers
 func (lm *LedgerManager) RevertDrug(params *models.RevertDrugParams) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return err
+	}
+
 	// Get current timestamp
 	now := time.Now()
 	timestamp := now.Format(time.RFC3339)
 
-	// Create blockchain transaction
-	txData := map[string]interface{}{
-		"drug_id":    params.DrugID,
-		"reason":     params.Reason,
-		"updated_by": params.UserID,
-		"updated_at": timestamp,
-	}
-	txHash, err := lm.blockchain.CreateTransaction("drug_revert", txData)
+	// Check that the drug can be reverted
+	drugStatus, err := lm.drugStatus(params.DrugID)
 	if err != nil {
-		return fmt.Errorf("failed to create blockchain transaction: %v", err)
+		return err
+	}
+	if err := models.CheckDrugTransition(params.DrugID, drugStatus, models.DrugReverted); err != nil {
+		return err
 	}
 
 	// Get drug from database
@@ -516,10 +596,22 @@ func (lm *LedgerManager) RevertDrug(params *models.RevertDrugParams) error {
 		return fmt.Errorf("failed to get drug from database: %v", err)
 	}
 
-	// Get manufacturer ledger
-	manufacturerLedger, err := lm.storage.GetManufacturerLedger(drug.ManufacturerID)
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("revert_drug", drug.ManufacturerID)
 	if err != nil {
-		return fmt.Errorf("failed to get manufacturer ledger: %v", err)
+		return err
+	}
+
+	// Create blockchain transaction
+	txData := map[string]interface{}{
+		"drug_id":    params.DrugID,
+		"reason":     params.Reason,
+		"updated_by": params.UserID,
+		"updated_at": timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, "drug_revert", txData)
+	if err != nil {
+		return err
 	}
 
 	// Update drug status in manufacturer ledger
@@ -536,18 +628,7 @@ func (lm *LedgerManager) RevertDrug(params *models.RevertDrugParams) error {
 			break
 		}
 	}
-
-	// Save manufacturer ledger
 	manufacturerLedger.LastUpdated = timestamp
-	if err := lm.storage.SaveManufacturerLedger(manufacturerLedger); err != nil {
-		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
-	}
-
-	// Get common ledger
-	commonLedger, err := lm.storage.GetCommonLedger()
-	if err != nil {
-		return fmt.Errorf("failed to get common ledger: %v", err)
-	}
 
 	// Update drug status in common ledger
 	for i, d := range commonLedger.Drugs {
@@ -562,21 +643,13 @@ func (lm *LedgerManager) RevertDrug(params *models.RevertDrugParams) error {
 			break
 		}
 	}
-
-	// Save common ledger
 	commonLedger.LastUpdated = timestamp
-	if err := lm.storage.SaveCommonLedger(commonLedger); err != nil {
-		return fmt.Errorf("failed to save common ledger: %v", err)
-	}
 
 	// Update drug in database
 	drug.Status = "reverted"
 	drug.BlockchainTxID = txHash
 	drug.UpdatedAt = now
-
-	if err := lm.storage.UpdateDrug(drug); err != nil {
-		return fmt.Errorf("failed to update drug in database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
 
 	// Insert drug status update into database
 	drugStatusUpdate := &models.DrugStatusUpdate{
@@ -587,11 +660,10 @@ func (lm *LedgerManager) RevertDrug(params *models.RevertDrugParams) error {
 		BlockchainTxID: txHash,
 		Timestamp:      now,
 	}
-	if err := lm.storage.InsertDrugStatusUpdate(drugStatusUpdate); err != nil {
-		return fmt.Errorf("failed to insert drug status update into database: %v", err)
-	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
 
-	return nil
+	// Journal and apply the ledger and database changes
+	return lm.commitEntry(entry, manufacturerLedger, commonLedger)
 }
 
 // VerifyDrug verifies a drug's authenticity
@@ -621,6 +693,11 @@ func (lm *LedgerManager) VerifyDrug(drugID string) (bool, error) {
 		return false, fmt.Errorf("drug not found in common ledger: %s", drugID)
 	}
 
+	// Refuse expired drugs, whether or not their expiry has been recorded yet
+	if commonDrug.CurrentStatus == models.DrugExpired || models.IsExpired(commonDrug.ExpiryDate, time.Now()) {
+		return false, errExpired("drug "+drugID, commonDrug.ExpiryDate)
+	}
+
 	// Verify drug's verification hash
 	if drug.VerificationHash != commonDrug.VerificationHash {
 		return false, nil
@@ -640,6 +717,422 @@ func (lm *LedgerManager) GetShipmentHistory(shipmentID string) ([]models.Shipmen
 	return lm.storage.GetShipmentStatusUpdates(shipmentID)
 }
 
+// RecoverFromWAL replays ledger operations that were interrupted before they completed.
+// An operation whose block cannot be appended is rolled back; one whose block is on the
+// chain is always replayed forward. An operation whose database writes fail has them
+// queued in the outbox, or without an outbox stays pending and is retried on the next
+// recovery.
+func (lm *LedgerManager) RecoverFromWAL() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	entries, err := lm.wal.Pending()
+	if err != nil {
+		return fmt.Errorf("failed to read pending WAL entries: %v", err)
+	}
+
+	for _, entry := range entries {
+		log.Printf("Replaying interrupted %s operation %s from step %d", entry.Operation, entry.ID, entry.StepsApplied)
+		if err := lm.applyEntry(entry); err != nil {
+			log.Printf("Warning: Failed to replay WAL entry %s: %v", entry.ID, err)
+			continue
+		}
+		log.Printf("Recovered %s operation %s", entry.Operation, entry.ID)
+	}
+
+	return nil
+}
+
+// drugStatus returns the current status of a drug in the common ledger
+func (lm *LedgerManager) drugStatus(drugID string) (string, error) {
+	drug, err := lm.drug(drugID)
+	if err != nil {
+		return "", err
+	}
+	return drug.CurrentStatus, nil
+}
+
+// drug returns a drug from the common ledger
+func (lm *LedgerManager) drug(drugID string) (*models.CommonDrugRecord, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, drug := range commonLedger.Drugs {
+		if drug.DrugID == drugID {
+			return &drug, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: drug %s", models.ErrRecordNotFound, drugID)
+}
+
+// shipmentStatus returns the current status of a shipment in the common ledger
+func (lm *LedgerManager) shipmentStatus(shipmentID string) (string, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return "", fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, shipment := range commonLedger.Shipments {
+		if shipment.ShipmentID == shipmentID {
+			return shipment.CurrentStatus, nil
+		}
+	}
+	return "", fmt.Errorf("%w: shipment %s", models.ErrRecordNotFound, shipmentID)
+}
+
+// drugStatusTx returns the data of a drug_update transaction
+func drugStatusTx(drugID, status, updatedBy string, timestamp time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"drug_id":    drugID,
+		"status":     status,
+		"updated_by": updatedBy,
+		"updated_at": timestamp.Format(time.RFC3339),
+	}
+}
+
+// setDrugStatus moves a drug to a new status in the manufacturer and common ledgers
+func setDrugStatus(manufacturerLedger *models.ManufacturerLedger, commonLedger *models.CommonLedger, drugID, status, timestamp, details string) {
+	for i, drug := range manufacturerLedger.Drugs {
+		if drug.DrugID == drugID {
+			manufacturerLedger.Drugs[i].Status = status
+			manufacturerLedger.Drugs[i].CurrentStatus = status
+			manufacturerLedger.Drugs[i].History = append(manufacturerLedger.Drugs[i].History, models.Status{
+				Status:    status,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	manufacturerLedger.LastUpdated = timestamp
+
+	for i, drug := range commonLedger.Drugs {
+		if drug.DrugID == drugID {
+			commonLedger.Drugs[i].Status = status
+			commonLedger.Drugs[i].CurrentStatus = status
+			commonLedger.Drugs[i].History = append(commonLedger.Drugs[i].History, models.Status{
+				Status:    status,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	commonLedger.LastUpdated = timestamp
+}
+
+// beginEntry loads the manufacturer and common ledgers and prepares a WAL entry holding
+// them as loaded. The returned ledgers are modified by the caller.
+func (lm *LedgerManager) beginEntry(operation, manufacturerID string) (*models.ManufacturerLedger, *models.CommonLedger, *storage.WALEntry, error) {
+	// An operation already on the chain has to reach the ledgers before they are read again
+	if err := lm.finishStalled(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Get manufacturer ledger
+	manufacturerLedger, err := lm.storage.GetManufacturerLedger(manufacturerID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get manufacturer ledger: %v", err)
+	}
+
+	// Get common ledger
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	entry := &storage.WALEntry{
+		Operation:              operation,
+		BaseManufacturerLedger: manufacturerLedger.Clone(),
+		BaseCommonLedger:       commonLedger.Clone(),
+	}
+
+	return manufacturerLedger, commonLedger, entry, nil
+}
+
+// addTransaction prepares a blockchain transaction of an operation, see addTransactions
+func (lm *LedgerManager) addTransaction(entry *storage.WALEntry, txType string, data map[string]interface{}) (string, error) {
+	txHashes, err := lm.addTransactions(entry, txType, []map[string]interface{}{data})
+	if err != nil {
+		return "", err
+	}
+	return txHashes[0], nil
+}
+
+// addTransactions hashes and signs a batch of blockchain transactions of an operation and
+// adds them to its WAL entry. The transactions of an operation are journaled with it and
+// appended to the chain together, in a single block, when the entry is applied.
+func (lm *LedgerManager) addTransactions(entry *storage.WALEntry, txType string, batch []map[string]interface{}) ([]string, error) {
+	txs, err := lm.blockchain.PrepareTransactions(txType, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blockchain transaction: %v", err)
+	}
+
+	txHashes := make([]string, len(txs))
+	for i, tx := range txs {
+		txHashes[i] = tx.TxHash
+	}
+	entry.Transactions = append(entry.Transactions, txs...)
+	entry.TxHashes = append(entry.TxHashes, txHashes...)
+
+	return txHashes, nil
+}
+
+// commitEntry journals an operation with its transactions and the records it changed in
+// its ledgers, then applies it
+func (lm *LedgerManager) commitEntry(entry *storage.WALEntry, manufacturerLedger *models.ManufacturerLedger, commonLedger *models.CommonLedger) error {
+	if manufacturerLedger != nil {
+		delta, err := storage.DiffManufacturerLedger(entry.BaseManufacturerLedger, manufacturerLedger)
+		if err != nil {
+			return fmt.Errorf("failed to journal %s operation: %v", entry.Operation, err)
+		}
+		if len(delta.Changes) > 0 {
+			entry.Ledgers = append(entry.Ledgers, *delta)
+		}
+	}
+	if commonLedger != nil {
+		delta, err := storage.DiffCommonLedger(entry.BaseCommonLedger, commonLedger)
+		if err != nil {
+			return fmt.Errorf("failed to journal %s operation: %v", entry.Operation, err)
+		}
+		if len(delta.Changes) > 0 {
+			entry.Ledgers = append(entry.Ledgers, *delta)
+		}
+	}
+
+	if err := lm.wal.Begin(entry); err != nil {
+		return fmt.Errorf("failed to journal %s operation: %v", entry.Operation, err)
+	}
+
+	return lm.applyEntry(entry)
+}
+
+// applyEntry executes the remaining steps of a journaled operation, recording progress
+// after each step: the block of its transactions is appended first, then the ledgers and
+// the database are written. An operation whose block cannot be appended is rolled back.
+// Once the block is on the chain the operation can only move forward, so an operation
+// whose ledgers cannot be saved stays pending and is replayed before the next operation.
+// Database writes are applied at least once: a write interrupted before its progress was
+// recorded is repeated on replay, and a write Supabase rejects is handed to the outbox
+// since the ledgers already hold the change.
+func (lm *LedgerManager) applyEntry(entry *storage.WALEntry) error {
+	chainSteps := entry.ChainSteps()
+	ledgerSteps := chainSteps + entry.LedgerSteps()
+	totalSteps := ledgerSteps + len(entry.Writes)
+
+	for entry.StepsApplied < totalSteps {
+		step := entry.StepsApplied
+
+		var err error
+		switch {
+		case step < chainSteps:
+			err = lm.blockchain.AppendTransactions(entry.Transactions)
+		case step < ledgerSteps:
+			err = lm.applyLedgerStep(entry, step-chainSteps)
+		default:
+			write := entry.Writes[step-ledgerSteps]
+			if err = lm.applyWrite(write); err != nil && lm.outbox != nil {
+				err = lm.deferWrite(entry, write, err)
+			}
+		}
+
+		if err != nil {
+			switch {
+			case step < chainSteps:
+				// Nothing of the operation was applied yet
+				lm.rollBackEntry(entry, err)
+			case step < ledgerSteps:
+				// The block is on the chain, so the ledgers have to catch up with it
+				lm.stalled = entry
+				return fmt.Errorf("%v (%s operation %s is on the chain and will be replayed)", err, entry.Operation, entry.ID)
+			}
+			return err
+		}
+
+		entry.StepsApplied++
+		if err := lm.wal.Update(entry); err != nil {
+			return fmt.Errorf("failed to record progress of %s operation: %v", entry.Operation, err)
+		}
+	}
+
+	if err := lm.wal.Commit(entry); err != nil {
+		return fmt.Errorf("failed to commit %s operation: %v", entry.Operation, err)
+	}
+
+	return nil
+}
+
+// finishStalled replays an operation whose block was appended but whose ledgers could not
+// be saved, so later operations start from ledgers that match the chain
+func (lm *LedgerManager) finishStalled() error {
+	entry := lm.stalled
+	if entry == nil {
+		return nil
+	}
+	lm.stalled = nil
+
+	log.Printf("Replaying unfinished %s operation %s from step %d", entry.Operation, entry.ID, entry.StepsApplied)
+	if err := lm.applyEntry(entry); err != nil {
+		if lm.stalled != nil {
+			return fmt.Errorf("unfinished %s operation %s could not be replayed: %v", entry.Operation, entry.ID, err)
+		}
+		// The ledgers are saved, the remaining database writes wait for the next recovery
+		log.Printf("Warning: Failed to replay WAL entry %s: %v", entry.ID, err)
+	}
+
+	return nil
+}
+
+// applyLedgerStep applies the records an operation changed in one of its ledgers. A ledger
+// still at the version the changes were made to takes them as journaled. On replay, a
+// ledger at a later version already holds the step or was written since by a later
+// operation, so only records still as the operation found them are changed and a record
+// a later operation changed is kept.
+func (lm *LedgerManager) applyLedgerStep(entry *storage.WALEntry, step int) error {
+	delta := &entry.Ledgers[step]
+
+	if delta.ManufacturerID == "" {
+		commonLedger, err := lm.storage.GetCommonLedger()
+		if err != nil {
+			return fmt.Errorf("failed to get common ledger: %v", err)
+		}
+		applied, conflicts, err := delta.ApplyToCommonLedger(commonLedger)
+		if err != nil {
+			return fmt.Errorf("failed to apply changes to common ledger: %v", err)
+		}
+		if !ledgerStepNeeded(entry, "common", commonLedger.Version, delta, applied, conflicts) {
+			return nil
+		}
+		if commonLedger.Version == delta.BaseVersion {
+			commonLedger.LastUpdated = delta.LastUpdated
+		}
+		commonLedger.Version++
+
+		// Save common ledger
+		if err := lm.storage.SaveCommonLedger(commonLedger); err != nil {
+			return fmt.Errorf("failed to save common ledger: %v", err)
+		}
+		return nil
+	}
+
+	manufacturerLedger, err := lm.storage.GetManufacturerLedger(delta.ManufacturerID)
+	if err != nil {
+		return fmt.Errorf("failed to get manufacturer ledger: %v", err)
+	}
+	applied, conflicts, err := delta.ApplyToManufacturerLedger(manufacturerLedger)
+	if err != nil {
+		return fmt.Errorf("failed to apply changes to manufacturer ledger: %v", err)
+	}
+	if !ledgerStepNeeded(entry, "manufacturer", manufacturerLedger.Version, delta, applied, conflicts) {
+		return nil
+	}
+	if manufacturerLedger.Version == delta.BaseVersion {
+		manufacturerLedger.LastUpdated = delta.LastUpdated
+	}
+	manufacturerLedger.Version++
+
+	// Save manufacturer ledger
+	if err := lm.storage.SaveManufacturerLedger(manufacturerLedger); err != nil {
+		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
+	}
+	return nil
+}
+
+// ledgerStepNeeded reports whether a ledger has to be saved after a delta was applied to
+// it: always at the version the delta was made to, and at a later version only if the
+// delta changed records the ledger did not hold yet. Records kept as a later operation
+// changed them are logged.
+func ledgerStepNeeded(entry *storage.WALEntry, ledger string, version int64, delta *storage.LedgerDelta, applied int, conflicts []string) bool {
+	if len(conflicts) > 0 {
+		log.Printf("Warning: %s operation %s kept %s in the %s ledger as a later operation changed them", entry.Operation, entry.ID, strings.Join(conflicts, ", "), ledger)
+	}
+	return version == delta.BaseVersion || applied > 0
+}
+
+// applyWrite applies a single journaled database write
+func (lm *LedgerManager) applyWrite(write storage.WALWrite) error {
+	switch write.Action {
+	case storage.WALInsertDrug:
+		if err := lm.storage.InsertDrug(write.Drug); err != nil {
+			return fmt.Errorf("failed to insert drug into database: %v", err)
+		}
+	case storage.WALUpdateDrug:
+		if err := lm.storage.UpdateDrug(write.Drug); err != nil {
+			return fmt.Errorf("failed to update drug in database: %v", err)
+		}
+	case storage.WALInsertLot:
+		if err := lm.storage.InsertLot(write.Lot); err != nil {
+			return fmt.Errorf("failed to insert lot into database: %v", err)
+		}
+	case storage.WALUpdateLot:
+		if err := lm.storage.UpdateLot(write.Lot); err != nil {
+			return fmt.Errorf("failed to update lot in database: %v", err)
+		}
+	case storage.WALInsertRecall:
+		if err := lm.storage.InsertRecall(write.Recall); err != nil {
+			return fmt.Errorf("failed to insert recall into database: %v", err)
+		}
+	case storage.WALInsertDrugStatusUpdate:
+		if err := lm.storage.InsertDrugStatusUpdate(write.DrugStatusUpdate); err != nil {
+			return fmt.Errorf("failed to insert drug status update into database: %v", err)
+		}
+	case storage.WALInsertShipment:
+		if err := lm.storage.InsertShipment(write.Shipment); err != nil {
+			return fmt.Errorf("failed to insert shipment into database: %v", err)
+		}
+	case storage.WALUpdateShipment:
+		if err := lm.storage.UpdateShipment(write.Shipment); err != nil {
+			return fmt.Errorf("failed to update shipment in database: %v", err)
+		}
+	case storage.WALInsertShipmentStatusUpdate:
+		if err := lm.storage.InsertShipmentStatusUpdate(write.ShipmentStatusUpdate); err != nil {
+			return fmt.Errorf("failed to insert shipment status update into database: %v", err)
+		}
+	case storage.WALInsertPrescription:
+		if err := lm.storage.InsertPrescription(write.Prescription); err != nil {
+			return fmt.Errorf("failed to insert prescription into database: %v", err)
+		}
+	case storage.WALUpdatePrescription:
+		if err := lm.storage.UpdatePrescription(write.Prescription); err != nil {
+			return fmt.Errorf("failed to update prescription in database: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown WAL write action: %s", write.Action)
+	}
+
+	return nil
+}
+
+// deferWrite queues a database write that failed in the outbox, versioned at the time of
+// the operation, so the sync service pushes it once Supabase accepts writes again
+func (lm *LedgerManager) deferWrite(entry *storage.WALEntry, write storage.WALWrite, cause error) error {
+	change, err := storage.NewOutboxChange(write, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%v (and failed to queue it: %v)", cause, err)
+	}
+	change.LastError = cause.Error()
+
+	if err := lm.outbox.Enqueue(change); err != nil {
+		return fmt.Errorf("%v (and failed to queue it: %v)", cause, err)
+	}
+
+	log.Printf("Warning: Queued %s write of %s operation %s for the next sync: %v", change.Table, entry.Operation, entry.ID, cause)
+	return nil
+}
+
+// rollBackEntry marks an operation whose block could not be appended as rolled back. Its
+// ledgers are only written after the block, so there is nothing to restore.
+func (lm *LedgerManager) rollBackEntry(entry *storage.WALEntry, cause error) {
+	if err := lm.wal.RollBack(entry, cause); err != nil {
+		log.Printf("Warning: Failed to mark WAL entry %s as rolled back: %v", entry.ID, err)
+		return
+	}
+
+	log.Printf("Rolled back %s operation %s: %v", entry.Operation, entry.ID, cause)
+}
+
 // generateVerificationHash generates a unique hash for drug verification
 func (lm *LedgerManager) generateVerificationHash(drugID, manufacturerID, timestamp string) string {
 	h := sha256.New()
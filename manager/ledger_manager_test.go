@@ -0,0 +1,504 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/blockchain"
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// fakeStore keeps the ledgers in a file backend and the database records in memory. A
+// database or ledger write named in fail returns an error.
+type fakeStore struct {
+	storage.Backend
+	drugs         map[string]*models.Drug
+	lots          map[string]*models.Lot
+	shipments     map[string]*models.Shipment
+	prescriptions map[string]*models.Prescription
+	statusUpdates []models.DrugStatusUpdate
+	fail          map[string]bool
+}
+
+// copyOf returns a copy of a record, so the store does not share it with the caller
+func copyOf[T any](record *T) *T {
+	c := *record
+	return &c
+}
+
+// failed returns an error if the write is set to fail
+func (f *fakeStore) failed(write string) error {
+	if f.fail[write] {
+		return fmt.Errorf("%s failed", write)
+	}
+	return nil
+}
+
+func (f *fakeStore) GetManufacturerLedger(manufacturerID string) (*models.ManufacturerLedger, error) {
+	ledger, err := f.Backend.GetManufacturerLedger(manufacturerID)
+	if err != nil {
+		return models.NewManufacturerLedger(manufacturerID), nil
+	}
+	return ledger, nil
+}
+
+func (f *fakeStore) SaveManufacturerLedger(ledger *models.ManufacturerLedger) error {
+	if err := f.failed("SaveManufacturerLedger"); err != nil {
+		return err
+	}
+	return f.Backend.SaveManufacturerLedger(ledger)
+}
+
+func (f *fakeStore) SaveCommonLedger(ledger *models.CommonLedger) error {
+	if err := f.failed("SaveCommonLedger"); err != nil {
+		return err
+	}
+	return f.Backend.SaveCommonLedger(ledger)
+}
+
+func (f *fakeStore) InsertDrug(drug *models.Drug) error {
+	f.drugs[drug.ID] = copyOf(drug)
+	return nil
+}
+
+func (f *fakeStore) UpdateDrug(drug *models.Drug) error {
+	if err := f.failed("UpdateDrug"); err != nil {
+		return err
+	}
+	f.drugs[drug.ID] = copyOf(drug)
+	return nil
+}
+
+func (f *fakeStore) GetDrug(drugID string) (*models.Drug, error) {
+	if f.drugs[drugID] == nil {
+		return nil, fmt.Errorf("%w: drug %s", models.ErrRecordNotFound, drugID)
+	}
+	return copyOf(f.drugs[drugID]), nil
+}
+
+func (f *fakeStore) InsertLot(lot *models.Lot) error {
+	f.lots[lot.ID] = copyOf(lot)
+	return nil
+}
+
+func (f *fakeStore) UpdateLot(lot *models.Lot) error {
+	f.lots[lot.ID] = copyOf(lot)
+	return nil
+}
+
+func (f *fakeStore) GetLot(lotID string) (*models.Lot, error) {
+	if f.lots[lotID] == nil {
+		return nil, fmt.Errorf("%w: lot %s", models.ErrRecordNotFound, lotID)
+	}
+	return copyOf(f.lots[lotID]), nil
+}
+
+func (f *fakeStore) InsertRecall(*models.Recall) error {
+	return nil
+}
+
+func (f *fakeStore) InsertDrugStatusUpdate(update *models.DrugStatusUpdate) error {
+	if err := f.failed("InsertDrugStatusUpdate"); err != nil {
+		return err
+	}
+	f.statusUpdates = append(f.statusUpdates, *update)
+	return nil
+}
+
+func (f *fakeStore) GetDrugStatusUpdates(drugID string) ([]models.DrugStatusUpdate, error) {
+	var updates []models.DrugStatusUpdate
+	for _, update := range f.statusUpdates {
+		if update.DrugID == drugID {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+func (f *fakeStore) InsertShipment(shipment *models.Shipment) error {
+	f.shipments[shipment.ID] = copyOf(shipment)
+	return nil
+}
+
+func (f *fakeStore) UpdateShipment(shipment *models.Shipment) error {
+	f.shipments[shipment.ID] = copyOf(shipment)
+	return nil
+}
+
+func (f *fakeStore) GetShipment(shipmentID string) (*models.Shipment, error) {
+	if f.shipments[shipmentID] == nil {
+		return nil, fmt.Errorf("%w: shipment %s", models.ErrRecordNotFound, shipmentID)
+	}
+	return copyOf(f.shipments[shipmentID]), nil
+}
+
+func (f *fakeStore) InsertShipmentStatusUpdate(*models.ShipmentStatusUpdate) error {
+	return nil
+}
+
+func (f *fakeStore) GetShipmentStatusUpdates(string) ([]models.ShipmentStatusUpdate, error) {
+	return nil, nil
+}
+
+func (f *fakeStore) InsertPrescription(prescription *models.Prescription) error {
+	f.prescriptions[prescription.ID] = copyOf(prescription)
+	return nil
+}
+
+func (f *fakeStore) UpdatePrescription(prescription *models.Prescription) error {
+	f.prescriptions[prescription.ID] = copyOf(prescription)
+	return nil
+}
+
+func (f *fakeStore) GetPrescription(prescriptionID string) (*models.Prescription, error) {
+	if f.prescriptions[prescriptionID] == nil {
+		return nil, fmt.Errorf("%w: prescription %s", models.ErrRecordNotFound, prescriptionID)
+	}
+	return copyOf(f.prescriptions[prescriptionID]), nil
+}
+
+// newTestManager creates a ledger manager over a fake store in a temporary directory,
+// with signing keys for manufacturer m1, distributor d1, doctor doc1 and pharmacy ph1.
+// Supabase is unreachable, so only the local chain is written.
+func newTestManager(t *testing.T) (*LedgerManager, *fakeStore) {
+	t.Helper()
+	dir := t.TempDir()
+
+	// The data storage keeps its files relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Setenv("SUPABASE_URL", "http://127.0.0.1:1")
+	t.Setenv("SUPABASE_KEY", "test")
+	t.Setenv("SUPABASE_SERVICE_KEY", "test")
+
+	backend, err := storage.NewFileBackend(filepath.Join(dir, "ledger_data"), filepath.Join(dir, "ledger_records"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	if err := backend.SaveCommonLedger(models.NewCommonLedger()); err != nil {
+		t.Fatal(err)
+	}
+	dataStorage, err := storage.NewDataStorage(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := blockchain.NewKeyStore(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("m1", blockchain.RoleManufacturer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("d1", blockchain.RoleDistributor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("doc1", blockchain.RoleDoctor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.GenerateKey("ph1", blockchain.RolePharmacy); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := storage.NewWAL(filepath.Join(dir, "ledger_wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &fakeStore{
+		Backend:       backend,
+		drugs:         map[string]*models.Drug{},
+		lots:          map[string]*models.Lot{},
+		shipments:     map[string]*models.Shipment{},
+		prescriptions: map[string]*models.Prescription{},
+		fail:          map[string]bool{},
+	}
+	return NewLedgerManager(fs, blockchain.NewBlockchainService(dataStorage, keys), wal, nil), fs
+}
+
+// restart returns a new ledger manager over the storage of lm, as after a crash
+func restart(lm *LedgerManager) *LedgerManager {
+	return NewLedgerManager(lm.storage, lm.blockchain, lm.wal, lm.outbox)
+}
+
+// createTestDrug creates drug D1 of manufacturer m1
+func createTestDrug(t *testing.T, lm *LedgerManager) {
+	t.Helper()
+	params := &models.CreateDrugParams{
+		DrugID:         "D1",
+		ManufacturerID: "m1",
+		Name:           "Test drug",
+		ExpiryDate:     time.Now().AddDate(1, 0, 0).Format("2006-01-02"),
+		UserID:         "m1",
+	}
+	if _, err := lm.CreateDrug(params); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setTestDrugStatus moves drug D1 to a status in an operation of five steps: the chain,
+// the manufacturer and common ledgers, and two database writes
+func setTestDrugStatus(lm *LedgerManager, status string) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("set_drug_status", "m1")
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	txHash, err := lm.addTransaction(entry, "drug_update", drugStatusTx("D1", status, "m1", now))
+	if err != nil {
+		return "", err
+	}
+	setDrugStatus(manufacturerLedger, commonLedger, "D1", status, now.Format(time.RFC3339Nano), "")
+
+	entry.Writes = append(entry.Writes,
+		storage.WALWrite{Action: storage.WALUpdateDrug, Drug: &models.Drug{ID: "D1", ManufacturerID: "m1", Status: status, BlockchainTxID: txHash}},
+		storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: &models.DrugStatusUpdate{DrugID: "D1", Status: status, BlockchainTxID: txHash}},
+	)
+
+	return txHash, lm.commitEntry(entry, manufacturerLedger, commonLedger)
+}
+
+// rewind records a pending operation as applied up to a step, as if the process crashed
+// after the next step was executed but before its progress was recorded
+func rewind(t *testing.T, wal *storage.WAL, steps int) {
+	t.Helper()
+	entries, err := wal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d pending WAL entries, want 1", len(entries))
+	}
+	entries[0].StepsApplied = steps
+	if err := wal.Update(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countTransaction returns the number of times a transaction was appended to the chain
+func countTransaction(t *testing.T, fs *fakeStore, txHash string) int {
+	t.Helper()
+	blocks, err := fs.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			if tx.TxHash == txHash {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// drugHistory returns the statuses of drug D1 in the manufacturer and common ledgers and
+// the versions of the ledgers
+func drugHistory(t *testing.T, fs *fakeStore) (manufacturer, common []string, manufacturerVersion, commonVersion int64) {
+	t.Helper()
+	manufacturerLedger, err := fs.GetManufacturerLedger("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drug := range manufacturerLedger.Drugs {
+		for _, status := range drug.History {
+			manufacturer = append(manufacturer, status.Status)
+		}
+	}
+	commonLedger, err := fs.GetCommonLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drug := range commonLedger.Drugs {
+		for _, status := range drug.History {
+			common = append(common, status.Status)
+		}
+	}
+	return manufacturer, common, manufacturerLedger.Version, commonLedger.Version
+}
+
+func TestRecoverFromWAL(t *testing.T) {
+	tests := []struct {
+		name string
+		fail string // write failing the step after the crash
+		step int    // steps recorded as applied when the process crashed
+	}{
+		{"crash after the chain step", "SaveManufacturerLedger", 0},
+		{"crash after the ledger step", "UpdateDrug", 1},
+		{"crash after the database step", "InsertDrugStatusUpdate", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lm, fs := newTestManager(t)
+			createTestDrug(t, lm)
+			_, _, manufacturerVersion, commonVersion := drugHistory(t, fs)
+
+			fs.fail[tt.fail] = true
+			txHash, err := setTestDrugStatus(lm, models.DrugDelivered)
+			if err == nil {
+				t.Fatal("expected the operation to be interrupted")
+			}
+			rewind(t, lm.wal, tt.step)
+
+			delete(fs.fail, tt.fail)
+			lm = restart(lm)
+			if err := lm.RecoverFromWAL(); err != nil {
+				t.Fatal(err)
+			}
+
+			if pending, err := lm.wal.Pending(); err != nil || len(pending) != 0 {
+				t.Fatalf("%d WAL entries pending after recovery (%v)", len(pending), err)
+			}
+			if count := countTransaction(t, fs, txHash); count != 1 {
+				t.Fatalf("transaction appended %d times, want once", count)
+			}
+			manufacturer, common, gotManufacturerVersion, gotCommonVersion := drugHistory(t, fs)
+			want := []string{models.DrugCreated, models.DrugDelivered}
+			if fmt.Sprint(manufacturer) != fmt.Sprint(want) || fmt.Sprint(common) != fmt.Sprint(want) {
+				t.Fatalf("drug history = %v and %v, want %v", manufacturer, common, want)
+			}
+			if gotManufacturerVersion != manufacturerVersion+1 || gotCommonVersion != commonVersion+1 {
+				t.Fatalf("ledger versions = %d and %d, want %d and %d", gotManufacturerVersion, gotCommonVersion, manufacturerVersion+1, commonVersion+1)
+			}
+			if drug := fs.drugs["D1"]; drug.Status != models.DrugDelivered || drug.BlockchainTxID != txHash {
+				t.Fatalf("database drug = %s (%s)", drug.Status, drug.BlockchainTxID)
+			}
+			if updates, _ := fs.GetDrugStatusUpdates("D1"); len(updates) != 2 {
+				t.Fatalf("%d drug status updates in the database, want 2", len(updates))
+			}
+		})
+	}
+}
+
+func TestRecoverFromWALKeepsLaterLedgerChanges(t *testing.T) {
+	lm, fs := newTestManager(t)
+	createTestDrug(t, lm)
+
+	// The operation reaches the ledgers but crashes before recording it, and its entry is
+	// still pending when the next operation changes the same drug
+	fs.fail["UpdateDrug"] = true
+	if _, err := setTestDrugStatus(lm, models.DrugDelivered); err == nil {
+		t.Fatal("expected the operation to be interrupted")
+	}
+	rewind(t, lm.wal, 1)
+	delete(fs.fail, "UpdateDrug")
+
+	lm = restart(lm)
+	if _, err := setTestDrugStatus(lm, models.DrugDispensed); err != nil {
+		t.Fatal(err)
+	}
+	_, _, manufacturerVersion, commonVersion := drugHistory(t, fs)
+
+	if err := lm.RecoverFromWAL(); err != nil {
+		t.Fatal(err)
+	}
+
+	manufacturer, common, gotManufacturerVersion, gotCommonVersion := drugHistory(t, fs)
+	want := []string{models.DrugCreated, models.DrugDelivered, models.DrugDispensed}
+	if fmt.Sprint(manufacturer) != fmt.Sprint(want) || fmt.Sprint(common) != fmt.Sprint(want) {
+		t.Fatalf("drug history = %v and %v, want %v", manufacturer, common, want)
+	}
+	if gotManufacturerVersion != manufacturerVersion || gotCommonVersion != commonVersion {
+		t.Fatal("replaying an operation the ledgers already hold rewrote them")
+	}
+}
+
+func TestStalledOperationIsFinishedBeforeTheNext(t *testing.T) {
+	lm, fs := newTestManager(t)
+	createTestDrug(t, lm)
+
+	// The block is appended but the common ledger cannot be saved
+	fs.fail["SaveCommonLedger"] = true
+	txHash, err := setTestDrugStatus(lm, models.DrugDelivered)
+	if err == nil {
+		t.Fatal("expected the operation to stall")
+	}
+	if count := countTransaction(t, fs, txHash); count != 1 {
+		t.Fatalf("transaction appended %d times, want once", count)
+	}
+
+	// The next operation first brings the ledgers up to the chain
+	delete(fs.fail, "SaveCommonLedger")
+	if _, err := setTestDrugStatus(lm, models.DrugDispensed); err != nil {
+		t.Fatal(err)
+	}
+
+	manufacturer, common, _, _ := drugHistory(t, fs)
+	want := []string{models.DrugCreated, models.DrugDelivered, models.DrugDispensed}
+	if fmt.Sprint(manufacturer) != fmt.Sprint(want) || fmt.Sprint(common) != fmt.Sprint(want) {
+		t.Fatalf("drug history = %v and %v, want %v", manufacturer, common, want)
+	}
+}
+
+func TestIllegalTransitionsAreRejected(t *testing.T) {
+	lm, fs := newTestManager(t)
+	createTestDrug(t, lm)
+	if _, err := lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S1", DrugID: "D1", ManufacturerID: "m1", DistributorID: "d1", UserID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	updateShipment := func(status string) error {
+		return lm.UpdateShipmentStatus(&models.UpdateShipmentStatusParams{ShipmentID: "S1", Status: status, UserID: "d1"})
+	}
+	revertDrug := func() error {
+		return lm.RevertDrug(&models.RevertDrugParams{DrugID: "D1", ManufacturerID: "m1", UserID: "m1"})
+	}
+
+	tests := []struct {
+		name    string
+		setup   []string // shipment states reached before the rejected call
+		call    func() error
+		entity  string
+		from    string
+		allowed []string
+	}{
+		{"shipment delivered before it was picked up", nil, func() error { return updateShipment(models.ShipmentDelivered) }, "shipment", models.ShipmentCreated, models.ShipmentTransitions[models.ShipmentCreated]},
+		{"delivered drug reverted", []string{models.ShipmentPickedUp, models.ShipmentInTransit, models.ShipmentDelivered}, revertDrug, "drug", models.DrugDelivered, models.DrugTransitions[models.DrugDelivered]},
+		{"delivered shipment returned", nil, func() error { return updateShipment(models.ShipmentReturned) }, "shipment", models.ShipmentDelivered, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, status := range tt.setup {
+				if err := updateShipment(status); err != nil {
+					t.Fatal(err)
+				}
+			}
+			height, _, _ := fs.Tip()
+
+			var transitionErr *models.TransitionError
+			if err := tt.call(); !errors.As(err, &transitionErr) {
+				t.Fatalf("err = %v, want a transition error", err)
+			}
+			if transitionErr.Entity != tt.entity || transitionErr.From != tt.from || fmt.Sprint(transitionErr.Allowed) != fmt.Sprint(tt.allowed) {
+				t.Fatalf("transition error = %+v", transitionErr)
+			}
+
+			// A rejected transition reaches neither the chain nor the WAL
+			if after, _, _ := fs.Tip(); after != height {
+				t.Fatalf("rejected transition appended %d blocks", after-height)
+			}
+			if pending, _ := lm.wal.Pending(); len(pending) != 0 {
+				t.Fatalf("rejected transition left %d WAL entries", len(pending))
+			}
+		})
+	}
+}
@@ -0,0 +1,627 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// CreateLot creates a lot of serialized units of a drug in the manufacturer and common
+// ledgers, with every unit in the created state
+func (lm *LedgerManager) CreateLot(params *models.CreateLotParams) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return "", err
+	}
+
+	// Get current timestamp
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+
+	// Validate the lot and number its units
+	if err := models.ValidateGTIN(params.GTIN); err != nil {
+		return "", err
+	}
+	if params.BatchNumber == "" {
+		return "", fmt.Errorf("%w: batch_number is required", models.ErrInvalidLot)
+	}
+	if err := models.ValidateDates(params.ManufactureDate, params.ExpiryDate, true); err != nil {
+		return "", err
+	}
+
+	// Check the drug, and that no unit with the same GTIN and serial exists in another lot
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return "", fmt.Errorf("failed to get common ledger: %v", err)
+	}
+	serials, err := lotSerials(params, nextSerial(commonLedger, params.GTIN))
+	if err != nil {
+		return "", err
+	}
+	drugFound := false
+	for _, drug := range commonLedger.Drugs {
+		if drug.DrugID == params.DrugID {
+			if drug.ManufacturerID != params.ManufacturerID {
+				return "", fmt.Errorf("%w: drug %s belongs to another manufacturer", models.ErrInvalidLot, params.DrugID)
+			}
+			drugFound = true
+			break
+		}
+	}
+	if !drugFound {
+		return "", fmt.Errorf("%w: drug %s", models.ErrRecordNotFound, params.DrugID)
+	}
+	newSerials := make(map[string]bool, len(serials))
+	for _, serial := range serials {
+		newSerials[serial] = true
+	}
+	for _, lot := range commonLedger.Lots {
+		if lot.LotID == params.LotID {
+			return "", fmt.Errorf("%w: lot %s already exists", models.ErrInvalidLot, params.LotID)
+		}
+		if lot.GTIN != params.GTIN {
+			continue
+		}
+		for _, unit := range lot.Units {
+			if newSerials[unit.Serial] {
+				return "", fmt.Errorf("%w: unit %s already belongs to lot %s", models.ErrInvalidLot, models.UnitID(params.GTIN, unit.Serial), lot.LotID)
+			}
+		}
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("create_lot", params.ManufacturerID)
+	if err != nil {
+		return "", err
+	}
+
+	// Create blockchain transaction
+	txData := map[string]interface{}{
+		"lot_id":           params.LotID,
+		"drug_id":          params.DrugID,
+		"manufacturer_id":  params.ManufacturerID,
+		"gtin":             params.GTIN,
+		"batch_number":     params.BatchNumber,
+		"manufacture_date": params.ManufactureDate,
+		"expiry_date":      params.ExpiryDate,
+		"unit_count":       len(serials),
+		"serials":          serials,
+		"signer_id":        params.ManufacturerID,
+		"created_at":       timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, "lot_create", txData)
+	if err != nil {
+		return "", err
+	}
+
+	history := []models.Status{
+		{
+			Status:    models.LotCreated,
+			Timestamp: timestamp,
+			Details:   fmt.Sprintf("Lot created with %d units", len(serials)),
+		},
+	}
+
+	// Add lot to manufacturer ledger
+	manufacturerLedger.Lots = append(manufacturerLedger.Lots, models.LotRecord{
+		LotID:           params.LotID,
+		DrugID:          params.DrugID,
+		GTIN:            params.GTIN,
+		BatchNumber:     params.BatchNumber,
+		ManufactureDate: params.ManufactureDate,
+		ExpiryDate:      params.ExpiryDate,
+		Status:          models.LotCreated,
+		CreatedAt:       timestamp,
+		CurrentStatus:   models.LotCreated,
+		History:         history,
+		Units:           newUnits(serials, timestamp),
+	})
+	manufacturerLedger.LastUpdated = timestamp
+
+	// Add lot to common ledger
+	commonLedger.Lots = append(commonLedger.Lots, models.CommonLotRecord{
+		LotID:           params.LotID,
+		DrugID:          params.DrugID,
+		ManufacturerID:  params.ManufacturerID,
+		GTIN:            params.GTIN,
+		BatchNumber:     params.BatchNumber,
+		ManufactureDate: params.ManufactureDate,
+		ExpiryDate:      params.ExpiryDate,
+		Status:          models.LotCreated,
+		CreatedAt:       timestamp,
+		CurrentStatus:   models.LotCreated,
+		History:         append([]models.Status{}, history...),
+		Units:           newUnits(serials, timestamp),
+	})
+	commonLedger.LastUpdated = timestamp
+
+	// Insert lot into database
+	lot := &models.Lot{
+		ID:              params.LotID,
+		DrugID:          params.DrugID,
+		ManufacturerID:  params.ManufacturerID,
+		GTIN:            params.GTIN,
+		BatchNumber:     params.BatchNumber,
+		ManufactureDate: params.ManufactureDate,
+		ExpiryDate:      params.ExpiryDate,
+		UnitCount:       len(serials),
+		Status:          models.LotCreated,
+		BlockchainTxID:  txHash,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertLot, Lot: lot})
+
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return "", err
+	}
+
+	return txHash, nil
+}
+
+// UpdateUnitStatus moves the selected units of a lot to a new status in the manufacturer
+// and common ledgers. Units enter and leave transit only through shipments.
+func (lm *LedgerManager) UpdateUnitStatus(params *models.UpdateUnitStatusParams) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return "", err
+	}
+
+	// Get current timestamp
+	timestamp := time.Now().Format(time.RFC3339)
+
+	if params.Status == models.DrugInTransit || params.Status == models.DrugDelivered {
+		return "", fmt.Errorf("%w: units become %s through shipments", models.ErrInvalidLot, params.Status)
+	}
+
+	// Check that every selected unit may move to the new status
+	lot, err := lm.lot(params.LotID)
+	if err != nil {
+		return "", err
+	}
+	serials, err := selectUnits(lot, params.UnitSelection)
+	if err != nil {
+		return "", err
+	}
+	if len(serials) == 0 {
+		return "", fmt.Errorf("%w: select units by serials or by serial_from and serial_to", models.ErrInvalidLot)
+	}
+	if err := checkUnitTransitions(lot, serials, params.Status); err != nil {
+		return "", err
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("update_unit_status", lot.ManufacturerID)
+	if err != nil {
+		return "", err
+	}
+
+	// Create blockchain transaction signed by the lot's manufacturer
+	txHash, err := lm.addTransaction(entry, "unit_status_update", unitStatusTx(lot, serials, params.Status, params.Reason, params.UserID, timestamp))
+	if err != nil {
+		return "", err
+	}
+
+	// Update unit status in both ledgers
+	setUnitStatus(manufacturerLedger, commonLedger, lot.LotID, serials, params.Status, "", timestamp)
+
+	// Journal and apply the ledger changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return "", err
+	}
+
+	return txHash, nil
+}
+
+// ListLots retrieves the lots in the common ledger, optionally filtered by drug and
+// manufacturer. Units are left out; each lot reports its number of units in each status.
+func (lm *LedgerManager) ListLots(drugID, manufacturerID string) ([]models.LotView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	lots := []models.LotView{}
+	for _, lot := range commonLedger.Lots {
+		if drugID != "" && lot.DrugID != drugID {
+			continue
+		}
+		if manufacturerID != "" && lot.ManufacturerID != manufacturerID {
+			continue
+		}
+
+		view, err := lm.lotView(lot)
+		if err != nil {
+			return nil, err
+		}
+		view.Units = nil
+		lots = append(lots, *view)
+	}
+
+	return lots, nil
+}
+
+// GetLot retrieves a lot and its units from the common ledger
+func (lm *LedgerManager) GetLot(lotID string) (*models.LotView, error) {
+	lot, err := lm.lot(lotID)
+	if err != nil {
+		return nil, err
+	}
+	return lm.lotView(*lot)
+}
+
+// GetUnit retrieves a serialized unit from the common ledger by its GTIN and serial
+func (lm *LedgerManager) GetUnit(gtin, serial string) (*models.UnitView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, lot := range commonLedger.Lots {
+		if lot.GTIN != gtin {
+			continue
+		}
+		for _, unit := range lot.Units {
+			if unit.Serial != serial {
+				continue
+			}
+
+			// Keep the lot's transactions that name this unit
+			txs, err := lm.blockchain.GetTransactionsByIndex(storage.IndexLot, lot.LotID)
+			if err != nil {
+				return nil, err
+			}
+			txIDs := []string{}
+			for _, tx := range txs {
+				if txNamesSerial(tx.TxData, serial) {
+					txIDs = append(txIDs, tx.TxHash)
+				}
+			}
+
+			return &models.UnitView{
+				UnitRecord:      unit,
+				GTIN:            lot.GTIN,
+				LotID:           lot.LotID,
+				DrugID:          lot.DrugID,
+				ManufacturerID:  lot.ManufacturerID,
+				BatchNumber:     lot.BatchNumber,
+				ExpiryDate:      lot.ExpiryDate,
+				BlockchainTxIDs: txIDs,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unit %s", models.ErrRecordNotFound, models.UnitID(gtin, serial))
+}
+
+// lot returns a lot from the common ledger
+func (lm *LedgerManager) lot(lotID string) (*models.CommonLotRecord, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, lot := range commonLedger.Lots {
+		if lot.LotID == lotID {
+			return &lot, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: lot %s", models.ErrRecordNotFound, lotID)
+}
+
+// lotView joins a common ledger lot with its unit counts and blockchain transactions
+func (lm *LedgerManager) lotView(record models.CommonLotRecord) (*models.LotView, error) {
+	txIDs, err := lm.transactionIDs(storage.IndexLot, record.LotID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, unit := range record.Units {
+		counts[unit.Status]++
+	}
+
+	return &models.LotView{
+		CommonLotRecord: record,
+		UnitCounts:      counts,
+		BlockchainTxIDs: txIDs,
+	}, nil
+}
+
+// unitStatusTx returns the data of a unit_status_update transaction, signed by the lot's
+// manufacturer
+func unitStatusTx(lot *models.CommonLotRecord, serials []string, status, reason, updatedBy, timestamp string) map[string]interface{} {
+	return map[string]interface{}{
+		"lot_id":     lot.LotID,
+		"drug_id":    lot.DrugID,
+		"gtin":       lot.GTIN,
+		"serials":    serials,
+		"status":     status,
+		"reason":     reason,
+		"updated_by": updatedBy,
+		"signer_id":  lot.ManufacturerID,
+		"updated_at": timestamp,
+	}
+}
+
+// lotSerials returns the serials of a new lot: the given ones, or UnitCount serials
+// numbered upwards from first when none are given
+func lotSerials(params *models.CreateLotParams, first int) ([]string, error) {
+	serials := params.Serials
+	if len(serials) == 0 {
+		if params.UnitCount <= 0 {
+			return nil, fmt.Errorf("%w: serials or a positive unit_count is required", models.ErrInvalidLot)
+		}
+		if params.UnitCount > models.MaxLotUnits {
+			return nil, fmt.Errorf("%w: a lot may hold at most %d units", models.ErrInvalidLot, models.MaxLotUnits)
+		}
+		serials = make([]string, params.UnitCount)
+		for i := range serials {
+			serials[i] = fmt.Sprintf("%06d", first+i)
+		}
+		return serials, nil
+	}
+
+	if params.UnitCount != 0 && params.UnitCount != len(serials) {
+		return nil, fmt.Errorf("%w: unit_count %d does not match the %d serials", models.ErrInvalidLot, params.UnitCount, len(serials))
+	}
+	if len(serials) > models.MaxLotUnits {
+		return nil, fmt.Errorf("%w: a lot may hold at most %d units", models.ErrInvalidLot, models.MaxLotUnits)
+	}
+	seen := make(map[string]bool, len(serials))
+	for _, serial := range serials {
+		if serial == "" || len(serial) > models.MaxSerialLength {
+			return nil, fmt.Errorf("%w: serial %q must have 1 to %d characters", models.ErrInvalidLot, serial, models.MaxSerialLength)
+		}
+		if seen[serial] {
+			return nil, fmt.Errorf("%w: serial %s is repeated", models.ErrInvalidLot, serial)
+		}
+		seen[serial] = true
+	}
+	return serials, nil
+}
+
+// nextSerial returns the number following the highest numeric serial of the units with a
+// GTIN, so numbered units of a new lot never collide with those of earlier lots
+func nextSerial(commonLedger *models.CommonLedger, gtin string) int {
+	highest := 0
+	for _, lot := range commonLedger.Lots {
+		if lot.GTIN != gtin {
+			continue
+		}
+		for _, unit := range lot.Units {
+			if n, err := strconv.Atoi(unit.Serial); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	return highest + 1
+}
+
+// newUnits creates the unit records of a new lot
+func newUnits(serials []string, timestamp string) []models.UnitRecord {
+	units := make([]models.UnitRecord, len(serials))
+	for i, serial := range serials {
+		units[i] = models.UnitRecord{
+			Serial:    serial,
+			Status:    models.DrugCreated,
+			UpdatedAt: timestamp,
+		}
+	}
+	return units
+}
+
+// selectUnits returns the serials of the units of a lot chosen by a selection, or none if
+// the selection is empty. A range runs from serial_from to serial_to in lot order.
+func selectUnits(lot *models.CommonLotRecord, selection models.UnitSelection) ([]string, error) {
+	byRange := selection.SerialFrom != "" || selection.SerialTo != ""
+	if len(selection.Serials) > 0 && byRange {
+		return nil, fmt.Errorf("%w: select units by serials or by a range, not both", models.ErrInvalidLot)
+	}
+
+	position := make(map[string]int, len(lot.Units))
+	for i, unit := range lot.Units {
+		position[unit.Serial] = i
+	}
+
+	if byRange {
+		from, fromOK := position[selection.SerialFrom]
+		to, toOK := position[selection.SerialTo]
+		if !fromOK || !toOK {
+			return nil, fmt.Errorf("%w: serial_from and serial_to must both be units of lot %s", models.ErrInvalidLot, lot.LotID)
+		}
+		if from > to {
+			return nil, fmt.Errorf("%w: serial_from must not follow serial_to", models.ErrInvalidLot)
+		}
+
+		serials := make([]string, 0, to-from+1)
+		for _, unit := range lot.Units[from : to+1] {
+			serials = append(serials, unit.Serial)
+		}
+		return serials, nil
+	}
+
+	serials := make([]string, 0, len(selection.Serials))
+	seen := make(map[string]bool, len(selection.Serials))
+	for _, serial := range selection.Serials {
+		if _, ok := position[serial]; !ok {
+			return nil, fmt.Errorf("%w: serial %s is not a unit of lot %s", models.ErrInvalidLot, serial, lot.LotID)
+		}
+		if !seen[serial] {
+			seen[serial] = true
+			serials = append(serials, serial)
+		}
+	}
+	return serials, nil
+}
+
+// checkUnitTransitions returns a *models.TransitionError for the first unit of a lot that
+// may not move to the given status
+func checkUnitTransitions(lot *models.CommonLotRecord, serials []string, status string) error {
+	current := make(map[string]string, len(lot.Units))
+	for _, unit := range lot.Units {
+		current[unit.Serial] = unit.Status
+	}
+
+	for _, serial := range serials {
+		if err := models.CheckUnitTransition(lot.GTIN, serial, current[serial], status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setUnitStatus moves units of a lot to a new status in the manufacturer and common
+// ledgers. A non-empty shipment ID is recorded as the shipment carrying the units.
+func setUnitStatus(manufacturerLedger *models.ManufacturerLedger, commonLedger *models.CommonLedger, lotID string, serials []string, status, shipmentID, timestamp string) {
+	selected := make(map[string]bool, len(serials))
+	for _, serial := range serials {
+		selected[serial] = true
+	}
+	update := func(units []models.UnitRecord) {
+		for i, unit := range units {
+			if !selected[unit.Serial] {
+				continue
+			}
+			units[i].Status = status
+			units[i].UpdatedAt = timestamp
+			if shipmentID != "" {
+				units[i].ShipmentID = shipmentID
+			}
+		}
+	}
+
+	for i, lot := range manufacturerLedger.Lots {
+		if lot.LotID == lotID {
+			update(manufacturerLedger.Lots[i].Units)
+			break
+		}
+	}
+	manufacturerLedger.LastUpdated = timestamp
+
+	for i, lot := range commonLedger.Lots {
+		if lot.LotID == lotID {
+			update(commonLedger.Lots[i].Units)
+			break
+		}
+	}
+	commonLedger.LastUpdated = timestamp
+}
+
+// setLotStatus moves a lot to a new status in the manufacturer and common ledgers
+func setLotStatus(manufacturerLedger *models.ManufacturerLedger, commonLedger *models.CommonLedger, lotID, status, timestamp, details string) {
+	for i, lot := range manufacturerLedger.Lots {
+		if lot.LotID == lotID {
+			manufacturerLedger.Lots[i].Status = status
+			manufacturerLedger.Lots[i].CurrentStatus = status
+			manufacturerLedger.Lots[i].History = append(manufacturerLedger.Lots[i].History, models.Status{
+				Status:    status,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	manufacturerLedger.LastUpdated = timestamp
+
+	for i, lot := range commonLedger.Lots {
+		if lot.LotID == lotID {
+			commonLedger.Lots[i].Status = status
+			commonLedger.Lots[i].CurrentStatus = status
+			commonLedger.Lots[i].History = append(commonLedger.Lots[i].History, models.Status{
+				Status:    status,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	commonLedger.LastUpdated = timestamp
+}
+
+// txNamesSerial reports whether transaction data lists a serial in its serials field
+func txNamesSerial(txData interface{}, serial string) bool {
+	data, ok := txData.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	switch serials := data["serials"].(type) {
+	case []string:
+		for _, s := range serials {
+			if s == serial {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, s := range serials {
+			if s == serial {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shippableUnits resolves the lot of a shipment and the units it carries: the selected
+// units, or every unit of the lot still in the created state. The shipment's drug is
+// taken from the lot when not given.
+func (lm *LedgerManager) shippableUnits(params *models.CreateShipmentParams) (*models.CommonLotRecord, []string, error) {
+	lot, err := lm.lot(params.LotID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if params.DrugID == "" {
+		params.DrugID = lot.DrugID
+	}
+	if params.DrugID != lot.DrugID {
+		return nil, nil, fmt.Errorf("%w: lot %s is not a lot of drug %s", models.ErrInvalidLot, lot.LotID, params.DrugID)
+	}
+	if models.IsExpired(lot.ExpiryDate, time.Now()) {
+		return nil, nil, errExpired("lot "+lot.LotID, lot.ExpiryDate)
+	}
+	if lot.CurrentStatus != models.LotCreated {
+		return nil, nil, fmt.Errorf("%w: lot %s is %s and cannot be shipped", models.ErrInvalidLot, lot.LotID, lot.CurrentStatus)
+	}
+
+	serials, err := selectUnits(lot, params.UnitSelection)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(serials) == 0 {
+		for _, unit := range lot.Units {
+			if unit.Status == models.DrugCreated {
+				serials = append(serials, unit.Serial)
+			}
+		}
+		if len(serials) == 0 {
+			return nil, nil, fmt.Errorf("%w: lot %s has no units left to ship", models.ErrInvalidLot, lot.LotID)
+		}
+	}
+
+	if err := checkUnitTransitions(lot, serials, models.DrugInTransit); err != nil {
+		return nil, nil, err
+	}
+	return lot, serials, nil
+}
+
+// shippedUnits returns the serials of the units of a lot still in transit with a shipment
+func shippedUnits(lot *models.CommonLotRecord, shipmentID string) []string {
+	var serials []string
+	for _, unit := range lot.Units {
+		if unit.ShipmentID == shipmentID && unit.Status == models.DrugInTransit {
+			serials = append(serials, unit.Serial)
+		}
+	}
+	return serials
+}
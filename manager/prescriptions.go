@@ -0,0 +1,282 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// IssuePrescription issues a prescription for a drug and records it in the blockchain,
+// signed by the prescribing doctor
+func (lm *LedgerManager) IssuePrescription(params *models.IssuePrescriptionParams) (string, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return "", err
+	}
+
+	// Get current timestamp
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+
+	if params.Quantity <= 0 {
+		params.Quantity = 1
+	}
+
+	// Check that the drug exists
+	if _, err := lm.drugStatus(params.DrugID); err != nil {
+		return "", err
+	}
+
+	// Create blockchain transaction
+	entry := &storage.WALEntry{Operation: "issue_prescription"}
+	txData := map[string]interface{}{
+		"prescription_id": params.PrescriptionID,
+		"drug_id":         params.DrugID,
+		"patient_id":      params.PatientID,
+		"doctor_id":       params.DoctorID,
+		"dosage":          params.Dosage,
+		"quantity":        params.Quantity,
+		"status":          models.PrescriptionIssued,
+		"updated_by":      params.UserID,
+		"signer_id":       params.DoctorID,
+		"created_at":      timestamp,
+	}
+	if params.ExpiresAt != nil {
+		txData["expires_at"] = params.ExpiresAt.Format(time.RFC3339)
+	}
+	txHash, err := lm.addTransaction(entry, "prescription_issue", txData)
+	if err != nil {
+		return "", err
+	}
+
+	// Insert prescription into database
+	prescription := &models.Prescription{
+		ID:             params.PrescriptionID,
+		DrugID:         params.DrugID,
+		PatientID:      params.PatientID,
+		DoctorID:       params.DoctorID,
+		Dosage:         params.Dosage,
+		Instructions:   params.Instructions,
+		Quantity:       params.Quantity,
+		Status:         models.PrescriptionIssued,
+		BlockchainTxID: txHash,
+		ExpiresAt:      params.ExpiresAt,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertPrescription, Prescription: prescription})
+
+	// Journal and apply the database changes
+	if err := lm.commitEntry(entry, nil, nil); err != nil {
+		return "", err
+	}
+
+	return txHash, nil
+}
+
+// FillPrescription dispenses some or all of the remaining units of a prescription and
+// records the fill in the blockchain, signed by the dispensing pharmacy. The first fill
+// from a delivered drug moves the drug to dispensed.
+func (lm *LedgerManager) FillPrescription(params *models.FillPrescriptionParams) (*models.Prescription, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return nil, err
+	}
+
+	// Get current timestamp
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+
+	// Get prescription from database
+	prescription, err := lm.storage.GetPrescription(params.PrescriptionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prescription from database: %w", err)
+	}
+	if prescription.ExpiresAt != nil && now.After(*prescription.ExpiresAt) {
+		return nil, fmt.Errorf("%w: prescription %s expired at %s", models.ErrPrescriptionExpired, prescription.ID, prescription.ExpiresAt.Format(time.RFC3339))
+	}
+
+	// Work out how much is dispensed and the resulting prescription status
+	remaining := prescription.Quantity - prescription.QuantityFilled
+	quantity := params.Quantity
+	if quantity == 0 {
+		quantity = remaining
+	}
+	if quantity <= 0 || quantity > remaining {
+		return nil, fmt.Errorf("%w: cannot dispense %d of %d remaining units", models.ErrInvalidFillQuantity, quantity, remaining)
+	}
+
+	status := models.PrescriptionPartiallyFilled
+	if quantity == remaining {
+		status = models.PrescriptionFilled
+	}
+	if err := models.CheckPrescriptionTransition(prescription.ID, prescription.Status, status); err != nil {
+		return nil, err
+	}
+
+	// Check that the drug can be dispensed
+	drugStatus, err := lm.drugStatus(prescription.DrugID)
+	if err != nil {
+		return nil, err
+	}
+	dispensesDrug := drugStatus != models.DrugDispensed
+	if dispensesDrug {
+		if err := models.CheckDrugTransition(prescription.DrugID, drugStatus, models.DrugDispensed); err != nil {
+			return nil, err
+		}
+	}
+
+	// Load the ledgers when the drug is dispensed, and journal their current state
+	var drug *models.Drug
+	var manufacturerLedger *models.ManufacturerLedger
+	var commonLedger *models.CommonLedger
+	entry := &storage.WALEntry{Operation: "fill_prescription"}
+	if dispensesDrug {
+		// Get drug from database
+		drug, err = lm.storage.GetDrug(prescription.DrugID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get drug from database: %v", err)
+		}
+
+		manufacturerLedger, commonLedger, entry, err = lm.beginEntry("fill_prescription", drug.ManufacturerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create blockchain transaction linking the fill to the drug, doctor and patient
+	txData := map[string]interface{}{
+		"prescription_id": prescription.ID,
+		"drug_id":         prescription.DrugID,
+		"patient_id":      prescription.PatientID,
+		"doctor_id":       prescription.DoctorID,
+		"pharmacy_id":     params.PharmacyID,
+		"quantity":        quantity,
+		"quantity_filled": prescription.QuantityFilled + quantity,
+		"status":          status,
+		"updated_by":      params.UserID,
+		"signer_id":       params.PharmacyID,
+		"updated_at":      timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, "prescription_fill", txData)
+	if err != nil {
+		return nil, err
+	}
+
+	if dispensesDrug {
+		// Record the drug status update in the blockchain
+		drugStatusTxHash, err := lm.addTransaction(entry, "drug_update", drugStatusTx(prescription.DrugID, models.DrugDispensed, params.UserID, now))
+		if err != nil {
+			return nil, err
+		}
+
+		// Update drug status in the ledgers
+		setDrugStatus(manufacturerLedger, commonLedger, prescription.DrugID, models.DrugDispensed, timestamp,
+			fmt.Sprintf("Drug dispensed for prescription %s", prescription.ID))
+
+		// Update drug in database
+		drug.Status = models.DrugDispensed
+		drug.BlockchainTxID = drugStatusTxHash
+		drug.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
+
+		// Insert drug status update into database
+		drugStatusUpdate := &models.DrugStatusUpdate{
+			DrugID:         prescription.DrugID,
+			Status:         models.DrugDispensed,
+			Location:       params.Location,
+			UpdatedBy:      params.UserID,
+			BlockchainTxID: drugStatusTxHash,
+			Timestamp:      now,
+		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
+	}
+
+	// Update prescription in database
+	prescription.QuantityFilled += quantity
+	prescription.Status = status
+	prescription.PharmacyID = params.PharmacyID
+	prescription.BlockchainTxID = txHash
+	prescription.UpdatedAt = now
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdatePrescription, Prescription: prescription})
+
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return nil, err
+	}
+
+	return prescription, nil
+}
+
+// CancelPrescription cancels a prescription that has not been completely filled
+func (lm *LedgerManager) CancelPrescription(params *models.PrescriptionStatusParams) error {
+	return lm.closePrescription(params, models.PrescriptionCancelled, "cancel_prescription", "prescription_cancel")
+}
+
+// ExpirePrescription marks a prescription that has not been completely filled as expired
+func (lm *LedgerManager) ExpirePrescription(params *models.PrescriptionStatusParams) error {
+	return lm.closePrescription(params, models.PrescriptionExpired, "expire_prescription", "prescription_expire")
+}
+
+// GetPrescription retrieves a prescription from the database
+func (lm *LedgerManager) GetPrescription(prescriptionID string) (*models.Prescription, error) {
+	return lm.storage.GetPrescription(prescriptionID)
+}
+
+// closePrescription moves a prescription to a final status and records it in the blockchain
+func (lm *LedgerManager) closePrescription(params *models.PrescriptionStatusParams, status, operation, txType string) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return err
+	}
+
+	// Get current timestamp
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+
+	// Get prescription from database
+	prescription, err := lm.storage.GetPrescription(params.PrescriptionID)
+	if err != nil {
+		return fmt.Errorf("failed to get prescription from database: %w", err)
+	}
+	if err := models.CheckPrescriptionTransition(prescription.ID, prescription.Status, status); err != nil {
+		return err
+	}
+
+	// Create blockchain transaction
+	entry := &storage.WALEntry{Operation: operation}
+	txData := map[string]interface{}{
+		"prescription_id": prescription.ID,
+		"drug_id":         prescription.DrugID,
+		"patient_id":      prescription.PatientID,
+		"doctor_id":       prescription.DoctorID,
+		"status":          status,
+		"reason":          params.Reason,
+		"updated_by":      params.UserID,
+		"updated_at":      timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, txType, txData)
+	if err != nil {
+		return err
+	}
+
+	// Update prescription in database
+	prescription.Status = status
+	prescription.BlockchainTxID = txHash
+	prescription.UpdatedAt = now
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdatePrescription, Prescription: prescription})
+
+	// Journal and apply the database changes
+	return lm.commitEntry(entry, nil, nil)
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// deliverTestDrug ships drug D1 to distributor d1 and delivers it
+func deliverTestDrug(t *testing.T, lm *LedgerManager) {
+	t.Helper()
+	if _, err := lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S1", DrugID: "D1", ManufacturerID: "m1", DistributorID: "d1", UserID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []string{models.ShipmentPickedUp, models.ShipmentInTransit, models.ShipmentDelivered} {
+		if err := lm.UpdateShipmentStatus(&models.UpdateShipmentStatusParams{ShipmentID: "S1", Status: status, UserID: "d1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// issueTestPrescription issues a prescription of drug D1 by doctor doc1
+func issueTestPrescription(t *testing.T, lm *LedgerManager, prescriptionID string, quantity int, expiresAt *time.Time) {
+	t.Helper()
+	params := &models.IssuePrescriptionParams{
+		PrescriptionID: prescriptionID,
+		DrugID:         "D1",
+		PatientID:      "patient-1",
+		DoctorID:       "doc1",
+		Quantity:       quantity,
+		ExpiresAt:      expiresAt,
+		UserID:         "doc1",
+	}
+	if _, err := lm.IssuePrescription(params); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFillPrescription(t *testing.T) {
+	lm, fs := newTestManager(t)
+	createTestDrug(t, lm)
+	deliverTestDrug(t, lm)
+	issueTestPrescription(t, lm, "P1", 10, nil)
+
+	// Each fill runs against the prescription left by the fills before it
+	tests := []struct {
+		name     string
+		quantity int
+		err      error
+		status   string
+		filled   int
+	}{
+		{"partial fill", 4, nil, models.PrescriptionPartiallyFilled, 4},
+		{"overfill", 7, models.ErrInvalidFillQuantity, models.PrescriptionPartiallyFilled, 4},
+		{"negative fill", -1, models.ErrInvalidFillQuantity, models.PrescriptionPartiallyFilled, 4},
+		{"fill of the remaining units", 6, nil, models.PrescriptionFilled, 10},
+		{"fill of a filled prescription", 0, models.ErrInvalidFillQuantity, models.PrescriptionFilled, 10},
+		{"overfill of a filled prescription", 1, models.ErrInvalidFillQuantity, models.PrescriptionFilled, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			height, _, _ := fs.Tip()
+
+			_, err := lm.FillPrescription(&models.FillPrescriptionParams{PrescriptionID: "P1", PharmacyID: "ph1", Quantity: tt.quantity, UserID: "ph1"})
+			if tt.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+
+			prescription, err := lm.GetPrescription("P1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prescription.Status != tt.status || prescription.QuantityFilled != tt.filled {
+				t.Fatalf("prescription is %s with %d units filled, want %s with %d", prescription.Status, prescription.QuantityFilled, tt.status, tt.filled)
+			}
+
+			// A rejected fill reaches neither the chain nor the WAL
+			if tt.err != nil {
+				if after, _, _ := fs.Tip(); after != height {
+					t.Fatalf("rejected fill appended %d blocks", after-height)
+				}
+				if pending, _ := lm.wal.Pending(); len(pending) != 0 {
+					t.Fatalf("rejected fill left %d WAL entries", len(pending))
+				}
+			}
+		})
+	}
+
+	// The first fill dispensed the drug
+	status, err := lm.drugStatus("D1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != models.DrugDispensed {
+		t.Fatalf("drug status = %s, want %s", status, models.DrugDispensed)
+	}
+}
+
+func TestFillExpiredPrescription(t *testing.T) {
+	lm, _ := newTestManager(t)
+	createTestDrug(t, lm)
+	deliverTestDrug(t, lm)
+	expiresAt := time.Now().Add(-time.Hour)
+	issueTestPrescription(t, lm, "P1", 2, &expiresAt)
+
+	_, err := lm.FillPrescription(&models.FillPrescriptionParams{PrescriptionID: "P1", PharmacyID: "ph1", Quantity: 1, UserID: "ph1"})
+	if !errors.Is(err, models.ErrPrescriptionExpired) {
+		t.Fatalf("err = %v, want ErrPrescriptionExpired", err)
+	}
+}
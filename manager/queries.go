@@ -0,0 +1,376 @@
+package manager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// sortableTime formats timestamps as fixed-width UTC strings that sort lexically
+const sortableTime = "2006-01-02T15:04:05.000000000Z"
+
+// pageCursor marks the position of the last record of a page in the sort order
+type pageCursor struct {
+	Key string `json:"k"`
+	ID  string `json:"id"`
+}
+
+// pageItem is a record reduced to what list queries need to sort and page it
+type pageItem struct {
+	index int
+	id    string
+	key   string
+}
+
+// ListDrugs retrieves a page of drugs from the common ledger. Drugs can be filtered by
+// manufacturer, by a distributor that shipped them, by current status and by creation time.
+func (lm *LedgerManager) ListDrugs(query *models.ListQuery) (*models.DrugPage, error) {
+	if query.SortBy == "" {
+		query.SortBy = "created_at"
+	}
+	if query.SortBy != "created_at" && query.SortBy != "status" && query.SortBy != "manufacturer_id" && query.SortBy != "drug_id" {
+		return nil, fmt.Errorf("%w: cannot sort drugs by %s", models.ErrInvalidQuery, query.SortBy)
+	}
+
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	// Drugs are matched to distributors through the shipments that carried them
+	var distributorDrugs map[string]bool
+	if query.DistributorID != "" {
+		distributorDrugs = make(map[string]bool)
+		for _, shipment := range commonLedger.Shipments {
+			if shipment.DistributorID == query.DistributorID {
+				distributorDrugs[shipment.DrugID] = true
+			}
+		}
+	}
+
+	var items []pageItem
+	for i, drug := range commonLedger.Drugs {
+		if query.ManufacturerID != "" && drug.ManufacturerID != query.ManufacturerID {
+			continue
+		}
+		if distributorDrugs != nil && !distributorDrugs[drug.DrugID] {
+			continue
+		}
+		if query.Status != "" && drug.CurrentStatus != query.Status {
+			continue
+		}
+		if !createdInRange(drug.CreatedAt, query) {
+			continue
+		}
+
+		var key string
+		switch query.SortBy {
+		case "created_at":
+			key = sortableTimestamp(drug.CreatedAt)
+		case "status":
+			key = drug.CurrentStatus
+		case "manufacturer_id":
+			key = drug.ManufacturerID
+		}
+		items = append(items, pageItem{index: i, id: drug.DrugID, key: key})
+	}
+
+	page, nextCursor, err := paginate(items, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.DrugPage{
+		Drugs:      make([]models.DrugView, 0, len(page)),
+		NextCursor: nextCursor,
+	}
+	for _, item := range page {
+		view, err := lm.drugView(commonLedger.Drugs[item.index])
+		if err != nil {
+			return nil, err
+		}
+		result.Drugs = append(result.Drugs, *view)
+	}
+	result.Count = len(result.Drugs)
+
+	return result, nil
+}
+
+// GetDrug retrieves a drug from the common ledger
+func (lm *LedgerManager) GetDrug(drugID string) (*models.DrugView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, drug := range commonLedger.Drugs {
+		if drug.DrugID == drugID {
+			return lm.drugView(drug)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: drug %s", models.ErrRecordNotFound, drugID)
+}
+
+// ListShipments retrieves a page of shipments from the common ledger. Shipments can be
+// filtered by manufacturer, distributor, current status and creation time.
+func (lm *LedgerManager) ListShipments(query *models.ListQuery) (*models.ShipmentPage, error) {
+	if query.SortBy == "" {
+		query.SortBy = "created_at"
+	}
+	if query.SortBy != "created_at" && query.SortBy != "status" && query.SortBy != "manufacturer_id" && query.SortBy != "distributor_id" && query.SortBy != "shipment_id" {
+		return nil, fmt.Errorf("%w: cannot sort shipments by %s", models.ErrInvalidQuery, query.SortBy)
+	}
+
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	var items []pageItem
+	for i, shipment := range commonLedger.Shipments {
+		if query.ManufacturerID != "" && shipment.ManufacturerID != query.ManufacturerID {
+			continue
+		}
+		if query.DistributorID != "" && shipment.DistributorID != query.DistributorID {
+			continue
+		}
+		if query.Status != "" && shipment.CurrentStatus != query.Status {
+			continue
+		}
+		if !createdInRange(shipment.CreatedAt, query) {
+			continue
+		}
+
+		var key string
+		switch query.SortBy {
+		case "created_at":
+			key = sortableTimestamp(shipment.CreatedAt)
+		case "status":
+			key = shipment.CurrentStatus
+		case "manufacturer_id":
+			key = shipment.ManufacturerID
+		case "distributor_id":
+			key = shipment.DistributorID
+		}
+		items = append(items, pageItem{index: i, id: shipment.ShipmentID, key: key})
+	}
+
+	page, nextCursor, err := paginate(items, query)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.ShipmentPage{
+		Shipments:  make([]models.ShipmentView, 0, len(page)),
+		NextCursor: nextCursor,
+	}
+	for _, item := range page {
+		view, err := lm.shipmentView(commonLedger.Shipments[item.index])
+		if err != nil {
+			return nil, err
+		}
+		result.Shipments = append(result.Shipments, *view)
+	}
+	result.Count = len(result.Shipments)
+
+	return result, nil
+}
+
+// GetShipment retrieves a shipment from the common ledger
+func (lm *LedgerManager) GetShipment(shipmentID string) (*models.ShipmentView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, shipment := range commonLedger.Shipments {
+		if shipment.ShipmentID == shipmentID {
+			return lm.shipmentView(shipment)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: shipment %s", models.ErrRecordNotFound, shipmentID)
+}
+
+// drugView joins a common ledger drug with its database record and blockchain transactions.
+// A missing database record is tolerated, since database writes can lag behind the ledger.
+func (lm *LedgerManager) drugView(record models.CommonDrugRecord) (*models.DrugView, error) {
+	txIDs, err := lm.transactionIDs(storage.IndexDrug, record.DrugID)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &models.DrugView{
+		CommonDrugRecord: record,
+		BlockchainTxIDs:  txIDs,
+	}
+
+	drug, err := lm.storage.GetDrug(record.DrugID)
+	if err != nil {
+		log.Printf("Warning: Failed to load drug %s from database: %v", record.DrugID, err)
+		return view, nil
+	}
+	view.Name = drug.Name
+	view.Description = drug.Description
+	if !drug.UpdatedAt.IsZero() {
+		view.UpdatedAt = drug.UpdatedAt.Format(time.RFC3339)
+	}
+
+	return view, nil
+}
+
+// shipmentView joins a common ledger shipment with its database record and blockchain
+// transactions
+func (lm *LedgerManager) shipmentView(record models.CommonShipmentRecord) (*models.ShipmentView, error) {
+	txIDs, err := lm.transactionIDs(storage.IndexShipment, record.ShipmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &models.ShipmentView{
+		CommonShipmentRecord: record,
+		BlockchainTxIDs:      txIDs,
+	}
+
+	shipment, err := lm.storage.GetShipment(record.ShipmentID)
+	if err != nil {
+		log.Printf("Warning: Failed to load shipment %s from database: %v", record.ShipmentID, err)
+		return view, nil
+	}
+	if !shipment.UpdatedAt.IsZero() {
+		view.UpdatedAt = shipment.UpdatedAt.Format(time.RFC3339)
+	}
+
+	return view, nil
+}
+
+// transactionIDs returns the hashes of the blockchain transactions that mention an ID, in chain order
+func (lm *LedgerManager) transactionIDs(kind, value string) ([]string, error) {
+	txs, err := lm.blockchain.GetTransactionsByIndex(kind, value)
+	if err != nil {
+		return nil, err
+	}
+
+	txIDs := make([]string, len(txs))
+	for i, tx := range txs {
+		txIDs[i] = tx.TxHash
+	}
+	return txIDs, nil
+}
+
+// paginate sorts the items by key and ID and returns the page following the query's
+// cursor, along with the cursor of the next page if there is one
+func paginate(items []pageItem, query *models.ListQuery) ([]pageItem, string, error) {
+	switch query.Order {
+	case "":
+		query.Order = models.SortAsc
+	case models.SortAsc, models.SortDesc:
+	default:
+		return nil, "", fmt.Errorf("%w: unknown sort order %s", models.ErrInvalidQuery, query.Order)
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = models.DefaultPageLimit
+	}
+	if limit > models.MaxPageLimit {
+		limit = models.MaxPageLimit
+	}
+
+	desc := query.Order == models.SortDesc
+	less := func(a, b pageCursor) bool {
+		if a.Key != b.Key {
+			return (a.Key < b.Key) != desc
+		}
+		if a.ID != b.ID {
+			return (a.ID < b.ID) != desc
+		}
+		return false
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return less(pageCursor{Key: items[i].key, ID: items[i].id}, pageCursor{Key: items[j].key, ID: items[j].id})
+	})
+
+	// Skip the records up to and including the cursor
+	start := 0
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(items), func(i int) bool {
+			return less(cursor, pageCursor{Key: items[i].key, ID: items[i].id})
+		})
+	}
+
+	end := start + limit
+	if end >= len(items) {
+		return items[start:], "", nil
+	}
+
+	last := items[end-1]
+	nextCursor, err := encodeCursor(pageCursor{Key: last.key, ID: last.id})
+	if err != nil {
+		return nil, "", err
+	}
+	return items[start:end], nextCursor, nil
+}
+
+// encodeCursor encodes a page cursor as an opaque URL-safe string
+func encodeCursor(cursor pageCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor decodes a page cursor returned by encodeCursor
+func decodeCursor(encoded string) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", models.ErrInvalidQuery)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", models.ErrInvalidQuery)
+	}
+	return cursor, nil
+}
+
+// createdInRange reports whether a ledger creation timestamp falls within the query's
+// created_at range. Records with unparseable timestamps only match unbounded queries.
+func createdInRange(createdAt string, query *models.ListQuery) bool {
+	if query.CreatedFrom.IsZero() && query.CreatedTo.IsZero() {
+		return true
+	}
+
+	created, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return false
+	}
+	if !query.CreatedFrom.IsZero() && created.Before(query.CreatedFrom) {
+		return false
+	}
+	if !query.CreatedTo.IsZero() && created.After(query.CreatedTo) {
+		return false
+	}
+	return true
+}
+
+// sortableTimestamp converts a ledger timestamp to a key that sorts chronologically
+func sortableTimestamp(timestamp string) string {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return parsed.UTC().Format(sortableTime)
+}
@@ -0,0 +1,557 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// CreateRecall recalls the drugs and lot units of a manufacturer, optionally narrowed to a
+// lot and to an expiry date window. Every drug and unit in scope that may still be
+// recalled moves to recalled, along with its lot, and the shipments carrying them that
+// are still in flight are marked with the recall in the manufacturer and common ledgers.
+// The recall and the status updates are appended in one block and journaled as one
+// operation, so a failure leaves no partial recall and a retry finds the recall recorded.
+func (lm *LedgerManager) CreateRecall(params *models.CreateRecallParams) (*models.RecallRecord, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	// Validate against ledgers that have caught up with the chain
+	if err := lm.finishStalled(); err != nil {
+		return nil, err
+	}
+
+	// Get current timestamp
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+
+	// Validate the scope
+	if params.ManufacturerID == "" {
+		return nil, fmt.Errorf("%w: manufacturer_id is required", models.ErrInvalidRecall)
+	}
+	if params.Reason == "" {
+		return nil, fmt.Errorf("%w: reason is required", models.ErrInvalidRecall)
+	}
+	if err := validateExpiryWindow(params.ExpiryFrom, params.ExpiryTo); err != nil {
+		return nil, err
+	}
+
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+	for _, recall := range commonLedger.Recalls {
+		if recall.RecallID == params.RecallID {
+			return nil, fmt.Errorf("%w: recall %s already exists", models.ErrInvalidRecall, params.RecallID)
+		}
+	}
+
+	recall := models.RecallRecord{
+		RecallID:       params.RecallID,
+		ManufacturerID: params.ManufacturerID,
+		LotID:          params.LotID,
+		ExpiryFrom:     params.ExpiryFrom,
+		ExpiryTo:       params.ExpiryTo,
+		Reason:         params.Reason,
+		DrugIDs:        []string{},
+		Lots:           []models.RecalledLot{},
+		ShipmentIDs:    []string{},
+		CreatedBy:      params.UserID,
+		CreatedAt:      timestamp,
+	}
+
+	// Find the drugs in scope that may still be recalled. A lot recall leaves drug records alone.
+	recalledDrugs := make(map[string]bool)
+	if params.LotID == "" {
+		for _, drug := range commonLedger.Drugs {
+			if drug.ManufacturerID != params.ManufacturerID || !inExpiryWindow(drug.ExpiryDate, params.ExpiryFrom, params.ExpiryTo) {
+				continue
+			}
+			if models.CheckDrugTransition(drug.DrugID, drug.CurrentStatus, models.DrugRecalled) != nil {
+				continue
+			}
+			recall.DrugIDs = append(recall.DrugIDs, drug.DrugID)
+			recalledDrugs[drug.DrugID] = true
+		}
+	}
+
+	// Find the lots in scope, and their units that may still be recalled
+	lotFound := false
+	recalledUnits := make(map[string]map[string]bool)
+	var lots []*models.CommonLotRecord
+	for i, lot := range commonLedger.Lots {
+		if params.LotID != "" && lot.LotID != params.LotID {
+			continue
+		}
+		if params.LotID != "" {
+			lotFound = true
+			if lot.ManufacturerID != params.ManufacturerID {
+				return nil, fmt.Errorf("%w: lot %s belongs to another manufacturer", models.ErrInvalidRecall, lot.LotID)
+			}
+		}
+		if lot.ManufacturerID != params.ManufacturerID || !inExpiryWindow(lot.ExpiryDate, params.ExpiryFrom, params.ExpiryTo) {
+			continue
+		}
+
+		serials := []string{}
+		units := make(map[string]bool)
+		for _, unit := range lot.Units {
+			if models.CheckUnitTransition(lot.GTIN, unit.Serial, unit.Status, models.DrugRecalled) == nil {
+				serials = append(serials, unit.Serial)
+				units[unit.Serial] = true
+			}
+		}
+		if len(serials) == 0 && models.CheckLotTransition(lot.LotID, lot.CurrentStatus, models.LotRecalled) != nil {
+			continue
+		}
+		recall.Lots = append(recall.Lots, models.RecalledLot{LotID: lot.LotID, Serials: serials})
+		recalledUnits[lot.LotID] = units
+		lots = append(lots, &commonLedger.Lots[i])
+	}
+	if params.LotID != "" && !lotFound {
+		return nil, fmt.Errorf("%w: lot %s", models.ErrRecordNotFound, params.LotID)
+	}
+	if len(recall.DrugIDs) == 0 && len(recall.Lots) == 0 {
+		return nil, fmt.Errorf("%w: no drugs or units in scope can be recalled", models.ErrInvalidRecall)
+	}
+
+	// Find the shipments still in flight with recalled drugs or units
+	for _, shipment := range commonLedger.Shipments {
+		if !shipmentInFlight(shipment.CurrentStatus) {
+			continue
+		}
+		caught := shipment.LotID == "" && recalledDrugs[shipment.DrugID]
+		for _, serial := range shipment.Serials {
+			if recalledUnits[shipment.LotID][serial] {
+				caught = true
+				break
+			}
+		}
+		if caught {
+			recall.ShipmentIDs = append(recall.ShipmentIDs, shipment.ShipmentID)
+		}
+	}
+
+	// Get the affected records from database
+	drugs := make([]*models.Drug, 0, len(recall.DrugIDs))
+	for _, drugID := range recall.DrugIDs {
+		drug, err := lm.storage.GetDrug(drugID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get drug from database: %v", err)
+		}
+		drugs = append(drugs, drug)
+	}
+	var dbLots []*models.Lot
+	for _, lot := range lots {
+		if models.CheckLotTransition(lot.LotID, lot.CurrentStatus, models.LotRecalled) != nil {
+			continue
+		}
+		dbLot, err := lm.storage.GetLot(lot.LotID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get lot from database: %v", err)
+		}
+		dbLots = append(dbLots, dbLot)
+	}
+	shipments := make([]*models.Shipment, 0, len(recall.ShipmentIDs))
+	for _, shipmentID := range recall.ShipmentIDs {
+		shipment, err := lm.storage.GetShipment(shipmentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get shipment from database: %v", err)
+		}
+		shipments = append(shipments, shipment)
+	}
+
+	// Load the ledgers and journal their current state
+	manufacturerLedger, commonLedger, entry, err := lm.beginEntry("create_recall", recall.ManufacturerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the recall transaction, then the status updates of its drugs and units, all
+	// appended in one block
+	lotIDs := make([]string, len(recall.Lots))
+	unitCount := 0
+	for i, lot := range recall.Lots {
+		lotIDs[i] = lot.LotID
+		unitCount += len(lot.Serials)
+	}
+	txData := map[string]interface{}{
+		"recall_id":       recall.RecallID,
+		"manufacturer_id": recall.ManufacturerID,
+		"lot_id":          recall.LotID,
+		"expiry_from":     recall.ExpiryFrom,
+		"expiry_to":       recall.ExpiryTo,
+		"reason":          recall.Reason,
+		"drug_ids":        recall.DrugIDs,
+		"lot_ids":         lotIDs,
+		"shipment_ids":    recall.ShipmentIDs,
+		"unit_count":      unitCount,
+		"updated_by":      params.UserID,
+		"signer_id":       recall.ManufacturerID,
+		"created_at":      timestamp,
+	}
+	txHash, err := lm.addTransaction(entry, "recall", txData)
+	if err != nil {
+		return nil, err
+	}
+
+	drugTxHashes := make([]string, 0, len(recall.DrugIDs))
+	if len(recall.DrugIDs) > 0 {
+		batch := make([]map[string]interface{}, len(recall.DrugIDs))
+		for i, drugID := range recall.DrugIDs {
+			batch[i] = map[string]interface{}{
+				"drug_id":    drugID,
+				"status":     models.DrugRecalled,
+				"recall_id":  recall.RecallID,
+				"reason":     recall.Reason,
+				"updated_by": params.UserID,
+				"signer_id":  recall.ManufacturerID,
+				"updated_at": timestamp,
+			}
+		}
+		drugTxHashes, err = lm.addTransactions(entry, "drug_update", batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var unitBatch []map[string]interface{}
+	for i, lot := range lots {
+		if serials := recall.Lots[i].Serials; len(serials) > 0 {
+			data := unitStatusTx(lot, serials, models.DrugRecalled, recall.Reason, params.UserID, timestamp)
+			data["recall_id"] = recall.RecallID
+			unitBatch = append(unitBatch, data)
+		}
+	}
+	if len(unitBatch) > 0 {
+		if _, err := lm.addTransactions(entry, "unit_status_update", unitBatch); err != nil {
+			return nil, err
+		}
+	}
+
+	// Recall the drugs, lots and units in both ledgers
+	details := fmt.Sprintf("Recalled under recall %s: %s", recall.RecallID, recall.Reason)
+	for _, drugID := range recall.DrugIDs {
+		setDrugStatus(manufacturerLedger, commonLedger, drugID, models.DrugRecalled, timestamp, details)
+	}
+	for i, lot := range lots {
+		if models.CheckLotTransition(lot.LotID, lot.CurrentStatus, models.LotRecalled) == nil {
+			setLotStatus(manufacturerLedger, commonLedger, lot.LotID, models.LotRecalled, timestamp, details)
+		}
+		setUnitStatus(manufacturerLedger, commonLedger, lot.LotID, recall.Lots[i].Serials, models.DrugRecalled, "", timestamp)
+	}
+
+	// Mark the shipments in flight in both ledgers
+	for _, shipmentID := range recall.ShipmentIDs {
+		markShipmentRecall(manufacturerLedger, commonLedger, shipmentID, recall.RecallID, timestamp)
+	}
+
+	// Add recall to both ledgers
+	manufacturerLedger.Recalls = append(manufacturerLedger.Recalls, recall)
+	commonLedger.Recalls = append(commonLedger.Recalls, recall)
+
+	// Insert recall into database
+	entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertRecall, Recall: &models.Recall{
+		ID:             recall.RecallID,
+		ManufacturerID: recall.ManufacturerID,
+		LotID:          recall.LotID,
+		ExpiryFrom:     recall.ExpiryFrom,
+		ExpiryTo:       recall.ExpiryTo,
+		Reason:         recall.Reason,
+		DrugCount:      len(recall.DrugIDs),
+		UnitCount:      unitCount,
+		ShipmentCount:  len(recall.ShipmentIDs),
+		CreatedBy:      params.UserID,
+		BlockchainTxID: txHash,
+		CreatedAt:      now,
+	}})
+
+	// Update drugs in database and insert their status updates
+	for i, drug := range drugs {
+		drug.Status = models.DrugRecalled
+		drug.BlockchainTxID = drugTxHashes[i]
+		drug.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateDrug, Drug: drug})
+
+		drugStatusUpdate := &models.DrugStatusUpdate{
+			DrugID:         drug.ID,
+			Status:         models.DrugRecalled,
+			Location:       params.Location,
+			UpdatedBy:      params.UserID,
+			BlockchainTxID: drugTxHashes[i],
+			Timestamp:      now,
+		}
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALInsertDrugStatusUpdate, DrugStatusUpdate: drugStatusUpdate})
+	}
+
+	// Update lots and shipments in database
+	for _, lot := range dbLots {
+		lot.Status = models.LotRecalled
+		lot.BlockchainTxID = txHash
+		lot.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateLot, Lot: lot})
+	}
+	for _, shipment := range shipments {
+		shipment.RecallID = recall.RecallID
+		shipment.UpdatedAt = now
+		entry.Writes = append(entry.Writes, storage.WALWrite{Action: storage.WALUpdateShipment, Shipment: shipment})
+	}
+
+	// Journal and apply the ledger and database changes
+	if err := lm.commitEntry(entry, manufacturerLedger, commonLedger); err != nil {
+		return nil, err
+	}
+
+	return &recall, nil
+}
+
+// ListRecalls retrieves the recalls in the common ledger, optionally filtered by manufacturer
+func (lm *LedgerManager) ListRecalls(manufacturerID string) ([]models.RecallView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	recalls := []models.RecallView{}
+	for _, recall := range commonLedger.Recalls {
+		if manufacturerID != "" && recall.ManufacturerID != manufacturerID {
+			continue
+		}
+
+		txIDs, err := lm.transactionIDs(storage.IndexRecall, recall.RecallID)
+		if err != nil {
+			return nil, err
+		}
+		recalls = append(recalls, models.RecallView{RecallRecord: recall, BlockchainTxIDs: txIDs})
+	}
+
+	return recalls, nil
+}
+
+// GetRecall retrieves a recall from the common ledger
+func (lm *LedgerManager) GetRecall(recallID string) (*models.RecallView, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	for _, recall := range commonLedger.Recalls {
+		if recall.RecallID == recallID {
+			txIDs, err := lm.transactionIDs(storage.IndexRecall, recallID)
+			if err != nil {
+				return nil, err
+			}
+			return &models.RecallView{RecallRecord: recall, BlockchainTxIDs: txIDs}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: recall %s", models.ErrRecordNotFound, recallID)
+}
+
+// GetRecallReport reports where each drug and unit of a recall is now, based on its status
+// and the shipments that carried it
+func (lm *LedgerManager) GetRecallReport(recallID string) (*models.RecallReport, error) {
+	commonLedger, err := lm.storage.GetCommonLedger()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get common ledger: %v", err)
+	}
+
+	var recall *models.RecallRecord
+	for i := range commonLedger.Recalls {
+		if commonLedger.Recalls[i].RecallID == recallID {
+			recall = &commonLedger.Recalls[i]
+			break
+		}
+	}
+	if recall == nil {
+		return nil, fmt.Errorf("%w: recall %s", models.ErrRecordNotFound, recallID)
+	}
+
+	shipments, lastDrugShipment := indexShipments(commonLedger)
+	report := &models.RecallReport{
+		RecallID:       recall.RecallID,
+		ManufacturerID: recall.ManufacturerID,
+		Reason:         recall.Reason,
+		CreatedAt:      recall.CreatedAt,
+		Holders:        []models.RecallHolder{},
+		Items:          []models.RecallItem{},
+		GeneratedAt:    time.Now().Format(time.RFC3339),
+	}
+
+	drugStatus := make(map[string]string, len(commonLedger.Drugs))
+	for _, drug := range commonLedger.Drugs {
+		drugStatus[drug.DrugID] = drug.CurrentStatus
+	}
+	for _, drugID := range recall.DrugIDs {
+		item := models.RecallItem{DrugID: drugID, Status: drugStatus[drugID]}
+		if shipment := lastDrugShipment[drugID]; shipment != nil {
+			item.ShipmentID = shipment.ShipmentID
+		}
+		item.Custody, item.HolderID = custody(item.Status, lastDrugShipment[drugID], recall.ManufacturerID)
+		report.Items = append(report.Items, item)
+	}
+
+	for _, recalled := range recall.Lots {
+		for _, lot := range commonLedger.Lots {
+			if lot.LotID != recalled.LotID {
+				continue
+			}
+			units := make(map[string]models.UnitRecord, len(lot.Units))
+			for _, unit := range lot.Units {
+				units[unit.Serial] = unit
+			}
+			for _, serial := range recalled.Serials {
+				unit := units[serial]
+				item := models.RecallItem{
+					DrugID:     lot.DrugID,
+					LotID:      lot.LotID,
+					GTIN:       lot.GTIN,
+					Serial:     serial,
+					Status:     unit.Status,
+					ShipmentID: unit.ShipmentID,
+				}
+				item.Custody, item.HolderID = custody(item.Status, shipments[unit.ShipmentID], recall.ManufacturerID)
+				report.Items = append(report.Items, item)
+			}
+			break
+		}
+	}
+
+	// Count the items by custody and holder
+	holders := make(map[[2]string]int)
+	for _, item := range report.Items {
+		switch item.Custody {
+		case models.CustodyDestroyed:
+			report.Destroyed++
+			continue
+		case models.CustodyManufacturer:
+			report.Unshipped++
+		case models.CustodyReturned:
+			report.Returned++
+		default:
+			report.Located++
+		}
+		holders[[2]string{item.HolderID, item.Custody}]++
+	}
+	report.Total = len(report.Items)
+	for key, count := range holders {
+		report.Holders = append(report.Holders, models.RecallHolder{HolderID: key[0], Custody: key[1], Items: count})
+	}
+	sort.Slice(report.Holders, func(i, j int) bool {
+		if report.Holders[i].Items != report.Holders[j].Items {
+			return report.Holders[i].Items > report.Holders[j].Items
+		}
+		if report.Holders[i].HolderID != report.Holders[j].HolderID {
+			return report.Holders[i].HolderID < report.Holders[j].HolderID
+		}
+		return report.Holders[i].Custody < report.Holders[j].Custody
+	})
+
+	return report, nil
+}
+
+// custody derives who holds a drug or unit from its status and the last shipment that
+// carried it, if any
+func custody(status string, shipment *models.CommonShipmentRecord, manufacturerID string) (string, string) {
+	switch {
+	case status == models.DrugDestroyed:
+		return models.CustodyDestroyed, ""
+	case status == models.DrugDispensed && shipment != nil:
+		return models.CustodyDispensed, shipment.DistributorID
+	case shipment == nil:
+		return models.CustodyManufacturer, manufacturerID
+	case shipment.CurrentStatus == models.ShipmentReturned:
+		return models.CustodyReturned, manufacturerID
+	case shipment.CurrentStatus == models.ShipmentDelivered:
+		return models.CustodyDistributor, shipment.DistributorID
+	default:
+		return models.CustodyInTransit, shipment.DistributorID
+	}
+}
+
+// indexShipments indexes the shipments of the common ledger by ID, and the last shipment
+// of each drug shipped without a lot by drug ID
+func indexShipments(commonLedger *models.CommonLedger) (map[string]*models.CommonShipmentRecord, map[string]*models.CommonShipmentRecord) {
+	shipments := make(map[string]*models.CommonShipmentRecord, len(commonLedger.Shipments))
+	lastDrugShipment := make(map[string]*models.CommonShipmentRecord)
+	for i, shipment := range commonLedger.Shipments {
+		shipments[shipment.ShipmentID] = &commonLedger.Shipments[i]
+		if shipment.LotID == "" {
+			lastDrugShipment[shipment.DrugID] = &commonLedger.Shipments[i]
+		}
+	}
+	return shipments, lastDrugShipment
+}
+
+// markShipmentRecall records in the manufacturer and common ledgers that a recall caught a
+// shipment in flight. The shipment keeps its status.
+func markShipmentRecall(manufacturerLedger *models.ManufacturerLedger, commonLedger *models.CommonLedger, shipmentID, recallID, timestamp string) {
+	details := fmt.Sprintf("Shipment caught in flight by recall %s", recallID)
+
+	for i, shipment := range manufacturerLedger.Shipments {
+		if shipment.ShipmentID == shipmentID {
+			manufacturerLedger.Shipments[i].RecallID = recallID
+			manufacturerLedger.Shipments[i].History = append(manufacturerLedger.Shipments[i].History, models.Status{
+				Status:    shipment.CurrentStatus,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	manufacturerLedger.LastUpdated = timestamp
+
+	for i, shipment := range commonLedger.Shipments {
+		if shipment.ShipmentID == shipmentID {
+			commonLedger.Shipments[i].RecallID = recallID
+			commonLedger.Shipments[i].History = append(commonLedger.Shipments[i].History, models.Status{
+				Status:    shipment.CurrentStatus,
+				Timestamp: timestamp,
+				Details:   details,
+			})
+			break
+		}
+	}
+	commonLedger.LastUpdated = timestamp
+}
+
+// shipmentInFlight reports whether a shipment has not yet reached a final state
+func shipmentInFlight(status string) bool {
+	return status == models.ShipmentCreated || status == models.ShipmentPickedUp || status == models.ShipmentInTransit
+}
+
+// validateExpiryWindow checks the optional bounds of an expiry date window
+func validateExpiryWindow(from, to string) error {
+	var start, end time.Time
+	var err error
+	if from != "" {
+		if start, err = models.ParseDate("expiry_from", from); err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		if end, err = models.ParseDate("expiry_to", to); err != nil {
+			return err
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return fmt.Errorf("%w: expiry_to must not precede expiry_from", models.ErrInvalidDate)
+	}
+	return nil
+}
+
+// inExpiryWindow reports whether an expiry date falls within an inclusive window. Without
+// a window every record matches; with one, records without an expiry date never do.
+func inExpiryWindow(expiryDate, from, to string) bool {
+	if from == "" && to == "" {
+		return true
+	}
+	if expiryDate == "" {
+		return false
+	}
+	// Dates formatted as YYYY-MM-DD order as strings
+	return (from == "" || expiryDate >= from) && (to == "" || expiryDate <= to)
+}
@@ -0,0 +1,89 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+func TestRecallHolders(t *testing.T) {
+	lm, fs := newTestManager(t)
+	date := func(months int) string { return time.Now().AddDate(0, months, 0).Format("2006-01-02") }
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	updateShipment := func(shipmentID string, statuses ...string) {
+		t.Helper()
+		for _, status := range statuses {
+			must(lm.UpdateShipmentStatus(&models.UpdateShipmentStatusParams{ShipmentID: shipmentID, Status: status, UserID: "d1"}))
+		}
+	}
+
+	// Drug D1 and lot L1 expire within the recalled window, drug D2 after it
+	_, err := lm.CreateDrug(&models.CreateDrugParams{DrugID: "D1", ManufacturerID: "m1", Name: "Recalled drug", ExpiryDate: date(6), UserID: "m1"})
+	must(err)
+	_, err = lm.CreateDrug(&models.CreateDrugParams{DrugID: "D2", ManufacturerID: "m1", Name: "Later drug", ExpiryDate: date(36), UserID: "m1"})
+	must(err)
+	_, err = lm.CreateLot(&models.CreateLotParams{LotID: "L1", DrugID: "D1", ManufacturerID: "m1", GTIN: "96385074", BatchNumber: "B1", ManufactureDate: date(-1), ExpiryDate: date(7), UnitCount: 5, UserID: "m1"})
+	must(err)
+
+	// D1 is in transit, units 1 to 3 of L1 were delivered to d1, unit 4 is still at the
+	// manufacturer and unit 5 was destroyed
+	_, err = lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S1", DrugID: "D1", ManufacturerID: "m1", DistributorID: "d1", UserID: "m1"})
+	must(err)
+	updateShipment("S1", models.ShipmentPickedUp)
+	_, err = lm.CreateShipment(&models.CreateShipmentParams{ShipmentID: "S2", LotID: "L1", ManufacturerID: "m1", DistributorID: "d1", UserID: "m1", UnitSelection: models.UnitSelection{SerialFrom: "000001", SerialTo: "000003"}})
+	must(err)
+	updateShipment("S2", models.ShipmentPickedUp, models.ShipmentInTransit, models.ShipmentDelivered)
+	_, err = lm.UpdateUnitStatus(&models.UpdateUnitStatusParams{LotID: "L1", Status: models.DrugDestroyed, UserID: "m1", UnitSelection: models.UnitSelection{Serials: []string{"000005"}}})
+	must(err)
+
+	recall, err := lm.CreateRecall(&models.CreateRecallParams{RecallID: "R1", ManufacturerID: "m1", ExpiryFrom: date(0), ExpiryTo: date(12), Reason: "contamination", UserID: "m1"})
+	must(err)
+	if fmt.Sprint(recall.DrugIDs) != "[D1]" || len(recall.Lots) != 1 || fmt.Sprint(recall.Lots[0].Serials) != "[000001 000002 000003 000004]" || fmt.Sprint(recall.ShipmentIDs) != "[S1]" {
+		t.Fatalf("recall = %+v, want D1, units 1 to 4 of L1 and shipment S1", recall)
+	}
+	if fs.drugs["D1"].Status != models.DrugRecalled || fs.drugs["D2"].Status == models.DrugRecalled || fs.shipments["S1"].RecallID != "R1" {
+		t.Fatal("the recall was not written to the database")
+	}
+
+	tests := []struct {
+		name     string
+		statuses []string // statuses shipment S1 moves through before the report
+		holders  string
+		counts   [5]int // total, located, unshipped, returned and destroyed items
+	}{
+		{
+			name:    "shipment in flight",
+			holders: "[{d1 distributor 3} {d1 in_transit 1} {m1 manufacturer 1}]",
+			counts:  [5]int{5, 4, 1, 0, 0},
+		},
+		{
+			name:     "shipment returned",
+			statuses: []string{models.ShipmentInTransit, models.ShipmentReturned},
+			holders:  "[{d1 distributor 3} {m1 manufacturer 1} {m1 returned 1}]",
+			counts:   [5]int{5, 3, 1, 1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updateShipment("S1", tt.statuses...)
+
+			report, err := lm.GetRecallReport("R1")
+			must(err)
+			if holders := fmt.Sprint(report.Holders); holders != tt.holders {
+				t.Fatalf("holders = %s, want %s", holders, tt.holders)
+			}
+			counts := [5]int{report.Total, report.Located, report.Unshipped, report.Returned, report.Destroyed}
+			if counts != tt.counts {
+				t.Fatalf("total, located, unshipped, returned and destroyed = %v, want %v", counts, tt.counts)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Leaf and interior nodes are hashed with distinct prefixes (as in RFC 6962) so a leaf
+// can never be passed off as an interior node
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Sibling positions within a proof step
+const (
+	PositionLeft  = "left"
+	PositionRight = "right"
+)
+
+// ProofStep is one sibling hash on the path from a leaf to the root
+type ProofStep struct {
+	Hash     string `json:"hash"`
+	Position string `json:"position"` // left or right of the running hash
+}
+
+// LeafHash returns the hex-encoded hash of a leaf's data
+func LeafHash(data []byte) string {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Root computes the Merkle root of a list of hex-encoded leaf hashes. A node without a
+// sibling is carried up to the next level unchanged. The root of an empty tree is the
+// hash of empty input.
+func Root(leaves []string) (string, error) {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+
+	level, err := decodeHashes(leaves)
+	if err != nil {
+		return "", err
+	}
+
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+
+	return hex.EncodeToString(level[0]), nil
+}
+
+// Proof builds the inclusion proof for the leaf at the given index
+func Proof(leaves []string, index int) ([]ProofStep, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range for %d leaves", index, len(leaves))
+	}
+
+	level, err := decodeHashes(leaves)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []ProofStep{}
+	for len(level) > 1 {
+		if index%2 == 1 {
+			steps = append(steps, ProofStep{Hash: hex.EncodeToString(level[index-1]), Position: PositionLeft})
+		} else if index+1 < len(level) {
+			steps = append(steps, ProofStep{Hash: hex.EncodeToString(level[index+1]), Position: PositionRight})
+		}
+
+		level = nextLevel(level)
+		index /= 2
+	}
+
+	return steps, nil
+}
+
+// Verify checks that a leaf hash combined with the proof steps yields the expected root
+func Verify(leafHash string, steps []ProofStep, root string) bool {
+	current, err := hex.DecodeString(leafHash)
+	if err != nil {
+		return false
+	}
+
+	for _, step := range steps {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+
+		switch step.Position {
+		case PositionLeft:
+			current = nodeHash(sibling, current)
+		case PositionRight:
+			current = nodeHash(current, sibling)
+		default:
+			return false
+		}
+	}
+
+	return hex.EncodeToString(current) == root
+}
+
+// nextLevel combines adjacent pairs of nodes into their parents
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, nodeHash(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+// nodeHash hashes two child nodes into their parent
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// decodeHashes converts hex-encoded hashes into raw bytes
+func decodeHashes(hashes []string) ([][]byte, error) {
+	decoded := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		b, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid leaf hash at index %d: %v", i, err)
+		}
+		decoded[i] = b
+	}
+	return decoded, nil
+}
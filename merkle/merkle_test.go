@@ -0,0 +1,111 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// testLeaves returns the hashes of n leaves with data "leaf-0", "leaf-1", ...
+func testLeaves(n int) []string {
+	leaves := make([]string, n)
+	for i := range leaves {
+		leaves[i] = LeafHash([]byte(fmt.Sprintf("leaf-%d", i)))
+	}
+	return leaves
+}
+
+// parent hashes two hex-encoded children independently of nodeHash
+func parent(left, right string) string {
+	l, _ := hex.DecodeString(left)
+	r, _ := hex.DecodeString(right)
+	sum := sha256.Sum256(append(append([]byte{0x01}, l...), r...))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLeafHash(t *testing.T) {
+	sum := sha256.Sum256([]byte("\x00leaf-0"))
+	if got, want := LeafHash([]byte("leaf-0")), hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("LeafHash = %s, want %s", got, want)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	l := testLeaves(7)
+	tests := []struct {
+		name   string
+		leaves []string
+		want   string
+	}{
+		{"no leaves", nil, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"one leaf", l[:1], l[0]},
+		{"two leaves", l[:2], parent(l[0], l[1])},
+		{"three leaves", l[:3], parent(parent(l[0], l[1]), l[2])},
+		{"seven leaves", l, parent(
+			parent(parent(l[0], l[1]), parent(l[2], l[3])),
+			parent(parent(l[4], l[5]), l[6]),
+		)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Root(tt.leaves)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Root = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRootRejectsInvalidLeaf(t *testing.T) {
+	if _, err := Root([]string{testLeaves(1)[0], "not-hex"}); err == nil {
+		t.Fatal("expected an invalid leaf hash to be rejected")
+	}
+}
+
+func TestProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7} {
+		leaves := testLeaves(n)
+		root, err := Root(leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, leaf := range leaves {
+			steps, err := Proof(leaves, i)
+			if err != nil {
+				t.Fatalf("%d leaves: Proof(%d): %v", n, i, err)
+			}
+			if !Verify(leaf, steps, root) {
+				t.Errorf("%d leaves: proof of leaf %d does not verify", n, i)
+			}
+
+			// The proof must not verify another leaf
+			other := LeafHash([]byte("other"))
+			if Verify(other, steps, root) {
+				t.Errorf("%d leaves: proof of leaf %d verifies a foreign leaf", n, i)
+			}
+
+			// Nor with a sibling on the wrong side
+			if len(steps) > 0 {
+				flipped := append([]ProofStep{}, steps...)
+				if flipped[0].Position == PositionLeft {
+					flipped[0].Position = PositionRight
+				} else {
+					flipped[0].Position = PositionLeft
+				}
+				if Verify(leaf, flipped, root) {
+					t.Errorf("%d leaves: proof of leaf %d verifies with a flipped step", n, i)
+				}
+			}
+		}
+	}
+
+	if _, err := Proof(testLeaves(3), 3); err == nil {
+		t.Fatal("expected an out of range index to be rejected")
+	}
+}
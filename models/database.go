@@ -8,6 +8,9 @@ type Drug struct {
 	ManufacturerID   string    `json:"manufacturer_id"`
 	Name             string    `json:"name"`
 	Description      string    `json:"description"`
+	BatchNumber      string    `json:"batch_number,omitempty"`
+	ManufactureDate  string    `json:"manufacture_date,omitempty"` // YYYY-MM-DD
+	ExpiryDate       string    `json:"expiry_date,omitempty"`      // YYYY-MM-DD
 	Status           string    `json:"status"`
 	VerificationHash string    `json:"verification_hash"`
 	BlockchainTxID   string    `json:"blockchain_tx_id"`
@@ -15,6 +18,40 @@ type Drug struct {
 	UpdatedAt        time.Time `json:"updated_at"`
 }
 
+// Lot represents a manufactured lot of a drug in the database. The status of each of its
+// serialized units is tracked in the ledgers.
+type Lot struct {
+	ID              string    `json:"id"`
+	DrugID          string    `json:"drug_id"`
+	ManufacturerID  string    `json:"manufacturer_id"`
+	GTIN            string    `json:"gtin"`
+	BatchNumber     string    `json:"batch_number"`
+	ManufactureDate string    `json:"manufacture_date"` // YYYY-MM-DD
+	ExpiryDate      string    `json:"expiry_date"`      // YYYY-MM-DD
+	UnitCount       int       `json:"unit_count"`
+	Status          string    `json:"status"`
+	BlockchainTxID  string    `json:"blockchain_tx_id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Recall represents a recall in the database. The drugs, units and shipments it affected
+// are recorded in the ledgers.
+type Recall struct {
+	ID             string    `json:"id"`
+	ManufacturerID string    `json:"manufacturer_id"`
+	LotID          string    `json:"lot_id,omitempty"`
+	ExpiryFrom     string    `json:"expiry_from,omitempty"` // YYYY-MM-DD
+	ExpiryTo       string    `json:"expiry_to,omitempty"`   // YYYY-MM-DD
+	Reason         string    `json:"reason"`
+	DrugCount      int       `json:"drug_count"`
+	UnitCount      int       `json:"unit_count"`
+	ShipmentCount  int       `json:"shipment_count"`
+	CreatedBy      string    `json:"created_by"`
+	BlockchainTxID string    `json:"blockchain_tx_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
 // DrugStatusUpdate represents a drug status update in the database
 type DrugStatusUpdate struct {
 	ID             string    `json:"id"`
@@ -30,6 +67,9 @@ type DrugStatusUpdate struct {
 type Shipment struct {
 	ID             string    `json:"id"`
 	DrugID         string    `json:"drug_id"`
+	LotID          string    `json:"lot_id,omitempty"`
+	Serials        []string  `json:"serials,omitempty"`   // units of the lot carried by the shipment
+	RecallID       string    `json:"recall_id,omitempty"` // recall that caught the shipment in flight
 	ManufacturerID string    `json:"manufacturer_id"`
 	DistributorID  string    `json:"distributor_id"`
 	Status         string    `json:"status"`
@@ -51,24 +91,38 @@ type ShipmentStatusUpdate struct {
 
 // Prescription represents a prescription record in the database
 type Prescription struct {
-	ID             string    `json:"id"`
-	DrugID         string    `json:"drug_id"`
-	PatientID      string    `json:"patient_id"`
-	DoctorID       string    `json:"doctor_id"`
-	Dosage         string    `json:"dosage"`
-	Instructions   string    `json:"instructions"`
-	Status         string    `json:"status"`
-	BlockchainTxID string    `json:"blockchain_tx_id"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             string     `json:"id"`
+	DrugID         string     `json:"drug_id"`
+	PatientID      string     `json:"patient_id"`
+	DoctorID       string     `json:"doctor_id"`
+	Dosage         string     `json:"dosage"`
+	Instructions   string     `json:"instructions"`
+	Quantity       int        `json:"quantity"`
+	QuantityFilled int        `json:"quantity_filled"`
+	PharmacyID     string     `json:"pharmacy_id,omitempty"` // pharmacy of the last fill
+	Status         string     `json:"status"`
+	BlockchainTxID string     `json:"blockchain_tx_id"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
 }
 
+// User roles
+const (
+	RoleManufacturer = "manufacturer"
+	RoleDistributor  = "distributor"
+	RolePharmacy     = "pharmacy"
+	RoleDoctor       = "doctor"
+	RolePatient      = "patient"
+	RoleAdmin        = "admin"
+)
+
 // User represents a user record in the database
 type User struct {
 	ID        string    `json:"id"`
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
-	Role      string    `json:"role"` // manufacturer, distributor, doctor, patient
+	Role      string    `json:"role"` // manufacturer, distributor, pharmacy, doctor, patient, admin
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -91,22 +145,75 @@ type BlockchainTransaction struct {
 
 // CreateDrugParams represents the parameters for creating a drug
 type CreateDrugParams struct {
-	DrugID         string `json:"drug_id"`
+	DrugID          string `json:"drug_id"`
+	ManufacturerID  string `json:"manufacturer_id"`
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	BatchNumber     string `json:"batch_number"`
+	ManufactureDate string `json:"manufacture_date"` // optional, YYYY-MM-DD
+	ExpiryDate      string `json:"expiry_date"`      // optional, YYYY-MM-DD
+	UserID          string `json:"user_id"`
+	Location        string `json:"location"`
+}
+
+// UnitSelection selects serialized units of a lot, either by serial or by an inclusive
+// range of serials in the order the lot's units were created
+type UnitSelection struct {
+	Serials    []string `json:"serials,omitempty"`
+	SerialFrom string   `json:"serial_from,omitempty"`
+	SerialTo   string   `json:"serial_to,omitempty"`
+}
+
+// CreateLotParams represents the parameters for creating a lot of serialized units
+type CreateLotParams struct {
+	LotID           string   `json:"lot_id"`
+	DrugID          string   `json:"drug_id"`
+	ManufacturerID  string   `json:"manufacturer_id"`
+	GTIN            string   `json:"gtin"`
+	BatchNumber     string   `json:"batch_number"`
+	ManufactureDate string   `json:"manufacture_date"` // YYYY-MM-DD
+	ExpiryDate      string   `json:"expiry_date"`      // YYYY-MM-DD
+	Serials         []string `json:"serials"`          // serial numbers of the units
+	UnitCount       int      `json:"unit_count"`       // number of units to number upwards, after the GTIN's highest serial, when no serials are given
+	UserID          string   `json:"user_id"`
+	Location        string   `json:"location"`
+}
+
+// UpdateUnitStatusParams represents the parameters for updating the status of units of a lot
+type UpdateUnitStatusParams struct {
+	LotID         string `json:"lot_id"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason"`
+	UserID        string `json:"user_id"`
+	Location      string `json:"location"`
+	UnitSelection        // units to update
+}
+
+// CreateRecallParams represents the parameters for recalling the drugs and lot units of a
+// manufacturer, optionally narrowed to a lot and to an inclusive expiry date window
+type CreateRecallParams struct {
+	RecallID       string `json:"recall_id"`
 	ManufacturerID string `json:"manufacturer_id"`
-	Name           string `json:"name"`
-	Description    string `json:"description"`
+	LotID          string `json:"lot_id"`
+	ExpiryFrom     string `json:"expiry_from"` // YYYY-MM-DD
+	ExpiryTo       string `json:"expiry_to"`   // YYYY-MM-DD
+	Reason         string `json:"reason"`
 	UserID         string `json:"user_id"`
 	Location       string `json:"location"`
 }
 
-// CreateShipmentParams represents the parameters for creating a shipment
+// CreateShipmentParams represents the parameters for creating a shipment. A shipment
+// carries either a drug or units of a lot: the selected units, or every unit of the lot
+// still at the manufacturer when none are selected.
 type CreateShipmentParams struct {
 	ShipmentID     string `json:"shipment_id"`
 	DrugID         string `json:"drug_id"`
+	LotID          string `json:"lot_id"`
 	ManufacturerID string `json:"manufacturer_id"`
 	DistributorID  string `json:"distributor_id"`
 	UserID         string `json:"user_id"`
 	Location       string `json:"location"`
+	UnitSelection         // units of the lot to ship
 }
 
 // UpdateShipmentStatusParams represents the parameters for updating a shipment status
@@ -125,3 +232,32 @@ type RevertDrugParams struct {
 	UserID         string `json:"user_id"`
 	Location       string `json:"location"`
 }
+
+// IssuePrescriptionParams represents the parameters for issuing a prescription
+type IssuePrescriptionParams struct {
+	PrescriptionID string     `json:"prescription_id"`
+	DrugID         string     `json:"drug_id"`
+	PatientID      string     `json:"patient_id"`
+	DoctorID       string     `json:"doctor_id"`
+	Dosage         string     `json:"dosage"`
+	Instructions   string     `json:"instructions"`
+	Quantity       int        `json:"quantity"` // units prescribed, 1 if not given
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	UserID         string     `json:"user_id"`
+}
+
+// FillPrescriptionParams represents the parameters for filling a prescription
+type FillPrescriptionParams struct {
+	PrescriptionID string `json:"prescription_id"`
+	PharmacyID     string `json:"pharmacy_id"`
+	Quantity       int    `json:"quantity"` // units dispensed, the remaining units if not given
+	UserID         string `json:"user_id"`
+	Location       string `json:"location"`
+}
+
+// PrescriptionStatusParams represents the parameters for cancelling or expiring a prescription
+type PrescriptionStatusParams struct {
+	PrescriptionID string `json:"prescription_id"`
+	Reason         string `json:"reason"`
+	UserID         string `json:"user_id"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// Limits of the upcoming expiry window, in days
+const (
+	DefaultExpiryWindowDays = 30
+	MaxExpiryWindowDays     = 365
+)
+
+// IsExpired reports whether stock with the given expiry date has expired at a time. Stock
+// may be used through its expiry date and expires the day after; stock without an expiry
+// date never expires.
+func IsExpired(expiryDate string, now time.Time) bool {
+	// Dates formatted as YYYY-MM-DD order as strings
+	return expiryDate != "" && now.Format(DateLayout) > expiryDate
+}
+
+// ExpiryQuery selects the stock of a manufacturer, or held by a distributor, that expires
+// within a number of days
+type ExpiryQuery struct {
+	ManufacturerID string
+	DistributorID  string
+	Days           int
+}
+
+// ExpiryItem represents a drug, or the units of a lot with one holder, nearing expiry
+type ExpiryItem struct {
+	DrugID         string `json:"drug_id"`
+	LotID          string `json:"lot_id,omitempty"`
+	GTIN           string `json:"gtin,omitempty"`
+	BatchNumber    string `json:"batch_number,omitempty"`
+	ManufacturerID string `json:"manufacturer_id"`
+	ExpiryDate     string `json:"expiry_date"`
+	DaysLeft       int    `json:"days_left"`
+	Custody        string `json:"custody"`
+	HolderID       string `json:"holder_id"`
+	Units          int    `json:"units"`
+}
+
+// ExpiryReport represents the stock expiring between two dates, soonest first
+type ExpiryReport struct {
+	ManufacturerID string       `json:"manufacturer_id,omitempty"`
+	DistributorID  string       `json:"distributor_id,omitempty"`
+	From           string       `json:"from"`
+	To             string       `json:"to"`
+	Units          int          `json:"units"`
+	Items          []ExpiryItem `json:"items"`
+	GeneratedAt    string       `json:"generated_at"`
+}
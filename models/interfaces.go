@@ -17,6 +17,12 @@ type LedgerStorage interface {
 	UpdateDrug(drug *Drug) error
 	GetDrug(drugID string) (*Drug, error)
 
+	InsertLot(lot *Lot) error
+	UpdateLot(lot *Lot) error
+	GetLot(lotID string) (*Lot, error)
+
+	InsertRecall(recall *Recall) error
+
 	InsertDrugStatusUpdate(update *DrugStatusUpdate) error
 	GetDrugStatusUpdates(drugID string) ([]DrugStatusUpdate, error)
 
@@ -26,6 +32,10 @@ type LedgerStorage interface {
 
 	InsertShipmentStatusUpdate(update *ShipmentStatusUpdate) error
 	GetShipmentStatusUpdates(shipmentID string) ([]ShipmentStatusUpdate, error)
+
+	InsertPrescription(prescription *Prescription) error
+	UpdatePrescription(prescription *Prescription) error
+	GetPrescription(prescriptionID string) (*Prescription, error)
 }
 
 // BlockchainService defines the interface for blockchain operations
@@ -48,12 +58,40 @@ type LedgerManager interface {
 	CreateDrug(params *CreateDrugParams) (string, error)
 	RevertDrug(params *RevertDrugParams) error
 
+	// Lot operations
+	CreateLot(params *CreateLotParams) (string, error)
+	UpdateUnitStatus(params *UpdateUnitStatusParams) (string, error)
+
+	// Recall operations
+	CreateRecall(params *CreateRecallParams) (*RecallRecord, error)
+
 	// Shipment operations
 	CreateShipment(params *CreateShipmentParams) (string, error)
 	UpdateShipmentStatus(params *UpdateShipmentStatusParams) error
 
+	// Prescription operations
+	IssuePrescription(params *IssuePrescriptionParams) (string, error)
+	FillPrescription(params *FillPrescriptionParams) (*Prescription, error)
+	CancelPrescription(params *PrescriptionStatusParams) error
+	ExpirePrescription(params *PrescriptionStatusParams) error
+	GetPrescription(prescriptionID string) (*Prescription, error)
+
 	// Verification operations
 	VerifyDrug(drugID string) (bool, error)
+	VerifyUnit(gtin, serial string) (bool, error)
 	GetDrugHistory(drugID string) ([]DrugStatusUpdate, error)
 	GetShipmentHistory(shipmentID string) ([]ShipmentStatusUpdate, error)
+
+	// Query operations
+	ListDrugs(query *ListQuery) (*DrugPage, error)
+	GetDrug(drugID string) (*DrugView, error)
+	ListShipments(query *ListQuery) (*ShipmentPage, error)
+	GetShipment(shipmentID string) (*ShipmentView, error)
+	ListLots(drugID, manufacturerID string) ([]LotView, error)
+	GetLot(lotID string) (*LotView, error)
+	GetUnit(gtin, serial string) (*UnitView, error)
+	ListRecalls(manufacturerID string) ([]RecallView, error)
+	GetRecall(recallID string) (*RecallView, error)
+	GetRecallReport(recallID string) (*RecallReport, error)
+	GetExpiryReport(query *ExpiryQuery) (*ExpiryReport, error)
 }
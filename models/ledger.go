@@ -16,25 +16,58 @@ type Status struct {
 type ManufacturerLedger struct {
 	ManufacturerID string           `json:"manufacturer_id"`
 	Drugs          []DrugRecord     `json:"drugs"`
+	Lots           []LotRecord      `json:"lots"`
 	Shipments      []ShipmentRecord `json:"shipments"`
+	Recalls        []RecallRecord   `json:"recalls"`
+	Version        int64            `json:"version"` // incremented on every write of the ledger
 	LastUpdated    string           `json:"last_updated"`
 }
 
 // DrugRecord represents a drug's status and history
 type DrugRecord struct {
-	DrugID        string   `json:"drug_id"`
-	Status        string   `json:"status"` // created, reverted, in_transit, delivered
-	CreatedAt     string   `json:"created_at"`
-	RevertedAt    string   `json:"reverted_at,omitempty"`
-	CurrentStatus string   `json:"current_status"`
-	History       []Status `json:"history"`
+	DrugID          string   `json:"drug_id"`
+	BatchNumber     string   `json:"batch_number,omitempty"`
+	ManufactureDate string   `json:"manufacture_date,omitempty"`
+	ExpiryDate      string   `json:"expiry_date,omitempty"`
+	Status          string   `json:"status"` // see DrugTransitions
+	CreatedAt       string   `json:"created_at"`
+	RevertedAt      string   `json:"reverted_at,omitempty"`
+	CurrentStatus   string   `json:"current_status"`
+	History         []Status `json:"history"`
+}
+
+// LotRecord represents a lot of a drug, its status and history, and its serialized units
+type LotRecord struct {
+	LotID           string       `json:"lot_id"`
+	DrugID          string       `json:"drug_id"`
+	GTIN            string       `json:"gtin"`
+	BatchNumber     string       `json:"batch_number"`
+	ManufactureDate string       `json:"manufacture_date"`
+	ExpiryDate      string       `json:"expiry_date"`
+	Status          string       `json:"status"` // see LotTransitions
+	CreatedAt       string       `json:"created_at"`
+	CurrentStatus   string       `json:"current_status"`
+	History         []Status     `json:"history"`
+	Units           []UnitRecord `json:"units,omitempty"`
+}
+
+// UnitRecord represents the status of a serialized unit of a lot. A unit is identified by
+// its lot's GTIN and its serial.
+type UnitRecord struct {
+	Serial     string `json:"serial"`
+	Status     string `json:"status"`                // see DrugTransitions
+	ShipmentID string `json:"shipment_id,omitempty"` // last shipment that carried the unit
+	UpdatedAt  string `json:"updated_at"`
 }
 
 // ShipmentRecord represents a shipment's status and history
 type ShipmentRecord struct {
 	ShipmentID    string   `json:"shipment_id"`
 	DrugID        string   `json:"drug_id"`
-	Status        string   `json:"status"` // created, in_transit, delivered, failed
+	LotID         string   `json:"lot_id,omitempty"`
+	Serials       []string `json:"serials,omitempty"`
+	RecallID      string   `json:"recall_id,omitempty"`
+	Status        string   `json:"status"` // see ShipmentTransitions
 	CreatedAt     string   `json:"created_at"`
 	CurrentStatus string   `json:"current_status"`
 	History       []Status `json:"history"`
@@ -43,7 +76,10 @@ type ShipmentRecord struct {
 // CommonLedger represents the shared ledger for distributors and users
 type CommonLedger struct {
 	Drugs       []CommonDrugRecord     `json:"drugs"`
+	Lots        []CommonLotRecord      `json:"lots"`
 	Shipments   []CommonShipmentRecord `json:"shipments"`
+	Recalls     []RecallRecord         `json:"recalls"`
+	Version     int64                  `json:"version"` // incremented on every write of the ledger
 	LastUpdated string                 `json:"last_updated"`
 }
 
@@ -51,31 +87,78 @@ type CommonLedger struct {
 type CommonDrugRecord struct {
 	DrugID           string   `json:"drug_id"`
 	ManufacturerID   string   `json:"manufacturer_id"`
-	Status           string   `json:"status"` // active, reverted, in_transit, delivered
+	BatchNumber      string   `json:"batch_number,omitempty"`
+	ManufactureDate  string   `json:"manufacture_date,omitempty"`
+	ExpiryDate       string   `json:"expiry_date,omitempty"`
+	Status           string   `json:"status"` // see DrugTransitions
 	CreatedAt        string   `json:"created_at"`
 	CurrentStatus    string   `json:"current_status"`
 	History          []Status `json:"history"`
 	VerificationHash string   `json:"verification_hash"`
 }
 
+// CommonLotRecord represents a lot's public information and its serialized units in the
+// common ledger
+type CommonLotRecord struct {
+	LotID           string       `json:"lot_id"`
+	DrugID          string       `json:"drug_id"`
+	ManufacturerID  string       `json:"manufacturer_id"`
+	GTIN            string       `json:"gtin"`
+	BatchNumber     string       `json:"batch_number"`
+	ManufactureDate string       `json:"manufacture_date"`
+	ExpiryDate      string       `json:"expiry_date"`
+	Status          string       `json:"status"` // see LotTransitions
+	CreatedAt       string       `json:"created_at"`
+	CurrentStatus   string       `json:"current_status"`
+	History         []Status     `json:"history"`
+	Units           []UnitRecord `json:"units,omitempty"`
+}
+
 // CommonShipmentRecord represents a shipment's public information in the common ledger
 type CommonShipmentRecord struct {
 	ShipmentID     string   `json:"shipment_id"`
 	DrugID         string   `json:"drug_id"`
+	LotID          string   `json:"lot_id,omitempty"`
+	Serials        []string `json:"serials,omitempty"`
+	RecallID       string   `json:"recall_id,omitempty"` // recall that caught the shipment in flight
 	ManufacturerID string   `json:"manufacturer_id"`
 	DistributorID  string   `json:"distributor_id"`
-	Status         string   `json:"status"` // created, in_transit, delivered, failed
+	Status         string   `json:"status"` // see ShipmentTransitions
 	CreatedAt      string   `json:"created_at"`
 	CurrentStatus  string   `json:"current_status"`
 	History        []Status `json:"history"`
 }
 
+// RecallRecord represents a recall, its scope and the drugs, units and in-flight shipments
+// it affected
+type RecallRecord struct {
+	RecallID       string        `json:"recall_id"`
+	ManufacturerID string        `json:"manufacturer_id"`
+	LotID          string        `json:"lot_id,omitempty"`
+	ExpiryFrom     string        `json:"expiry_from,omitempty"`
+	ExpiryTo       string        `json:"expiry_to,omitempty"`
+	Reason         string        `json:"reason"`
+	DrugIDs        []string      `json:"drug_ids"`
+	Lots           []RecalledLot `json:"lots"`
+	ShipmentIDs    []string      `json:"shipment_ids"`
+	CreatedBy      string        `json:"created_by"`
+	CreatedAt      string        `json:"created_at"`
+}
+
+// RecalledLot represents a lot caught by a recall and the serials of its recalled units
+type RecalledLot struct {
+	LotID   string   `json:"lot_id"`
+	Serials []string `json:"serials"`
+}
+
 // NewManufacturerLedger creates a new manufacturer ledger
 func NewManufacturerLedger(manufacturerID string) *ManufacturerLedger {
 	return &ManufacturerLedger{
 		ManufacturerID: manufacturerID,
 		Drugs:          []DrugRecord{},
+		Lots:           []LotRecord{},
 		Shipments:      []ShipmentRecord{},
+		Recalls:        []RecallRecord{},
 		LastUpdated:    time.Now().Format(time.RFC3339),
 	}
 }
@@ -84,7 +167,9 @@ func NewManufacturerLedger(manufacturerID string) *ManufacturerLedger {
 func NewCommonLedger() *CommonLedger {
 	return &CommonLedger{
 		Drugs:       []CommonDrugRecord{},
+		Lots:        []CommonLotRecord{},
 		Shipments:   []CommonShipmentRecord{},
+		Recalls:     []RecallRecord{},
 		LastUpdated: time.Now().Format(time.RFC3339),
 	}
 }
@@ -98,3 +183,31 @@ func (ml *ManufacturerLedger) ToJSON() ([]byte, error) {
 func (cl *CommonLedger) ToJSON() ([]byte, error) {
 	return json.MarshalIndent(cl, "", "  ")
 }
+
+// Clone returns a deep copy of the manufacturer ledger
+func (ml *ManufacturerLedger) Clone() *ManufacturerLedger {
+	data, err := json.Marshal(ml)
+	if err != nil {
+		return nil
+	}
+
+	var clone ManufacturerLedger
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil
+	}
+	return &clone
+}
+
+// Clone returns a deep copy of the common ledger
+func (cl *CommonLedger) Clone() *CommonLedger {
+	data, err := json.Marshal(cl)
+	if err != nil {
+		return nil
+	}
+
+	var clone CommonLedger
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil
+	}
+	return &clone
+}
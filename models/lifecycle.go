@@ -0,0 +1,148 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Drug lifecycle states
+const (
+	DrugCreated   = "created"
+	DrugInTransit = "in_transit"
+	DrugDelivered = "delivered"
+	DrugDispensed = "dispensed"
+	DrugReverted  = "reverted"
+	DrugRecalled  = "recalled"
+	DrugExpired   = "expired"
+	DrugDestroyed = "destroyed"
+)
+
+// Lot lifecycle states. The units of a lot follow the drug lifecycle.
+const (
+	LotCreated   = "created"
+	LotRecalled  = "recalled"
+	LotExpired   = "expired"
+	LotDestroyed = "destroyed"
+)
+
+// Shipment lifecycle states
+const (
+	ShipmentCreated   = "created"
+	ShipmentPickedUp  = "picked_up"
+	ShipmentInTransit = "in_transit"
+	ShipmentDelivered = "delivered"
+	ShipmentFailed    = "failed"
+	ShipmentReturned  = "returned"
+)
+
+// Prescription lifecycle states
+const (
+	PrescriptionIssued          = "issued"
+	PrescriptionPartiallyFilled = "partially_filled"
+	PrescriptionFilled          = "filled"
+	PrescriptionCancelled       = "cancelled"
+	PrescriptionExpired         = "expired"
+)
+
+// DrugTransitions lists the states a drug may move to from each state. A drug returns to
+// created when its shipment is returned, so it can be shipped again.
+var DrugTransitions = map[string][]string{
+	DrugCreated:   {DrugInTransit, DrugReverted, DrugRecalled, DrugExpired, DrugDestroyed},
+	DrugInTransit: {DrugDelivered, DrugCreated, DrugReverted, DrugRecalled, DrugExpired},
+	DrugDelivered: {DrugDispensed, DrugRecalled, DrugExpired, DrugDestroyed},
+	DrugDispensed: {DrugRecalled},
+	DrugReverted:  {DrugDestroyed},
+	DrugRecalled:  {DrugDestroyed},
+	DrugExpired:   {DrugDestroyed},
+	DrugDestroyed: {},
+}
+
+// LotTransitions lists the states a lot may move to from each state
+var LotTransitions = map[string][]string{
+	LotCreated:   {LotRecalled, LotExpired, LotDestroyed},
+	LotRecalled:  {LotDestroyed},
+	LotExpired:   {LotDestroyed},
+	LotDestroyed: {},
+}
+
+// ShipmentTransitions lists the states a shipment may move to from each state
+var ShipmentTransitions = map[string][]string{
+	ShipmentCreated:   {ShipmentPickedUp, ShipmentFailed},
+	ShipmentPickedUp:  {ShipmentInTransit, ShipmentFailed, ShipmentReturned},
+	ShipmentInTransit: {ShipmentDelivered, ShipmentFailed, ShipmentReturned},
+	ShipmentFailed:    {ShipmentReturned},
+	ShipmentDelivered: {},
+	ShipmentReturned:  {},
+}
+
+// PrescriptionTransitions lists the states a prescription may move to from each state. A
+// partially filled prescription stays partially filled until its last unit is dispensed.
+var PrescriptionTransitions = map[string][]string{
+	PrescriptionIssued:          {PrescriptionPartiallyFilled, PrescriptionFilled, PrescriptionCancelled, PrescriptionExpired},
+	PrescriptionPartiallyFilled: {PrescriptionPartiallyFilled, PrescriptionFilled, PrescriptionCancelled, PrescriptionExpired},
+	PrescriptionFilled:          {},
+	PrescriptionCancelled:       {},
+	PrescriptionExpired:         {},
+}
+
+// TransitionError is returned when a drug, lot, unit, shipment or prescription is asked to move to a
+// state that is not reachable from its current state
+type TransitionError struct {
+	Entity  string   `json:"entity"` // drug, lot, unit, shipment or prescription
+	ID      string   `json:"id"`
+	From    string   `json:"current_status"`
+	To      string   `json:"requested_status"`
+	Allowed []string `json:"allowed_next_states"`
+}
+
+// Error describes the rejected transition and the allowed next states
+func (e *TransitionError) Error() string {
+	if len(e.Allowed) == 0 {
+		return fmt.Sprintf("%s %s cannot move from %s to %s: %s is a final state", e.Entity, e.ID, e.From, e.To, e.From)
+	}
+	return fmt.Sprintf("%s %s cannot move from %s to %s: allowed next states are %s", e.Entity, e.ID, e.From, e.To, strings.Join(e.Allowed, ", "))
+}
+
+// CheckDrugTransition returns a *TransitionError if a drug may not move from one state to another
+func CheckDrugTransition(drugID, from, to string) error {
+	return checkTransition(DrugTransitions, "drug", drugID, from, to)
+}
+
+// CheckLotTransition returns a *TransitionError if a lot may not move from one state to another
+func CheckLotTransition(lotID, from, to string) error {
+	return checkTransition(LotTransitions, "lot", lotID, from, to)
+}
+
+// CheckUnitTransition returns a *TransitionError if a serialized unit, identified by its
+// GTIN and serial, may not move from one state to another
+func CheckUnitTransition(gtin, serial, from, to string) error {
+	return checkTransition(DrugTransitions, "unit", UnitID(gtin, serial), from, to)
+}
+
+// CheckShipmentTransition returns a *TransitionError if a shipment may not move from one state to another
+func CheckShipmentTransition(shipmentID, from, to string) error {
+	return checkTransition(ShipmentTransitions, "shipment", shipmentID, from, to)
+}
+
+// CheckPrescriptionTransition returns a *TransitionError if a prescription may not move from one state to another
+func CheckPrescriptionTransition(prescriptionID, from, to string) error {
+	return checkTransition(PrescriptionTransitions, "prescription", prescriptionID, from, to)
+}
+
+// checkTransition looks a transition up in a state table
+func checkTransition(transitions map[string][]string, entity, id, from, to string) error {
+	allowed := transitions[from]
+	for _, state := range allowed {
+		if state == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{
+		Entity:  entity,
+		ID:      id,
+		From:    from,
+		To:      to,
+		Allowed: append([]string{}, allowed...),
+	}
+}
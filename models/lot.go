@@ -0,0 +1,106 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateLayout is the format of manufacture and expiry dates
+const DateLayout = "2006-01-02"
+
+// Limits on the serialized units of a lot. Serials follow GS1 application identifier 21,
+// which allows up to 20 characters.
+const (
+	MaxLotUnits     = 10000
+	MaxSerialLength = 20
+)
+
+// LotView represents a lot from the common ledger with the number of its units in each
+// status and the blockchain transactions that mention it
+type LotView struct {
+	CommonLotRecord
+	UnitCounts      map[string]int `json:"unit_counts"`
+	BlockchainTxIDs []string       `json:"blockchain_tx_ids"`
+}
+
+// UnitView represents a serialized unit with the lot it belongs to and the blockchain
+// transactions that moved it
+type UnitView struct {
+	UnitRecord
+	GTIN            string   `json:"gtin"`
+	LotID           string   `json:"lot_id"`
+	DrugID          string   `json:"drug_id"`
+	ManufacturerID  string   `json:"manufacturer_id"`
+	BatchNumber     string   `json:"batch_number"`
+	ExpiryDate      string   `json:"expiry_date"`
+	BlockchainTxIDs []string `json:"blockchain_tx_ids"`
+}
+
+// UnitID returns the identifier of a serialized unit, its GTIN and serial in GS1 element
+// string order
+func UnitID(gtin, serial string) string {
+	return fmt.Sprintf("(01)%s(21)%s", gtin, serial)
+}
+
+// ValidateGTIN checks that a GTIN has 8, 12, 13 or 14 digits and a valid check digit
+func ValidateGTIN(gtin string) error {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return fmt.Errorf("%w: GTIN %s must have 8, 12, 13 or 14 digits", ErrInvalidLot, gtin)
+	}
+
+	// Weight the digits 3 and 1 alternately from the right, excluding the check digit
+	sum := 0
+	for i := len(gtin) - 2; i >= 0; i-- {
+		digit := int(gtin[i] - '0')
+		if digit < 0 || digit > 9 {
+			return fmt.Errorf("%w: GTIN %s must only contain digits", ErrInvalidLot, gtin)
+		}
+		if (len(gtin)-2-i)%2 == 0 {
+			sum += 3 * digit
+		} else {
+			sum += digit
+		}
+	}
+
+	check := int(gtin[len(gtin)-1] - '0')
+	if check < 0 || check > 9 || (10-sum%10)%10 != check {
+		return fmt.Errorf("%w: GTIN %s has an invalid check digit", ErrInvalidLot, gtin)
+	}
+	return nil
+}
+
+// ParseDate parses a manufacture or expiry date
+func ParseDate(field, value string) (time.Time, error) {
+	date, err := time.Parse(DateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s must be a date formatted as YYYY-MM-DD", ErrInvalidDate, field)
+	}
+	return date, nil
+}
+
+// ValidateDates checks the manufacture and expiry dates of a drug or lot. Either may be
+// empty unless required; when both are given the expiry must follow the manufacture.
+func ValidateDates(manufactureDate, expiryDate string, required bool) error {
+	if required && (manufactureDate == "" || expiryDate == "") {
+		return fmt.Errorf("%w: manufacture_date and expiry_date are required", ErrInvalidDate)
+	}
+
+	var manufactured, expires time.Time
+	var err error
+	if manufactureDate != "" {
+		if manufactured, err = ParseDate("manufacture_date", manufactureDate); err != nil {
+			return err
+		}
+	}
+	if expiryDate != "" {
+		if expires, err = ParseDate("expiry_date", expiryDate); err != nil {
+			return err
+		}
+	}
+	if !manufactured.IsZero() && !expires.IsZero() && !expires.After(manufactured) {
+		return fmt.Errorf("%w: expiry_date must be after manufacture_date", ErrInvalidDate)
+	}
+	return nil
+}
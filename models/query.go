@@ -0,0 +1,92 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Query errors returned by ledger read operations
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrInvalidQuery   = errors.New("invalid query")
+)
+
+// Prescription errors returned by ledger operations
+var (
+	ErrPrescriptionExpired = errors.New("prescription has expired")
+	ErrInvalidFillQuantity = errors.New("invalid fill quantity")
+)
+
+// Lot errors returned by ledger operations
+var (
+	ErrInvalidLot  = errors.New("invalid lot") // a lot, or a selection of its units, is rejected
+	ErrInvalidDate = errors.New("invalid date")
+)
+
+// Recall errors returned by ledger operations
+var (
+	ErrInvalidRecall = errors.New("invalid recall")
+)
+
+// Expiry errors returned by ledger operations
+var (
+	ErrDrugExpired = errors.New("drug has expired")
+)
+
+// Pagination limits for list queries
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// Sort orders for list queries
+const (
+	SortAsc  = "asc"
+	SortDesc = "desc"
+)
+
+// ListQuery holds the filters, sorting and cursor of a drug or shipment list query.
+// Zero values mean no filter; the cursor is the opaque next_cursor of a previous page.
+type ListQuery struct {
+	ManufacturerID string
+	DistributorID  string
+	Status         string
+	CreatedFrom    time.Time
+	CreatedTo      time.Time
+	SortBy         string // created_at, status, manufacturer_id, or the record ID
+	Order          string // asc or desc
+	Cursor         string
+	Limit          int
+}
+
+// DrugView represents a drug from the common ledger joined with its database record
+// and the blockchain transactions that mention it
+type DrugView struct {
+	CommonDrugRecord
+	Name            string   `json:"name,omitempty"`
+	Description     string   `json:"description,omitempty"`
+	UpdatedAt       string   `json:"updated_at,omitempty"`
+	BlockchainTxIDs []string `json:"blockchain_tx_ids"`
+}
+
+// ShipmentView represents a shipment from the common ledger joined with its database
+// record and the blockchain transactions that mention it
+type ShipmentView struct {
+	CommonShipmentRecord
+	UpdatedAt       string   `json:"updated_at,omitempty"`
+	BlockchainTxIDs []string `json:"blockchain_tx_ids"`
+}
+
+// DrugPage represents a page of drugs
+type DrugPage struct {
+	Drugs      []DrugView `json:"drugs"`
+	Count      int        `json:"count"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// ShipmentPage represents a page of shipments
+type ShipmentPage struct {
+	Shipments  []ShipmentView `json:"shipments"`
+	Count      int            `json:"count"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
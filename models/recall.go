@@ -0,0 +1,55 @@
+package models
+
+// Custody of a recalled drug or unit, derived from its status and its last shipment
+const (
+	CustodyManufacturer = "manufacturer" // never shipped, it has not left the manufacturer
+	CustodyReturned     = "returned"     // its shipment was returned to the manufacturer
+	CustodyInTransit    = "in_transit"   // its shipment has not been delivered
+	CustodyDistributor  = "distributor"  // its shipment was delivered
+	CustodyDispensed    = "dispensed"    // dispensed after delivery to the distributor
+	CustodyDestroyed    = "destroyed"
+)
+
+// RecallView represents a recall from the common ledger with the blockchain transactions
+// that recorded it
+type RecallView struct {
+	RecallRecord
+	BlockchainTxIDs []string `json:"blockchain_tx_ids"`
+}
+
+// RecallItem represents a recalled drug, or serialized unit of a lot, and who holds it
+type RecallItem struct {
+	DrugID     string `json:"drug_id"`
+	LotID      string `json:"lot_id,omitempty"`
+	GTIN       string `json:"gtin,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Status     string `json:"status"`
+	Custody    string `json:"custody"`
+	HolderID   string `json:"holder_id,omitempty"`
+	ShipmentID string `json:"shipment_id,omitempty"` // last shipment that carried the item
+}
+
+// RecallHolder represents an organization holding recalled items
+type RecallHolder struct {
+	HolderID string `json:"holder_id"`
+	Custody  string `json:"custody"`
+	Items    int    `json:"items"`
+}
+
+// RecallReport represents the progress of a recall. Located items are still in the
+// field, in transit, with a distributor or dispensed; unshipped items never left the
+// manufacturer, and returned items came back to it with their shipment.
+type RecallReport struct {
+	RecallID       string         `json:"recall_id"`
+	ManufacturerID string         `json:"manufacturer_id"`
+	Reason         string         `json:"reason"`
+	CreatedAt      string         `json:"created_at"`
+	Total          int            `json:"total"`
+	Located        int            `json:"located"`
+	Unshipped      int            `json:"unshipped"`
+	Returned       int            `json:"returned"`
+	Destroyed      int            `json:"destroyed"`
+	Holders        []RecallHolder `json:"holders"`
+	Items          []RecallItem   `json:"items"`
+	GeneratedAt    string         `json:"generated_at"`
+}
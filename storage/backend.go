@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// Storage backend kinds selectable through the STORAGE_BACKEND environment variable
+const (
+	BackendFile = "file"
+	BackendKV   = "kv"
+)
+
+// ErrNotFound is returned by a backend when a ledger or record does not exist
+var ErrNotFound = errors.New("not found")
+
+// Backend persists blocks, manufacturer ledgers, the common ledger and data records
+type Backend interface {
+	// Block operations
+	AppendBlock(block Block) error
+	ReadBlock(height int) (*Block, error)
+	Blocks() ([]Block, error)
+	Tip() (int, string, string)
+
+	// Manufacturer ledger operations
+	GetManufacturerLedger(manufacturerID string) (*models.ManufacturerLedger, error)
+	SaveManufacturerLedger(ledger *models.ManufacturerLedger) error
+	ListManufacturerLedgers() ([]string, error)
+	DeleteManufacturerLedger(manufacturerID string) error
+
+	// Common ledger operations
+	GetCommonLedger() (*models.CommonLedger, error)
+	SaveCommonLedger(ledger *models.CommonLedger) error
+
+	// Record operations
+	SaveRecord(name string, data []byte) error
+	GetRecord(name string) ([]byte, error)
+	ListRecords() ([]string, error)
+
+	Close() error
+}
+
+// NewBackend opens the storage backend selected by the STORAGE_BACKEND environment
+// variable: "file" (default) keeps JSON files and a segmented block log on disk, "kv"
+// keeps everything in a single embedded key-value store at STORAGE_KV_PATH.
+func NewBackend() (Backend, error) {
+	kind := os.Getenv("STORAGE_BACKEND")
+	if kind == "" {
+		kind = BackendFile
+	}
+
+	switch kind {
+	case BackendFile:
+		return NewFileBackend("blockchain_data", "data_records")
+	case BackendKV:
+		path := os.Getenv("STORAGE_KV_PATH")
+		if path == "" {
+			path = filepath.Join("blockchain_data", "ledger.kv")
+		}
+
+		backend, err := NewKVBackend(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Import the file backend the first time the key-value store is used
+		if err := importFileBackend(backend, "blockchain_data", "data_records"); err != nil {
+			backend.Close()
+			return nil, err
+		}
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", kind)
+	}
+}
+
+// importFileBackend copies the contents of an existing file backend into an empty backend
+func importFileBackend(dst Backend, blockchainDir, recordsDir string) error {
+	if height, _, _ := dst.Tip(); height > 0 {
+		return nil
+	}
+	if ids, err := dst.ListManufacturerLedgers(); err != nil || len(ids) > 0 {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(blockchainDir, "segments")); os.IsNotExist(err) {
+		return nil
+	}
+
+	src, err := NewFileBackend(blockchainDir, recordsDir)
+	if err != nil {
+		return fmt.Errorf("failed to open file backend for import: %v", err)
+	}
+	defer src.Close()
+
+	if err := CopyBackend(dst, src); err != nil {
+		return fmt.Errorf("failed to import file backend: %v", err)
+	}
+
+	height, _, _ := dst.Tip()
+	log.Printf("Imported %d blocks and ledgers from %s into the key-value store", height, blockchainDir)
+	return nil
+}
+
+// CopyBackend copies all blocks, ledgers and records from one backend into another
+func CopyBackend(dst, src Backend) error {
+	blocks, err := src.Blocks()
+	if err != nil {
+		return fmt.Errorf("failed to read blocks: %v", err)
+	}
+	for _, block := range blocks {
+		if err := dst.AppendBlock(block); err != nil {
+			return fmt.Errorf("failed to copy block %d: %v", block.BlockHeight, err)
+		}
+	}
+
+	manufacturerIDs, err := src.ListManufacturerLedgers()
+	if err != nil {
+		return fmt.Errorf("failed to list manufacturer ledgers: %v", err)
+	}
+	for _, manufacturerID := range manufacturerIDs {
+		ledger, err := src.GetManufacturerLedger(manufacturerID)
+		if err != nil {
+			return fmt.Errorf("failed to read manufacturer ledger %s: %v", manufacturerID, err)
+		}
+		if err := dst.SaveManufacturerLedger(ledger); err != nil {
+			return fmt.Errorf("failed to copy manufacturer ledger %s: %v", manufacturerID, err)
+		}
+	}
+
+	commonLedger, err := src.GetCommonLedger()
+	if err == nil {
+		if err := dst.SaveCommonLedger(commonLedger); err != nil {
+			return fmt.Errorf("failed to copy common ledger: %v", err)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to read common ledger: %v", err)
+	}
+
+	names, err := src.ListRecords()
+	if err != nil {
+		return fmt.Errorf("failed to list records: %v", err)
+	}
+	for _, name := range names {
+		data, err := src.GetRecord(name)
+		if err != nil {
+			return fmt.Errorf("failed to read record %s: %v", name, err)
+		}
+		if err := dst.SaveRecord(name, data); err != nil {
+			return fmt.Errorf("failed to copy record %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// validName reports whether a ledger or record name is safe to use as a file name
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultSegmentSize is the size at which the block log rolls over to a new segment file
+const DefaultSegmentSize int64 = 64 * 1024 * 1024
+
+// recordHeaderSize is the size of the length and checksum prefix of every record
+const recordHeaderSize = 8
+
+// segmentPattern matches the segment files of a block log
+const segmentPattern = "segment-*.log"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord marks a record that was only partially written or fails its checksum
+var errTornRecord = errors.New("torn or corrupt record")
+
+// blockPosition locates a block record inside the segment files
+type blockPosition struct {
+	segment int
+	offset  int64
+	length  uint32
+}
+
+// BlockLog is an append-only log of blocks stored in rolling segment files. Each record
+// is a big-endian uint32 payload length, a CRC-32C checksum of the payload and the JSON
+// encoded block. Appends are O(1) and a torn write at the tail is discarded on startup.
+// No record is larger than a segment.
+type BlockLog struct {
+	mu             sync.RWMutex
+	Dir            string
+	MaxSegmentSize int64
+	segments       []string
+	positions      []blockPosition
+	active         *os.File
+	activeSize     int64
+	lastHash       string
+	lastTimestamp  string
+	failed         error // set when a failed append could not be undone, refusing further appends
+}
+
+// OpenBlockLog opens the block log in the given directory, scanning all segments to
+// rebuild the block positions and truncating an incomplete record at the tail
+func OpenBlockLog(dir string, maxSegmentSize int64) (*BlockLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create block log directory: %v", err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block log segments: %v", err)
+	}
+	sort.Strings(segments)
+
+	bl := &BlockLog{
+		Dir:            dir,
+		MaxSegmentSize: maxSegmentSize,
+		segments:       segments,
+	}
+
+	if err := bl.recover(); err != nil {
+		return nil, err
+	}
+
+	if len(bl.segments) == 0 {
+		if err := bl.rollSegment(); err != nil {
+			return nil, err
+		}
+	} else {
+		lastSegment := bl.segments[len(bl.segments)-1]
+		active, err := os.OpenFile(lastSegment, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open active segment: %v", err)
+		}
+		info, err := active.Stat()
+		if err != nil {
+			active.Close()
+			return nil, fmt.Errorf("failed to stat active segment: %v", err)
+		}
+		bl.active = active
+		bl.activeSize = info.Size()
+	}
+
+	return bl, nil
+}
+
+// recover scans every segment, rebuilding the block positions. A bad record that runs to
+// the end of the last segment is treated as a torn write and truncated; anywhere else it
+// is corruption, and the log refuses to open rather than drop the blocks after it.
+func (bl *BlockLog) recover() error {
+	for i, segment := range bl.segments {
+		validSize, err := bl.scanSegment(i, segment)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errTornRecord) || i != len(bl.segments)-1 {
+			return fmt.Errorf("block log segment %s is corrupt: %v", segment, err)
+		}
+		torn, tailErr := bl.tornTail(segment, validSize)
+		if tailErr != nil {
+			return tailErr
+		}
+		if !torn {
+			return fmt.Errorf("block log segment %s is corrupt at offset %d: %v", segment, validSize, err)
+		}
+
+		log.Printf("Warning: truncating torn record at offset %d of block log segment %s", validSize, segment)
+		if err := os.Truncate(segment, validSize); err != nil {
+			return fmt.Errorf("failed to truncate block log segment %s: %v", segment, err)
+		}
+	}
+
+	return nil
+}
+
+// tornTail reports whether the bad record at an offset of a segment is the tail torn by an
+// interrupted append: a record that extends to, or past, the end of the segment with a
+// length an append could have written, or a run of zeros left by a size extended before
+// its data reached the disk
+func (bl *BlockLog) tornTail(path string, offset int64) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read segment: %v", err)
+	}
+	rest := data[offset:]
+
+	zeros := true
+	for _, b := range rest {
+		if b != 0 {
+			zeros = false
+			break
+		}
+	}
+	if zeros || len(rest) < recordHeaderSize {
+		return true, nil
+	}
+
+	length := int64(binary.BigEndian.Uint32(rest[0:4]))
+	if length == 0 || length > bl.MaxSegmentSize {
+		return false, nil
+	}
+	return recordHeaderSize+length >= int64(len(rest)), nil
+}
+
+// scanSegment reads all records of a segment and returns the size of its valid prefix
+func (bl *BlockLog) scanSegment(index int, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		payload, err := readRecord(f, bl.MaxSegmentSize)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		// A record that passes its checksum was written whole, so a bad block is corruption
+		var block Block
+		if err := json.Unmarshal(payload, &block); err != nil {
+			return offset, fmt.Errorf("failed to unmarshal block at offset %d: %v", offset, err)
+		}
+		if block.BlockHeight != len(bl.positions)+1 {
+			return offset, fmt.Errorf("unexpected block height %d at position %d", block.BlockHeight, len(bl.positions)+1)
+		}
+
+		bl.positions = append(bl.positions, blockPosition{
+			segment: index,
+			offset:  offset,
+			length:  uint32(len(payload)),
+		})
+		bl.lastHash = block.BlockHash
+		bl.lastTimestamp = block.Timestamp
+
+		offset += recordHeaderSize + int64(len(payload))
+	}
+}
+
+// readRecord reads and checksums the next record from a segment. Records longer than
+// maxLength are rejected before their payload is allocated.
+func readRecord(r io.Reader, maxLength int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: short header (%d bytes)", errTornRecord, n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length == 0 {
+		return nil, fmt.Errorf("%w: empty record", errTornRecord)
+	}
+	if int64(length) > maxLength {
+		return nil, fmt.Errorf("%w: record length %d exceeds %d", errTornRecord, length, maxLength)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: short payload", errTornRecord)
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errTornRecord)
+	}
+
+	return payload, nil
+}
+
+// rollSegment closes the active segment and starts a new one
+func (bl *BlockLog) rollSegment() error {
+	if bl.active != nil {
+		if err := bl.active.Close(); err != nil {
+			return fmt.Errorf("failed to close active segment: %v", err)
+		}
+	}
+
+	path := filepath.Join(bl.Dir, fmt.Sprintf("segment-%08d.log", len(bl.segments)+1))
+	active, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %s: %v", path, err)
+	}
+
+	bl.segments = append(bl.segments, path)
+	bl.active = active
+	bl.activeSize = 0
+	return nil
+}
+
+// Append writes a block to the end of the log. The block must directly follow the
+// current tip of the log.
+func (bl *BlockLog) Append(block Block) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.failed != nil {
+		return fmt.Errorf("block log is unusable after a failed append: %v", bl.failed)
+	}
+	if block.BlockHeight != len(bl.positions)+1 {
+		return fmt.Errorf("block height %d does not follow tip %d", block.BlockHeight, len(bl.positions))
+	}
+	if block.PreviousBlockHash != bl.lastHash {
+		return fmt.Errorf("block %d does not link to the current tip", block.BlockHeight)
+	}
+
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("failed to marshal block: %v", err)
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+	if int64(len(record)) > bl.MaxSegmentSize {
+		return fmt.Errorf("block %d of %d bytes exceeds the segment size", block.BlockHeight, len(record))
+	}
+
+	if bl.activeSize > 0 && bl.activeSize+int64(len(record)) > bl.MaxSegmentSize {
+		if err := bl.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := bl.active.Write(record); err != nil {
+		return bl.undoAppend(fmt.Errorf("failed to append block %d: %v", block.BlockHeight, err))
+	}
+	if err := bl.active.Sync(); err != nil {
+		return bl.undoAppend(fmt.Errorf("failed to sync block %d: %v", block.BlockHeight, err))
+	}
+
+	bl.positions = append(bl.positions, blockPosition{
+		segment: len(bl.segments) - 1,
+		offset:  bl.activeSize,
+		length:  uint32(len(payload)),
+	})
+	bl.activeSize += int64(len(record))
+	bl.lastHash = block.BlockHash
+	bl.lastTimestamp = block.Timestamp
+
+	return nil
+}
+
+// undoAppend truncates a partially written record off the active segment, so the next
+// append starts at the recorded end of the log. If that fails the log refuses further
+// appends, since they would land behind bytes that recovery treats as a torn tail.
+func (bl *BlockLog) undoAppend(cause error) error {
+	err := bl.active.Truncate(bl.activeSize)
+	if err == nil {
+		err = bl.active.Sync()
+	}
+	if err != nil {
+		bl.failed = fmt.Errorf("%v; failed to truncate the partial record: %v", cause, err)
+		return bl.failed
+	}
+	return cause
+}
+
+// Height returns the height of the last block in the log
+func (bl *BlockLog) Height() int {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return len(bl.positions)
+}
+
+// Tip returns the height, hash and timestamp of the last block in the log
+func (bl *BlockLog) Tip() (int, string, string) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return len(bl.positions), bl.lastHash, bl.lastTimestamp
+}
+
+// ReadBlock reads the block at the given height
+func (bl *BlockLog) ReadBlock(height int) (*Block, error) {
+	bl.mu.RLock()
+	if height < 1 || height > len(bl.positions) {
+		bl.mu.RUnlock()
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	pos := bl.positions[height-1]
+	segment := bl.segments[pos.segment]
+	bl.mu.RUnlock()
+
+	f, err := os.Open(segment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment: %v", err)
+	}
+	defer f.Close()
+
+	payload, err := readRecord(io.NewSectionReader(f, pos.offset, recordHeaderSize+int64(pos.length)), bl.MaxSegmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %v", height, err)
+	}
+
+	var block Block
+	if err := json.Unmarshal(payload, &block); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal block %d: %v", height, err)
+	}
+
+	return &block, nil
+}
+
+// Blocks reads every block in the log in order
+func (bl *BlockLog) Blocks() ([]Block, error) {
+	bl.mu.RLock()
+	segments := append([]string(nil), bl.segments...)
+	count := len(bl.positions)
+	bl.mu.RUnlock()
+
+	blocks := make([]Block, 0, count)
+	for _, segment := range segments {
+		f, err := os.Open(segment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open segment: %v", err)
+		}
+
+		for len(blocks) < count {
+			payload, err := readRecord(f, bl.MaxSegmentSize)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to read segment %s: %v", segment, err)
+			}
+
+			var block Block
+			if err := json.Unmarshal(payload, &block); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to unmarshal block: %v", err)
+			}
+			blocks = append(blocks, block)
+		}
+		f.Close()
+	}
+
+	return blocks, nil
+}
+
+// Close closes the active segment
+func (bl *BlockLog) Close() error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if bl.active == nil {
+		return nil
+	}
+	err := bl.active.Close()
+	bl.active = nil
+	return err
+}
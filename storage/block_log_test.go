@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendBlocks appends count blocks linked to the tip of a block log
+func appendBlocks(t *testing.T, bl *BlockLog, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		height, lastHash, _ := bl.Tip()
+		block := Block{
+			BlockHeight:       height + 1,
+			Timestamp:         fmt.Sprintf("2026-01-01T00:00:%02dZ", height+1),
+			PreviousBlockHash: lastHash,
+			BlockHash:         fmt.Sprintf("hash-%d", height+1),
+			Transactions:      []BlockTransaction{{TxHash: fmt.Sprintf("tx-%d", height+1), TxData: map[string]interface{}{"n": height + 1}}},
+		}
+		if err := bl.Append(block); err != nil {
+			t.Fatalf("failed to append block %d: %v", height+1, err)
+		}
+	}
+}
+
+// segmentSize returns the size of a segment file
+func segmentSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestBlockLogRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage modifies the only segment, whose records start at the given offsets
+		damage     func(t *testing.T, path string, offsets []int64)
+		wantHeight int
+		wantErr    bool
+	}{
+		{
+			name:       "intact",
+			damage:     func(t *testing.T, path string, offsets []int64) {},
+			wantHeight: 3,
+		},
+		{
+			name: "torn header at tail",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				appendBytes(t, path, []byte{0, 0, 1})
+			},
+			wantHeight: 3,
+		},
+		{
+			name: "torn payload at tail",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				if err := os.Truncate(path, segmentSize(t, path)-5); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantHeight: 2,
+		},
+		{
+			name: "checksum mismatch in last record",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				flipByte(t, path, segmentSize(t, path)-2)
+			},
+			wantHeight: 2,
+		},
+		{
+			name: "checksum mismatch mid-segment",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				flipByte(t, path, offsets[1]+recordHeaderSize+2)
+			},
+			wantErr: true,
+		},
+		{
+			name: "oversized length mid-segment",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				writeAt(t, path, offsets[1], []byte{0xff, 0xff, 0xff, 0xff})
+			},
+			wantErr: true,
+		},
+		{
+			name: "zero-filled tail",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				appendBytes(t, path, make([]byte, 100))
+			},
+			wantHeight: 3,
+		},
+		{
+			name: "invalid block mid-segment",
+			damage: func(t *testing.T, path string, offsets []int64) {
+				// A record with a valid checksum that is not a block
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload := []byte("{not json}")
+				record := make([]byte, recordHeaderSize+len(payload))
+				binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+				binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+				copy(record[recordHeaderSize:], payload)
+				damaged := append(append(append([]byte{}, data[:offsets[1]]...), record...), data[offsets[1]:]...)
+				if err := os.WriteFile(path, damaged, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bl, err := OpenBlockLog(dir, DefaultSegmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendBlocks(t, bl, 3)
+			offsets := make([]int64, len(bl.positions))
+			for i, pos := range bl.positions {
+				offsets[i] = pos.offset
+			}
+			path := bl.segments[0]
+			bl.Close()
+
+			tt.damage(t, path, offsets)
+
+			reopened, err := OpenBlockLog(dir, DefaultSegmentSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected corruption to be reported, got height %d", reopened.Height())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to reopen: %v", err)
+			}
+			defer reopened.Close()
+			if got := reopened.Height(); got != tt.wantHeight {
+				t.Fatalf("height = %d, want %d", got, tt.wantHeight)
+			}
+
+			// The log accepts new blocks after recovery, and they survive a reopen
+			appendBlocks(t, reopened, 1)
+			reopened.Close()
+			again, err := OpenBlockLog(dir, DefaultSegmentSize)
+			if err != nil {
+				t.Fatalf("failed to reopen after append: %v", err)
+			}
+			defer again.Close()
+			if got := again.Height(); got != tt.wantHeight+1 {
+				t.Fatalf("height after append = %d, want %d", got, tt.wantHeight+1)
+			}
+		})
+	}
+}
+
+func TestBlockLogRollsSegments(t *testing.T) {
+	dir := t.TempDir()
+	bl, err := OpenBlockLog(dir, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendBlocks(t, bl, 10)
+	bl.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, segmentPattern))
+	if len(segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+
+	reopened, err := OpenBlockLog(dir, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	blocks, err := reopened.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 10 {
+		t.Fatalf("read %d blocks, want 10", len(blocks))
+	}
+	for i, block := range blocks {
+		if block.BlockHeight != i+1 {
+			t.Fatalf("block %d has height %d", i, block.BlockHeight)
+		}
+	}
+	block, err := reopened.ReadBlock(7)
+	if err != nil || block.BlockHash != "hash-7" {
+		t.Fatalf("ReadBlock(7) = %v, %v", block, err)
+	}
+}
+
+func TestBlockLogRejectsOversizedBlock(t *testing.T) {
+	bl, err := OpenBlockLog(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bl.Close()
+
+	err = bl.Append(Block{BlockHeight: 1, BlockHash: "hash-1", Timestamp: "2026-01-01T00:00:00Z"})
+	if err == nil {
+		t.Fatal("expected a block larger than a segment to be rejected")
+	}
+	if bl.Height() != 0 || bl.activeSize != 0 {
+		t.Fatalf("rejected append changed the log: height %d, size %d", bl.Height(), bl.activeSize)
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeAt(t *testing.T, path string, offset int64, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockLogRefusesAppendsAfterUndoFails(t *testing.T) {
+	bl, err := OpenBlockLog(t.TempDir(), DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendBlocks(t, bl, 1)
+
+	// With the segment closed underneath it, the write fails and so does the truncation
+	bl.active.Close()
+	if err := bl.Append(Block{BlockHeight: 2, PreviousBlockHash: "hash-1", BlockHash: "hash-2"}); err == nil {
+		t.Fatal("expected the append to fail")
+	}
+	if bl.failed == nil {
+		t.Fatal("expected the log to be marked failed")
+	}
+	if bl.Height() != 1 {
+		t.Fatalf("height = %d, want 1", bl.Height())
+	}
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// FileBackend stores blocks in a segmented block log and every ledger and record as
+// its own JSON file
+type FileBackend struct {
+	BlockLogDir            string
+	ManufacturerLedgersDir string
+	CommonLedgerPath       string
+	RecordsDir             string
+	blockLog               *BlockLog
+}
+
+// NewFileBackend opens a file backend rooted at the given blockchain and records directories
+func NewFileBackend(blockchainDir, recordsDir string) (*FileBackend, error) {
+	fb := &FileBackend{
+		BlockLogDir:            filepath.Join(blockchainDir, "segments"),
+		ManufacturerLedgersDir: filepath.Join(blockchainDir, "manufacturer_ledgers"),
+		CommonLedgerPath:       filepath.Join(blockchainDir, "common_ledger.json"),
+		RecordsDir:             recordsDir,
+	}
+
+	// Ensure directories exist
+	dirs := []string{blockchainDir, fb.ManufacturerLedgersDir, fb.RecordsDir}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+		}
+	}
+
+	blockLog, err := OpenBlockLog(fb.BlockLogDir, DefaultSegmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block log: %v", err)
+	}
+	fb.blockLog = blockLog
+
+	return fb, nil
+}
+
+// AppendBlock appends a block to the block log
+func (fb *FileBackend) AppendBlock(block Block) error {
+	return fb.blockLog.Append(block)
+}
+
+// ReadBlock reads the block at the given height from the block log
+func (fb *FileBackend) ReadBlock(height int) (*Block, error) {
+	return fb.blockLog.ReadBlock(height)
+}
+
+// Blocks reads every block of the block log in order
+func (fb *FileBackend) Blocks() ([]Block, error) {
+	return fb.blockLog.Blocks()
+}
+
+// Tip returns the height, hash and timestamp of the last block
+func (fb *FileBackend) Tip() (int, string, string) {
+	return fb.blockLog.Tip()
+}
+
+// GetManufacturerLedger loads a manufacturer's ledger from disk
+func (fb *FileBackend) GetManufacturerLedger(manufacturerID string) (*models.ManufacturerLedger, error) {
+	if !validName(manufacturerID) {
+		return nil, fmt.Errorf("invalid manufacturer ID: %q", manufacturerID)
+	}
+
+	data, err := os.ReadFile(fb.manufacturerLedgerPath(manufacturerID))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manufacturer ledger: %v", err)
+	}
+
+	var ledger models.ManufacturerLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manufacturer ledger: %v", err)
+	}
+
+	return &ledger, nil
+}
+
+// SaveManufacturerLedger saves a manufacturer's ledger to disk
+func (fb *FileBackend) SaveManufacturerLedger(ledger *models.ManufacturerLedger) error {
+	if !validName(ledger.ManufacturerID) {
+		return fmt.Errorf("invalid manufacturer ID: %q", ledger.ManufacturerID)
+	}
+
+	data, err := ledger.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal manufacturer ledger: %v", err)
+	}
+
+	if err := WriteFileAtomic(fb.manufacturerLedgerPath(ledger.ManufacturerID), data); err != nil {
+		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
+	}
+
+	return nil
+}
+
+// ListManufacturerLedgers returns the IDs of all manufacturers that have ledgers
+func (fb *FileBackend) ListManufacturerLedgers() ([]string, error) {
+	files, err := os.ReadDir(fb.ManufacturerLedgersDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manufacturer ledgers directory: %v", err)
+	}
+
+	var manufacturerIDs []string
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			manufacturerIDs = append(manufacturerIDs, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+
+	return manufacturerIDs, nil
+}
+
+// DeleteManufacturerLedger deletes a manufacturer's ledger
+func (fb *FileBackend) DeleteManufacturerLedger(manufacturerID string) error {
+	if !validName(manufacturerID) {
+		return fmt.Errorf("invalid manufacturer ID: %q", manufacturerID)
+	}
+
+	if err := os.Remove(fb.manufacturerLedgerPath(manufacturerID)); err != nil {
+		return fmt.Errorf("failed to delete manufacturer ledger: %v", err)
+	}
+	return nil
+}
+
+// GetCommonLedger loads the common ledger from disk
+func (fb *FileBackend) GetCommonLedger() (*models.CommonLedger, error) {
+	data, err := os.ReadFile(fb.CommonLedgerPath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read common ledger: %v", err)
+	}
+
+	var ledger models.CommonLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal common ledger: %v", err)
+	}
+
+	return &ledger, nil
+}
+
+// SaveCommonLedger saves the common ledger to disk
+func (fb *FileBackend) SaveCommonLedger(ledger *models.CommonLedger) error {
+	data, err := ledger.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal common ledger: %v", err)
+	}
+
+	if err := WriteFileAtomic(fb.CommonLedgerPath, data); err != nil {
+		return fmt.Errorf("failed to save common ledger: %v", err)
+	}
+
+	return nil
+}
+
+// SaveRecord writes a data record file to the records directory
+func (fb *FileBackend) SaveRecord(name string, data []byte) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid record name: %q", name)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(fb.RecordsDir, name), data); err != nil {
+		return fmt.Errorf("failed to save record %s: %v", name, err)
+	}
+	return nil
+}
+
+// GetRecord reads a data record file from the records directory
+func (fb *FileBackend) GetRecord(name string) ([]byte, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid record name: %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(fb.RecordsDir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// ListRecords returns the names of all data records
+func (fb *FileBackend) ListRecords() ([]string, error) {
+	files, err := os.ReadDir(fb.RecordsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read records directory: %v", err)
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Close closes the block log
+func (fb *FileBackend) Close() error {
+	return fb.blockLog.Close()
+}
+
+// manufacturerLedgerPath returns the file path of a manufacturer's ledger
+func (fb *FileBackend) manufacturerLedgerPath(manufacturerID string) string {
+	return filepath.Join(fb.ManufacturerLedgersDir, fmt.Sprintf("%s.json", manufacturerID))
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyRetention is how long a stored response is replayed for its key
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// Errors returned when a request cannot run under its idempotency key
+var (
+	ErrIdempotencyKeyReused   = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyKeyInFlight = errors.New("request with this idempotency key is in progress")
+)
+
+// IdempotentResponse is the response stored for an idempotency key
+type IdempotentResponse struct {
+	Fingerprint string `json:"fingerprint"` // hash of the request the key was first used with
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// IdempotencyStore keeps the responses of requests sent with an idempotency key, so a
+// retried request gets the original response instead of being applied again. Each response
+// is held in its own file for the retention window; requests still running are tracked
+// in memory.
+type IdempotencyStore struct {
+	Dir       string
+	Retention time.Duration
+
+	mu        sync.Mutex
+	inFlight  map[string]string // key to the fingerprint of its running request
+	lastPrune time.Time
+}
+
+// NewIdempotencyStore creates an idempotency store in the given directory, keeping
+// responses for the IDEMPOTENCY_RETENTION duration (24h by default)
+func NewIdempotencyStore(dir string) (*IdempotencyStore, error) {
+	retention := DefaultIdempotencyRetention
+	if value := os.Getenv("IDEMPOTENCY_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_RETENTION: %s", value)
+		}
+		retention = parsed
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency directory: %v", err)
+	}
+
+	return &IdempotencyStore{
+		Dir:       dir,
+		Retention: retention,
+		inFlight:  make(map[string]string),
+	}, nil
+}
+
+// Begin claims a key for a request. It returns the stored response when the key was
+// already used with the same request, ErrIdempotencyKeyReused when it was used with a
+// different one, and ErrIdempotencyKeyInFlight while the first request is still running.
+// Otherwise it returns nil, and the caller must Complete or Release the key.
+func (s *IdempotencyStore) Begin(key, fingerprint string) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > time.Hour {
+		s.prune(now)
+		s.lastPrune = now
+	}
+
+	stored, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil && !s.expired(stored, now) {
+		if stored.Fingerprint != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		return stored, nil
+	}
+
+	if running, ok := s.inFlight[key]; ok {
+		if running != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		return nil, ErrIdempotencyKeyInFlight
+	}
+
+	s.inFlight[key] = fingerprint
+	return nil, nil
+}
+
+// Complete stores the response of a claimed key
+func (s *IdempotencyStore) Complete(key string, response *IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inFlight, key)
+
+	response.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotent response: %v", err)
+	}
+	if err := WriteFileAtomic(s.path(key), data); err != nil {
+		return fmt.Errorf("failed to write idempotent response: %v", err)
+	}
+	return nil
+}
+
+// Release frees a claimed key without storing a response, so the request can be retried
+func (s *IdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, key)
+}
+
+// read loads the response stored for a key, or nil if there is none
+func (s *IdempotencyStore) read(key string) (*IdempotentResponse, error) {
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotent response: %v", err)
+	}
+
+	var response IdempotentResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse idempotent response: %v", err)
+	}
+	return &response, nil
+}
+
+// expired reports whether a stored response has left the retention window
+func (s *IdempotencyStore) expired(response *IdempotentResponse, now time.Time) bool {
+	createdAt, err := time.Parse(time.RFC3339Nano, response.CreatedAt)
+	return err != nil || now.Sub(createdAt) > s.Retention
+}
+
+// prune removes the responses that left the retention window
+func (s *IdempotencyStore) prune(now time.Time) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err == nil && now.Sub(info.ModTime()) > s.Retention {
+			os.Remove(file)
+		}
+	}
+}
+
+// path returns the file path of a key's response. Keys are chosen by clients, so the
+// file is named by the key's hash.
+func (s *IdempotencyStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ankit/blockchain_ledger/kv"
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// Buckets of the key-value backend
+const (
+	blocksBucket              = "blocks"
+	manufacturerLedgersBucket = "manufacturer_ledgers"
+	commonLedgerBucket        = "common_ledger"
+	recordsBucket             = "records"
+)
+
+// commonLedgerKey is the key of the common ledger in its bucket
+const commonLedgerKey = "common"
+
+// compactionThreshold is the minimum size of the store before it is compacted on open
+const compactionThreshold int64 = 16 * 1024 * 1024
+
+// KVBackend stores blocks, ledgers and records in a single embedded key-value store
+type KVBackend struct {
+	mu            sync.RWMutex
+	db            *kv.DB
+	height        int
+	lastHash      string
+	lastTimestamp string
+}
+
+// NewKVBackend opens a key-value backend at the given path. The store is compacted when
+// more than half of it is held by overwritten ledgers.
+func NewKVBackend(path string) (*KVBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for key-value store: %v", err)
+	}
+
+	db, err := kv.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key-value store: %v", err)
+	}
+
+	size, stale := db.Size()
+	if size > compactionThreshold && stale > size/2 {
+		log.Printf("Compacting key-value store %s (%d of %d bytes stale)", path, stale, size)
+		if err := db.Compact(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to compact key-value store: %v", err)
+		}
+	}
+
+	kb := &KVBackend{db: db}
+
+	// Restore the tip from the last block
+	kb.height = db.Count(blocksBucket)
+	if kb.height > 0 {
+		tip, err := kb.ReadBlock(kb.height)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to read tip of key-value store: %v", err)
+		}
+		kb.lastHash = tip.BlockHash
+		kb.lastTimestamp = tip.Timestamp
+	}
+
+	return kb, nil
+}
+
+// AppendBlock stores a block after the current tip
+func (kb *KVBackend) AppendBlock(block Block) error {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	if block.BlockHeight != kb.height+1 {
+		return fmt.Errorf("block height %d does not follow tip %d", block.BlockHeight, kb.height)
+	}
+	if block.PreviousBlockHash != kb.lastHash {
+		return fmt.Errorf("block %d does not link to the current tip", block.BlockHeight)
+	}
+
+	data, err := json.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("failed to marshal block: %v", err)
+	}
+
+	if err := kb.db.Put(blocksBucket, blockKey(block.BlockHeight), data); err != nil {
+		return fmt.Errorf("failed to append block %d: %v", block.BlockHeight, err)
+	}
+
+	kb.height = block.BlockHeight
+	kb.lastHash = block.BlockHash
+	kb.lastTimestamp = block.Timestamp
+	return nil
+}
+
+// ReadBlock reads the block at the given height
+func (kb *KVBackend) ReadBlock(height int) (*Block, error) {
+	data, err := kb.db.Get(blocksBucket, blockKey(height))
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var block Block
+	if err := json.Unmarshal(data, &block); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal block %d: %v", height, err)
+	}
+
+	return &block, nil
+}
+
+// Blocks reads every block in order
+func (kb *KVBackend) Blocks() ([]Block, error) {
+	height, _, _ := kb.Tip()
+
+	blocks := make([]Block, 0, height)
+	for h := 1; h <= height; h++ {
+		block, err := kb.ReadBlock(h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, *block)
+	}
+
+	return blocks, nil
+}
+
+// Tip returns the height, hash and timestamp of the last block
+func (kb *KVBackend) Tip() (int, string, string) {
+	kb.mu.RLock()
+	defer kb.mu.RUnlock()
+	return kb.height, kb.lastHash, kb.lastTimestamp
+}
+
+// GetManufacturerLedger loads a manufacturer's ledger
+func (kb *KVBackend) GetManufacturerLedger(manufacturerID string) (*models.ManufacturerLedger, error) {
+	data, err := kb.db.Get(manufacturerLedgersBucket, manufacturerID)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manufacturer ledger: %v", err)
+	}
+
+	var ledger models.ManufacturerLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manufacturer ledger: %v", err)
+	}
+
+	return &ledger, nil
+}
+
+// SaveManufacturerLedger saves a manufacturer's ledger
+func (kb *KVBackend) SaveManufacturerLedger(ledger *models.ManufacturerLedger) error {
+	if ledger.ManufacturerID == "" {
+		return fmt.Errorf("invalid manufacturer ID: %q", ledger.ManufacturerID)
+	}
+
+	data, err := json.Marshal(ledger)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manufacturer ledger: %v", err)
+	}
+
+	if err := kb.db.Put(manufacturerLedgersBucket, ledger.ManufacturerID, data); err != nil {
+		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
+	}
+
+	return nil
+}
+
+// ListManufacturerLedgers returns the IDs of all manufacturers that have ledgers
+func (kb *KVBackend) ListManufacturerLedgers() ([]string, error) {
+	return kb.db.Keys(manufacturerLedgersBucket), nil
+}
+
+// DeleteManufacturerLedger deletes a manufacturer's ledger
+func (kb *KVBackend) DeleteManufacturerLedger(manufacturerID string) error {
+	if _, err := kb.db.Get(manufacturerLedgersBucket, manufacturerID); err != nil {
+		return fmt.Errorf("failed to delete manufacturer ledger: %v", err)
+	}
+
+	if err := kb.db.Delete(manufacturerLedgersBucket, manufacturerID); err != nil {
+		return fmt.Errorf("failed to delete manufacturer ledger: %v", err)
+	}
+	return nil
+}
+
+// GetCommonLedger loads the common ledger
+func (kb *KVBackend) GetCommonLedger() (*models.CommonLedger, error) {
+	data, err := kb.db.Get(commonLedgerBucket, commonLedgerKey)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read common ledger: %v", err)
+	}
+
+	var ledger models.CommonLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal common ledger: %v", err)
+	}
+
+	return &ledger, nil
+}
+
+// SaveCommonLedger saves the common ledger
+func (kb *KVBackend) SaveCommonLedger(ledger *models.CommonLedger) error {
+	data, err := json.Marshal(ledger)
+	if err != nil {
+		return fmt.Errorf("failed to marshal common ledger: %v", err)
+	}
+
+	if err := kb.db.Put(commonLedgerBucket, commonLedgerKey, data); err != nil {
+		return fmt.Errorf("failed to save common ledger: %v", err)
+	}
+
+	return nil
+}
+
+// SaveRecord stores a data record under its name
+func (kb *KVBackend) SaveRecord(name string, data []byte) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid record name: %q", name)
+	}
+
+	if err := kb.db.Put(recordsBucket, name, data); err != nil {
+		return fmt.Errorf("failed to save record %s: %v", name, err)
+	}
+	return nil
+}
+
+// GetRecord reads a data record by name
+func (kb *KVBackend) GetRecord(name string) ([]byte, error) {
+	data, err := kb.db.Get(recordsBucket, name)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// ListRecords returns the names of all data records
+func (kb *KVBackend) ListRecords() ([]string, error) {
+	return kb.db.Keys(recordsBucket), nil
+}
+
+// Close closes the key-value store
+func (kb *KVBackend) Close() error {
+	return kb.db.Close()
+}
+
+// blockKey returns the key of a block, zero-padded so keys sort by height
+func blockKey(height int) string {
+	return fmt.Sprintf("%012d", height)
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ankit/blockchain_ledger/models"
+)
+
+// Kinds of ledger records changed by an operation
+const (
+	RecordDrug     = "drug"
+	RecordLot      = "lot"
+	RecordShipment = "shipment"
+	RecordRecall   = "recall"
+)
+
+// RecordChange represents the change of a single ledger record by an operation, as the
+// JSON encodings of the record before and after the operation
+type RecordChange struct {
+	Kind   string          `json:"kind"`
+	ID     string          `json:"id"`
+	Before json.RawMessage `json:"before,omitempty"` // absent for a record the operation added
+	After  json.RawMessage `json:"after,omitempty"`  // absent for a record the operation removed
+}
+
+// LedgerDelta represents the records of one ledger changed by an operation, and the
+// version of the ledger the changes were made to
+type LedgerDelta struct {
+	ManufacturerID string         `json:"manufacturer_id,omitempty"` // absent for the common ledger
+	BaseVersion    int64          `json:"base_version"`
+	LastUpdated    string         `json:"last_updated"`
+	Changes        []RecordChange `json:"changes"`
+}
+
+// DiffManufacturerLedger returns the records of a manufacturer ledger changed from before
+// to after
+func DiffManufacturerLedger(before, after *models.ManufacturerLedger) (*LedgerDelta, error) {
+	if before == nil {
+		before = models.NewManufacturerLedger(after.ManufacturerID)
+		before.Version = after.Version
+	}
+	delta := &LedgerDelta{ManufacturerID: after.ManufacturerID, BaseVersion: before.Version, LastUpdated: after.LastUpdated}
+
+	if err := diffRecords(delta, RecordDrug, before.Drugs, after.Drugs, drugRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordLot, before.Lots, after.Lots, lotRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordShipment, before.Shipments, after.Shipments, shipmentRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordRecall, before.Recalls, after.Recalls, recallRecordID); err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+// DiffCommonLedger returns the records of the common ledger changed from before to after
+func DiffCommonLedger(before, after *models.CommonLedger) (*LedgerDelta, error) {
+	if before == nil {
+		before = models.NewCommonLedger()
+		before.Version = after.Version
+	}
+	delta := &LedgerDelta{BaseVersion: before.Version, LastUpdated: after.LastUpdated}
+
+	if err := diffRecords(delta, RecordDrug, before.Drugs, after.Drugs, commonDrugRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordLot, before.Lots, after.Lots, commonLotRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordShipment, before.Shipments, after.Shipments, commonShipmentRecordID); err != nil {
+		return nil, err
+	}
+	if err := diffRecords(delta, RecordRecall, before.Recalls, after.Recalls, recallRecordID); err != nil {
+		return nil, err
+	}
+
+	return delta, nil
+}
+
+// ApplyToManufacturerLedger applies the changes to a manufacturer ledger, see patchRecords.
+// It returns the number of records changed and the records left as a later operation
+// changed them.
+func (d *LedgerDelta) ApplyToManufacturerLedger(ledger *models.ManufacturerLedger) (int, []string, error) {
+	var p patch
+	var err error
+	if ledger.Drugs, err = patchRecords(&p, ledger.Drugs, RecordDrug, d.Changes, drugRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Lots, err = patchRecords(&p, ledger.Lots, RecordLot, d.Changes, lotRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Shipments, err = patchRecords(&p, ledger.Shipments, RecordShipment, d.Changes, shipmentRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Recalls, err = patchRecords(&p, ledger.Recalls, RecordRecall, d.Changes, recallRecordID); err != nil {
+		return 0, nil, err
+	}
+	return p.applied, p.conflicts, nil
+}
+
+// ApplyToCommonLedger applies the changes to the common ledger, see patchRecords. It
+// returns the number of records changed and the records left as a later operation changed
+// them.
+func (d *LedgerDelta) ApplyToCommonLedger(ledger *models.CommonLedger) (int, []string, error) {
+	var p patch
+	var err error
+	if ledger.Drugs, err = patchRecords(&p, ledger.Drugs, RecordDrug, d.Changes, commonDrugRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Lots, err = patchRecords(&p, ledger.Lots, RecordLot, d.Changes, commonLotRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Shipments, err = patchRecords(&p, ledger.Shipments, RecordShipment, d.Changes, commonShipmentRecordID); err != nil {
+		return 0, nil, err
+	}
+	if ledger.Recalls, err = patchRecords(&p, ledger.Recalls, RecordRecall, d.Changes, recallRecordID); err != nil {
+		return 0, nil, err
+	}
+	return p.applied, p.conflicts, nil
+}
+
+// diffRecords appends the changes between two versions of a list of records of one kind,
+// in the order of the records after the change followed by the records removed
+func diffRecords[T any](d *LedgerDelta, kind string, before, after []T, id func(*T) string) error {
+	previous := make(map[string]json.RawMessage, len(before))
+	for i := range before {
+		data, err := json.Marshal(&before[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode %s %s: %v", kind, id(&before[i]), err)
+		}
+		previous[id(&before[i])] = data
+	}
+
+	kept := make(map[string]bool, len(after))
+	for i := range after {
+		key := id(&after[i])
+		kept[key] = true
+		data, err := json.Marshal(&after[i])
+		if err != nil {
+			return fmt.Errorf("failed to encode %s %s: %v", kind, key, err)
+		}
+		if bytes.Equal(previous[key], data) {
+			continue
+		}
+		d.Changes = append(d.Changes, RecordChange{Kind: kind, ID: key, Before: previous[key], After: data})
+	}
+
+	for i := range before {
+		if key := id(&before[i]); !kept[key] {
+			d.Changes = append(d.Changes, RecordChange{Kind: kind, ID: key, Before: previous[key]})
+		}
+	}
+
+	return nil
+}
+
+// patch counts the records changed while a delta is applied, and the records skipped
+type patch struct {
+	applied   int
+	conflicts []string
+}
+
+// patchRecords applies the changes of one kind to a list of records. A change is applied only
+// to a record that still holds the value it starts from. A record that already holds the
+// value the change ends at is left alone, and so is one holding neither, which a later
+// operation changed; it is reported as a conflict rather than overwritten.
+func patchRecords[T any](p *patch, records []T, kind string, changes []RecordChange, id func(*T) string) ([]T, error) {
+	for _, change := range changes {
+		if change.Kind != kind {
+			continue
+		}
+		from, to := change.Before, change.After
+
+		index := -1
+		var current json.RawMessage
+		for i := range records {
+			if id(&records[i]) == change.ID {
+				data, err := json.Marshal(&records[i])
+				if err != nil {
+					return nil, fmt.Errorf("failed to encode %s %s: %v", kind, change.ID, err)
+				}
+				index, current = i, data
+				break
+			}
+		}
+
+		if sameJSON(current, to) {
+			continue
+		}
+		if !sameJSON(current, from) {
+			p.conflicts = append(p.conflicts, kind+" "+change.ID)
+			continue
+		}
+
+		p.applied++
+		if len(to) == 0 {
+			records = append(records[:index], records[index+1:]...)
+			continue
+		}
+		var record T
+		if err := json.Unmarshal(to, &record); err != nil {
+			return nil, fmt.Errorf("failed to decode %s %s: %v", kind, change.ID, err)
+		}
+		if index >= 0 {
+			records[index] = record
+		} else {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// sameJSON reports whether two JSON encodings hold the same value, ignoring white space.
+// An absent encoding only matches another absent one.
+func sameJSON(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return false
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// Record IDs of each kind of ledger record
+func drugRecordID(r *models.DrugRecord) string                     { return r.DrugID }
+func commonDrugRecordID(r *models.CommonDrugRecord) string         { return r.DrugID }
+func lotRecordID(r *models.LotRecord) string                       { return r.LotID }
+func commonLotRecordID(r *models.CommonLotRecord) string           { return r.LotID }
+func shipmentRecordID(r *models.ShipmentRecord) string             { return r.ShipmentID }
+func commonShipmentRecordID(r *models.CommonShipmentRecord) string { return r.ShipmentID }
+func recallRecordID(r *models.RecallRecord) string                 { return r.RecallID }
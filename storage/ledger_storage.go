@@ -2,9 +2,8 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/ankit/blockchain_ledger/models"
 	"github.com/ankit/blockchain_ledger/supabase"
@@ -12,13 +11,12 @@ import (
 
 // LedgerStorage handles the storage of manufacturer and common ledgers
 type LedgerStorage struct {
-	ManufacturerLedgersDir string
-	CommonLedgerPath       string
-	Supabase               *supabase.Client
+	Backend  Backend
+	Supabase *supabase.Client
 }
 
-// NewLedgerStorage creates a new ledger storage instance
-func NewLedgerStorage() (*LedgerStorage, error) {
+// NewLedgerStorage creates a new ledger storage instance on top of a storage backend
+func NewLedgerStorage(backend Backend) (*LedgerStorage, error) {
 	// Initialize Supabase client
 	supabaseClient, err := supabase.NewClient(true) // Use service key
 	if err != nil {
@@ -26,37 +24,26 @@ func NewLedgerStorage() (*LedgerStorage, error) {
 	}
 
 	ls := &LedgerStorage{
-		ManufacturerLedgersDir: "blockchain_data/manufacturer_ledgers",
-		CommonLedgerPath:       "blockchain_data/common_ledger.json",
-		Supabase:               supabaseClient,
+		Backend:  backend,
+		Supabase: supabaseClient,
 	}
 
-	// Create manufacturer ledgers directory if it doesn't exist
-	if err := os.MkdirAll(ls.ManufacturerLedgersDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create manufacturer ledgers directory: %v", err)
-	}
-
-	// Create common ledger file if it doesn't exist
-	if _, err := os.Stat(ls.CommonLedgerPath); os.IsNotExist(err) {
-		commonLedger := models.NewCommonLedger()
-		data, err := commonLedger.ToJSON()
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal initial common ledger: %v", err)
-		}
-		if err := os.WriteFile(ls.CommonLedgerPath, data, 0644); err != nil {
-			return nil, fmt.Errorf("failed to create common ledger file: %v", err)
+	// Create the common ledger if it doesn't exist
+	if _, err := backend.GetCommonLedger(); errors.Is(err, ErrNotFound) {
+		if err := backend.SaveCommonLedger(models.NewCommonLedger()); err != nil {
+			return nil, fmt.Errorf("failed to create common ledger: %v", err)
 		}
+	} else if err != nil {
+		return nil, err
 	}
 
 	return ls, nil
 }
 
-// GetManufacturerLedger loads a manufacturer's ledger from disk
+// GetManufacturerLedger loads a manufacturer's ledger, creating it if it doesn't exist
 func (ls *LedgerStorage) GetManufacturerLedger(manufacturerID string) (*models.ManufacturerLedger, error) {
-	ledgerPath := filepath.Join(ls.ManufacturerLedgersDir, fmt.Sprintf("%s.json", manufacturerID))
-
-	// Check if the ledger file exists
-	if _, err := os.Stat(ledgerPath); os.IsNotExist(err) {
+	ledger, err := ls.Backend.GetManufacturerLedger(manufacturerID)
+	if errors.Is(err, ErrNotFound) {
 		// Create a new ledger if it doesn't exist
 		newLedger := models.NewManufacturerLedger(manufacturerID)
 		if err := ls.SaveManufacturerLedger(newLedger); err != nil {
@@ -64,88 +51,44 @@ func (ls *LedgerStorage) GetManufacturerLedger(manufacturerID string) (*models.M
 		}
 		return newLedger, nil
 	}
-
-	data, err := os.ReadFile(ledgerPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read manufacturer ledger: %v", err)
-	}
-
-	var ledger models.ManufacturerLedger
-	if err := json.Unmarshal(data, &ledger); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal manufacturer ledger: %v", err)
+		return nil, err
 	}
 
-	return &ledger, nil
+	return ledger, nil
 }
 
-// SaveManufacturerLedger saves a manufacturer's ledger to disk
+// SaveManufacturerLedger saves a manufacturer's ledger
 func (ls *LedgerStorage) SaveManufacturerLedger(ledger *models.ManufacturerLedger) error {
-	data, err := ledger.ToJSON()
-	if err != nil {
-		return fmt.Errorf("failed to marshal manufacturer ledger: %v", err)
-	}
-
-	ledgerPath := filepath.Join(ls.ManufacturerLedgersDir, fmt.Sprintf("%s.json", ledger.ManufacturerID))
-	if err := os.WriteFile(ledgerPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to save manufacturer ledger: %v", err)
-	}
-
-	return nil
+	return ls.Backend.SaveManufacturerLedger(ledger)
 }
 
-// GetCommonLedger loads the common ledger from disk
+// GetCommonLedger loads the common ledger
 func (ls *LedgerStorage) GetCommonLedger() (*models.CommonLedger, error) {
-	data, err := os.ReadFile(ls.CommonLedgerPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read common ledger: %v", err)
+	ledger, err := ls.Backend.GetCommonLedger()
+	if errors.Is(err, ErrNotFound) {
+		return models.NewCommonLedger(), nil
 	}
-
-	var ledger models.CommonLedger
-	if err := json.Unmarshal(data, &ledger); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal common ledger: %v", err)
+	if err != nil {
+		return nil, err
 	}
 
-	return &ledger, nil
+	return ledger, nil
 }
 
-// SaveCommonLedger saves the common ledger to disk
+// SaveCommonLedger saves the common ledger
 func (ls *LedgerStorage) SaveCommonLedger(ledger *models.CommonLedger) error {
-	data, err := ledger.ToJSON()
-	if err != nil {
-		return fmt.Errorf("failed to marshal common ledger: %v", err)
-	}
-
-	if err := os.WriteFile(ls.CommonLedgerPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to save common ledger: %v", err)
-	}
-
-	return nil
+	return ls.Backend.SaveCommonLedger(ledger)
 }
 
 // ListManufacturerLedgers returns a list of all manufacturer IDs that have ledgers
 func (ls *LedgerStorage) ListManufacturerLedgers() ([]string, error) {
-	files, err := os.ReadDir(ls.ManufacturerLedgersDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read manufacturer ledgers directory: %v", err)
-	}
-
-	var manufacturerIDs []string
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			manufacturerIDs = append(manufacturerIDs, file.Name()[:len(file.Name())-5])
-		}
-	}
-
-	return manufacturerIDs, nil
+	return ls.Backend.ListManufacturerLedgers()
 }
 
 // DeleteManufacturerLedger deletes a manufacturer's ledger
 func (ls *LedgerStorage) DeleteManufacturerLedger(manufacturerID string) error {
-	ledgerPath := filepath.Join(ls.ManufacturerLedgersDir, fmt.Sprintf("%s.json", manufacturerID))
-	if err := os.Remove(ledgerPath); err != nil {
-		return fmt.Errorf("failed to delete manufacturer ledger: %v", err)
-	}
-	return nil
+	return ls.Backend.DeleteManufacturerLedger(manufacturerID)
 }
 
 // Database operations
@@ -198,6 +141,60 @@ func (ls *LedgerStorage) GetDrug(drugID string) (*models.Drug, error) {
 	return &drug, nil
 }
 
+// InsertLot inserts a lot record into the database
+func (ls *LedgerStorage) InsertLot(lot *models.Lot) error {
+	_, err := ls.Supabase.Insert("lots", lot)
+	return err
+}
+
+// UpdateLot updates a lot record in the database
+func (ls *LedgerStorage) UpdateLot(lot *models.Lot) error {
+	// Convert lot to map for update
+	lotData, err := json.Marshal(lot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lot: %v", err)
+	}
+
+	var updateData map[string]interface{}
+	if err := json.Unmarshal(lotData, &updateData); err != nil {
+		return fmt.Errorf("failed to unmarshal lot data: %v", err)
+	}
+
+	_, err = ls.Supabase.Update("lots", lot.ID, updateData)
+	return err
+}
+
+// GetLot retrieves a lot record from the database
+func (ls *LedgerStorage) GetLot(lotID string) (*models.Lot, error) {
+	where := map[string]interface{}{"id": lotID}
+	result, err := ls.Supabase.Select("lots", "*", where)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: lot %s", models.ErrRecordNotFound, lotID)
+	}
+
+	// Convert map to Lot struct
+	lotData, err := json.Marshal(result[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var lot models.Lot
+	if err := json.Unmarshal(lotData, &lot); err != nil {
+		return nil, err
+	}
+
+	return &lot, nil
+}
+
+// InsertRecall inserts a recall record into the database
+func (ls *LedgerStorage) InsertRecall(recall *models.Recall) error {
+	_, err := ls.Supabase.Insert("recalls", recall)
+	return err
+}
+
 // InsertDrugStatusUpdate inserts a drug status update into the database
 func (ls *LedgerStorage) InsertDrugStatusUpdate(update *models.DrugStatusUpdate) error {
 	_, err := ls.Supabase.Insert("drug_status_updates", update)
@@ -305,3 +302,51 @@ func (ls *LedgerStorage) GetShipmentStatusUpdates(shipmentID string) ([]models.S
 
 	return updates, nil
 }
+
+// InsertPrescription inserts a prescription record into the database
+func (ls *LedgerStorage) InsertPrescription(prescription *models.Prescription) error {
+	_, err := ls.Supabase.Insert("prescriptions", prescription)
+	return err
+}
+
+// UpdatePrescription updates a prescription record in the database
+func (ls *LedgerStorage) UpdatePrescription(prescription *models.Prescription) error {
+	// Convert prescription to map for update
+	prescriptionData, err := json.Marshal(prescription)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prescription: %v", err)
+	}
+
+	var updateData map[string]interface{}
+	if err := json.Unmarshal(prescriptionData, &updateData); err != nil {
+		return fmt.Errorf("failed to unmarshal prescription data: %v", err)
+	}
+
+	_, err = ls.Supabase.Update("prescriptions", prescription.ID, updateData)
+	return err
+}
+
+// GetPrescription retrieves a prescription record from the database
+func (ls *LedgerStorage) GetPrescription(prescriptionID string) (*models.Prescription, error) {
+	where := map[string]interface{}{"id": prescriptionID}
+	result, err := ls.Supabase.Select("prescriptions", "*", where)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: prescription %s", models.ErrRecordNotFound, prescriptionID)
+	}
+
+	// Convert map to Prescription struct
+	prescriptionData, err := json.Marshal(result[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var prescription models.Prescription
+	if err := json.Unmarshal(prescriptionData, &prescription); err != nil {
+		return nil, err
+	}
+
+	return &prescription, nil
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outbox change actions
+const (
+	OutboxInsert = "insert"
+	OutboxUpdate = "update"
+)
+
+// OutboxChange represents a ledger-originated database change waiting to be pushed to Supabase
+type OutboxChange struct {
+	ID        string                 `json:"id"`
+	Table     string                 `json:"table"`
+	Action    string                 `json:"action"`
+	RecordID  string                 `json:"record_id,omitempty"` // row to update, empty for inserts
+	Fields    map[string]interface{} `json:"fields"`
+	LocalAt   string                 `json:"local_at"` // time of the local write, the change's version for conflict checks
+	Attempts  int                    `json:"attempts"`
+	LastError string                 `json:"last_error,omitempty"`
+	CreatedAt string                 `json:"created_at"`
+}
+
+// Outbox is a durable, ordered queue of database changes that failed to reach Supabase
+// when they were made. Each change is held in its own file, named so that listing the
+// directory returns changes in the order they were enqueued.
+type Outbox struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// NewOutbox creates an outbox in the given directory
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+	return &Outbox{Dir: dir}, nil
+}
+
+// Enqueue durably adds a change to the outbox
+func (o *Outbox) Enqueue(change *OutboxChange) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	change.ID = fmt.Sprintf("%020d-%s", now.UnixNano(), uuid.New().String())
+	change.CreatedAt = now.Format(time.RFC3339Nano)
+	if change.LocalAt == "" {
+		change.LocalAt = change.CreatedAt
+	}
+
+	return o.write(change)
+}
+
+// Pending returns the queued changes of a table in the order they were enqueued, or of
+// every table when table is empty
+func (o *Outbox) Pending(table string) ([]*OutboxChange, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %v", err)
+	}
+	sort.Strings(files)
+
+	changes := make([]*OutboxChange, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read outbox change %s: %v", file, err)
+		}
+
+		var change OutboxChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			return nil, fmt.Errorf("failed to parse outbox change %s: %v", file, err)
+		}
+		if table == "" || change.Table == table {
+			changes = append(changes, &change)
+		}
+	}
+
+	return changes, nil
+}
+
+// Tables returns the tables that have queued changes
+func (o *Outbox) Tables() ([]string, error) {
+	changes, err := o.Pending("")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var tables []string
+	for _, change := range changes {
+		if !seen[change.Table] {
+			seen[change.Table] = true
+			tables = append(tables, change.Table)
+		}
+	}
+	return tables, nil
+}
+
+// RecordFailure records a failed attempt to push a change
+func (o *Outbox) RecordFailure(change *OutboxChange, cause error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	change.Attempts++
+	change.LastError = cause.Error()
+	return o.write(change)
+}
+
+// Remove deletes a change that has been pushed
+func (o *Outbox) Remove(change *OutboxChange) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.Remove(o.path(change.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove outbox change %s: %v", change.ID, err)
+	}
+	return nil
+}
+
+// write persists a change
+func (o *Outbox) write(change *OutboxChange) error {
+	data, err := json.MarshalIndent(change, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox change: %v", err)
+	}
+	if err := WriteFileAtomic(o.path(change.ID), data); err != nil {
+		return fmt.Errorf("failed to write outbox change: %v", err)
+	}
+	return nil
+}
+
+// path returns the file path of a change
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.Dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
+
+// NewOutboxChange converts a journaled database write into an outbox change made at localAt
+func NewOutboxChange(write WALWrite, localAt string) (*OutboxChange, error) {
+	var table, action, recordID string
+	var record interface{}
+
+	switch write.Action {
+	case WALInsertDrug:
+		table, action, record = "drugs", OutboxInsert, write.Drug
+	case WALUpdateDrug:
+		table, action, record, recordID = "drugs", OutboxUpdate, write.Drug, write.Drug.ID
+	case WALInsertLot:
+		table, action, record = "lots", OutboxInsert, write.Lot
+	case WALUpdateLot:
+		table, action, record, recordID = "lots", OutboxUpdate, write.Lot, write.Lot.ID
+	case WALInsertRecall:
+		table, action, record = "recalls", OutboxInsert, write.Recall
+	case WALInsertDrugStatusUpdate:
+		table, action, record = "drug_status_updates", OutboxInsert, write.DrugStatusUpdate
+	case WALInsertShipment:
+		table, action, record = "shipments", OutboxInsert, write.Shipment
+	case WALUpdateShipment:
+		table, action, record, recordID = "shipments", OutboxUpdate, write.Shipment, write.Shipment.ID
+	case WALInsertShipmentStatusUpdate:
+		table, action, record = "shipment_status_updates", OutboxInsert, write.ShipmentStatusUpdate
+	case WALInsertPrescription:
+		table, action, record = "prescriptions", OutboxInsert, write.Prescription
+	case WALUpdatePrescription:
+		table, action, record, recordID = "prescriptions", OutboxUpdate, write.Prescription, write.Prescription.ID
+	default:
+		return nil, fmt.Errorf("unknown WAL write action: %s", write.Action)
+	}
+
+	// Convert the record to the column map sent to Supabase
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s record: %v", table, err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s record: %v", table, err)
+	}
+
+	return &OutboxChange{
+		Table:    table,
+		Action:   action,
+		RecordID: recordID,
+		Fields:   fields,
+		LocalAt:  localAt,
+	}, nil
+}
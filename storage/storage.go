@@ -1,14 +1,18 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/ankit/blockchain_ledger/models"
+	"github.com/ankit/blockchain_ledger/canonical"
+	"github.com/ankit/blockchain_ledger/merkle"
 	"github.com/ankit/blockchain_ledger/supabase"
 )
 
@@ -17,11 +21,17 @@ type DataStorage struct {
 	Supabase       *supabase.Client
 	DataDir        string
 	WalDir         string
+	OutboxDir      string
 	BlockchainDir  string
-	BlockchainFile string
+	BlockchainFile string // legacy single-file ledger, migrated into the backend on startup
+	Backend        Backend
+	Index          *TxIndex
+	Outbox         *Outbox // database changes waiting to be pushed to Supabase
+	legacyChecked  bool
+	appendLock     sync.Mutex
 }
 
-// BlockchainLedger represents the structure of the blockchain ledger file
+// BlockchainLedger represents the blockchain ledger as a whole
 type BlockchainLedger struct {
 	Blocks      []Block `json:"blocks"`
 	LastUpdated string  `json:"last_updated"`
@@ -30,11 +40,63 @@ type BlockchainLedger struct {
 
 // Block represents a single block in the blockchain
 type Block struct {
-	BlockHeight       int         `json:"block_height"`
-	TxHash            string      `json:"tx_hash"`
-	TxData            interface{} `json:"tx_data"`
-	Timestamp         string      `json:"timestamp"`
-	PreviousBlockHash string      `json:"previous_block_hash"`
+	BlockHeight       int                `json:"block_height"`
+	Timestamp         string             `json:"timestamp"`
+	PreviousBlockHash string             `json:"previous_block_hash"`
+	MerkleRoot        string             `json:"merkle_root"`
+	BlockHash         string             `json:"block_hash"`
+	Transactions      []BlockTransaction `json:"transactions"`
+	LegacyBlockHash   string             `json:"legacy_block_hash,omitempty"` // hash in the legacy ledger file, if migrated under another
+}
+
+// BlockTransaction represents a single transaction included in a block
+type BlockTransaction struct {
+	TxHash string      `json:"tx_hash"`
+	TxData interface{} `json:"tx_data"`
+}
+
+// BlockHeader represents the publishable header of a block. The block hash is computed
+// over the header alone, so partners can verify inclusion proofs against headers without
+// receiving the transactions themselves.
+type BlockHeader struct {
+	BlockHeight       int    `json:"block_height"`
+	Timestamp         string `json:"timestamp"`
+	PreviousBlockHash string `json:"previous_block_hash"`
+	MerkleRoot        string `json:"merkle_root"`
+	BlockHash         string `json:"block_hash"`
+	TxCount           int    `json:"tx_count"`
+}
+
+// Header returns the header of the block
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		BlockHeight:       b.BlockHeight,
+		Timestamp:         b.Timestamp,
+		PreviousBlockHash: b.PreviousBlockHash,
+		MerkleRoot:        b.MerkleRoot,
+		BlockHash:         b.BlockHash,
+		TxCount:           len(b.Transactions),
+	}
+}
+
+// FindTransaction returns the index of a transaction within the block
+func (b *Block) FindTransaction(txHash string) (int, bool) {
+	for i, tx := range b.Transactions {
+		if tx.TxHash == txHash {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// ChainTransaction is a transaction together with the block that contains it
+type ChainTransaction struct {
+	BlockHeight    int         `json:"block_height"`
+	BlockHash      string      `json:"block_hash"`
+	BlockTimestamp string      `json:"block_timestamp"`
+	TxIndex        int         `json:"tx_index"`
+	TxHash         string      `json:"tx_hash"`
+	TxData         interface{} `json:"tx_data"`
 }
 
 // ConsistencyCheckResult represents the result of a consistency check
@@ -45,8 +107,8 @@ type ConsistencyCheckResult struct {
 	Recommendation string `json:"recommendation,omitempty"`
 }
 
-// NewDataStorage initializes a new DataStorage instance
-func NewDataStorage() (*DataStorage, error) {
+// NewDataStorage initializes a new DataStorage instance on top of a storage backend
+func NewDataStorage(backend Backend) (*DataStorage, error) {
 	// Initialize Supabase client
 	supabaseClient, err := supabase.NewClient(true) // Use service key
 	if err != nil {
@@ -58,8 +120,10 @@ func NewDataStorage() (*DataStorage, error) {
 		Supabase:       supabaseClient,
 		DataDir:        "data_records",
 		WalDir:         "wal_logs",
+		OutboxDir:      "outbox",
 		BlockchainDir:  "blockchain_data",
 		BlockchainFile: filepath.Join("blockchain_data", "blockchain_ledger.json"),
+		Backend:        backend,
 	}
 
 	// Ensure directories exist
@@ -70,105 +134,416 @@ func NewDataStorage() (*DataStorage, error) {
 		}
 	}
 
+	// Initialize the outbox of changes that failed to reach Supabase
+	outbox, err := NewOutbox(storage.OutboxDir)
+	if err != nil {
+		return nil, err
+	}
+	storage.Outbox = outbox
+
 	// Ensure blockchain ledger exists
 	if err := storage.EnsureBlockchainLedgerExists(); err != nil {
 		return nil, fmt.Errorf("failed to ensure blockchain ledger exists: %v", err)
 	}
 
+	// Open the transaction index and index any blocks appended while it was closed
+	index, err := OpenTxIndex(filepath.Join(storage.BlockchainDir, "tx_index.kv"))
+	if err != nil {
+		return nil, err
+	}
+	storage.Index = index
+	if err := index.CatchUp(backend); err != nil {
+		return nil, fmt.Errorf("failed to update transaction index: %v", err)
+	}
+
 	return storage, nil
 }
 
-// EnsureBlockchainLedgerExists ensures the blockchain ledger file exists
+// EnsureBlockchainLedgerExists ensures the storage backend is ready, migrating a legacy
+// blockchain_ledger.json file into it the first time
 func (s *DataStorage) EnsureBlockchainLedgerExists() error {
-	if _, err := os.Stat(s.BlockchainFile); os.IsNotExist(err) {
-		log.Printf("Creating new blockchain ledger file at %s", s.BlockchainFile)
-
-		// Create an empty ledger file with initial structure
-		initialData := BlockchainLedger{
-			Blocks:      []Block{},
-			LastUpdated: time.Now().Format(time.RFC3339),
-			BlockHeight: 0,
-		}
+	s.appendLock.Lock()
+	defer s.appendLock.Unlock()
+
+	if s.Backend == nil {
+		return fmt.Errorf("no storage backend configured")
+	}
+	if s.legacyChecked {
+		return nil
+	}
+
+	if err := s.migrateLegacyLedger(); err != nil {
+		return err
+	}
+
+	s.legacyChecked = true
+	return nil
+}
+
+// migrateLegacyLedger appends the blocks of the legacy ledger file to an empty backend
+// and renames the file so the migration only happens once. The file is verified first,
+// and left in place with nothing appended if any block fails verification.
+func (s *DataStorage) migrateLegacyLedger() error {
+	data, err := os.ReadFile(s.BlockchainFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy blockchain ledger: %v", err)
+	}
+
+	if height, _, _ := s.Backend.Tip(); height > 0 {
+		log.Printf("Warning: ignoring legacy blockchain ledger %s because the backend is not empty", s.BlockchainFile)
+		return nil
+	}
+
+	var ledger struct {
+		Blocks []legacyBlock `json:"blocks"`
+	}
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return fmt.Errorf("failed to unmarshal legacy blockchain ledger: %v", err)
+	}
+
+	if err := verifyLegacyChain(ledger.Blocks); err != nil {
+		return fmt.Errorf("refusing to migrate legacy blockchain ledger %s: %v", s.BlockchainFile, err)
+	}
 
-		data, err := json.MarshalIndent(initialData, "", "  ")
+	for _, legacy := range ledger.Blocks {
+		block, err := upgradeLegacyBlock(legacy, s.Backend)
 		if err != nil {
-			return fmt.Errorf("failed to marshal initial blockchain data: %v", err)
+			return err
 		}
+		if err := s.Backend.AppendBlock(*block); err != nil {
+			return fmt.Errorf("failed to migrate block %d: %v", block.BlockHeight, err)
+		}
+	}
+
+	if err := os.Rename(s.BlockchainFile, s.BlockchainFile+".migrated"); err != nil {
+		return fmt.Errorf("failed to rename legacy blockchain ledger: %v", err)
+	}
+
+	log.Printf("Migrated %d blocks from %s into the storage backend", len(ledger.Blocks), s.BlockchainFile)
+	return nil
+}
+
+// legacyBlock is a block of the legacy ledger file in any of the formats it was written
+// in: a single tx_hash/tx_data pair linked to the previous transaction hash, the same
+// pair with a block_hash over its contents, or a batch of transactions under a Merkle root
+type legacyBlock struct {
+	Block
+	TxHash string      `json:"tx_hash"`
+	TxData interface{} `json:"tx_data"`
+}
+
+// singleTransaction reports whether the block was written before transactions were batched
+func (b *legacyBlock) singleTransaction() bool {
+	return len(b.Transactions) == 0
+}
+
+// legacyBlockHash computes the hash of a single-transaction block over its height,
+// timestamp, transaction and previous block hash, with its transaction data encoded by
+// marshal
+func legacyBlockHash(b *legacyBlock, marshal func(interface{}) ([]byte, error)) (string, error) {
+	txDataJSON, err := marshal(b.TxData)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal transaction data: %v", err)
+	}
 
-		if err := os.WriteFile(s.BlockchainFile, data, 0644); err != nil {
-			return fmt.Errorf("failed to write blockchain ledger file: %v", err)
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%d:%s:%s:%s:%s", b.BlockHeight, b.Timestamp, b.TxHash, string(txDataJSON), b.PreviousBlockHash)))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyLegacyChain checks every block of the legacy ledger file against the hash scheme
+// it was written with, and its height and link to the block before it. Blocks written
+// before block hashes existed link to the previous transaction hash and can only be
+// checked for their links.
+func verifyLegacyChain(blocks []legacyBlock) error {
+	for i := range blocks {
+		block := &blocks[i]
+		if block.BlockHeight != i+1 {
+			return fmt.Errorf("block %d is at height %d", i+1, block.BlockHeight)
+		}
+
+		previousBlockHash := ""
+		if i > 0 {
+			previous := &blocks[i-1]
+			previousBlockHash = previous.BlockHash
+			if block.BlockHash == "" {
+				previousBlockHash = previous.TxHash
+			}
+		}
+		if block.PreviousBlockHash != previousBlockHash {
+			return fmt.Errorf("previous block hash mismatch at block %d", block.BlockHeight)
+		}
+
+		switch {
+		case !block.singleTransaction():
+			merkleRoot, err := CalculateMerkleRoot(block.Transactions)
+			if err != nil {
+				return fmt.Errorf("failed to calculate merkle root of block %d: %v", block.BlockHeight, err)
+			}
+			if merkleRoot != block.MerkleRoot {
+				return fmt.Errorf("merkle root mismatch at block %d: transactions have been modified", block.BlockHeight)
+			}
+			if CalculateBlockHash(block.Header()) != block.BlockHash {
+				return fmt.Errorf("block hash mismatch at block %d: contents have been modified", block.BlockHeight)
+			}
+		case block.BlockHash != "":
+			// Block hashes covered the transaction data as plain JSON before it was
+			// encoded as canonical JSON
+			matched := false
+			for _, marshal := range []func(interface{}) ([]byte, error){json.Marshal, canonical.Marshal} {
+				blockHash, err := legacyBlockHash(block, marshal)
+				if err != nil {
+					return fmt.Errorf("failed to calculate hash of block %d: %v", block.BlockHeight, err)
+				}
+				if blockHash == block.BlockHash {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("block hash mismatch at block %d: contents have been modified", block.BlockHeight)
+			}
+		case block.TxHash == "":
+			return fmt.Errorf("block %d has no transaction", block.BlockHeight)
 		}
 	}
 
 	return nil
 }
 
+// upgradeLegacyBlock rebuilds a verified block of the legacy ledger file chained to the
+// current tip of the backend. Blocks written before transactions were batched become
+// one-transaction blocks. A block whose hash changes keeps the hash it had in the legacy
+// file as its legacy block hash.
+func upgradeLegacyBlock(legacy legacyBlock, backend Backend) (*Block, error) {
+	block := legacy.Block
+	if legacy.singleTransaction() {
+		block.Transactions = []BlockTransaction{{TxHash: legacy.TxHash, TxData: legacy.TxData}}
+		merkleRoot, err := CalculateMerkleRoot(block.Transactions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate merkle root of legacy block %d: %v", block.BlockHeight, err)
+		}
+		block.MerkleRoot = merkleRoot
+	}
+
+	height, previousBlockHash, _ := backend.Tip()
+	block.BlockHeight = height + 1
+	block.PreviousBlockHash = previousBlockHash
+	block.BlockHash = CalculateBlockHash(block.Header())
+	if block.BlockHash != legacy.BlockHash {
+		block.LegacyBlockHash = legacy.BlockHash
+	}
+
+	return &block, nil
+}
+
 // GetBlockchainLedger retrieves the blockchain ledger data
 func (s *DataStorage) GetBlockchainLedger() (*BlockchainLedger, error) {
 	if err := s.EnsureBlockchainLedgerExists(); err != nil {
 		return nil, err
 	}
 
-	data, err := os.ReadFile(s.BlockchainFile)
+	blocks, err := s.Backend.Blocks()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read blockchain ledger: %v", err)
 	}
 
-	var ledger BlockchainLedger
-	if err := json.Unmarshal(data, &ledger); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal blockchain ledger: %v", err)
+	ledger := &BlockchainLedger{
+		Blocks:      blocks,
+		BlockHeight: len(blocks),
+	}
+	if len(blocks) > 0 {
+		ledger.LastUpdated = blocks[len(blocks)-1].Timestamp
 	}
 
-	return &ledger, nil
+	return ledger, nil
 }
 
-// AddTransactionToBlockchain adds a transaction to the blockchain ledger
+// GetBlock retrieves a single block by height without reading the whole ledger
+func (s *DataStorage) GetBlock(height int) (*Block, error) {
+	if err := s.EnsureBlockchainLedgerExists(); err != nil {
+		return nil, err
+	}
+
+	return s.Backend.ReadBlock(height)
+}
+
+// FindTransaction locates a transaction through the transaction index and returns the
+// block containing it and its position in the block
+func (s *DataStorage) FindTransaction(txHash string) (*Block, int, error) {
+	if err := s.ensureIndexed(); err != nil {
+		return nil, 0, err
+	}
+
+	height, ok, err := s.Index.LookupTransaction(txHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("transaction not found: %s", txHash)
+	}
+
+	block, err := s.Backend.ReadBlock(height)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read block %d: %v", height, err)
+	}
+
+	index, ok := block.FindTransaction(txHash)
+	if !ok {
+		return nil, 0, fmt.Errorf("transaction %s missing from indexed block %d", txHash, height)
+	}
+
+	return block, index, nil
+}
+
+// HasTransaction reports whether a transaction is on the chain
+func (s *DataStorage) HasTransaction(txHash string) (bool, error) {
+	if err := s.ensureIndexed(); err != nil {
+		return false, err
+	}
+
+	_, ok, err := s.Index.LookupTransaction(txHash)
+	return ok, err
+}
+
+// FindTransactions returns every transaction that mentions an ID under the given index
+// kind (IndexDrug, IndexShipment or IndexActor), in chain order
+func (s *DataStorage) FindTransactions(kind, value string) ([]ChainTransaction, error) {
+	if err := s.ensureIndexed(); err != nil {
+		return nil, err
+	}
+
+	heights, err := s.Index.Heights(kind, value)
+	if err != nil {
+		return nil, err
+	}
+
+	txs := []ChainTransaction{}
+	for _, height := range heights {
+		block, err := s.Backend.ReadBlock(height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block %d: %v", height, err)
+		}
+
+		for i, tx := range block.Transactions {
+			if !matchesIndex(tx.TxData, kind, value) {
+				continue
+			}
+			txs = append(txs, ChainTransaction{
+				BlockHeight:    block.BlockHeight,
+				BlockHash:      block.BlockHash,
+				BlockTimestamp: block.Timestamp,
+				TxIndex:        i,
+				TxHash:         tx.TxHash,
+				TxData:         tx.TxData,
+			})
+		}
+	}
+
+	return txs, nil
+}
+
+// RebuildIndex discards the transaction index and rebuilds it from the chain
+func (s *DataStorage) RebuildIndex() error {
+	s.appendLock.Lock()
+	defer s.appendLock.Unlock()
+
+	if err := s.Index.Rebuild(s.Backend); err != nil {
+		return fmt.Errorf("failed to rebuild transaction index: %v", err)
+	}
+
+	log.Printf("Rebuilt transaction index up to block %d", s.Index.Height())
+	return nil
+}
+
+// ensureIndexed indexes blocks that were appended without being indexed
+func (s *DataStorage) ensureIndexed() error {
+	if err := s.EnsureBlockchainLedgerExists(); err != nil {
+		return err
+	}
+	if s.Index == nil {
+		return fmt.Errorf("transaction index is not open")
+	}
+
+	if tip, _, _ := s.Backend.Tip(); s.Index.Height() == tip {
+		return nil
+	}
+
+	s.appendLock.Lock()
+	defer s.appendLock.Unlock()
+
+	if err := s.Index.CatchUp(s.Backend); err != nil {
+		return fmt.Errorf("failed to update transaction index: %v", err)
+	}
+	return nil
+}
+
+// AddTransactionToBlockchain adds a transaction to the blockchain ledger in a block of its own
 func (s *DataStorage) AddTransactionToBlockchain(txData map[string]interface{}, txHash string) error {
+	return s.AddTransactionsToBlockchain([]BlockTransaction{{TxHash: txHash, TxData: txData}})
+}
+
+// AddTransactionsToBlockchain adds a batch of transactions to the blockchain ledger as a
+// single block committed to by the Merkle root of its transactions
+func (s *DataStorage) AddTransactionsToBlockchain(txs []BlockTransaction) error {
+	if len(txs) == 0 {
+		return fmt.Errorf("cannot add an empty block to the blockchain")
+	}
+
 	// Add to local blockchain ledger
 	if err := s.EnsureBlockchainLedgerExists(); err != nil {
 		return fmt.Errorf("could not ensure blockchain ledger exists: %v", err)
 	}
 
-	// Read the current ledger data
-	ledger, err := s.GetBlockchainLedger()
-	if err != nil {
-		return fmt.Errorf("could not read blockchain ledger: %v", err)
-	}
+	s.appendLock.Lock()
 
-	// Get the current block height and increment it
-	currentHeight := ledger.BlockHeight
+	// Get the current block height and increment it, linking to the hash of the previous block
+	currentHeight, previousBlockHash, _ := s.Backend.Tip()
 	newHeight := currentHeight + 1
 
-	// Create a new block
-	var previousBlockHash string
-	if len(ledger.Blocks) > 0 {
-		previousBlockHash = ledger.Blocks[len(ledger.Blocks)-1].TxHash
+	// Normalize the transaction data so hashes survive a round trip through the backend
+	blockTxs := make([]BlockTransaction, len(txs))
+	for i, tx := range txs {
+		normalizedTxData, err := normalizeTxData(tx.TxData)
+		if err != nil {
+			s.appendLock.Unlock()
+			return fmt.Errorf("failed to normalize transaction data for %s: %v", tx.TxHash, err)
+		}
+		blockTxs[i] = BlockTransaction{TxHash: tx.TxHash, TxData: normalizedTxData}
+	}
+
+	merkleRoot, err := CalculateMerkleRoot(blockTxs)
+	if err != nil {
+		s.appendLock.Unlock()
+		return fmt.Errorf("failed to calculate merkle root: %v", err)
 	}
 
 	newBlock := Block{
 		BlockHeight:       newHeight,
-		TxHash:            txHash,
-		TxData:            txData,
 		Timestamp:         time.Now().Format(time.RFC3339),
 		PreviousBlockHash: previousBlockHash,
+		MerkleRoot:        merkleRoot,
+		Transactions:      blockTxs,
 	}
-
-	// Add the new block to the ledger
-	ledger.Blocks = append(ledger.Blocks, newBlock)
-	ledger.BlockHeight = newHeight
-	ledger.LastUpdated = time.Now().Format(time.RFC3339)
-
-	// Write the updated ledger data back to the file
-	data, err := json.MarshalIndent(ledger, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated blockchain data: %v", err)
+	newBlock.BlockHash = CalculateBlockHash(newBlock.Header())
+
+	// Append the new block to the backend
+	err = s.Backend.AppendBlock(newBlock)
+	if err == nil && s.Index != nil {
+		// A block missing from the index is picked up by the next lookup
+		if indexErr := s.Index.IndexBlock(&newBlock); indexErr != nil {
+			log.Printf("Warning: Failed to index block %d: %v", newHeight, indexErr)
+		}
 	}
-
-	if err := os.WriteFile(s.BlockchainFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write updated blockchain ledger: %v", err)
+	s.appendLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to append block to blockchain ledger: %v", err)
 	}
 
-	// Update Supabase with the transaction hash
+	// Update Supabase with the transaction hashes
 	// First, ensure the blockchain_ledger table exists
 	_, err = s.Supabase.Select("blockchain_ledger", "count", map[string]interface{}{"limit": 1})
 	if err != nil {
@@ -186,11 +561,27 @@ func (s *DataStorage) AddTransactionToBlockchain(txData map[string]interface{},
 		log.Printf("Please execute the following SQL in your Supabase database:\n%s", createTableSQL)
 	}
 
+	for _, tx := range txs {
+		txData, ok := tx.TxData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		s.recordTransaction(txData, tx.TxHash, newHeight)
+	}
+
+	log.Printf("Added block %d with %d transaction(s) to blockchain ledger", newHeight, len(txs))
+	return nil
+}
+
+// recordTransaction mirrors a committed transaction to Supabase and the local records. The
+// manufacturer and common ledgers are written by the ledger manager alone, through its
+// write-ahead log, and never from here.
+func (s *DataStorage) recordTransaction(txData map[string]interface{}, txHash string, blockHeight int) {
 	// Add transaction to blockchain_ledger table
-	_, err = s.Supabase.Insert("blockchain_ledger", map[string]interface{}{
+	_, err := s.Supabase.Insert("blockchain_ledger", map[string]interface{}{
 		"tx_hash":      txHash,
 		"tx_data":      txData,
-		"block_height": newHeight,
+		"block_height": blockHeight,
 		"timestamp":    time.Now().Format(time.RFC3339),
 	})
 	if err != nil {
@@ -199,141 +590,76 @@ func (s *DataStorage) AddTransactionToBlockchain(txData map[string]interface{},
 		log.Printf("Added transaction to blockchain_ledger table: %s", txHash)
 	}
 
-	// Update the corresponding record
-	if drugID, ok := txData["drug_id"].(string); ok {
+	// Point a created drug or shipment at the transaction that created it
+	if kind, recordID := createdRecord(txData); kind != "" {
+		table := kind + "s"
 		updateData := map[string]interface{}{
 			"blockchain_tx_id": txHash,
 		}
-		_, err = s.Supabase.Update("drugs", drugID, updateData)
+		_, err = s.Supabase.Update(table, recordID, updateData)
 		if err != nil {
-			log.Printf("Warning: Failed to update blockchain_tx_id for drug %s: %v", drugID, err)
+			log.Printf("Warning: Failed to update blockchain_tx_id for %s %s, queued for the next sync: %v", kind, recordID, err)
+			s.enqueueUpdate(table, recordID, updateData, err)
 		} else {
-			log.Printf("Updated blockchain_tx_id for drug %s", drugID)
+			log.Printf("Updated blockchain_tx_id for %s %s", kind, recordID)
 
 			// Only save to data_records after successful update of blockchain_tx_id
-			recordFile := filepath.Join(s.DataDir, fmt.Sprintf("drug_%s.json", drugID))
+			recordName := fmt.Sprintf("%s_%s.json", kind, recordID)
 
 			// Update the txData with the final blockchain_tx_id
 			txData["blockchain_tx_id"] = txHash
 
 			recordData, err := json.MarshalIndent(txData, "", "  ")
 			if err != nil {
-				log.Printf("Warning: Failed to marshal drug record: %v", err)
+				log.Printf("Warning: Failed to marshal %s record: %v", kind, err)
 			} else {
-				if err := os.WriteFile(recordFile, recordData, 0644); err != nil {
-					log.Printf("Warning: Failed to write drug record to file: %v", err)
+				if err := s.Backend.SaveRecord(recordName, recordData); err != nil {
+					log.Printf("Warning: Failed to save %s record: %v", kind, err)
 				} else {
-					log.Printf("Saved drug record to %s", recordFile)
+					log.Printf("Saved %s record %s", kind, recordName)
 				}
 			}
-
-			// Update manufacturer and common ledgers
-			if manufacturerID, ok := txData["manufacturer"].(string); ok {
-				// Initialize ledger storage
-				ledgerStorage, err := NewLedgerStorage()
-				if err != nil {
-					log.Printf("Warning: Failed to initialize ledger storage: %v", err)
-				} else {
-					// Get manufacturer ledger
-					manufacturerLedger, err := ledgerStorage.GetManufacturerLedger(manufacturerID)
-					if err != nil {
-						log.Printf("Warning: Failed to get manufacturer ledger: %v", err)
-					} else {
-						// Create drug record in manufacturer ledger
-						timestamp := time.Now().Format(time.RFC3339)
-						drugRecord := models.DrugRecord{
-							DrugID:        drugID,
-							Status:        "created",
-							CreatedAt:     timestamp,
-							CurrentStatus: "created",
-							History: []models.Status{
-								{
-									Status:    "created",
-									Timestamp: timestamp,
-									Details:   "Drug created",
-								},
-							},
-						}
-
-						// Add drug to manufacturer ledger
-						manufacturerLedger.Drugs = append(manufacturerLedger.Drugs, drugRecord)
-						manufacturerLedger.LastUpdated = timestamp
-
-						// Save manufacturer ledger
-						if err := ledgerStorage.SaveManufacturerLedger(manufacturerLedger); err != nil {
-							log.Printf("Warning: Failed to save manufacturer ledger: %v", err)
-						} else {
-							log.Printf("Updated manufacturer ledger for %s", manufacturerID)
-						}
-
-						// Get common ledger
-						commonLedger, err := ledgerStorage.GetCommonLedger()
-						if err != nil {
-							log.Printf("Warning: Failed to get common ledger: %v", err)
-						} else {
-							// Create drug record in common ledger
-							commonDrugRecord := models.CommonDrugRecord{
-								DrugID:         drugID,
-								ManufacturerID: manufacturerID,
-								Status:         "created",
-								CreatedAt:      timestamp,
-								CurrentStatus:  "created",
-								History: []models.Status{
-									{
-										Status:    "created",
-										Timestamp: timestamp,
-										Details:   "Drug created",
-									},
-								},
-								VerificationHash: txHash,
-							}
-
-							// Add drug to common ledger
-							commonLedger.Drugs = append(commonLedger.Drugs, commonDrugRecord)
-							commonLedger.LastUpdated = timestamp
-
-							// Save common ledger
-							if err := ledgerStorage.SaveCommonLedger(commonLedger); err != nil {
-								log.Printf("Warning: Failed to save common ledger: %v", err)
-							} else {
-								log.Printf("Updated common ledger with drug %s", drugID)
-							}
-						}
-					}
-				}
-			}
-		}
-	} else if shipmentID, ok := txData["shipment_id"].(string); ok {
-		updateData := map[string]interface{}{
-			"blockchain_tx_id": txHash,
 		}
-		_, err = s.Supabase.Update("shipments", shipmentID, updateData)
-		if err != nil {
-			log.Printf("Warning: Failed to update blockchain_tx_id for shipment %s: %v", shipmentID, err)
-		} else {
-			log.Printf("Updated blockchain_tx_id for shipment %s", shipmentID)
-
-			// Only save to data_records after successful update of blockchain_tx_id
-			recordFile := filepath.Join(s.DataDir, fmt.Sprintf("shipment_%s.json", shipmentID))
+	}
 
-			// Update the txData with the final blockchain_tx_id
-			txData["blockchain_tx_id"] = txHash
+	log.Printf("Added transaction %s to blockchain ledger at block height %d", txHash, blockHeight)
+}
 
-			recordData, err := json.MarshalIndent(txData, "", "  ")
-			if err != nil {
-				log.Printf("Warning: Failed to marshal shipment record: %v", err)
-			} else {
-				if err := os.WriteFile(recordFile, recordData, 0644); err != nil {
-					log.Printf("Warning: Failed to write shipment record to file: %v", err)
-				} else {
-					log.Printf("Saved shipment record to %s", recordFile)
-				}
-			}
+// createdRecord returns the kind and ID of the drug or shipment a transaction created, or
+// an empty kind for any other transaction. Later transactions of a record keep the one
+// that created it, and the sync service writes back the transactions anchoring pulled
+// rows itself.
+func createdRecord(txData map[string]interface{}) (string, string) {
+	txType, _ := txData["tx_type"].(string)
+	switch txType {
+	case "drug_create":
+		if drugID, ok := txData["drug_id"].(string); ok {
+			return RecordDrug, drugID
+		}
+	case "shipment_create":
+		if shipmentID, ok := txData["shipment_id"].(string); ok {
+			return RecordShipment, shipmentID
 		}
 	}
+	return "", ""
+}
 
-	log.Printf("Added transaction %s to blockchain ledger at block height %d", txHash, newHeight)
-	return nil
+// enqueueUpdate queues a Supabase update that failed so the sync service pushes it later
+func (s *DataStorage) enqueueUpdate(table, recordID string, fields map[string]interface{}, cause error) {
+	if s.Outbox == nil {
+		return
+	}
+
+	change := &OutboxChange{
+		Table:     table,
+		Action:    OutboxUpdate,
+		RecordID:  recordID,
+		Fields:    fields,
+		LastError: cause.Error(),
+	}
+	if err := s.Outbox.Enqueue(change); err != nil {
+		log.Printf("Warning: Failed to queue %s update for %s: %v", table, recordID, err)
+	}
 }
 
 // RunConsistencyCheck runs consistency checks and returns a detailed report
@@ -380,9 +706,6 @@ func (s *DataStorage) RunConsistencyCheck() ConsistencyCheckResult {
 
 // checkConsistency performs the actual consistency check
 func (s *DataStorage) checkConsistency() (bool, error) {
-	// This is a simplified implementation
-	// In a real-world scenario, this would perform more thorough checks
-
 	// Get the blockchain ledger
 	ledger, err := s.GetBlockchainLedger()
 	if err != nil {
@@ -395,25 +718,103 @@ func (s *DataStorage) checkConsistency() (bool, error) {
 		return true, nil
 	}
 
-	// Check block sequence integrity
-	for i := 1; i < len(ledger.Blocks); i++ {
-		currentBlock := ledger.Blocks[i]
-		previousBlock := ledger.Blocks[i-1]
+	// Check block sequence integrity and recompute every block hash
+	for i, currentBlock := range ledger.Blocks {
+		if i > 0 {
+			previousBlock := ledger.Blocks[i-1]
+
+			// Check block height sequence
+			if currentBlock.BlockHeight != previousBlock.BlockHeight+1 {
+				return false, fmt.Errorf("block height sequence broken at block %d", currentBlock.BlockHeight)
+			}
 
-		// Check block height sequence
-		if currentBlock.BlockHeight != previousBlock.BlockHeight+1 {
-			return false, fmt.Errorf("block height sequence broken at block %d", i)
+			// Check previous block hash reference
+			if currentBlock.PreviousBlockHash != previousBlock.BlockHash {
+				return false, fmt.Errorf("previous block hash mismatch at block %d", currentBlock.BlockHeight)
+			}
+		} else if currentBlock.PreviousBlockHash != "" {
+			return false, fmt.Errorf("genesis block %d references a previous block", currentBlock.BlockHeight)
 		}
 
-		// Check previous block hash reference
-		if currentBlock.PreviousBlockHash != previousBlock.TxHash {
-			return false, fmt.Errorf("previous block hash mismatch at block %d", i)
+		// Check the transactions against the recorded merkle root
+		merkleRoot, err := CalculateMerkleRoot(currentBlock.Transactions)
+		if err != nil {
+			return false, fmt.Errorf("failed to calculate merkle root of block %d: %v", currentBlock.BlockHeight, err)
+		}
+		if currentBlock.MerkleRoot != merkleRoot {
+			return false, fmt.Errorf("merkle root mismatch at block %d: transactions have been modified", currentBlock.BlockHeight)
+		}
+
+		// Check the block header against its recorded hash
+		if currentBlock.BlockHash != CalculateBlockHash(currentBlock.Header()) {
+			return false, fmt.Errorf("block hash mismatch at block %d: header has been modified", currentBlock.BlockHeight)
 		}
 	}
 
 	return true, nil
 }
 
+// CalculateBlockHash computes the hash of a block header over its height, timestamp,
+// merkle root and the hash of the previous block
+func CalculateBlockHash(header BlockHeader) string {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%d:%s:%s:%s", header.BlockHeight, header.Timestamp, header.MerkleRoot, header.PreviousBlockHash)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TransactionLeafHash computes the merkle leaf hash of a block transaction from its
+// canonical JSON encoding
+func TransactionLeafHash(tx BlockTransaction) (string, error) {
+	data, err := canonical.Marshal(tx)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode transaction %s: %v", tx.TxHash, err)
+	}
+	return merkle.LeafHash(data), nil
+}
+
+// TransactionLeafHashes computes the merkle leaf hashes of a list of block transactions
+func TransactionLeafHashes(txs []BlockTransaction) ([]string, error) {
+	leaves := make([]string, len(txs))
+	for i, tx := range txs {
+		leaf, err := TransactionLeafHash(tx)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// CalculateMerkleRoot computes the merkle root over a list of block transactions
+func CalculateMerkleRoot(txs []BlockTransaction) (string, error) {
+	leaves, err := TransactionLeafHashes(txs)
+	if err != nil {
+		return "", err
+	}
+	return merkle.Root(leaves)
+}
+
+// normalizeTxData converts transaction data into the generic form it has after being
+// read back from the ledger file, so hashes computed before and after storage agree
+func normalizeTxData(txData interface{}) (interface{}, error) {
+	data, err := json.Marshal(txData)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+
+	return normalized, nil
+}
+
+// SaveRecord saves a data record through the storage backend
+func (s *DataStorage) SaveRecord(name string, data []byte) error {
+	return s.Backend.SaveRecord(name, data)
+}
+
 // WriteFile writes data to a file in the specified path
 func (s *DataStorage) WriteFile(filePath string, data []byte) error {
 	// Ensure the directory exists
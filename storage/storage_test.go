@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hashedLegacyChain builds a legacy chain of single-transaction blocks with block hashes,
+// followed by a batched block linked to the last of them
+func hashedLegacyChain(t *testing.T, singles int) []legacyBlock {
+	t.Helper()
+	var blocks []legacyBlock
+	previousBlockHash := ""
+	for i := 1; i <= singles; i++ {
+		block := legacyBlock{
+			Block: Block{
+				BlockHeight:       i,
+				Timestamp:         fmt.Sprintf("2025-01-01T00:00:%02dZ", i),
+				PreviousBlockHash: previousBlockHash,
+			},
+			TxHash: fmt.Sprintf("tx-%d", i),
+			TxData: map[string]interface{}{"drug_id": fmt.Sprintf("D%d", i), "quantity": float64(i)},
+		}
+		blockHash, err := legacyBlockHash(&block, json.Marshal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.BlockHash = blockHash
+		previousBlockHash = blockHash
+		blocks = append(blocks, block)
+	}
+
+	batched := Block{
+		BlockHeight:       singles + 1,
+		Timestamp:         "2025-01-02T00:00:00Z",
+		PreviousBlockHash: previousBlockHash,
+		Transactions: []BlockTransaction{
+			{TxHash: "tx-a", TxData: map[string]interface{}{"drug_id": "DA"}},
+			{TxHash: "tx-b", TxData: map[string]interface{}{"drug_id": "DB"}},
+		},
+	}
+	merkleRoot, err := CalculateMerkleRoot(batched.Transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batched.MerkleRoot = merkleRoot
+	batched.BlockHash = CalculateBlockHash(batched.Header())
+	return append(blocks, legacyBlock{Block: batched})
+}
+
+// linkedLegacyChain builds a legacy chain written before block hashes, where each block
+// links to the previous transaction hash
+func linkedLegacyChain(count int) []legacyBlock {
+	var blocks []legacyBlock
+	for i := 1; i <= count; i++ {
+		block := legacyBlock{
+			Block:  Block{BlockHeight: i, Timestamp: fmt.Sprintf("2024-01-01T00:00:%02dZ", i)},
+			TxHash: fmt.Sprintf("tx-%d", i),
+			TxData: map[string]interface{}{"drug_id": fmt.Sprintf("D%d", i)},
+		}
+		if i > 1 {
+			block.PreviousBlockHash = blocks[i-2].TxHash
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// migrate writes a legacy ledger file and migrates it into a new file backend
+func migrate(t *testing.T, blocks []legacyBlock) (*DataStorage, error) {
+	t.Helper()
+	dir := t.TempDir()
+	backend, err := NewFileBackend(filepath.Join(dir, "blockchain_data"), filepath.Join(dir, "data_records"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	s := &DataStorage{
+		BlockchainFile: filepath.Join(dir, "blockchain_data", "blockchain_ledger.json"),
+		Backend:        backend,
+	}
+	data, err := json.Marshal(map[string]interface{}{"blocks": blocks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.BlockchainFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, s.EnsureBlockchainLedgerExists()
+}
+
+func TestMigrateLegacyLedger(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks []legacyBlock
+	}{
+		{"hashed blocks", hashedLegacyChain(t, 3)},
+		{"linked blocks", linkedLegacyChain(3)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := migrate(t, tt.blocks)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blocks, err := s.Backend.Blocks()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != len(tt.blocks) {
+				t.Fatalf("migrated %d blocks, want %d", len(blocks), len(tt.blocks))
+			}
+			previousBlockHash := ""
+			for i, block := range blocks {
+				if block.PreviousBlockHash != previousBlockHash || block.BlockHash != CalculateBlockHash(block.Header()) {
+					t.Fatalf("migrated block %d is not chained under the current hash scheme", block.BlockHeight)
+				}
+				if block.LegacyBlockHash != tt.blocks[i].BlockHash {
+					t.Fatalf("block %d: legacy block hash = %q, want %q", block.BlockHeight, block.LegacyBlockHash, tt.blocks[i].BlockHash)
+				}
+				previousBlockHash = block.BlockHash
+			}
+
+			if _, err := os.Stat(s.BlockchainFile + ".migrated"); err != nil {
+				t.Fatalf("legacy file was not renamed: %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyLedgerRefusesTamperedFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(blocks []legacyBlock) []legacyBlock
+	}{
+		{
+			name: "edited transaction data",
+			tamper: func(blocks []legacyBlock) []legacyBlock {
+				blocks[1].TxData = map[string]interface{}{"drug_id": "D2", "quantity": float64(200)}
+				return blocks
+			},
+		},
+		{
+			name: "edited batched transaction",
+			tamper: func(blocks []legacyBlock) []legacyBlock {
+				blocks[3].Transactions[1].TxData = map[string]interface{}{"drug_id": "DX"}
+				return blocks
+			},
+		},
+		{
+			name: "removed block",
+			tamper: func(blocks []legacyBlock) []legacyBlock {
+				blocks = append(blocks[:1], blocks[2:]...)
+				for i := range blocks {
+					blocks[i].BlockHeight = i + 1
+				}
+				return blocks
+			},
+		},
+		{
+			name: "rehashed block",
+			tamper: func(blocks []legacyBlock) []legacyBlock {
+				blocks[0].TxData = map[string]interface{}{"drug_id": "DX"}
+				blockHash, _ := legacyBlockHash(&blocks[0], json.Marshal)
+				blocks[0].BlockHash = blockHash
+				return blocks
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := migrate(t, tt.tamper(hashedLegacyChain(t, 3)))
+			if err == nil {
+				t.Fatal("expected the tampered legacy ledger to be refused")
+			}
+			if height, _, _ := s.Backend.Tip(); height != 0 {
+				t.Fatalf("%d blocks were appended from a refused legacy ledger", height)
+			}
+			if _, err := os.Stat(s.BlockchainFile); err != nil {
+				t.Fatalf("refused legacy file was moved: %v", err)
+			}
+		})
+	}
+
+	t.Run("broken transaction link", func(t *testing.T) {
+		blocks := linkedLegacyChain(3)
+		blocks[2].PreviousBlockHash = "tx-x"
+		if _, err := migrate(t, blocks); err == nil {
+			t.Fatal("expected the broken legacy ledger to be refused")
+		}
+	})
+}
+
+func TestCreatedRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		txData   map[string]interface{}
+		kind, id string
+	}{
+		{"drug creation", map[string]interface{}{"tx_type": "drug_create", "drug_id": "D1"}, RecordDrug, "D1"},
+		{"drug update", map[string]interface{}{"tx_type": "drug_update", "drug_id": "D1"}, "", ""},
+		{"drug revert", map[string]interface{}{"tx_type": "drug_revert", "drug_id": "D1"}, "", ""},
+		{"shipment creation", map[string]interface{}{"tx_type": "shipment_create", "shipment_id": "S1", "drug_id": "D1"}, RecordShipment, "S1"},
+		{"shipment update", map[string]interface{}{"tx_type": "shipment_update", "shipment_id": "S1", "drug_id": "D1"}, "", ""},
+		{"lot creation", map[string]interface{}{"tx_type": "lot_create", "lot_id": "L1", "drug_id": "D1"}, "", ""},
+		{"synced drug row", map[string]interface{}{"tx_type": "drug", "drug_id": "D2", "manufacturer": "m1"}, "", ""},
+		{"synced status update", map[string]interface{}{"tx_type": "drug_status_update", "drug_id": "D2"}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, id := createdRecord(tt.txData)
+			if kind != tt.kind || id != tt.id {
+				t.Fatalf("created record = %q %q, want %q %q", kind, id, tt.kind, tt.id)
+			}
+		})
+	}
+}
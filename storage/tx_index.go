@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ankit/blockchain_ledger/kv"
+)
+
+// Secondary index kinds and the transaction fields they are built from. A kind added later
+// only picks up the blocks indexed after it; rebuild the index to cover older blocks.
+const (
+	IndexDrug         = "drug"
+	IndexLot          = "lot"
+	IndexRecall       = "recall"
+	IndexShipment     = "shipment"
+	IndexActor        = "actor"
+	IndexPrescription = "prescription"
+)
+
+// indexFields lists the transaction data fields indexed under each kind. Actors are
+// indexed by the user who made an update and by the organization that signed it.
+var indexFields = map[string][]string{
+	IndexDrug:         {"drug_id"},
+	IndexLot:          {"lot_id"},
+	IndexRecall:       {"recall_id"},
+	IndexShipment:     {"shipment_id"},
+	IndexActor:        {"updated_by", "signer_id"},
+	IndexPrescription: {"prescription_id"},
+}
+
+// Buckets of the transaction index. Each ID of an index kind has a bucket of its own,
+// named after the kind and the ID, holding one key per block height that mentions it.
+const (
+	txHashBucket     = "tx"
+	indexMetaBucket  = "meta"
+	indexedHeightKey = "indexed_height"
+	indexFormatKey   = "format"
+)
+
+// indexFormat is the layout version of the index. An index of another version is
+// discarded on open and rebuilt from the chain.
+const indexFormat = "2"
+
+// TxIndex is a persistent index from transaction hash to block height and from drug,
+// shipment and actor IDs to the heights of the blocks that mention them. It is updated
+// as blocks are appended and can always be rebuilt from the chain.
+type TxIndex struct {
+	mu     sync.RWMutex
+	Path   string
+	db     *kv.DB
+	height int
+}
+
+// OpenTxIndex opens the transaction index stored at the given path
+func OpenTxIndex(path string) (*TxIndex, error) {
+	db, err := kv.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transaction index: %v", err)
+	}
+
+	// Discard an index in an older layout, it is rebuilt as blocks are looked up
+	if format, err := db.Get(indexMetaBucket, indexFormatKey); err != nil || string(format) != indexFormat {
+		if db.Count(indexMetaBucket) > 0 {
+			log.Printf("Discarding transaction index %s in an older format", path)
+			if err := db.Close(); err != nil {
+				return nil, fmt.Errorf("failed to close transaction index: %v", err)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove transaction index: %v", err)
+			}
+			if db, err = kv.Open(path); err != nil {
+				return nil, fmt.Errorf("failed to recreate transaction index: %v", err)
+			}
+		}
+	}
+
+	ix := &TxIndex{Path: path, db: db}
+
+	data, err := db.Get(indexMetaBucket, indexedHeightKey)
+	if err != nil && !errors.Is(err, kv.ErrNotFound) {
+		db.Close()
+		return nil, fmt.Errorf("failed to read transaction index height: %v", err)
+	}
+	if err == nil {
+		height, err := strconv.Atoi(string(data))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("invalid transaction index height: %v", err)
+		}
+		ix.height = height
+	}
+
+	return ix, nil
+}
+
+// Height returns the height of the last indexed block
+func (ix *TxIndex) Height() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.height
+}
+
+// IndexBlock adds the transactions of a block to the index. The block must directly
+// follow the last indexed block.
+func (ix *TxIndex) IndexBlock(block *Block) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if block.BlockHeight != ix.height+1 {
+		return fmt.Errorf("block %d does not follow indexed height %d", block.BlockHeight, ix.height)
+	}
+
+	// Collect the IDs mentioned by the block, each once per kind
+	mentions := make(map[string]map[string]bool)
+	for _, tx := range block.Transactions {
+		txData, ok := tx.TxData.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for kind, fields := range indexFields {
+			for _, field := range fields {
+				value, _ := txData[field].(string)
+				if value == "" {
+					continue
+				}
+				if mentions[kind] == nil {
+					mentions[kind] = make(map[string]bool)
+				}
+				mentions[kind][value] = true
+			}
+		}
+	}
+
+	err := ix.db.Update(func(b *kv.Batch) error {
+		height := []byte(strconv.Itoa(block.BlockHeight))
+		for _, tx := range block.Transactions {
+			b.Put(txHashBucket, tx.TxHash, height)
+		}
+
+		// One key per mention, so indexing a block never rewrites earlier entries
+		for kind, values := range mentions {
+			for value := range values {
+				b.Put(indexBucket(kind, value), heightKey(block.BlockHeight), nil)
+			}
+		}
+
+		b.Put(indexMetaBucket, indexedHeightKey, height)
+		b.Put(indexMetaBucket, indexFormatKey, []byte(indexFormat))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index block %d: %v", block.BlockHeight, err)
+	}
+
+	ix.height = block.BlockHeight
+	return nil
+}
+
+// CatchUp indexes the blocks of the backend that are not indexed yet. If the index is
+// ahead of the chain, it is rebuilt from scratch.
+func (ix *TxIndex) CatchUp(backend Backend) error {
+	tip, _, _ := backend.Tip()
+	if ix.Height() > tip {
+		return ix.Rebuild(backend)
+	}
+
+	for height := ix.Height() + 1; height <= tip; height++ {
+		block, err := backend.ReadBlock(height)
+		if err != nil {
+			return fmt.Errorf("failed to read block %d for indexing: %v", height, err)
+		}
+		if err := ix.IndexBlock(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuild discards the index and rebuilds it from every block of the backend
+func (ix *TxIndex) Rebuild(backend Backend) error {
+	ix.mu.Lock()
+	if err := ix.db.Close(); err != nil {
+		ix.mu.Unlock()
+		return fmt.Errorf("failed to close transaction index: %v", err)
+	}
+	if err := os.Remove(ix.Path); err != nil && !os.IsNotExist(err) {
+		ix.mu.Unlock()
+		return fmt.Errorf("failed to remove transaction index: %v", err)
+	}
+	db, err := kv.Open(ix.Path)
+	if err != nil {
+		ix.mu.Unlock()
+		return fmt.Errorf("failed to recreate transaction index: %v", err)
+	}
+	ix.db = db
+	ix.height = 0
+	ix.mu.Unlock()
+
+	return ix.CatchUp(backend)
+}
+
+// LookupTransaction returns the height of the block containing a transaction
+func (ix *TxIndex) LookupTransaction(txHash string) (int, bool, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	data, err := ix.db.Get(txHashBucket, txHash)
+	if errors.Is(err, kv.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to look up transaction %s: %v", txHash, err)
+	}
+
+	height, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid index entry for transaction %s: %v", txHash, err)
+	}
+	return height, true, nil
+}
+
+// Heights returns the heights of the blocks that mention an ID of the given index kind
+func (ix *TxIndex) Heights(kind, value string) ([]int, error) {
+	if _, ok := indexFields[kind]; !ok {
+		return nil, fmt.Errorf("unknown index: %s", kind)
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.heights(kind, value)
+}
+
+// heights reads the heights indexed for an ID, in ascending order; callers must hold the lock
+func (ix *TxIndex) heights(kind, value string) ([]int, error) {
+	keys := ix.db.Keys(indexBucket(kind, value))
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	heights := make([]int, len(keys))
+	for i, key := range keys {
+		height, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s index entry for %s: %v", kind, value, err)
+		}
+		heights[i] = height
+	}
+	return heights, nil
+}
+
+// indexBucket returns the bucket holding the heights indexed for an ID of a kind
+func indexBucket(kind, value string) string {
+	return kind + "\x00" + value
+}
+
+// heightKey returns the key of a block height, zero-padded so keys sort by height
+func heightKey(height int) string {
+	return fmt.Sprintf("%010d", height)
+}
+
+// Close closes the index
+func (ix *TxIndex) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.db.Close()
+}
+
+// matchesIndex reports whether a transaction mentions an ID under the given index kind
+func matchesIndex(txData interface{}, kind, value string) bool {
+	data, ok := txData.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, field := range indexFields[kind] {
+		if v, _ := data[field].(string); v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ankit/blockchain_ledger/kv"
+)
+
+func TestTxIndexHeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.kv")
+	ix, err := OpenTxIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for height := 1; height <= 12; height++ {
+		drugID := "drug-a"
+		if height%3 == 0 {
+			drugID = "drug-b"
+		}
+		block := &Block{
+			BlockHeight:  height,
+			Transactions: []BlockTransaction{{TxHash: "tx-" + heightKey(height), TxData: map[string]interface{}{"drug_id": drugID}}},
+		}
+		if err := ix.IndexBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.Close()
+
+	reopened, err := OpenTxIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Height() != 12 {
+		t.Fatalf("height = %d, want 12", reopened.Height())
+	}
+	heights, err := reopened.Heights(IndexDrug, "drug-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 6, 9, 12}; !reflect.DeepEqual(heights, want) {
+		t.Fatalf("heights = %v, want %v", heights, want)
+	}
+	if heights, _ := reopened.Heights(IndexDrug, "drug-c"); len(heights) != 0 {
+		t.Fatalf("heights of an unknown drug = %v", heights)
+	}
+	if height, ok, _ := reopened.LookupTransaction("tx-" + heightKey(10)); !ok || height != 10 {
+		t.Fatalf("LookupTransaction = %d, %v", height, ok)
+	}
+}
+
+func TestTxIndexDiscardsOlderFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.kv")
+
+	// An index that stored each ID's heights as one JSON list
+	db, err := kv.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heights, _ := json.Marshal([]int{1, 2})
+	db.Put(IndexDrug, "drug-a", heights)
+	db.Put(indexMetaBucket, indexedHeightKey, []byte("2"))
+	db.Close()
+
+	ix, err := OpenTxIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+
+	if ix.Height() != 0 {
+		t.Fatalf("height = %d, want the index to start over", ix.Height())
+	}
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/models"
+	"github.com/google/uuid"
+)
+
+// WAL entry states
+const (
+	WALStatusPending    = "pending"
+	WALStatusRolledBack = "rolled_back"
+)
+
+// WAL write actions applied to the database
+const (
+	WALInsertDrug                 = "insert_drug"
+	WALUpdateDrug                 = "update_drug"
+	WALInsertLot                  = "insert_lot"
+	WALUpdateLot                  = "update_lot"
+	WALInsertRecall               = "insert_recall"
+	WALInsertDrugStatusUpdate     = "insert_drug_status_update"
+	WALInsertShipment             = "insert_shipment"
+	WALUpdateShipment             = "update_shipment"
+	WALInsertShipmentStatusUpdate = "insert_shipment_status_update"
+	WALInsertPrescription         = "insert_prescription"
+	WALUpdatePrescription         = "update_prescription"
+)
+
+// File extensions of journaled entries
+const (
+	walPendingExt    = ".wal"
+	walRolledBackExt = ".rolled_back"
+)
+
+// WALEntry represents a journaled logical ledger operation. It carries the prepared
+// blockchain transactions of the operation, the records it changed in the manufacturer
+// and common ledgers and its database writes, so an interrupted operation can be
+// replayed or rolled back.
+type WALEntry struct {
+	ID           string             `json:"id"`
+	Operation    string             `json:"operation"`
+	Status       string             `json:"status"`
+	TxHashes     []string           `json:"tx_hashes"`
+	Transactions []BlockTransaction `json:"transactions,omitempty"`
+	Ledgers      []LedgerDelta      `json:"ledgers,omitempty"`
+	Writes       []WALWrite         `json:"writes"`
+	StepsApplied int                `json:"steps_applied"`
+	CreatedAt    string             `json:"created_at"`
+	UpdatedAt    string             `json:"updated_at"`
+	Error        string             `json:"error,omitempty"`
+
+	// Ledgers as the operation loaded them, kept in memory to compute its ledger deltas
+	BaseManufacturerLedger *models.ManufacturerLedger `json:"-"`
+	BaseCommonLedger       *models.CommonLedger       `json:"-"`
+}
+
+// legacyWALImages holds the ledger images journaled by entries written before ledger
+// deltas
+type legacyWALImages struct {
+	PreviousManufacturerLedger *models.ManufacturerLedger `json:"previous_manufacturer_ledger"`
+	PreviousCommonLedger       *models.CommonLedger       `json:"previous_common_ledger"`
+	ManufacturerLedger         *models.ManufacturerLedger `json:"manufacturer_ledger"`
+	CommonLedger               *models.CommonLedger       `json:"common_ledger"`
+}
+
+// WALWrite represents a single database write of a journaled operation
+type WALWrite struct {
+	Action               string                       `json:"action"`
+	Drug                 *models.Drug                 `json:"drug,omitempty"`
+	Lot                  *models.Lot                  `json:"lot,omitempty"`
+	Recall               *models.Recall               `json:"recall,omitempty"`
+	DrugStatusUpdate     *models.DrugStatusUpdate     `json:"drug_status_update,omitempty"`
+	Shipment             *models.Shipment             `json:"shipment,omitempty"`
+	ShipmentStatusUpdate *models.ShipmentStatusUpdate `json:"shipment_status_update,omitempty"`
+	Prescription         *models.Prescription         `json:"prescription,omitempty"`
+}
+
+// ChainSteps returns the number of block appends that precede the ledger file writes
+func (e *WALEntry) ChainSteps() int {
+	if len(e.Transactions) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// LedgerSteps returns the number of ledger file writes that precede the database writes
+func (e *WALEntry) LedgerSteps() int {
+	return len(e.Ledgers)
+}
+
+// WAL is a write-ahead log of ledger operations. Each pending operation is stored as
+// its own file in the WAL directory until it is committed or rolled back.
+type WAL struct {
+	mu  sync.Mutex
+	Dir string
+}
+
+// NewWAL creates a write-ahead log in the given directory
+func NewWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %v", err)
+	}
+
+	return &WAL{Dir: dir}, nil
+}
+
+// Begin journals an operation before any of its steps are executed
+func (w *WAL) Begin(entry *WALEntry) error {
+	if entry.ID == "" {
+		entry.ID = fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000000"), uuid.New().String())
+	}
+	entry.Status = WALStatusPending
+	entry.StepsApplied = 0
+	entry.CreatedAt = time.Now().Format(time.RFC3339Nano)
+
+	return w.Update(entry)
+}
+
+// Update persists the progress of a pending operation
+func (w *WAL) Update(entry *WALEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry.UpdatedAt = time.Now().Format(time.RFC3339Nano)
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal WAL entry: %v", err)
+	}
+
+	if err := WriteFileAtomic(w.entryPath(entry.ID, walPendingExt), data); err != nil {
+		return fmt.Errorf("failed to write WAL entry %s: %v", entry.ID, err)
+	}
+
+	return nil
+}
+
+// Commit removes a fully applied operation from the log
+func (w *WAL) Commit(entry *WALEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.Remove(w.entryPath(entry.ID, walPendingExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to commit WAL entry %s: %v", entry.ID, err)
+	}
+
+	return nil
+}
+
+// RollBack marks an operation as rolled back, keeping the entry for inspection
+func (w *WAL) RollBack(entry *WALEntry, cause error) error {
+	entry.Status = WALStatusRolledBack
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	if err := w.Update(entry); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.Rename(w.entryPath(entry.ID, walPendingExt), w.entryPath(entry.ID, walRolledBackExt)); err != nil {
+		return fmt.Errorf("failed to roll back WAL entry %s: %v", entry.ID, err)
+	}
+
+	return nil
+}
+
+// Pending returns the operations that were journaled but never committed, oldest first
+func (w *WAL) Pending() ([]*WALEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(w.Dir, "*"+walPendingExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL entries: %v", err)
+	}
+	sort.Strings(files)
+
+	entries := make([]*WALEntry, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WAL entry %s: %v", file, err)
+		}
+
+		var entry WALEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal WAL entry %s: %v", file, err)
+		}
+		if err := upgradeLegacyEntry(&entry, data); err != nil {
+			return nil, fmt.Errorf("failed to upgrade WAL entry %s: %v", file, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+// upgradeLegacyEntry converts the ledger images of an entry written before ledger deltas
+// into deltas. Every image becomes a delta, even one without changes, so the ledger steps
+// the entry already applied are counted the same way.
+func upgradeLegacyEntry(entry *WALEntry, data []byte) error {
+	if len(entry.Ledgers) > 0 {
+		return nil
+	}
+
+	var images legacyWALImages
+	if err := json.Unmarshal(data, &images); err != nil {
+		return err
+	}
+
+	if images.ManufacturerLedger != nil {
+		delta, err := DiffManufacturerLedger(images.PreviousManufacturerLedger, images.ManufacturerLedger)
+		if err != nil {
+			return err
+		}
+		entry.Ledgers = append(entry.Ledgers, *delta)
+	}
+	if images.CommonLedger != nil {
+		delta, err := DiffCommonLedger(images.PreviousCommonLedger, images.CommonLedger)
+		if err != nil {
+			return err
+		}
+		entry.Ledgers = append(entry.Ledgers, *delta)
+	}
+
+	return nil
+}
+
+// entryPath returns the file path of a WAL entry
+func (w *WAL) entryPath(id, ext string) string {
+	return filepath.Join(w.Dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+ext)
+}
+
+// WriteFileAtomic writes a file through a temporary file and rename so readers never
+// observe a partially written file
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
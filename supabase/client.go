@@ -1,13 +1,23 @@
 package supabase
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nedpals/supabase-go"
 )
 
+// httpClient performs the PostgREST requests the supabase-go client has no builder for
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 // Client represents a Supabase client with additional functionality
 type Client struct {
 	Client          *supabase.Client
@@ -88,17 +98,14 @@ func (c *Client) Insert(table string, data interface{}) (map[string]interface{},
 
 // Update updates data in the specified table
 func (c *Client) Update(table string, id string, data map[string]interface{}) (map[string]interface{}, error) {
+	// Apply match condition for the ID based on table name
+	return c.UpdateWhere(table, IDColumn(table), id, data)
+}
+
+// UpdateWhere updates the row of the specified table whose idColumn matches id
+func (c *Client) UpdateWhere(table, idColumn, id string, data map[string]interface{}) (map[string]interface{}, error) {
 	// Create request
 	req := c.Client.DB.From(table).Update(data)
-
-	// Apply match condition for the ID based on table name
-	idColumn := "id"
-	switch table {
-	case "drugs":
-		idColumn = "drug_id"
-	case "shipments":
-		idColumn = "shipment_id"
-	}
 	req.Filter(idColumn, "eq", id)
 
 	// Execute request
@@ -114,6 +121,80 @@ func (c *Client) Update(table string, id string, data map[string]interface{}) (m
 	return nil, nil
 }
 
+// IDColumn returns the primary key column of a table
+func IDColumn(table string) string {
+	switch table {
+	case "drugs":
+		return "drug_id"
+	case "shipments":
+		return "shipment_id"
+	}
+	return "id"
+}
+
+// PageQuery selects one page of the rows of a table changed after a watermark
+type PageQuery struct {
+	Column   string // timestamp column tracking changes, usually updated_at
+	IDColumn string // unique column ordering rows with equal timestamps, defaults to IDColumn(table)
+	After    string // watermark timestamp, exclusive; empty to start from the oldest row
+	AfterID  string // ID of the last row read at the watermark timestamp, if any
+	Limit    int    // maximum number of rows in the page
+}
+
+// SelectChanged returns a page of rows changed after the query's watermark, ordered by the
+// change column and then by ID so consecutive pages never skip or repeat a row. Rows
+// without a change timestamp are never returned.
+func (c *Client) SelectChanged(table string, query PageQuery) ([]map[string]interface{}, error) {
+	idColumn := query.IDColumn
+	if idColumn == "" {
+		idColumn = IDColumn(table)
+	}
+
+	params := url.Values{}
+	params.Set("select", "*")
+	params.Set("order", fmt.Sprintf("%s.asc,%s.asc", query.Column, idColumn))
+	params.Set("limit", strconv.Itoa(query.Limit))
+	switch {
+	case query.After == "":
+		params.Set(query.Column, "not.is.null")
+	case query.AfterID == "":
+		params.Set(query.Column, "gt."+query.After)
+	default:
+		params.Set("or", fmt.Sprintf("(%s.gt.%q,and(%s.eq.%q,%s.gt.%q))",
+			query.Column, query.After, query.Column, query.After, idColumn, query.AfterID))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(c.URL, "/")+"/rest/v1/"+url.PathEscape(table)+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create supabase request: %v", err)
+	}
+	key := c.Key
+	if c.UsingServiceKey {
+		key = c.ServiceKey
+	}
+	req.Header.Set("apikey", key)
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("supabase select error on %s: %v", table, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("supabase select error on %s: %s: %s", table, resp.Status, body)
+	}
+
+	var data []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode supabase rows of %s: %v", table, err)
+	}
+
+	return data, nil
+}
+
 // Delete deletes data from the specified table
 func (c *Client) Delete(table string, match map[string]interface{}) (map[string]interface{}, error) {
 	// Create request
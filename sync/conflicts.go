@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// ledgerFields are the columns recorded by ledger transactions. When a row changed in
+// Supabase after the local write, the ledger still wins for these columns, while the
+// other, descriptive columns keep the newer remote value (last writer wins).
+var ledgerFields = map[string]bool{
+	"status":            true,
+	"blockchain_tx_id":  true,
+	"verification_hash": true,
+	"manufacturer_id":   true,
+	"distributor_id":    true,
+	"drug_id":           true,
+	"patient_id":        true,
+	"doctor_id":         true,
+	"pharmacy_id":       true,
+	"quantity":          true,
+	"quantity_filled":   true,
+	"expires_at":        true,
+}
+
+// bookkeepingFields are never pushed when resolving a conflict
+var bookkeepingFields = map[string]bool{
+	"id":         true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// ConflictReport describes a pushed update whose Supabase row changed after the local write
+type ConflictReport struct {
+	Table      string   `json:"table"`
+	RecordID   string   `json:"record_id"`
+	ChangeID   string   `json:"change_id"`
+	LocalAt    string   `json:"local_at"`
+	RemoteAt   string   `json:"remote_updated_at"`
+	LedgerWins []string `json:"ledger_wins"` // columns overwritten with the ledger's value
+	RemoteWins []string `json:"remote_wins"` // columns whose newer remote value was kept
+}
+
+// resolveConflict returns the columns of an update to push given the current remote row,
+// and a report when the row changed after the local write
+func resolveConflict(change *storage.OutboxChange, remote map[string]interface{}) (map[string]interface{}, *ConflictReport) {
+	remoteAt, _ := remote[changeColumn].(string)
+	if !changedAfter(remoteAt, change.LocalAt) {
+		return change.Fields, nil
+	}
+
+	report := &ConflictReport{
+		Table:    change.Table,
+		RecordID: change.RecordID,
+		ChangeID: change.ID,
+		LocalAt:  change.LocalAt,
+		RemoteAt: remoteAt,
+	}
+
+	fields := make(map[string]interface{})
+	for column, value := range change.Fields {
+		if bookkeepingFields[column] {
+			continue
+		}
+		same := fmt.Sprintf("%v", value) == fmt.Sprintf("%v", remote[column])
+		switch {
+		case ledgerFields[column]:
+			fields[column] = value
+			if !same {
+				report.LedgerWins = append(report.LedgerWins, column)
+			}
+		case !same:
+			report.RemoteWins = append(report.RemoteWins, column)
+		}
+	}
+	sort.Strings(report.LedgerWins)
+	sort.Strings(report.RemoteWins)
+
+	return fields, report
+}
+
+// changedAfter reports whether a remote change timestamp is later than a local write.
+// Unknown timestamps count as no conflict, so the ledger's change is pushed whole.
+func changedAfter(remoteAt, localAt string) bool {
+	remote, err := time.Parse(time.RFC3339Nano, remoteAt)
+	if err != nil {
+		return false
+	}
+	local, err := time.Parse(time.RFC3339Nano, localAt)
+	if err != nil {
+		return false
+	}
+	return remote.After(local)
+}
@@ -0,0 +1,243 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/storage"
+	"github.com/google/uuid"
+)
+
+// DefaultDeadLetterDir is the directory holding webhook events whose processing failed
+const DefaultDeadLetterDir = "dead_letters"
+
+// ErrDeadLetterNotFound is returned when no dead letter has the requested ID
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetterAttempt records one failed attempt to process a webhook event
+type DeadLetterAttempt struct {
+	At     string `json:"at"`
+	Error  string `json:"error"`
+	Replay bool   `json:"replay"` // attempt made by an operator replay rather than the webhook retries
+}
+
+// DeadLetter is a webhook event that could not be processed, kept with its error history
+// until an operator replays or discards it
+type DeadLetter struct {
+	ID            string              `json:"id"`
+	Event         WebhookPayload      `json:"event"`
+	Attempts      []DeadLetterAttempt `json:"attempts"`
+	FirstFailedAt string              `json:"first_failed_at"`
+	LastFailedAt  string              `json:"last_failed_at"`
+	LastError     string              `json:"last_error"`
+}
+
+// DeadLetterStats describes the depth of the dead-letter queue
+type DeadLetterStats struct {
+	Depth          int            `json:"depth"`
+	ByTable        map[string]int `json:"by_table"`
+	OldestFailedAt string         `json:"oldest_failed_at,omitempty"`
+	DeadLettered   int            `json:"dead_lettered_total"` // events dead-lettered since the service started
+	Replayed       int            `json:"replayed_total"`      // dead letters replayed successfully since the service started
+	Discarded      int            `json:"discarded_total"`     // dead letters discarded since the service started
+}
+
+// DeadLetterStore durably holds failed webhook events. Each event is held in its own file,
+// named so that listing the directory returns events in the order they failed.
+type DeadLetterStore struct {
+	Dir          string
+	mu           sync.Mutex
+	deadLettered int
+	replayed     int
+	discarded    int
+}
+
+// NewDeadLetterStore creates a dead-letter store in the given directory
+func NewDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory: %v", err)
+	}
+	return &DeadLetterStore{Dir: dir}, nil
+}
+
+// Add durably stores an event whose processing failed after the given attempts
+func (s *DeadLetterStore) Add(event WebhookPayload, attempts []DeadLetterAttempt) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	letter := &DeadLetter{
+		ID:            fmt.Sprintf("%020d-%s", now.UnixNano(), uuid.New().String()),
+		Event:         event,
+		Attempts:      attempts,
+		FirstFailedAt: now.Format(time.RFC3339Nano),
+	}
+	if len(attempts) > 0 {
+		letter.FirstFailedAt = attempts[0].At
+		letter.LastFailedAt = attempts[len(attempts)-1].At
+		letter.LastError = attempts[len(attempts)-1].Error
+	}
+
+	if err := s.write(letter); err != nil {
+		return nil, err
+	}
+	s.deadLettered++
+	return letter, nil
+}
+
+// List returns the dead letters of a table in the order they failed, or of every table
+// when table is empty
+func (s *DeadLetterStore) List(table string) ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list(table)
+}
+
+// Get returns a dead letter by ID
+func (s *DeadLetterStore) Get(id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(id)
+}
+
+// RecordFailure appends a failed replay to the error history of a dead letter
+func (s *DeadLetterStore) RecordFailure(letter *DeadLetter, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt := DeadLetterAttempt{At: time.Now().UTC().Format(time.RFC3339Nano), Error: cause.Error(), Replay: true}
+	letter.Attempts = append(letter.Attempts, attempt)
+	letter.LastFailedAt = attempt.At
+	letter.LastError = attempt.Error
+	return s.write(letter)
+}
+
+// Resolve removes a dead letter whose event was replayed successfully
+func (s *DeadLetterStore) Resolve(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.remove(id); err != nil {
+		return err
+	}
+	s.replayed++
+	return nil
+}
+
+// Discard removes a dead letter without processing its event
+func (s *DeadLetterStore) Discard(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.remove(id); err != nil {
+		return err
+	}
+	s.discarded++
+	return nil
+}
+
+// Stats returns the depth of the queue and the dead-letter counters
+func (s *DeadLetterStore) Stats() (*DeadLetterStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters, err := s.list("")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DeadLetterStats{
+		Depth:        len(letters),
+		ByTable:      make(map[string]int),
+		DeadLettered: s.deadLettered,
+		Replayed:     s.replayed,
+		Discarded:    s.discarded,
+	}
+	for _, letter := range letters {
+		stats.ByTable[letter.Event.Table]++
+	}
+	if len(letters) > 0 {
+		stats.OldestFailedAt = letters[0].FirstFailedAt
+	}
+	return stats, nil
+}
+
+// list returns the dead letters of a table, or of every table when table is empty
+func (s *DeadLetterStore) list(table string) ([]*DeadLetter, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %v", err)
+	}
+	sort.Strings(files)
+
+	letters := make([]*DeadLetter, 0, len(files))
+	for _, file := range files {
+		letter, err := s.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if table == "" || letter.Event.Table == table {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, nil
+}
+
+// read loads a dead letter by ID
+func (s *DeadLetterStore) read(id string) (*DeadLetter, error) {
+	letter, err := s.readFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	return letter, err
+}
+
+// readFile loads a dead letter file
+func (s *DeadLetterStore) readFile(file string) (*DeadLetter, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter %s: %w", file, err)
+	}
+
+	var letter DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, fmt.Errorf("failed to parse dead letter %s: %v", file, err)
+	}
+	return &letter, nil
+}
+
+// remove deletes a dead letter
+func (s *DeadLetterStore) remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove dead letter %s: %v", id, err)
+	}
+	return nil
+}
+
+// write persists a dead letter
+func (s *DeadLetterStore) write(letter *DeadLetter) error {
+	data, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %v", err)
+	}
+	if err := storage.WriteFileAtomic(s.path(letter.ID), data); err != nil {
+		return fmt.Errorf("failed to write dead letter: %v", err)
+	}
+	return nil
+}
+
+// path returns the file path of a dead letter
+func (s *DeadLetterStore) path(id string) string {
+	return filepath.Join(s.Dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
@@ -0,0 +1,124 @@
+package sync
+
+import "fmt"
+
+// TableSync declares how the rows of a Supabase table are pulled and anchored on the chain
+type TableSync struct {
+	Table          string
+	IDColumn       string   // unique column identifying a row
+	ChangeColumn   string   // timestamp column the pull watermark tracks
+	TxType         string   // type of the transaction anchoring a row
+	RequiredFields []string // columns a row must have to be anchored
+	BuildTx        func(record map[string]interface{}) map[string]interface{}
+}
+
+// syncRegistry lists the tables pulled from Supabase, in the order they are synchronized.
+// Drugs come before the shipments that carry them, and both before their status updates.
+var syncRegistry = []TableSync{
+	{
+		Table:          "drugs",
+		IDColumn:       "drug_id",
+		ChangeColumn:   changeColumn,
+		TxType:         "drug",
+		RequiredFields: []string{"drug_id", "manufacturer"},
+		BuildTx:        copyRecord,
+	},
+	{
+		Table:          "shipments",
+		IDColumn:       "shipment_id",
+		ChangeColumn:   changeColumn,
+		TxType:         "shipment",
+		RequiredFields: []string{"shipment_id", "drug_id"},
+		BuildTx:        copyRecord,
+	},
+	{
+		Table:          "drug_status_updates",
+		IDColumn:       "id",
+		ChangeColumn:   "timestamp",
+		TxType:         "drug_status_update",
+		RequiredFields: []string{"id", "drug_id", "status"},
+		BuildTx: func(record map[string]interface{}) map[string]interface{} {
+			return statusUpdateTx(record, "drug_id")
+		},
+	},
+	{
+		Table:          "shipment_status_updates",
+		IDColumn:       "id",
+		ChangeColumn:   "timestamp",
+		TxType:         "shipment_status_update",
+		RequiredFields: []string{"id", "shipment_id", "status"},
+		BuildTx: func(record map[string]interface{}) map[string]interface{} {
+			return statusUpdateTx(record, "shipment_id")
+		},
+	},
+}
+
+// tableSync returns the registry entry of a table, or nil if the table is not pulled
+func tableSync(table string) *TableSync {
+	for i := range syncRegistry {
+		if syncRegistry[i].Table == table {
+			return &syncRegistry[i]
+		}
+	}
+	return nil
+}
+
+// missingFields returns the required fields a record lacks or holds empty
+func (t *TableSync) missingFields(record map[string]interface{}) []string {
+	var missing []string
+	for _, field := range t.RequiredFields {
+		if value, ok := record[field]; !ok || value == nil || value == "" {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+// changeValue returns the value of a record's watermark column. A record without one
+// cannot place the watermark and is rejected.
+func (t *TableSync) changeValue(record map[string]interface{}) (string, error) {
+	value, ok := record[t.ChangeColumn]
+	if !ok || value == nil || value == "" {
+		return "", fmt.Errorf("%s record %s has no %s to advance the sync watermark to", t.Table, t.recordID(record), t.ChangeColumn)
+	}
+	return fmt.Sprintf("%v", value), nil
+}
+
+// recordID returns the ID of a record
+func (t *TableSync) recordID(record map[string]interface{}) string {
+	return fmt.Sprintf("%v", record[t.IDColumn])
+}
+
+// needsAnchoring reports whether a record has no blockchain transaction yet
+func needsAnchoring(record map[string]interface{}) bool {
+	txID, _ := record["blockchain_tx_id"].(string)
+	return txID == "" || txID == "pending"
+}
+
+// copyRecord uses a copy of the whole record as the transaction data
+func copyRecord(record map[string]interface{}) map[string]interface{} {
+	txData := make(map[string]interface{}, len(record))
+	for k, v := range record {
+		txData[k] = v
+	}
+	return txData
+}
+
+// statusUpdateTx builds the transaction data of a status update row of the entity
+// identified by entityColumn
+func statusUpdateTx(record map[string]interface{}, entityColumn string) map[string]interface{} {
+	txData := map[string]interface{}{
+		entityColumn:       record[entityColumn],
+		"status_update_id": record["id"],
+		"status":           record["status"],
+	}
+	for _, column := range []string{"location", "updated_by"} {
+		if value, ok := record[column]; ok && value != nil {
+			txData[column] = value
+		}
+	}
+	if timestamp, ok := record["timestamp"]; ok && timestamp != nil {
+		txData["updated_at"] = timestamp
+	}
+	return txData
+}
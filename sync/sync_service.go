@@ -6,13 +6,22 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/ankit/blockchain_ledger/blockchain"
 	"github.com/ankit/blockchain_ledger/storage"
+	"github.com/ankit/blockchain_ledger/supabase"
 )
 
+// DefaultPageSize is the number of rows fetched per request by the pull sync
+const DefaultPageSize = 500
+
+// changeColumn is the timestamp column the pull sync tracks changes by, unless the
+// table's registry entry names another
+const changeColumn = "updated_at"
+
 // SyncService handles automatic synchronization between local storage and Supabase
 type SyncService struct {
 	Storage       *storage.DataStorage
@@ -25,16 +34,20 @@ type SyncService struct {
 	LastSyncTime  time.Time
 	SyncLogDir    string
 	SyncStatusMap map[string]time.Time // Maps table names to last sync time
+	PageSize      int                  // Rows fetched per pull request
+	Watermarks    *WatermarkStore      // Pull progress of each table
+	syncing       sync.Mutex           // Held while a synchronization runs
 }
 
 // SyncStatus represents the status of a synchronization operation
 type SyncStatus struct {
-	Table           string    `json:"table"`
-	LastSync        time.Time `json:"last_sync"`
-	RecordsSent     int       `json:"records_sent"`
-	RecordsReceived int       `json:"records_received"`
-	Status          string    `json:"status"`
-	Error           string    `json:"error,omitempty"`
+	Table           string           `json:"table"`
+	LastSync        time.Time        `json:"last_sync"`
+	RecordsSent     int              `json:"records_sent"`
+	RecordsReceived int              `json:"records_received"`
+	Status          string           `json:"status"`
+	Error           string           `json:"error,omitempty"`
+	Conflicts       []ConflictReport `json:"conflicts,omitempty"`
 }
 
 // NewSyncService creates a new synchronization service
@@ -45,6 +58,22 @@ func NewSyncService(dataStorage *storage.DataStorage, blockchain *blockchain.Blo
 		return nil, fmt.Errorf("failed to create sync logs directory: %v", err)
 	}
 
+	// Load the pull progress of each table
+	watermarks, err := NewWatermarkStore(dataStorage.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize sync watermarks: %v", err)
+	}
+
+	// Get page size from environment variable or use default
+	pageSize := DefaultPageSize
+	if value := os.Getenv("SYNC_PAGE_SIZE"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SYNC_PAGE_SIZE: %s", value)
+		}
+		pageSize = parsed
+	}
+
 	return &SyncService{
 		Storage:       dataStorage,
 		Blockchain:    blockchain,
@@ -53,6 +82,8 @@ func NewSyncService(dataStorage *storage.DataStorage, blockchain *blockchain.Blo
 		IsRunning:     false,
 		SyncLogDir:    syncLogDir,
 		SyncStatusMap: make(map[string]time.Time),
+		PageSize:      pageSize,
+		Watermarks:    watermarks,
 	}, nil
 }
 
@@ -110,13 +141,33 @@ func (s *SyncService) Stop() error {
 
 // performSync performs the actual synchronization
 func (s *SyncService) performSync() {
+	// Skip this run if the previous one is still going, rather than pulling the same pages twice
+	if !s.syncing.TryLock() {
+		log.Println("Synchronization already in progress, skipping")
+		return
+	}
+	defer s.syncing.Unlock()
+
 	// Only log when manually triggered or during initial sync
 	if s.LastSyncTime.IsZero() {
 		log.Println("Starting initial synchronization process")
 	}
 
-	// Tables to synchronize
-	tables := []string{"drugs", "shipments"}
+	// Tables to synchronize: the registered tables, then any other table with changes
+	// waiting in the outbox
+	var tables []string
+	for _, spec := range syncRegistry {
+		tables = append(tables, spec.Table)
+	}
+	outboxTables, err := s.Storage.Outbox.Tables()
+	if err != nil {
+		log.Printf("Warning: Failed to list outbox tables: %v", err)
+	}
+	for _, table := range outboxTables {
+		if tableSync(table) == nil {
+			tables = append(tables, table)
+		}
+	}
 
 	for _, table := range tables {
 		status := s.syncTable(table)
@@ -147,35 +198,32 @@ func (s *SyncService) syncTable(tableName string) SyncStatus {
 		Status:   "success",
 	}
 
-	// Get last sync time for this table
-	lastSyncTime, exists := s.SyncStatusMap[tableName]
-	if !exists {
-		lastSyncTime = time.Time{} // If never synced, use zero time
-	}
-
 	// 1. Pull changes from Supabase
-	recordsReceived, err := s.pullChangesFromSupabase(tableName)
-	if err != nil {
-		status.Status = "error"
-		status.Error = fmt.Sprintf("Failed to pull changes from Supabase: %v", err)
-		log.Printf("Error syncing %s: %v", tableName, err)
-		return status
-	}
-	status.RecordsReceived = recordsReceived
+	if spec := tableSync(tableName); spec != nil {
+		recordsReceived, err := s.pullChangesFromSupabase(spec)
+		if err != nil {
+			status.Status = "error"
+			status.Error = fmt.Sprintf("Failed to pull changes from Supabase: %v", err)
+			log.Printf("Error syncing %s: %v", tableName, err)
+			return status
+		}
+		status.RecordsReceived = recordsReceived
 
-	if recordsReceived > 0 {
-		logChanges = true
+		if recordsReceived > 0 {
+			logChanges = true
+		}
 	}
 
 	// 2. Push local changes to Supabase
-	recordsSent, err := s.pushChangesToSupabase(tableName, lastSyncTime)
+	recordsSent, conflicts, err := s.pushChangesToSupabase(tableName)
+	status.RecordsSent = recordsSent
+	status.Conflicts = conflicts
 	if err != nil {
 		status.Status = "error"
 		status.Error = fmt.Sprintf("Failed to push changes to Supabase: %v", err)
 		log.Printf("Error pushing changes for %s: %v", tableName, err)
 		return status
 	}
-	status.RecordsSent = recordsSent
 
 	if recordsSent > 0 {
 		logChanges = true
@@ -184,119 +232,321 @@ func (s *SyncService) syncTable(tableName string) SyncStatus {
 	// Only log when there are actual changes
 	if logChanges {
 		log.Printf("Sync completed for %s: Received %d records, Sent %d records",
-			tableName, recordsReceived, recordsSent)
+			tableName, status.RecordsReceived, recordsSent)
 	}
 
 	return status
 }
 
-// pullChangesFromSupabase pulls changes from Supabase and creates blockchain transactions
-func (s *SyncService) pullChangesFromSupabase(table string) (int, error) {
-	// Get records from Supabase
-	records, err := s.Storage.Supabase.Select(table, "*", nil)
+// pullChangesFromSupabase pulls the rows changed since the table's watermark page by page
+// and creates blockchain transactions. The watermark advances after each page is
+// processed, so an interrupted pull resumes from the last completed page. Rows skipped
+// for missing fields are kept with the watermark and retried by every pull.
+func (s *SyncService) pullChangesFromSupabase(spec *TableSync) (int, error) {
+	watermark := s.Watermarks.Get(spec.Table)
+
+	processedCount, err := s.retrySkipped(spec, &watermark)
 	if err != nil {
-		return 0, fmt.Errorf("failed to fetch records from Supabase: %v", err)
+		return processedCount, err
 	}
 
-	// Only log if there are records to process
-	if len(records) > 0 {
-		log.Printf("Received %d records for table %s", len(records), table)
+	for {
+		// Get the next page of changed records from Supabase
+		records, err := s.Storage.Supabase.SelectChanged(spec.Table, supabase.PageQuery{
+			Column:   spec.ChangeColumn,
+			IDColumn: spec.IDColumn,
+			After:    watermark.UpdatedAt,
+			AfterID:  watermark.LastID,
+			Limit:    s.PageSize,
+		})
+		if err != nil {
+			return processedCount, fmt.Errorf("failed to fetch records from Supabase: %v", err)
+		}
+
+		// Only log if there are records to process
+		if len(records) > 0 {
+			log.Printf("Received %d records for table %s", len(records), spec.Table)
+		}
+
+		count, skipped, err := s.processPage(spec, records)
+		processedCount += count
+		if err != nil {
+			return processedCount, err
+		}
+
+		// Advance the watermark past the last record of the page, keeping the skipped records
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			updatedAt, err := spec.changeValue(last)
+			if err != nil {
+				return processedCount, err
+			}
+			watermark = Watermark{
+				UpdatedAt: updatedAt,
+				LastID:    spec.recordID(last),
+				Skipped:   appendMissing(watermark.Skipped, skipped...),
+			}
+			if err := s.Watermarks.Set(spec.Table, watermark); err != nil {
+				return processedCount, err
+			}
+		}
+
+		if len(records) < s.PageSize {
+			return processedCount, nil
+		}
 	}
+}
 
+// processPage anchors the records of a page that have no blockchain transaction yet in a
+// single block, and writes the transaction hashes back to Supabase. It returns the IDs of
+// the records skipped for missing fields.
+func (s *SyncService) processPage(spec *TableSync, records []map[string]interface{}) (int, []string, error) {
 	// Count of records that need processing
 	processedCount := 0
 
+	var batch []map[string]interface{}
+	var recordIDs []string
+	var skipped []string
+
 	// Process each record
 	for _, record := range records {
 		// Skip records that already have a valid blockchain transaction
-		if txID, ok := record["blockchain_tx_id"].(string); ok && txID != "pending" {
+		if !needsAnchoring(record) {
 			continue
 		}
 
 		// Increment processed count
 		processedCount++
 
-		// Create blockchain transaction for drug records
-		if table == "drugs" {
-			// Create a copy of the record to avoid modifying the original
-			drugData := make(map[string]interface{})
-			for k, v := range record {
-				drugData[k] = v
-			}
+		if missing := spec.missingFields(record); len(missing) > 0 {
+			log.Printf("Warning: Skipping %s record %s without required fields %v until it is completed", spec.Table, spec.recordID(record), missing)
+			skipped = append(skipped, spec.recordID(record))
+			continue
+		}
 
-			// Create blockchain transaction
-			txHash, err := s.Blockchain.CreateTransaction("drug", drugData)
-			if err != nil {
-				log.Printf("Failed to create blockchain transaction for drug %s: %v", drugData["drug_id"], err)
-				continue
-			}
+		batch = append(batch, spec.BuildTx(record))
+		recordIDs = append(recordIDs, spec.recordID(record))
+	}
 
-			// Update Supabase record with blockchain hash
-			updateData := map[string]interface{}{
-				"blockchain_tx_id": txHash,
-			}
-			_, err = s.Storage.Supabase.Update("drugs", drugData["drug_id"].(string), updateData)
-			if err != nil {
-				log.Printf("Failed to update Supabase record with blockchain hash: %v", err)
-			} else {
-				log.Printf("Created blockchain transaction for drug %s: %s", drugData["drug_id"], txHash)
-			}
+	if len(batch) == 0 {
+		return processedCount, skipped, nil
+	}
+
+	// Create blockchain transactions. On failure the watermark stays before this page so
+	// the next sync retries it.
+	txHashes, err := s.Blockchain.CreateTransactions(spec.TxType, batch)
+	if err != nil {
+		return processedCount, nil, fmt.Errorf("failed to create blockchain transactions for %d %s records: %v", len(batch), spec.Table, err)
+	}
+
+	for i, recordID := range recordIDs {
+		s.writeBackTxID(spec, recordID, txHashes[i])
+	}
+
+	return processedCount, skipped, nil
+}
+
+// retrySkipped anchors the records skipped by earlier pulls that have since been
+// completed. Records still missing fields stay on the watermark's list, and records
+// deleted from Supabase are dropped from it.
+func (s *SyncService) retrySkipped(spec *TableSync, watermark *Watermark) (int, error) {
+	if len(watermark.Skipped) == 0 {
+		return 0, nil
+	}
+
+	processedCount := 0
+	var stillSkipped []string
+	for _, recordID := range watermark.Skipped {
+		records, err := s.Storage.Supabase.Select(spec.Table, "*", map[string]interface{}{spec.IDColumn: recordID})
+		if err != nil {
+			log.Printf("Warning: Failed to fetch skipped %s record %s: %v", spec.Table, recordID, err)
+			stillSkipped = append(stillSkipped, recordID)
+			continue
 		}
+		if len(records) == 0 {
+			log.Printf("Dropping skipped %s record %s, which no longer exists", spec.Table, recordID)
+			continue
+		}
+		if missing := spec.missingFields(records[0]); len(missing) > 0 {
+			stillSkipped = append(stillSkipped, recordID)
+			continue
+		}
+
+		if _, err := s.anchorRecord(spec, records[0]); err != nil {
+			log.Printf("Warning: Failed to anchor skipped %s record %s: %v", spec.Table, recordID, err)
+			stillSkipped = append(stillSkipped, recordID)
+			continue
+		}
+		processedCount++
 	}
 
+	if len(stillSkipped) == len(watermark.Skipped) {
+		return processedCount, nil
+	}
+	watermark.Skipped = stillSkipped
+	if err := s.Watermarks.Set(spec.Table, *watermark); err != nil {
+		return processedCount, err
+	}
 	return processedCount, nil
 }
 
-// createShipmentTransaction creates a blockchain transaction for a shipment record
-func (s *SyncService) createShipmentTransaction(shipmentData map[string]interface{}) string {
-	// Skip if already has a valid blockchain transaction
-	if txID, exists := shipmentData["blockchain_tx_id"].(string); exists && txID != "" && txID != "pending" {
-		return txID
+// appendMissing appends the IDs that are not in the list yet
+func appendMissing(ids []string, more ...string) []string {
+	for _, id := range more {
+		found := false
+		for _, existing := range ids {
+			if existing == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// anchorRecord creates the blockchain transaction of a single record and returns its
+// hash. A record that already has a transaction keeps it.
+func (s *SyncService) anchorRecord(spec *TableSync, record map[string]interface{}) (string, error) {
+	if !needsAnchoring(record) {
+		txID, _ := record["blockchain_tx_id"].(string)
+		return txID, nil
 	}
 
-	// Create a copy of the shipment data to avoid modifying the original
-	txData := make(map[string]interface{})
-	for k, v := range shipmentData {
-		txData[k] = v
+	recordID := spec.recordID(record)
+	if missing := spec.missingFields(record); len(missing) > 0 {
+		return "", fmt.Errorf("%s record %s is missing required fields %v", spec.Table, recordID, missing)
 	}
 
-	// Create blockchain transaction
-	_, err := blockchain.NewShipmentTransaction(txData)
+	txHashes, err := s.Blockchain.CreateTransactions(spec.TxType, []map[string]interface{}{spec.BuildTx(record)})
 	if err != nil {
-		log.Printf("Failed to create shipment transaction: %v", err)
-		return ""
+		return "", fmt.Errorf("failed to create blockchain transaction for %s record %s: %v", spec.Table, recordID, err)
 	}
 
-	// Generate transaction hash
-	txHash := blockchain.GenerateTransactionHash(txData)
+	s.writeBackTxID(spec, recordID, txHashes[0])
+	return txHashes[0], nil
+}
+
+// writeBackTxID updates a Supabase record with the hash of its blockchain transaction,
+// queuing the update in the outbox if Supabase rejects it
+func (s *SyncService) writeBackTxID(spec *TableSync, recordID, txHash string) {
+	updateData := map[string]interface{}{
+		"blockchain_tx_id": txHash,
+	}
+
+	if _, err := s.Storage.Supabase.UpdateWhere(spec.Table, spec.IDColumn, recordID, updateData); err != nil {
+		log.Printf("Warning: Failed to update %s record %s with blockchain hash, queued for the next sync: %v", spec.Table, recordID, err)
+
+		change := &storage.OutboxChange{
+			Table:     spec.Table,
+			Action:    storage.OutboxUpdate,
+			RecordID:  recordID,
+			Fields:    updateData,
+			LastError: err.Error(),
+		}
+		if err := s.Storage.Outbox.Enqueue(change); err != nil {
+			log.Printf("Warning: Failed to queue %s update for %s: %v", spec.Table, recordID, err)
+		}
+		return
+	}
+
+	log.Printf("Created blockchain transaction for %s record %s: %s", spec.Table, recordID, txHash)
+}
 
-	// Add transaction to blockchain
-	if err := s.Storage.AddTransactionToBlockchain(txData, txHash); err != nil {
-		log.Printf("Failed to add shipment transaction to blockchain: %v", err)
-		return ""
+// pushChangesToSupabase pushes the table's changes waiting in the outbox, in the order
+// they were made. A change that fails stays queued, and later changes of the same record
+// wait behind it so a row never receives its updates out of order.
+func (s *SyncService) pushChangesToSupabase(tableName string) (int, []ConflictReport, error) {
+	changes, err := s.Storage.Outbox.Pending(tableName)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	log.Printf("Created blockchain transaction for shipment %s: %s",
-		txData["shipment_id"], txHash)
+	sent := 0
+	var conflicts []ConflictReport
+	var lastErr error
+	failures := 0
+	blocked := make(map[string]bool)
+
+	for _, change := range changes {
+		key := outboxRecordKey(change)
+		if blocked[key] {
+			continue
+		}
+
+		conflict, err := s.pushChange(change)
+		if err != nil {
+			failures++
+			lastErr = err
+			blocked[key] = true
+			if recordErr := s.Storage.Outbox.RecordFailure(change, err); recordErr != nil {
+				log.Printf("Warning: Failed to record push failure of outbox change %s: %v", change.ID, recordErr)
+			}
+			continue
+		}
+
+		if conflict != nil {
+			log.Printf("Resolved conflict on %s %s: ledger kept %v, remote kept %v",
+				conflict.Table, conflict.RecordID, conflict.LedgerWins, conflict.RemoteWins)
+			conflicts = append(conflicts, *conflict)
+		}
 
-	// Update the original shipment data with the transaction hash
-	shipmentData["blockchain_tx_id"] = txHash
+		if err := s.Storage.Outbox.Remove(change); err != nil {
+			return sent, conflicts, err
+		}
+		sent++
+	}
 
-	return txHash
+	if failures > 0 {
+		return sent, conflicts, fmt.Errorf("failed to push %d of %d changes, last error: %v", failures, len(changes), lastErr)
+	}
+	return sent, conflicts, nil
 }
 
-// pushChangesToSupabase pushes local changes to Supabase
-func (s *SyncService) pushChangesToSupabase(tableName string, lastSyncTime time.Time) (int, error) {
-	// In a real implementation, you'd track local changes and push them to Supabase
-	// For this example, we'll assume there are no local changes to push
+// pushChange sends an outbox change to Supabase. Updates are checked against the current
+// remote row first, and resolved by the conflict policy if it changed after the local write.
+func (s *SyncService) pushChange(change *storage.OutboxChange) (*ConflictReport, error) {
+	switch change.Action {
+	case storage.OutboxInsert:
+		if _, err := s.Storage.Supabase.Insert(change.Table, change.Fields); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	case storage.OutboxUpdate:
+		idColumn := supabase.IDColumn(change.Table)
+		if spec := tableSync(change.Table); spec != nil {
+			idColumn = spec.IDColumn
+		}
+
+		where := map[string]interface{}{idColumn: change.RecordID}
+		rows, err := s.Storage.Supabase.Select(change.Table, "*", where)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s row %s: %v", change.Table, change.RecordID, err)
+		}
+		var remote map[string]interface{}
+		if len(rows) > 0 {
+			remote = rows[0]
+		}
 
-	// This would involve:
-	// 1. Identifying local records that have been created or modified since the last sync
-	// 2. Pushing those changes to Supabase
-	// 3. Handling any conflicts that arise
+		fields, conflict := resolveConflict(change, remote)
+		if len(fields) > 0 {
+			if _, err := s.Storage.Supabase.UpdateWhere(change.Table, idColumn, change.RecordID, fields); err != nil {
+				return nil, err
+			}
+		}
+		return conflict, nil
+	}
+	return nil, fmt.Errorf("unknown outbox action: %s", change.Action)
+}
 
-	// For now, we'll just return 0 records sent
-	return 0, nil
+// outboxRecordKey identifies the record an outbox change applies to
+func outboxRecordKey(change *storage.OutboxChange) string {
+	if change.RecordID != "" {
+		return change.RecordID
+	}
+	return fmt.Sprintf("%v", change.Fields["id"])
 }
 
 // logSyncStatus logs the synchronization status
@@ -328,11 +578,14 @@ func (s *SyncService) GetSyncStatus() map[string]interface{} {
 	statusMap["is_running"] = s.IsRunning
 	statusMap["last_sync"] = s.LastSyncTime
 	statusMap["sync_interval"] = s.SyncInterval.String()
+	statusMap["page_size"] = s.PageSize
 
+	watermarks := s.Watermarks.All()
 	tableStatus := make(map[string]interface{})
 	for table, lastSync := range s.SyncStatusMap {
 		tableStatus[table] = map[string]interface{}{
 			"last_sync": lastSync,
+			"watermark": watermarks[table],
 		}
 	}
 	statusMap["tables"] = tableStatus
@@ -349,41 +602,3 @@ func (s *SyncService) ForceSync() error {
 	go s.performSync()
 	return nil
 }
-
-// createDrugTransaction creates a blockchain transaction for a drug record
-func (s *SyncService) createDrugTransaction(drugData map[string]interface{}) string {
-	// Skip if already has a valid blockchain transaction
-	if txID, exists := drugData["blockchain_tx_id"].(string); exists && txID != "" && txID != "pending" {
-		return txID
-	}
-
-	// Create a copy of the drug data to avoid modifying the original
-	txData := make(map[string]interface{})
-	for k, v := range drugData {
-		txData[k] = v
-	}
-
-	// Create blockchain transaction
-	_, err := blockchain.NewDrugTransaction(txData)
-	if err != nil {
-		log.Printf("Failed to create drug transaction: %v", err)
-		return ""
-	}
-
-	// Generate transaction hash
-	txHash := blockchain.GenerateTransactionHash(txData)
-
-	// Add transaction to blockchain
-	if err := s.Storage.AddTransactionToBlockchain(txData, txHash); err != nil {
-		log.Printf("Failed to add drug transaction to blockchain: %v", err)
-		return ""
-	}
-
-	log.Printf("Created blockchain transaction for drug %s: %s",
-		txData["drug_id"], txHash)
-
-	// Update the original drug data with the transaction hash
-	drugData["blockchain_tx_id"] = txHash
-
-	return txHash
-}
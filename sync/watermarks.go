@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ankit/blockchain_ledger/storage"
+)
+
+// Watermark records how far the pull sync of a table has progressed: every row changed
+// up to UpdatedAt, and at UpdatedAt every row up to LastID, has been processed, except
+// the rows listed in Skipped, which lacked required fields and are retried by ID
+type Watermark struct {
+	UpdatedAt string   `json:"updated_at"`
+	LastID    string   `json:"last_id"`
+	Skipped   []string `json:"skipped,omitempty"`
+}
+
+// WatermarkStore persists the pull sync watermark of each table, so a restarted service
+// resumes from the last fully processed page instead of scanning the whole table
+type WatermarkStore struct {
+	mu         sync.Mutex
+	Path       string
+	Watermarks map[string]Watermark
+}
+
+// NewWatermarkStore loads the watermarks kept in the data directory
+func NewWatermarkStore(dataDir string) (*WatermarkStore, error) {
+	store := &WatermarkStore{
+		Path:       filepath.Join(dataDir, "sync_watermarks.json"),
+		Watermarks: make(map[string]Watermark),
+	}
+
+	data, err := os.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		return store, nil // No table synced yet
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync watermarks: %v", err)
+	}
+	if err := json.Unmarshal(data, &store.Watermarks); err != nil {
+		return nil, fmt.Errorf("failed to parse sync watermarks: %v", err)
+	}
+
+	return store, nil
+}
+
+// Get returns the watermark of a table, which is empty if the table was never synced
+func (s *WatermarkStore) Get(table string) Watermark {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Watermarks[table]
+}
+
+// Set advances the watermark of a table and persists all watermarks
+func (s *WatermarkStore) Set(table string, watermark Watermark) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Watermarks[table] = watermark
+
+	data, err := json.MarshalIndent(s.Watermarks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync watermarks: %v", err)
+	}
+	if err := storage.WriteFileAtomic(s.Path, data); err != nil {
+		return fmt.Errorf("failed to write sync watermarks: %v", err)
+	}
+
+	return nil
+}
+
+// All returns a copy of the watermarks of every table
+func (s *WatermarkStore) All() map[string]Watermark {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watermarks := make(map[string]Watermark, len(s.Watermarks))
+	for table, watermark := range s.Watermarks {
+		watermarks[table] = watermark
+	}
+	return watermarks
+}
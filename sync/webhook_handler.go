@@ -1,15 +1,21 @@
 package sync
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"time"
 
-	"github.com/gofiber/fiber/v2"
+	"github.com/ankit/blockchain_ledger/auth"
 )
 
+// maxWebhookBodySize is the largest webhook body accepted, in bytes
+const maxWebhookBodySize = 1 << 20
+
 // WebhookPayload represents the payload received from Supabase webhooks
 type WebhookPayload struct {
 	Type      string                 `json:"type"`
@@ -23,148 +29,209 @@ type WebhookPayload struct {
 // WebhookHandler handles incoming webhooks from Supabase
 type WebhookHandler struct {
 	SyncService        *SyncService
-	Secret             string // For webhook verification
-	MaxRetries         int    // Maximum number of retries for failed processing
+	Verifier           *auth.WebhookVerifier // Verifies webhook signatures and rejects replays
+	MaxRetries         int                   // Maximum number of retries for failed processing
 	TransactionTracker *TransactionTracker
+	DeadLetters        *DeadLetterStore // Holds events that failed every retry
+	Queue              *WebhookQueue    // Holds accepted events until a worker processes them
 }
 
 // NewWebhookHandler creates a new webhook handler
-func NewWebhookHandler(syncService *SyncService, secret string) (*WebhookHandler, error) {
+func NewWebhookHandler(syncService *SyncService, verifier *auth.WebhookVerifier) (*WebhookHandler, error) {
 	// Initialize transaction tracker
 	tracker, err := NewTransactionTracker(syncService.Storage.DataDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize transaction tracker: %v", err)
 	}
 
-	return &WebhookHandler{
+	// Initialize the dead-letter store for events that cannot be processed
+	deadLetters, err := NewDeadLetterStore(DefaultDeadLetterDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize dead-letter store: %v", err)
+	}
+
+	wh := &WebhookHandler{
 		SyncService:        syncService,
-		Secret:             secret,
+		Verifier:           verifier,
 		MaxRetries:         3, // Default to 3 retries
 		TransactionTracker: tracker,
-	}, nil
+		DeadLetters:        deadLetters,
+	}
+
+	// Initialize the work queue, which also queues the events left by the last run
+	wh.Queue, err = NewWebhookQueue(DefaultWebhookQueueDir, wh.processEventWithRetry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize webhook queue: %v", err)
+	}
+
+	return wh, nil
 }
 
-// RegisterRoutes registers webhook routes with the Fiber app
-func (wh *WebhookHandler) RegisterRoutes(app *fiber.App) {
-	app.Post("/api/webhooks/supabase", wh.HandleWebhook)
+// Start starts the workers processing queued webhook events
+func (wh *WebhookHandler) Start() {
+	wh.Queue.Start()
+}
+
+// Shutdown stops accepting webhook events and waits for the queued ones to be processed
+func (wh *WebhookHandler) Shutdown(ctx context.Context) error {
+	return wh.Queue.Drain(ctx)
 }
 
 // HandleWebhook processes incoming webhook events from Supabase
-func (wh *WebhookHandler) HandleWebhook(c *fiber.Ctx) error {
-	// Verify webhook signature if secret is set
-	if wh.Secret != "" {
-		signature := c.Get("X-Webhook-Signature")
-		log.Printf("Received signature: %s", signature)
-		log.Printf("Secret expected: %s", wh.Secret)
-
-		if !wh.verifySignature(signature, c.Body()) {
-			log.Printf("Invalid webhook signature received from %s", c.IP())
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid signature",
-			})
+func (wh *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Read the raw body, which the signature covers
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		log.Printf("Error reading webhook body: %v", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Verify the webhook signature over the raw body before parsing it
+	if err := wh.Verifier.Verify(r.Header.Get(auth.WebhookSignatureHeader), r.Header.Get(auth.WebhookTimestampHeader), body); err != nil {
+		if !errors.Is(err, auth.ErrInvalidWebhook) {
+			log.Printf("Error verifying webhook: %v", err)
+			http.Error(w, "Failed to verify webhook", http.StatusInternalServerError)
+			return
 		}
-		log.Printf("Signature verification successful")
+		log.Printf("Rejected webhook from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
 	}
 
 	// Parse webhook payload
 	var payload WebhookPayload
-	if err := c.BodyParser(&payload); err != nil {
+	if err := json.Unmarshal(body, &payload); err != nil {
 		log.Printf("Error parsing webhook payload: %v", err)
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid payload",
-		})
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
 	}
 
 	// Log webhook receipt
 	log.Printf("Received webhook event: type=%s, table=%s, timestamp=%v",
 		payload.Type, payload.Table, payload.Timestamp)
 
-	// Process the webhook based on the event type
-	switch payload.Type {
-	case "INSERT", "UPDATE":
-		go wh.processRecordWithRetry(payload.Table, payload.Record)
-	case "DELETE":
-		go wh.processDeleteWithRetry(payload.Table, payload.OldRecord)
-	default:
-		log.Printf("Unhandled webhook event type: %s", payload.Type)
+	// Queue the event for a worker; events that fail every retry are dead-lettered
+	item, err := wh.Queue.Enqueue(payload)
+	if err != nil {
+		// The event was not taken, so let the sender retry the same signed request
+		wh.Verifier.Release(r.Header.Get(auth.WebhookSignatureHeader))
+
+		if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueClosed) {
+			log.Printf("Deferred webhook event: %v", err)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Webhook queue unavailable, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Error queueing webhook event: %v", err)
+		http.Error(w, "Failed to queue webhook event", http.StatusInternalServerError)
+		return
 	}
 
 	// Acknowledge receipt of the webhook
-	return c.Status(http.StatusOK).JSON(fiber.Map{
-		"status":  "success",
-		"message": "Webhook received and processing started",
-	})
+	response := map[string]interface{}{
+		"status":   "success",
+		"message":  "Webhook received and queued for processing",
+		"queue_id": item.ID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// processRecordWithRetry processes a record with retry logic
-func (wh *WebhookHandler) processRecordWithRetry(tableName string, record map[string]interface{}) {
-	var err error
+// processEventWithRetry processes an event with retry logic, and stores it in the
+// dead-letter queue with its error history when every attempt fails. It only returns an
+// error when the event could be neither processed nor dead-lettered.
+func (wh *WebhookHandler) processEventWithRetry(event WebhookPayload) error {
+	var attempts []DeadLetterAttempt
 	for i := 0; i < wh.MaxRetries; i++ {
-		err = wh.processRecord(tableName, record)
+		err := wh.processEvent(event)
 		if err == nil {
-			return
+			return nil
+		}
+		log.Printf("Attempt %d/%d failed to process %s event for %s: %v", i+1, wh.MaxRetries, event.Type, event.Table, err)
+		attempts = append(attempts, DeadLetterAttempt{At: time.Now().UTC().Format(time.RFC3339Nano), Error: err.Error()})
+		if i < wh.MaxRetries-1 {
+			time.Sleep(time.Second * time.Duration(i+1)) // Linear backoff
 		}
-		log.Printf("Attempt %d/%d failed to process record: %v", i+1, wh.MaxRetries, err)
-		time.Sleep(time.Second * time.Duration(i+1)) // Exponential backoff
 	}
-	log.Printf("Failed to process record after %d attempts: %v", wh.MaxRetries, err)
+
+	letter, err := wh.DeadLetters.Add(event, attempts)
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter %s event for %s after %d attempts: %v", event.Type, event.Table, len(attempts), err)
+	}
+	log.Printf("Dead-lettered %s event for %s as %s after %d attempts", event.Type, event.Table, letter.ID, len(attempts))
+	return nil
 }
 
-// processDeleteWithRetry processes a delete event with retry logic
-func (wh *WebhookHandler) processDeleteWithRetry(tableName string, record map[string]interface{}) {
-	var err error
-	for i := 0; i < wh.MaxRetries; i++ {
-		err = wh.processDelete(tableName, record)
-		if err == nil {
-			return
+// processEvent processes a webhook event once
+func (wh *WebhookHandler) processEvent(event WebhookPayload) error {
+	switch event.Type {
+	case "INSERT", "UPDATE":
+		return wh.processRecord(event.Table, event.Record)
+	case "DELETE":
+		return wh.processDelete(event.Table, event.OldRecord)
+	default:
+		return fmt.Errorf("unhandled webhook event type: %s", event.Type)
+	}
+}
+
+// ReplayDeadLetter processes a dead-lettered event again. The dead letter is removed when
+// the event is processed, and the failure is added to its error history otherwise.
+func (wh *WebhookHandler) ReplayDeadLetter(id string) (*DeadLetter, error) {
+	letter, err := wh.DeadLetters.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wh.processEvent(letter.Event); err != nil {
+		if recordErr := wh.DeadLetters.RecordFailure(letter, err); recordErr != nil {
+			log.Printf("Warning: failed to record replay failure of dead letter %s: %v", id, recordErr)
 		}
-		log.Printf("Attempt %d/%d failed to process delete: %v", i+1, wh.MaxRetries, err)
-		time.Sleep(time.Second * time.Duration(i+1)) // Exponential backoff
+		return letter, fmt.Errorf("failed to replay dead letter %s: %v", id, err)
+	}
+
+	if err := wh.DeadLetters.Resolve(id); err != nil {
+		return letter, err
 	}
-	log.Printf("Failed to process delete after %d attempts: %v", wh.MaxRetries, err)
+	log.Printf("Replayed dead letter %s (%s event for %s)", id, letter.Event.Type, letter.Event.Table)
+	return letter, nil
 }
 
 // processRecord processes a record from a webhook event
 func (wh *WebhookHandler) processRecord(tableName string, record map[string]interface{}) error {
 	log.Printf("Processing %s record from webhook", tableName)
 
-	// Determine record ID and create transaction based on table type
-	var recordID string
-	var txHash string
-
-	switch tableName {
-	case "drugs":
-		if id, ok := record["drug_id"].(string); ok {
-			recordID = id
-
-			// Check if record already has a blockchain transaction ID
-			if txID, ok := record["blockchain_tx_id"].(string); ok && txID != "" && txID != "pending" {
-				txHash = txID
-			} else {
-				// Create blockchain transaction for drug
-				txHash = wh.SyncService.createDrugTransaction(record)
-			}
-		}
-	case "shipments":
-		if id, ok := record["shipment_id"].(string); ok {
-			recordID = id
-
-			// Check if record already has a blockchain transaction ID
-			if txID, ok := record["blockchain_tx_id"].(string); ok && txID != "" && txID != "pending" {
-				txHash = txID
-			} else {
-				// Create blockchain transaction for shipment
-				txHash = wh.SyncService.createShipmentTransaction(record)
-			}
-		}
-	default:
+	spec := tableSync(tableName)
+	if spec == nil {
 		return fmt.Errorf("unhandled table in webhook: %s", tableName)
 	}
 
+	var recordID string
+	if record[spec.IDColumn] != nil {
+		recordID = spec.recordID(record)
+	}
 	if recordID == "" {
 		return fmt.Errorf("no valid record ID found for table %s", tableName)
 	}
 
+	// Create the record's blockchain transaction unless it already has one
+	txHash, err := wh.SyncService.anchorRecord(spec, record)
+	if err != nil {
+		return err
+	}
+
 	// Check if transaction has already been processed
 	if txHash != "" && wh.TransactionTracker.IsTransactionProcessed(txHash) {
 		log.Printf("Transaction %s has already been processed, skipping record", txHash)
@@ -174,7 +241,6 @@ func (wh *WebhookHandler) processRecord(tableName string, record map[string]inte
 	// Save record to data_records directory
 	timestamp := time.Now().Format("20060102-150405")
 	filename := fmt.Sprintf("%s_%s_%s.json", tableName, recordID, timestamp)
-	filePath := fmt.Sprintf("%s/%s", wh.SyncService.Storage.DataDir, filename)
 
 	// Add blockchain transaction ID to record if available
 	if txHash != "" {
@@ -187,9 +253,9 @@ func (wh *WebhookHandler) processRecord(tableName string, record map[string]inte
 		return fmt.Errorf("failed to marshal record: %v", err)
 	}
 
-	// Write to file
-	if err := wh.SyncService.Storage.WriteFile(filePath, data); err != nil {
-		return fmt.Errorf("failed to write record to file: %v", err)
+	// Save record
+	if err := wh.SyncService.Storage.SaveRecord(filename, data); err != nil {
+		return fmt.Errorf("failed to save record: %v", err)
 	}
 
 	// Mark transaction as processed if we have a hash
@@ -199,7 +265,7 @@ func (wh *WebhookHandler) processRecord(tableName string, record map[string]inte
 		}
 	}
 
-	log.Printf("Successfully saved record to %s", filePath)
+	log.Printf("Successfully saved record %s", filename)
 
 	// Update last sync time for this table
 	wh.SyncService.SyncLock.Lock()
@@ -213,20 +279,15 @@ func (wh *WebhookHandler) processRecord(tableName string, record map[string]inte
 func (wh *WebhookHandler) processDelete(tableName string, record map[string]interface{}) error {
 	log.Printf("Processing DELETE event for %s", tableName)
 
-	var recordID string
-	switch tableName {
-	case "drugs":
-		if id, ok := record["drug_id"].(string); ok {
-			recordID = id
-		}
-	case "shipments":
-		if id, ok := record["shipment_id"].(string); ok {
-			recordID = id
-		}
-	default:
+	spec := tableSync(tableName)
+	if spec == nil {
 		return fmt.Errorf("unhandled table in delete webhook: %s", tableName)
 	}
 
+	var recordID string
+	if record[spec.IDColumn] != nil {
+		recordID = spec.recordID(record)
+	}
 	if recordID == "" {
 		return fmt.Errorf("no valid record ID found for table %s", tableName)
 	}
@@ -240,18 +301,17 @@ func (wh *WebhookHandler) processDelete(tableName string, record map[string]inte
 	// Save deletion record
 	timestamp := time.Now().Format("20060102-150405")
 	filename := fmt.Sprintf("%s_%s_%s_deleted.json", tableName, recordID, timestamp)
-	filePath := fmt.Sprintf("%s/%s", wh.SyncService.Storage.DataDir, filename)
 
 	data, err := json.MarshalIndent(deletionRecord, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal deletion record: %v", err)
 	}
 
-	if err := wh.SyncService.Storage.WriteFile(filePath, data); err != nil {
-		return fmt.Errorf("failed to write deletion record: %v", err)
+	if err := wh.SyncService.Storage.SaveRecord(filename, data); err != nil {
+		return fmt.Errorf("failed to save deletion record: %v", err)
 	}
 
-	log.Printf("Successfully saved deletion record to %s", filePath)
+	log.Printf("Successfully saved deletion record %s", filename)
 
 	// Update last sync time for this table
 	wh.SyncService.SyncLock.Lock()
@@ -260,14 +320,3 @@ func (wh *WebhookHandler) processDelete(tableName string, record map[string]inte
 
 	return nil
 }
-
-// verifySignature verifies the webhook signature
-func (wh *WebhookHandler) verifySignature(signature string, payload []byte) bool {
-	if signature == "" {
-		log.Printf("Warning: Empty signature received")
-		return false
-	}
-
-	// Simple string comparison of the signature with the webhook secret
-	return signature == wh.Secret
-}
@@ -0,0 +1,290 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ankit/blockchain_ledger/storage"
+	"github.com/google/uuid"
+)
+
+// Default webhook queue settings, overridden by WEBHOOK_QUEUE_SIZE and WEBHOOK_WORKERS
+const (
+	DefaultWebhookQueueDir  = "webhook_queue"
+	DefaultWebhookQueueSize = 1000
+	DefaultWebhookWorkers   = 4
+)
+
+// Errors returned when the queue does not accept an event
+var (
+	ErrQueueFull   = errors.New("webhook queue is full")
+	ErrQueueClosed = errors.New("webhook queue is closed")
+)
+
+// QueuedEvent is a webhook event accepted for processing
+type QueuedEvent struct {
+	ID         string         `json:"id"`
+	Key        string         `json:"key"` // events with the same key are processed in order
+	Event      WebhookPayload `json:"event"`
+	ReceivedAt string         `json:"received_at"`
+}
+
+// QueueStats describes the state of the webhook queue
+type QueueStats struct {
+	Depth    int  `json:"depth"`
+	Capacity int  `json:"capacity"`
+	Workers  int  `json:"workers"`
+	Closed   bool `json:"closed"`
+}
+
+// WebhookQueue is a durable, bounded queue of webhook events processed by a fixed pool of
+// workers. Each event is held in its own file until it is processed, so events accepted
+// before a restart are processed after it. Events are assigned to a worker by their
+// ordering key, so events for the same record are processed one at a time, in order.
+type WebhookQueue struct {
+	Dir      string
+	Capacity int
+	Workers  int
+
+	process    func(WebhookPayload) error
+	mu         sync.Mutex
+	depth      int
+	closed     bool
+	partitions []chan *QueuedEvent
+	wg         sync.WaitGroup
+}
+
+// NewWebhookQueue creates a queue in the given directory with its settings read from the
+// environment, and queues again the events left by a previous run
+func NewWebhookQueue(dir string, process func(WebhookPayload) error) (*WebhookQueue, error) {
+	capacity, err := envPositiveInt("WEBHOOK_QUEUE_SIZE", DefaultWebhookQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := envPositiveInt("WEBHOOK_WORKERS", DefaultWebhookWorkers)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create webhook queue directory: %v", err)
+	}
+
+	q := &WebhookQueue{
+		Dir:      dir,
+		Capacity: capacity,
+		Workers:  workers,
+		process:  process,
+	}
+
+	// Load the events accepted but not processed before the last shutdown
+	recovered, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Size every partition to hold the whole queue, so dispatching never blocks
+	buffer := capacity
+	if len(recovered) > buffer {
+		buffer = len(recovered)
+	}
+	q.partitions = make([]chan *QueuedEvent, workers)
+	for i := range q.partitions {
+		q.partitions[i] = make(chan *QueuedEvent, buffer)
+	}
+
+	for _, item := range recovered {
+		q.dispatch(item)
+	}
+	q.depth = len(recovered)
+	if len(recovered) > 0 {
+		log.Printf("Recovered %d queued webhook events", len(recovered))
+	}
+
+	return q, nil
+}
+
+// Start starts the workers
+func (q *WebhookQueue) Start() {
+	for _, partition := range q.partitions {
+		q.wg.Add(1)
+		go q.work(partition)
+	}
+	log.Printf("Webhook queue started with %d workers and capacity %d", q.Workers, q.Capacity)
+}
+
+// Enqueue durably adds an event to the queue. It fails with ErrQueueFull when the queue
+// holds its capacity, and with ErrQueueClosed once the queue is draining.
+func (q *WebhookQueue) Enqueue(event WebhookPayload) (*QueuedEvent, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	if q.depth >= q.Capacity {
+		return nil, ErrQueueFull
+	}
+
+	now := time.Now().UTC()
+	item := &QueuedEvent{
+		ID:         fmt.Sprintf("%020d-%s", now.UnixNano(), uuid.New().String()),
+		Key:        orderingKey(event),
+		Event:      event,
+		ReceivedAt: now.Format(time.RFC3339Nano),
+	}
+	if err := q.write(item); err != nil {
+		return nil, err
+	}
+
+	q.depth++
+	q.dispatch(item)
+	return item, nil
+}
+
+// Drain stops accepting events and waits for the workers to process the queued ones.
+// Events still queued when ctx is done stay on disk and are processed after a restart.
+func (q *WebhookQueue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, partition := range q.partitions {
+			close(partition)
+		}
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("Webhook queue drained")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook queue not drained, %d events left for the next start: %v", q.Stats().Depth, ctx.Err())
+	}
+}
+
+// Stats returns the depth and settings of the queue
+func (q *WebhookQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStats{
+		Depth:    q.depth,
+		Capacity: q.Capacity,
+		Workers:  q.Workers,
+		Closed:   q.closed,
+	}
+}
+
+// work processes the events of a partition until it is closed
+func (q *WebhookQueue) work(partition chan *QueuedEvent) {
+	defer q.wg.Done()
+
+	for item := range partition {
+		if err := q.process(item.Event); err != nil {
+			// Keep the event on disk so it is processed again after a restart
+			log.Printf("Error: webhook event %s kept in queue: %v", item.ID, err)
+		} else if err := os.Remove(q.path(item.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove processed webhook event %s: %v", item.ID, err)
+		}
+
+		q.mu.Lock()
+		q.depth--
+		q.mu.Unlock()
+	}
+}
+
+// dispatch hands an event to the worker owning its ordering key
+func (q *WebhookQueue) dispatch(item *QueuedEvent) {
+	hash := fnv.New32a()
+	hash.Write([]byte(item.Key))
+	q.partitions[hash.Sum32()%uint32(len(q.partitions))] <- item
+}
+
+// load returns the queued events in the order they were accepted
+func (q *WebhookQueue) load() ([]*QueuedEvent, error) {
+	files, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook queue: %v", err)
+	}
+	sort.Strings(files)
+
+	items := make([]*QueuedEvent, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queued webhook event %s: %v", file, err)
+		}
+
+		var item QueuedEvent
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, fmt.Errorf("failed to parse queued webhook event %s: %v", file, err)
+		}
+		items = append(items, &item)
+	}
+	return items, nil
+}
+
+// write persists a queued event
+func (q *WebhookQueue) write(item *QueuedEvent) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal queued webhook event: %v", err)
+	}
+	if err := storage.WriteFileAtomic(q.path(item.ID), data); err != nil {
+		return fmt.Errorf("failed to write queued webhook event: %v", err)
+	}
+	return nil
+}
+
+// path returns the file path of a queued event
+func (q *WebhookQueue) path(id string) string {
+	return filepath.Join(q.Dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
+
+// orderingKey returns the key ordering an event: the drug it concerns when it names one,
+// so a drug's rows and status updates are processed in order, or the changed row otherwise
+func orderingKey(event WebhookPayload) string {
+	record := event.Record
+	if event.Type == "DELETE" {
+		record = event.OldRecord
+	}
+
+	if drugID, ok := record["drug_id"]; ok && drugID != nil && drugID != "" {
+		return fmt.Sprintf("drug:%v", drugID)
+	}
+	if spec := tableSync(event.Table); spec != nil && record[spec.IDColumn] != nil {
+		return event.Table + ":" + spec.recordID(record)
+	}
+	return event.Table
+}
+
+// envPositiveInt reads a positive integer setting from the environment
+func envPositiveInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return parsed, nil
+}